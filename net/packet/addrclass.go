@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// AddressClass is a coarse classification of a destination address,
+// for bucketing traffic in metrics.
+type AddressClass uint8
+
+const (
+	// AddressUnknown is the class of packets that aren't valid IP.
+	AddressUnknown AddressClass = iota
+	// AddressUnicast is any address not in the other classes,
+	// including unspecified and loopback addresses.
+	AddressUnicast
+	AddressMulticast
+	// AddressBroadcast is the IPv4 limited broadcast address. IPv6
+	// has no broadcast.
+	AddressBroadcast
+	// AddressLinkLocal is a link-local unicast address, in
+	// 169.254.0.0/16 or fe80::/10. Link-local multicast addresses are
+	// AddressMulticast.
+	AddressLinkLocal
+)
+
+func (c AddressClass) String() string {
+	switch c {
+	case AddressUnicast:
+		return "unicast"
+	case AddressMulticast:
+		return "multicast"
+	case AddressBroadcast:
+		return "broadcast"
+	case AddressLinkLocal:
+		return "link-local"
+	default:
+		return "unknown"
+	}
+}
+
+// AddressClass returns the class of q's destination address, IPv4 or
+// IPv6.
+func (q *Parsed) AddressClass() AddressClass {
+	switch q.IPVersion {
+	case 4:
+		if q.subofs == 0 {
+			return AddressUnknown // the header didn't decode
+		}
+		switch dst := q.DstIP; {
+		case dst.IsMulticast():
+			return AddressMulticast
+		case dst.IsBroadcast():
+			return AddressBroadcast
+		case dst.IsLinkLocalUnicast():
+			return AddressLinkLocal
+		}
+		return AddressUnicast
+	case 6:
+		switch dst := ip6FromBytes(q.b[24:40]); {
+		case dst.IsMulticast():
+			return AddressMulticast
+		case dst.IsLinkLocalUnicast():
+			return AddressLinkLocal
+		}
+		return AddressUnicast
+	}
+	return AddressUnknown
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressClass(t *testing.T) {
+	tests := []struct {
+		dst  string
+		want AddressClass
+	}{
+		{"5.6.7.8", AddressUnicast},
+		{"10.0.0.1", AddressUnicast},
+		{"127.0.0.1", AddressUnicast},
+		{"0.0.0.0", AddressUnicast},
+		{"224.0.0.251", AddressMulticast},
+		{"239.1.2.3", AddressMulticast},
+		{"255.255.255.255", AddressBroadcast},
+		{"10.255.255.255", AddressUnicast}, // directed broadcast isn't known
+		{"169.254.1.2", AddressLinkLocal},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6269:1", AddressUnicast},
+		{"2001:db8::1", AddressUnicast},
+		{"ff02::1", AddressMulticast},
+		{"ff05::1:3", AddressMulticast},
+		{"fe80::1", AddressLinkLocal},
+		{"febf::1", AddressLinkLocal},
+		{"fec0::1", AddressUnicast},
+	}
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.dst)
+		var pkt []byte
+		if ip4 := ip.To4(); ip4 != nil {
+			pkt = append([]byte(nil), udpRequestBuffer...)
+			copy(pkt[16:20], ip4)
+		} else {
+			pkt = makeUDP6(4)
+			copy(pkt[24:40], ip)
+		}
+		var q Parsed
+		q.Decode(pkt)
+		if got := q.AddressClass(); got != tt.want {
+			t.Errorf("%s: AddressClass = %v; want %v", tt.dst, got, tt.want)
+		}
+	}
+
+	badLength := append([]byte(nil), udpRequestBuffer...)
+	put16(badLength[2:4], 1000)
+	for _, pkt := range [][]byte{{0x45, 0x00}, badLength} {
+		var q Parsed
+		q.Decode(pkt)
+		if got := q.AddressClass(); got != AddressUnknown {
+			t.Errorf("%x: AddressClass = %v; want unknown", pkt, got)
+		}
+	}
+}
+
+func TestAddressClassString(t *testing.T) {
+	for c, want := range map[AddressClass]string{
+		AddressUnknown:   "unknown",
+		AddressUnicast:   "unicast",
+		AddressBroadcast: "broadcast",
+		AddressLinkLocal: "link-local",
+		99:               "unknown",
+	} {
+		if got := c.String(); got != want {
+			t.Errorf("AddressClass(%d).String() = %q; want %q", uint8(c), got, want)
+		}
+	}
+}
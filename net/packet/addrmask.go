@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// icmp4AddrMaskLength is the length of all headers of an ICMP address
+// mask message: identifier, sequence number and the mask itself.
+const icmp4AddrMaskLength = icmpAllHeadersLength + 8
+
+// ICMP4AddrMaskHeader is an ICMP address mask request or reply, as
+// defined by RFC 950.
+type ICMP4AddrMaskHeader struct {
+	ICMP4Header
+	ID   uint16
+	Seq  uint16
+	Mask IP4 // zero in requests
+}
+
+func (ICMP4AddrMaskHeader) Len() int {
+	return icmp4AddrMaskLength
+}
+
+func (h ICMP4AddrMaskHeader) Marshal(buf []byte) error {
+	if len(buf) < icmp4AddrMaskLength {
+		return ErrSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return ErrLargePacket
+	}
+	put16(buf[24:26], h.ID)
+	put16(buf[26:28], h.Seq)
+	put32(buf[28:32], uint32(h.Mask))
+	return h.ICMP4Header.Marshal(buf)
+}
+
+// ToResponse turns h into a reply to the request h, keeping its
+// identifier and sequence number. The caller must set Mask.
+func (h *ICMP4AddrMaskHeader) ToResponse() {
+	h.Type = ICMP4AddrMaskReply
+	h.Code = ICMP4NoCode
+	h.IP4Header.ToResponse()
+}
+
+// AddrMaskHeader returns the address mask header of q. ok is false if
+// q is not an ICMP address mask request or reply.
+func (q *Parsed) AddrMaskHeader() (h ICMP4AddrMaskHeader, ok bool) {
+	if q.IPProto != ICMP || q.TransportSkipped || q.length < q.subofs+icmpHeaderLength+8 {
+		return ICMP4AddrMaskHeader{}, false
+	}
+	icmp := q.ICMPHeader()
+	if icmp.Type != ICMP4AddrMaskRequest && icmp.Type != ICMP4AddrMaskReply {
+		return ICMP4AddrMaskHeader{}, false
+	}
+	sub := q.b[q.subofs:]
+	return ICMP4AddrMaskHeader{
+		ICMP4Header: icmp,
+		ID:          get16(sub[4:6]),
+		Seq:         get16(sub[6:8]),
+		Mask:        IP4(get32(sub[8:12])),
+	}, true
+}
+
+// AddrMaskResponder answers ICMP address mask requests.
+//
+// Replies reveal the local subnet mask to whoever asks, so the zero
+// AddrMaskResponder never replies; responding must be enabled
+// explicitly.
+type AddrMaskResponder struct {
+	Enabled bool
+	Mask    IP4 // the mask to answer with
+
+	// Addr is the local address to reply from to requests sent to a
+	// broadcast or multicast address. If it is zero, such requests
+	// aren't answered.
+	Addr IP4
+}
+
+// Respond writes to buf a reply to q, if q is an address mask request
+// and r is enabled, and returns its length. It returns 0 and a nil
+// error if there is nothing to send.
+//
+// As RFC 1122 section 3.2.2.9 requires, a request from 0.0.0.0, sent by
+// a host that doesn't know its address yet, is answered by broadcast,
+// and replies never come from a broadcast or multicast address.
+func (r AddrMaskResponder) Respond(q *Parsed, buf []byte) (int, error) {
+	if !r.Enabled {
+		return 0, nil
+	}
+	h, ok := q.AddrMaskHeader()
+	if !ok || h.Type != ICMP4AddrMaskRequest || h.Code != ICMP4NoCode {
+		return 0, nil
+	}
+	if h.SrcIP.IsBroadcast() || h.SrcIP.IsMulticast() {
+		return 0, nil
+	}
+	src, dst := h.DstIP, h.SrcIP
+	if r.isBroadcast(src) {
+		if r.Addr == 0 {
+			return 0, nil
+		}
+		src = r.Addr
+	}
+	if dst == 0 {
+		dst = IP4(0xffffffff)
+	}
+	h.ToResponse()
+	h.SrcIP, h.DstIP = src, dst
+	h.Mask = r.Mask
+	if len(buf) < icmp4AddrMaskLength {
+		return 0, ErrSmallBuffer
+	}
+	if err := h.Marshal(buf[:icmp4AddrMaskLength]); err != nil {
+		return 0, err
+	}
+	return icmp4AddrMaskLength, nil
+}
+
+// isBroadcast reports whether ip is a broadcast or multicast address,
+// including the directed broadcast address of r's subnet.
+func (r AddrMaskResponder) isBroadcast(ip IP4) bool {
+	if ip.IsBroadcast() || ip.IsMulticast() {
+		return true
+	}
+	return r.Addr != 0 && r.Mask != 0 && ip == r.Addr|^r.Mask
+}
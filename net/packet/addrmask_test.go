@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddrMask(t *testing.T) {
+	src := NewIP4(net.ParseIP("10.0.0.9"))
+	dst := NewIP4(net.ParseIP("10.0.0.1"))
+	req := ICMP4AddrMaskHeader{
+		ICMP4Header: ICMP4Header{
+			IP4Header: IP4Header{SrcIP: src, DstIP: dst, IPID: 5},
+			Type:      ICMP4AddrMaskRequest,
+		},
+		ID:  0x1234,
+		Seq: 7,
+	}
+	pkt := make([]byte, req.Len())
+	if err := req.Marshal(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if ipChecksum(pkt[20:]) != 0 {
+		t.Errorf("bad ICMP checksum in request")
+	}
+
+	var q Parsed
+	q.Decode(pkt)
+	got, ok := q.AddrMaskHeader()
+	if !ok || got.Type != ICMP4AddrMaskRequest || got.ID != 0x1234 || got.Seq != 7 || got.Mask != 0 {
+		t.Fatalf("AddrMaskHeader = %+v, %v", got, ok)
+	}
+
+	buf := make([]byte, 64)
+	if n, err := (AddrMaskResponder{Mask: 0xffffff00}).Respond(&q, buf); n != 0 || err != nil {
+		t.Errorf("disabled responder: got %d, %v; want 0, nil", n, err)
+	}
+
+	r := AddrMaskResponder{Enabled: true, Mask: 0xffffff00}
+	n, err := r.Respond(&q, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := buf[:n]
+	if ipChecksum(reply[:20]) != 0 || ipChecksum(reply[20:]) != 0 {
+		t.Errorf("bad checksums in reply %x", reply)
+	}
+	var rq Parsed
+	rq.Decode(reply)
+	h, ok := rq.AddrMaskHeader()
+	if !ok {
+		t.Fatalf("reply not recognized: %x", reply)
+	}
+	if h.Type != ICMP4AddrMaskReply || h.ID != 0x1234 || h.Seq != 7 || h.Mask != 0xffffff00 {
+		t.Errorf("reply = %+v", h)
+	}
+	if rq.SrcIP != dst || rq.DstIP != src {
+		t.Errorf("reply addressed %v > %v; want %v > %v", rq.SrcIP, rq.DstIP, dst, src)
+	}
+
+	// Replies and other ICMP messages aren't answered.
+	if n, _ := r.Respond(&rq, buf); n != 0 {
+		t.Errorf("responded to a reply")
+	}
+	q.Decode(icmpRequestBuffer)
+	if _, ok := q.AddrMaskHeader(); ok {
+		t.Errorf("echo request classified as address mask")
+	}
+	if n, _ := r.Respond(&q, buf); n != 0 {
+		t.Errorf("responded to an echo request")
+	}
+	q.Decode(pkt)
+	if _, err := r.Respond(&q, buf[:31]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestAddrMaskBroadcast(t *testing.T) {
+	local := NewIP4(net.ParseIP("10.0.0.1"))
+	request := func(src, dst IP4) *Parsed {
+		req := ICMP4AddrMaskHeader{
+			ICMP4Header: ICMP4Header{
+				IP4Header: IP4Header{SrcIP: src, DstIP: dst},
+				Type:      ICMP4AddrMaskRequest,
+			},
+			ID: 1,
+		}
+		pkt := make([]byte, req.Len())
+		if err := req.Marshal(pkt); err != nil {
+			t.Fatal(err)
+		}
+		var q Parsed
+		q.Decode(pkt)
+		return &q
+	}
+
+	tests := []struct {
+		name     string
+		addr     IP4
+		src, dst string
+		// wantSrc and wantDst are empty if there is no reply.
+		wantSrc, wantDst string
+	}{
+		{"unknown_source", local, "0.0.0.0", "255.255.255.255", "10.0.0.1", "255.255.255.255"},
+		{"unknown_source_unicast", 0, "0.0.0.0", "10.0.0.1", "10.0.0.1", "255.255.255.255"},
+		{"broadcast", local, "10.0.0.9", "255.255.255.255", "10.0.0.1", "10.0.0.9"},
+		{"directed_broadcast", local, "10.0.0.9", "10.0.0.255", "10.0.0.1", "10.0.0.9"},
+		{"multicast", local, "10.0.0.9", "224.0.0.1", "10.0.0.1", "10.0.0.9"},
+		{"broadcast_no_addr", 0, "0.0.0.0", "255.255.255.255", "", ""},
+		{"multicast_no_addr", 0, "10.0.0.9", "224.0.0.1", "", ""},
+		{"broadcast_source", local, "255.255.255.255", "10.0.0.1", "", ""},
+	}
+	for _, tt := range tests {
+		r := AddrMaskResponder{Enabled: true, Mask: 0xffffff00, Addr: tt.addr}
+		q := request(NewIP4(net.ParseIP(tt.src)), NewIP4(net.ParseIP(tt.dst)))
+		buf := make([]byte, 64)
+		n, err := r.Respond(q, buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.wantSrc == "" {
+			if n != 0 {
+				t.Errorf("%s: replied; want no reply", tt.name)
+			}
+			continue
+		}
+		var rq Parsed
+		rq.Decode(buf[:n])
+		if got, want := rq.SrcIP.String()+" > "+rq.DstIP.String(), tt.wantSrc+" > "+tt.wantDst; got != want {
+			t.Errorf("%s: reply addressed %s; want %s", tt.name, got, want)
+		}
+		if ipChecksum(buf[:20]) != 0 {
+			t.Errorf("%s: bad IP checksum", tt.name)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+const (
+	arpHeaderLength = 28
+	arpHTypeEther   = 1
+	arpOpRequest    = 1
+)
+
+// MakeGratuitousARP writes into buf an Ethernet frame holding a
+// gratuitous ARP announcement that ip is at mac, and returns the
+// number of bytes written.
+//
+// Following RFC 5227 section 3, the announcement is an ARP request
+// broadcast to ff:ff:ff:ff:ff:ff whose sender and target protocol
+// addresses are both ip and whose target hardware address is zero.
+// Hosts and switches that see it update their cache entry for ip.
+// No padding is added to the 42-byte frame; the NIC pads it to the
+// Ethernet minimum.
+func MakeGratuitousARP(ip IP4, mac [6]byte, buf []byte) (int, error) {
+	const n = ethernetHeaderLength + arpHeaderLength
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+
+	eth := EthernetHeader{
+		Dst:       [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		Src:       mac,
+		EtherType: EtherTypeARP,
+	}
+	eth.Marshal(buf)
+
+	arp := buf[ethernetHeaderLength:]
+	put16(arp[0:2], arpHTypeEther)
+	put16(arp[2:4], EtherTypeIPv4)
+	arp[4] = 6 // hardware address length
+	arp[5] = 4 // protocol address length
+	put16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], mac[:])
+	put32(arp[14:18], uint32(ip))
+	for i := 18; i < 24; i++ {
+		arp[i] = 0
+	}
+	put32(arp[24:28], uint32(ip))
+	return n, nil
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestMakeGratuitousARP(t *testing.T) {
+	ip := NewIP4(net.ParseIP("192.168.1.10"))
+	mac := [6]byte{0x02, 0x11, 0x22, 0x33, 0x44, 0x55}
+	buf := bytes.Repeat([]byte{0xaa}, 64)
+	n, err := MakeGratuitousARP(ip, mac, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		// Ethernet: broadcast destination, our source, ARP
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0x11, 0x22, 0x33, 0x44, 0x55,
+		0x08, 0x06,
+		// ARP: Ethernet/IPv4, 6/4 byte addresses, request
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+		// sender MAC and IP
+		0x02, 0x11, 0x22, 0x33, 0x44, 0x55, 0xc0, 0xa8, 0x01, 0x0a,
+		// target MAC (zero) and IP (same as sender)
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xa8, 0x01, 0x0a,
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("got  %x\nwant %x", buf[:n], want)
+	}
+	if buf[n] != 0xaa {
+		t.Errorf("wrote past returned length")
+	}
+
+	if _, err := MakeGratuitousARP(ip, mac, buf[:41]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
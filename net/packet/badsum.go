@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+var errNoChecksum = errors.New("packet has no such checksum")
+
+// BadChecksum selects the checksums MarshalBadChecksum corrupts.
+type BadChecksum uint8
+
+const (
+	// BadIPChecksum corrupts the IPv4 header checksum.
+	BadIPChecksum BadChecksum = 1 << iota
+	// BadTransportChecksum corrupts the TCP, UDP, ICMP or ICMPv6
+	// checksum.
+	BadTransportChecksum
+)
+
+// MarshalBadChecksum is like h.Marshal, but stores a wrong value in
+// the checksums selected by bad, leaving every other byte as Marshal
+// wrote it. It is meant for testing that receivers validate checksums,
+// and should not be used otherwise.
+//
+// The wrong checksums never verify: they differ from the right ones
+// by more than the ambiguity between 0x0000 and 0xffff in one's
+// complement, and a UDP checksum is never zeroed, which would mean
+// "no checksum". MarshalBadChecksum returns an error if a selected
+// checksum isn't part of the packet, such as the IP checksum of an
+// IPv6 packet.
+func MarshalBadChecksum(h Header, buf []byte, bad BadChecksum) error {
+	if err := h.Marshal(buf); err != nil {
+		return err
+	}
+	return corruptChecksums(buf, bad)
+}
+
+// corruptChecksums corrupts the checksums selected by bad in the
+// freshly marshaled packet buf.
+func corruptChecksums(buf []byte, bad BadChecksum) error {
+	var hlen int
+	var proto IP4Proto
+	switch buf[0] >> 4 {
+	case 4:
+		hlen, proto = int(buf[0]&0x0F)<<2, IP4Proto(buf[9])
+		if bad&BadIPChecksum != 0 {
+			corruptChecksum(buf[10:12], false)
+		}
+	case 6:
+		if bad&BadIPChecksum != 0 {
+			return errNoChecksum
+		}
+		hlen, proto = ip6HeaderLength, IP4Proto(buf[6])
+	default:
+		return errNoChecksum
+	}
+	if bad&BadTransportChecksum == 0 {
+		return nil
+	}
+	ofs, ok := transportChecksumOffset(proto)
+	if proto == ICMPv6 {
+		ofs, ok = 2, true
+	}
+	if !ok || hlen+ofs+2 > len(buf) {
+		return errNoChecksum
+	}
+	corruptChecksum(buf[hlen+ofs:hlen+ofs+2], proto == UDP)
+	return nil
+}
+
+// corruptChecksum changes the checksum in the two bytes of b to a
+// value that doesn't verify. A checksum differing from the right one
+// by 1 or 2 can't be its one's complement equivalent, which differs
+// by 0xffff.
+func corruptChecksum(b []byte, udp bool) {
+	c := get16(b)
+	if udp && c == 1 {
+		put16(b, 3)
+		return
+	}
+	put16(b, c^1)
+}
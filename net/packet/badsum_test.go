@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestMarshalBadChecksum(t *testing.T) {
+	payload := []byte("payload")
+	udp := &UDP4Header{
+		IP4Header: IP4Header{SrcIP: 0x01020304, DstIP: 0x05060708},
+		SrcPort:   123,
+		DstPort:   456,
+	}
+	good := Generate(udp, payload)
+
+	for _, tt := range []struct {
+		name        string
+		bad         BadChecksum
+		ipOK, udpOK bool
+		changed     int
+	}{
+		{"none", 0, true, true, 0},
+		{"ip", BadIPChecksum, false, true, 1},
+		{"transport", BadTransportChecksum, true, false, 1},
+		{"both", BadIPChecksum | BadTransportChecksum, false, false, 2},
+	} {
+		buf := make([]byte, len(good))
+		copy(buf[udp.Len():], payload)
+		if err := MarshalBadChecksum(udp, buf, tt.bad); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok := ipChecksum(buf[:ipHeaderLength]) == 0; ok != tt.ipOK {
+			t.Errorf("%s: IP checksum valid = %v; want %v", tt.name, ok, tt.ipOK)
+		}
+		if ok := transportChecksum4(buf) == 0; ok != tt.udpOK {
+			t.Errorf("%s: UDP checksum valid = %v; want %v", tt.name, ok, tt.udpOK)
+		}
+		// Only the checksum fields differ.
+		diff := 0
+		for i := range buf {
+			if buf[i] != good[i] && i != 10 && i != 11 && i != 26 && i != 27 {
+				t.Errorf("%s: byte %d changed", tt.name, i)
+			}
+		}
+		if get16(buf[10:12]) != get16(good[10:12]) {
+			diff++
+		}
+		if get16(buf[26:28]) != get16(good[26:28]) {
+			diff++
+		}
+		if diff != tt.changed {
+			t.Errorf("%s: %d checksums changed; want %d", tt.name, diff, tt.changed)
+		}
+	}
+
+	// IPv6 has no header checksum.
+	h6 := &IP6Header{IPProto: UDP, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	if err := MarshalBadChecksum(h6, make([]byte, 48), BadIPChecksum); err != errNoChecksum {
+		t.Errorf("IPv6 header checksum: got %v; want %v", err, errNoChecksum)
+	}
+}
+
+func TestCorruptChecksum(t *testing.T) {
+	// Whatever the right checksum, the corrupted one never verifies,
+	// including across the 0x0000/0xffff equivalence, and a UDP
+	// checksum never becomes "none".
+	for c := 0; c <= 0xffff; c++ {
+		for _, udp := range []bool{false, true} {
+			b := make([]byte, 2)
+			put16(b, uint16(c))
+			corruptChecksum(b, udp)
+			got := get16(b)
+			if s := foldChecksum(uint64(got) + uint64(^uint16(c))); s == 0 || s == 0xffff {
+				t.Fatalf("corrupted %#04x to equivalent %#04x", c, got)
+			}
+			if udp && got == 0 {
+				t.Fatalf("corrupted UDP checksum %#04x to zero", c)
+			}
+		}
+	}
+}
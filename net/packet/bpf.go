@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"strconv"
+	"strings"
+)
+
+// BPFFilter returns a tcpdump (pcap-filter) expression matching q's
+// flow in both directions, such as "host 1.2.3.4 and host 5.6.7.8 and
+// tcp port 123 and tcp port 443", for capturing the same flow
+// elsewhere on its path. Ports are only included for TCP and UDP, and
+// protocols without a pcap-filter keyword are matched by number.
+// BPFFilter returns the empty string if q couldn't be decoded.
+func (q *Parsed) BPFFilter() string {
+	var src, dst string
+	var proto IP4Proto
+	var sport, dport uint16
+	hasPorts := false
+	switch q.IPVersion {
+	case 4:
+		src, dst = q.SrcIP.String(), q.DstIP.String()
+		proto = q.IPProto
+		if proto == Unknown {
+			// Decode doesn't know the protocol, but the header may
+			// still be fine.
+			if _, _, err := checkIP4(q.b); err != nil {
+				return ""
+			}
+			proto = IP4Proto(q.b[9])
+		}
+		hasPorts = q.HasValidPorts()
+		sport, dport = q.SrcPort, q.DstPort
+	case 6:
+		if len(q.b) < ip6HeaderLength {
+			return ""
+		}
+		src, dst = ip6FromBytes(q.b[8:24]).String(), ip6FromBytes(q.b[24:40]).String()
+		var off int
+		proto, off = ip6UpperProto(q.b)
+		if (proto == TCP || proto == UDP) && off+4 <= len(q.b) {
+			hasPorts = true
+			sport, dport = get16(q.b[off:off+2]), get16(q.b[off+2:off+4])
+		}
+	default:
+		return ""
+	}
+
+	var terms []string
+	terms = append(terms, "host "+src)
+	if dst != src {
+		terms = append(terms, "host "+dst)
+	}
+	var kw string
+	switch proto {
+	case TCP:
+		kw = "tcp"
+	case UDP:
+		kw = "udp"
+	case ICMP:
+		kw = "icmp"
+	case ICMPv6:
+		kw = "icmp6"
+	case IGMP:
+		kw = "igmp"
+	case ESP:
+		kw = "esp"
+	case AH:
+		kw = "ah"
+	case PIM:
+		kw = "pim"
+	case VRRP:
+		kw = "vrrp"
+	case Unknown, Fragment:
+		// Ports and protocol aren't known, so match on addresses.
+	default:
+		if q.IPVersion == 6 {
+			kw = "ip6 proto " + strconv.Itoa(int(proto))
+		} else {
+			kw = "ip proto " + strconv.Itoa(int(proto))
+		}
+	}
+	switch {
+	case hasPorts:
+		terms = append(terms, kw+" port "+strconv.Itoa(int(sport)))
+		if dport != sport {
+			terms = append(terms, kw+" port "+strconv.Itoa(int(dport)))
+		}
+	case kw != "":
+		terms = append(terms, kw)
+	}
+	return strings.Join(terms, " and ")
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestBPFFilter(t *testing.T) {
+	gre := append([]byte(nil), udpRequestBuffer...)
+	gre[9] = 47
+	esp := append([]byte(nil), udpRequestBuffer...)
+	esp[9] = uint8(ESP)
+	pim := append([]byte(nil), udpRequestBuffer...)
+	pim[9] = uint8(PIM)
+	hairpin := append([]byte(nil), tcpPacketBuffer...)
+	copy(hairpin[16:20], hairpin[12:16])
+	tcp6 := makeUDP6(4)
+	tcp6[6] = uint8(TCP)
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want string
+	}{
+		{"tcp", tcpPacketBuffer, "host 1.2.3.4 and host 5.6.7.8 and tcp port 123 and tcp port 567"},
+		{"udp", udpRequestBuffer, "host 1.2.3.4 and host 5.6.7.8 and udp port 123 and udp port 567"},
+		{"icmp", icmpRequestBuffer, "host 1.2.3.4 and host 5.6.7.8 and icmp"},
+		{"esp", esp, "host 1.2.3.4 and host 5.6.7.8 and esp"},
+		{"pim", pim, "host 1.2.3.4 and host 5.6.7.8 and pim"},
+		{"other_proto", gre, "host 1.2.3.4 and host 5.6.7.8 and ip proto 47"},
+		{"hairpin", hairpin, "host 1.2.3.4 and tcp port 123 and tcp port 567"},
+		{"udp6", makeUDP6(4), "host fd7a:115c:a1e0:ab12:4843:cd96:626b:430b and host fd7a:115c:a1e0:ab12:4843:cd96:6269:1 and udp port 123 and udp port 567"},
+		{"tcp6_hop_by_hop", withIP6ExtHeader(tcp6, ip6HopByHop, make([]byte, 8)), "host fd7a:115c:a1e0:ab12:4843:cd96:626b:430b and host fd7a:115c:a1e0:ab12:4843:cd96:6269:1 and tcp port 123 and tcp port 567"},
+		{"garbage", []byte{0x45, 0x00}, ""},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.BPFFilter(); got != tt.want {
+			t.Errorf("%s: got %q\nwant %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Replies get the same filter, with the terms swapped.
+	var resp Parsed
+	resp.Decode(udpReplyBuffer)
+	if got, want := resp.BPFFilter(), "host 5.6.7.8 and host 1.2.3.4 and udp port 567 and udp port 123"; got != want {
+		t.Errorf("reply: got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// GetUint16 returns the big-endian (network byte order) uint16
+// at the start of b. It fails if len(b) < 2.
+func GetUint16(b []byte) (uint16, error) {
+	if len(b) < 2 {
+		return 0, ErrSmallBuffer
+	}
+	return get16(b), nil
+}
+
+// PutUint16 writes v to the start of b in big-endian
+// (network byte order). It fails if len(b) < 2.
+func PutUint16(b []byte, v uint16) error {
+	if len(b) < 2 {
+		return ErrSmallBuffer
+	}
+	put16(b, v)
+	return nil
+}
+
+// GetUint32 returns the big-endian (network byte order) uint32
+// at the start of b. It fails if len(b) < 4.
+func GetUint32(b []byte) (uint32, error) {
+	if len(b) < 4 {
+		return 0, ErrSmallBuffer
+	}
+	return get32(b), nil
+}
+
+// PutUint32 writes v to the start of b in big-endian
+// (network byte order). It fails if len(b) < 4.
+func PutUint32(b []byte, v uint32) error {
+	if len(b) < 4 {
+		return ErrSmallBuffer
+	}
+	put32(b, v)
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestByteOrder(t *testing.T) {
+	b := []byte{0x12, 0x34, 0x56, 0x78, 0x9a}
+
+	if v, err := GetUint16(b); err != nil || v != 0x1234 {
+		t.Errorf("GetUint16 = %#x, %v; want 0x1234, nil", v, err)
+	}
+	if v, err := GetUint32(b[1:]); err != nil || v != 0x3456789a {
+		t.Errorf("GetUint32 = %#x, %v; want 0x3456789a, nil", v, err)
+	}
+	if _, err := GetUint16(b[:1]); err != ErrSmallBuffer {
+		t.Errorf("GetUint16 short: err = %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := GetUint32(b[:3]); err != ErrSmallBuffer {
+		t.Errorf("GetUint32 short: err = %v; want %v", err, ErrSmallBuffer)
+	}
+
+	out := make([]byte, 6)
+	if err := PutUint16(out, 0xabcd); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutUint32(out[2:], 0x01020304); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0xab, 0xcd, 0x01, 0x02, 0x03, 0x04}; !bytes.Equal(out, want) {
+		t.Errorf("got %x; want %x", out, want)
+	}
+	if err := PutUint16(out[:1], 0); err != ErrSmallBuffer {
+		t.Errorf("PutUint16 short: err = %v; want %v", err, ErrSmallBuffer)
+	}
+	if err := PutUint32(out[:3], 0); err != ErrSmallBuffer {
+		t.Errorf("PutUint32 short: err = %v; want %v", err, ErrSmallBuffer)
+	}
+	if want := []byte{0xab, 0xcd, 0x01, 0x02, 0x03, 0x04}; !bytes.Equal(out, want) {
+		t.Errorf("failed Put modified buffer: got %x; want %x", out, want)
+	}
+}
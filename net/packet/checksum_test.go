@@ -0,0 +1,162 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// ipChecksumReference is the straightforward RFC 1071 checksum,
+// adding one 16-bit word at a time, that ipChecksum must agree with.
+func ipChecksumReference(b []byte) uint16 {
+	var ac uint32
+	i := 0
+	n := len(b)
+	for n >= 2 {
+		ac += uint32(get16(b[i : i+2]))
+		n -= 2
+		i += 2
+	}
+	if n == 1 {
+		ac += uint32(b[i]) << 8
+	}
+	for (ac >> 16) > 0 {
+		ac = (ac >> 16) + (ac & 0xffff)
+	}
+	return uint16(^ac)
+}
+
+func TestIPChecksum(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 9001)
+	for _, fill := range []string{"zeros", "ones", "random"} {
+		for i := range buf {
+			switch fill {
+			case "zeros":
+				buf[i] = 0
+			case "ones":
+				buf[i] = 0xff
+			default:
+				buf[i] = byte(rnd.Intn(256))
+			}
+		}
+		for n := 0; n <= 70; n++ {
+			if got, want := ipChecksum(buf[:n]), ipChecksumReference(buf[:n]); got != want {
+				t.Errorf("%s len %d: got %#04x; want %#04x", fill, n, got, want)
+			}
+		}
+		for _, n := range []int{1499, 1500, 8999, 9000, 9001} {
+			if got, want := ipChecksum(buf[:n]), ipChecksumReference(buf[:n]); got != want {
+				t.Errorf("%s len %d: got %#04x; want %#04x", fill, n, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkIPChecksum(b *testing.B) {
+	for _, size := range []int{20, 1500, 9000} {
+		buf := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(buf)
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				ipChecksum(buf)
+			}
+		})
+		b.Run(fmt.Sprintf("%d/reference", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				ipChecksumReference(buf)
+			}
+		})
+	}
+}
+
+func TestUpdateChecksum(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 40)
+	for i := 0; i < 1000; i++ {
+		rnd.Read(buf)
+		csum := ipChecksum(buf)
+		ofs := 2 * rnd.Intn(len(buf)/2)
+		old := get16(buf[ofs:])
+		new := uint16(rnd.Intn(1 << 16))
+		if i%10 == 0 {
+			new = 0
+		}
+		put16(buf[ofs:], new)
+		if got, want := updateChecksum(csum, old, new), ipChecksum(buf); got != want {
+			t.Fatalf("%x: word %d %#04x -> %#04x: got %#04x; want %#04x", buf, ofs, old, new, got, want)
+		}
+	}
+}
+
+func TestChecksumExcluding(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	zeroed := make([]byte, 64)
+	for n := 2; n <= 64; n++ {
+		buf := make([]byte, n)
+		for ofs := 0; ofs+2 <= n; ofs++ {
+			rnd.Read(buf)
+			if ofs%7 == 0 {
+				// Exercise an all-zero remainder too.
+				for i := range buf {
+					buf[i] = 0
+				}
+				buf[ofs] = 0x12
+			}
+			orig := append([]byte(nil), buf...)
+			z := zeroed[:n]
+			copy(z, buf)
+			z[ofs], z[ofs+1] = 0, 0
+			if got, want := ChecksumExcluding(buf, ofs), ipChecksum(z); got != want {
+				t.Fatalf("%x: field at %d: got %#04x; want %#04x", buf, ofs, got, want)
+			}
+			if !bytes.Equal(buf, orig) {
+				t.Fatalf("ChecksumExcluding modified its input")
+			}
+		}
+	}
+
+	// Storing the result makes the whole buffer verify.
+	pkt := append([]byte(nil), udpRequestBuffer[:20]...)
+	put16(pkt[10:12], ChecksumExcluding(pkt, 10))
+	if ipChecksum(pkt) != 0 {
+		t.Errorf("header with stored checksum doesn't verify")
+	}
+}
+
+func TestPseudoHeaderChecksum(t *testing.T) {
+	// Seeding the transport checksum field with the pseudo-header
+	// sum and then checksumming just the segment, as offload
+	// hardware does, must give the full checksum.
+	src := IP4Port{IP: 0x01020304, Port: 123}
+	dst := IP4Port{IP: 0x05060708, Port: 567}
+	buf := make([]byte, 128)
+	n, err := MakeTCP4(src, dst, 1, 2, TCPAck, 100, []byte("some payload"), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := buf[:n]
+	seg := pkt[ipHeaderLength:]
+	put16(seg[16:18], 0)
+	want := transportChecksum4(pkt)
+	put16(seg[16:18], PseudoHeaderChecksum(src.IP, dst.IP, TCP, uint16(len(seg))))
+	if got := ipChecksum(seg); got != want {
+		t.Errorf("IPv4: seeded checksum %#04x; want %#04x", got, want)
+	}
+
+	pkt = makeUDP6(11)
+	seg = pkt[ip6HeaderLength:]
+	put16(seg[6:8], 0)
+	want = transportChecksum6(pkt)
+	put16(seg[6:8], PseudoHeaderChecksum6(testIP6Src, testIP6Dst, UDP, uint32(len(seg))))
+	if got := ipChecksum(seg); got != want {
+		t.Errorf("IPv6: seeded checksum %#04x; want %#04x", got, want)
+	}
+}
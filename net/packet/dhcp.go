@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+// UDP ports used by DHCP (RFC 2131).
+const (
+	DHCPServerPort = 67
+	DHCPClientPort = 68
+)
+
+// DHCPMessageType is the value of the DHCP message type option
+// (RFC 2132 section 9.6).
+type DHCPMessageType uint8
+
+const (
+	DHCPDiscover DHCPMessageType = 1
+	DHCPOffer    DHCPMessageType = 2
+	DHCPRequest  DHCPMessageType = 3
+	DHCPDecline  DHCPMessageType = 4
+	DHCPAck      DHCPMessageType = 5
+	DHCPNak      DHCPMessageType = 6
+	DHCPRelease  DHCPMessageType = 7
+	DHCPInform   DHCPMessageType = 8
+)
+
+func (t DHCPMessageType) String() string {
+	switch t {
+	case DHCPDiscover:
+		return "Discover"
+	case DHCPOffer:
+		return "Offer"
+	case DHCPRequest:
+		return "Request"
+	case DHCPDecline:
+		return "Decline"
+	case DHCPAck:
+		return "Ack"
+	case DHCPNak:
+		return "Nak"
+	case DHCPRelease:
+		return "Release"
+	case DHCPInform:
+		return "Inform"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	// dhcpFixedLength is the length of the fixed-format part of a
+	// DHCP message, up to and including the magic cookie.
+	dhcpFixedLength = 240
+	dhcpMagicCookie = 0x63825363
+
+	dhcpOptPad         = 0
+	dhcpOptRequestedIP = 50
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptEnd         = 255
+)
+
+var errNotDHCP = errors.New("not a DHCP message")
+
+// DHCPMessage is the part of a DHCP message (RFC 2131) useful for
+// observing leases: enough to follow a client through
+// DISCOVER/OFFER/REQUEST/ACK and learn the address it was assigned.
+type DHCPMessage struct {
+	Op     uint8  // 1 for requests from clients, 2 for replies
+	XID    uint32 // transaction ID chosen by the client
+	CIAddr IP4    // client's current address, if it has one
+	YIAddr IP4    // "your" address: the one being assigned
+	SIAddr IP4    // next server to use in bootstrap
+	GIAddr IP4    // relay agent address
+	CHAddr [6]byte
+
+	// Type is the DHCP message type option, or zero for a plain
+	// BOOTP message without one.
+	Type DHCPMessageType
+	// RequestedIP is the requested IP address option, or zero.
+	RequestedIP IP4
+	// ServerID is the server identifier option, or zero.
+	ServerID IP4
+}
+
+// IsDHCP reports whether q is a UDP packet between the DHCP server
+// and client ports, in either direction.
+func (q *Parsed) IsDHCP() bool {
+	return q.IPProto == UDP &&
+		((q.SrcPort == DHCPClientPort && q.DstPort == DHCPServerPort) ||
+			(q.SrcPort == DHCPServerPort && q.DstPort == DHCPClientPort) ||
+			// Relay agents talk to servers from the server port.
+			(q.SrcPort == DHCPServerPort && q.DstPort == DHCPServerPort))
+}
+
+// DHCPMessage parses the DHCP message carried by q, which must be a
+// packet for which IsDHCP is true.
+//
+// Option parsing is tolerant: unknown options are skipped, parsing
+// stops at the End option, and a truncated option list keeps the
+// options found before the truncation. The message is rejected only
+// if its fixed part is short or lacks the magic cookie.
+func (q *Parsed) DHCPMessage() (DHCPMessage, error) {
+	if !q.IsDHCP() {
+		return DHCPMessage{}, errNotDHCP
+	}
+	return parseDHCP(q.Payload())
+}
+
+func parseDHCP(b []byte) (DHCPMessage, error) {
+	if len(b) < dhcpFixedLength || get32(b[236:240]) != dhcpMagicCookie {
+		return DHCPMessage{}, errNotDHCP
+	}
+	m := DHCPMessage{
+		Op:     b[0],
+		XID:    get32(b[4:8]),
+		CIAddr: IP4(get32(b[12:16])),
+		YIAddr: IP4(get32(b[16:20])),
+		SIAddr: IP4(get32(b[20:24])),
+		GIAddr: IP4(get32(b[24:28])),
+	}
+	if b[1] == 1 && b[2] == 6 { // Ethernet
+		copy(m.CHAddr[:], b[28:34])
+	}
+	opts := b[dhcpFixedLength:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			break
+		}
+		data := opts[2 : 2+int(opts[1])]
+		opts = opts[2+len(data):]
+		switch code {
+		case dhcpOptMessageType:
+			if len(data) == 1 {
+				m.Type = DHCPMessageType(data[0])
+			}
+		case dhcpOptRequestedIP:
+			if len(data) == 4 {
+				m.RequestedIP = IP4(get32(data))
+			}
+		case dhcpOptServerID:
+			if len(data) == 4 {
+				m.ServerID = IP4(get32(data))
+			}
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+// makeDHCP returns a UDP packet carrying a DHCP message with the
+// given op, addresses and options (which should include End).
+func makeDHCP(t *testing.T, src, dst IP4Port, op uint8, yiaddr IP4, opts []byte) []byte {
+	t.Helper()
+	msg := make([]byte, dhcpFixedLength, dhcpFixedLength+len(opts))
+	msg[0] = op
+	msg[1], msg[2] = 1, 6 // Ethernet, 6-byte addresses
+	put32(msg[4:8], 0xcafef00d)
+	put32(msg[16:20], uint32(yiaddr))
+	copy(msg[28:34], []byte{0x02, 0, 0, 0, 0, 0x42})
+	put32(msg[236:240], dhcpMagicCookie)
+	msg = append(msg, opts...)
+	buf := make([]byte, udpTotalHeaderLength+len(msg))
+	n, err := MakeUDP4(src, dst, msg, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestDHCPMessage(t *testing.T) {
+	client := IP4Port{IP: 0, Port: DHCPClientPort}
+	server := IP4Port{IP: NewIP4(net.ParseIP("192.168.1.1")), Port: DHCPServerPort}
+	bcast := IP4Port{IP: 0xffffffff, Port: DHCPServerPort}
+	assigned := NewIP4(net.ParseIP("192.168.1.50"))
+
+	request := makeDHCP(t, client, bcast, 1, 0, []byte{
+		53, 1, 3, // message type: Request
+		0, 0, // padding
+		50, 4, 192, 168, 1, 50, // requested IP
+		54, 4, 192, 168, 1, 1, // server ID
+		12, 3, 'f', 'o', 'o', // host name, ignored
+		255,
+		53, 1, 7, // after End: ignored
+	})
+	ack := makeDHCP(t, server, IP4Port{IP: assigned, Port: DHCPClientPort}, 2, assigned, []byte{
+		53, 1, 5, // message type: Ack
+		51, 4, 0, 0, 0x0e, 0x10, // lease time, ignored
+		54, 4, 192, 168, 1, 1,
+		255,
+	})
+	truncated := makeDHCP(t, client, bcast, 1, 0, []byte{
+		53, 1, 1, // Discover
+		50, 4, 192, 168, // cut off
+	})
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want DHCPMessage
+	}{
+		{"request", request, DHCPMessage{Op: 1, Type: DHCPRequest, RequestedIP: assigned, ServerID: server.IP}},
+		{"ack", ack, DHCPMessage{Op: 2, Type: DHCPAck, YIAddr: assigned, ServerID: server.IP}},
+		{"truncated_options", truncated, DHCPMessage{Op: 1, Type: DHCPDiscover}},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if !q.IsDHCP() {
+			t.Fatalf("%s: IsDHCP = false", tt.name)
+		}
+		got, err := q.DHCPMessage()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tt.want.XID = 0xcafef00d
+		tt.want.CHAddr = [6]byte{0x02, 0, 0, 0, 0, 0x42}
+		if got != tt.want {
+			t.Errorf("%s: got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+	if DHCPAck.String() != "Ack" || DHCPMessageType(99).String() != "Unknown" {
+		t.Errorf("bad DHCPMessageType names")
+	}
+
+	// Not DHCP: wrong ports, or no magic cookie.
+	var q Parsed
+	q.Decode(udpRequestBuffer)
+	if q.IsDHCP() {
+		t.Errorf("IsDHCP true for ports %d > %d", q.SrcPort, q.DstPort)
+	}
+	if _, err := q.DHCPMessage(); err == nil {
+		t.Errorf("parsed a DHCP message from a non-DHCP packet")
+	}
+	noCookie := append([]byte(nil), request...)
+	noCookie[udpTotalHeaderLength+236] = 0
+	q.Decode(noCookie)
+	if _, err := q.DHCPMessage(); err == nil {
+		t.Errorf("parsed a DHCP message without magic cookie")
+	}
+	short := makeDHCP(t, client, bcast, 1, 0, nil)
+	short = short[:len(short)-1]
+	put16(short[2:4], uint16(len(short)))
+	q.Decode(short)
+	if _, err := q.DHCPMessage(); err == nil {
+		t.Errorf("parsed a short DHCP message")
+	}
+}
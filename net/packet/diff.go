@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Diff describes the differences between packets a and b, for use in
+// test failure messages. It returns the empty string if they're equal.
+//
+// If both are decodable IPv4 packets, the differences are reported
+// field by field, such as "SrcIP: 1.2.3.4 != 1.2.3.5, IP checksum:
+// 0x8c01 != 0x8c00". Otherwise, Diff falls back to reporting where
+// the bytes differ.
+func Diff(a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+	var pa, pb Parsed
+	pa.Decode(a)
+	pb.Decode(b)
+	if pa.IPVersion != 4 || pb.IPVersion != 4 || pa.IPProto == Unknown || pb.IPProto == Unknown {
+		return byteDiff(a, b)
+	}
+
+	var diffs []string
+	add := func(field string, x, y interface{}) {
+		if x != y {
+			diffs = append(diffs, fmt.Sprintf("%s: %v != %v", field, x, y))
+		}
+	}
+	add("IPProto", pa.IPProto, pb.IPProto)
+	add("SrcIP", pa.SrcIP, pb.SrcIP)
+	add("DstIP", pa.DstIP, pb.DstIP)
+	add("TotalLength", pa.length, pb.length)
+	add("IPID", get16(a[4:6]), get16(b[4:6]))
+	add("Flags/FragOffset", fmt.Sprintf("%#04x", get16(a[6:8])), fmt.Sprintf("%#04x", get16(b[6:8])))
+	add("TTL", a[8], b[8])
+	add("IP checksum", fmt.Sprintf("%#04x", get16(a[10:12])), fmt.Sprintf("%#04x", get16(b[10:12])))
+	if pa.IPProto == pb.IPProto {
+		switch pa.IPProto {
+		case TCP:
+			add("TCPFlags", fmt.Sprintf("%#02x", pa.TCPFlags), fmt.Sprintf("%#02x", pb.TCPFlags))
+			fallthrough
+		case UDP:
+			add("SrcPort", pa.SrcPort, pb.SrcPort)
+			add("DstPort", pa.DstPort, pb.DstPort)
+		case ICMP:
+			add("ICMP type", ICMP4Type(a[pa.subofs]), ICMP4Type(b[pb.subofs]))
+			add("ICMP code", a[pa.subofs+1], b[pb.subofs+1])
+		}
+		if ofs, ok := transportChecksumOffset(pa.IPProto); ok && pa.subofs+ofs+2 <= pa.length && pb.subofs+ofs+2 <= pb.length {
+			ca := get16(a[pa.subofs+ofs:])
+			cb := get16(b[pb.subofs+ofs:])
+			add(pa.IPProto.String()+" checksum", fmt.Sprintf("%#04x", ca), fmt.Sprintf("%#04x", cb))
+		}
+	}
+	if d := byteDiff(pa.Payload(), pb.Payload()); d != "" {
+		diffs = append(diffs, "payload "+d)
+	}
+	if len(diffs) == 0 {
+		// The difference is somewhere we don't decode,
+		// such as IP options or trailing bytes.
+		return byteDiff(a, b)
+	}
+	return strings.Join(diffs, ", ")
+}
+
+// DiffIgnore selects packet fields for DiffIgnoring to disregard.
+type DiffIgnore uint8
+
+const (
+	// IgnoreIPID ignores the IPv4 identification field.
+	IgnoreIPID DiffIgnore = 1 << iota
+	// IgnoreTTL ignores the IPv4 TTL.
+	IgnoreTTL
+	// IgnoreChecksums ignores the IPv4 header checksum and the
+	// TCP, UDP or ICMP checksum.
+	IgnoreChecksums
+)
+
+// DiffIgnoring is like Diff, but disregards the fields selected by
+// ignore, which legitimately vary between otherwise equal packets.
+// Fields are only ignored in packets Diff can decode.
+func DiffIgnoring(a, b []byte, ignore DiffIgnore) string {
+	return Diff(maskFields(a, ignore), maskFields(b, ignore))
+}
+
+// maskFields returns b, or a copy of it with the fields selected by
+// ignore zeroed if b is a decodable IPv4 packet.
+func maskFields(b []byte, ignore DiffIgnore) []byte {
+	var p Parsed
+	p.Decode(b)
+	if ignore == 0 || p.IPVersion != 4 || p.IPProto == Unknown {
+		return b
+	}
+	b = append([]byte(nil), b...)
+	if ignore&IgnoreIPID != 0 {
+		put16(b[4:6], 0)
+	}
+	if ignore&IgnoreTTL != 0 {
+		b[8] = 0
+	}
+	if ignore&IgnoreChecksums != 0 {
+		put16(b[10:12], 0)
+		if ofs, ok := transportChecksumOffset(p.IPProto); ok && p.subofs+ofs+2 <= p.length {
+			put16(b[p.subofs+ofs:], 0)
+		}
+	}
+	return b
+}
+
+// byteDiff describes where a and b differ byte-wise.
+// It returns the empty string if they're equal.
+func byteDiff(a, b []byte) string {
+	var diffs []string
+	if len(a) != len(b) {
+		diffs = append(diffs, fmt.Sprintf("length %d != %d", len(a), len(b)))
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			diffs = append(diffs, fmt.Sprintf("differs at offset %d (%#02x != %#02x)", i, a[i], b[i]))
+			break
+		}
+	}
+	return strings.Join(diffs, ", ")
+}
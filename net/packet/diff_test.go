@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	modify := func(b []byte, f func([]byte)) []byte {
+		b = append([]byte(nil), b...)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		a, b []byte
+		want string
+	}{
+		{"equal", udpRequestBuffer, udpRequestBuffer, ""},
+		{
+			"src_ip",
+			udpRequestBuffer,
+			modify(udpRequestBuffer, func(b []byte) { b[15] = 5; b[11] = 0x00 }),
+			"SrcIP: 1.2.3.4 != 1.2.3.5, IP checksum: 0x8c01 != 0x8c00",
+		},
+		{
+			"ports_and_payload",
+			udpRequestBuffer,
+			modify(udpRequestBuffer, func(b []byte) { b[23] = 0x38; b[28+12] = 'X' }),
+			"DstPort: 567 != 568, payload differs at offset 12 (0x6f != 0x58)",
+		},
+		{
+			"tcp_flags",
+			tcpPacketBuffer,
+			modify(tcpPacketBuffer, func(b []byte) { b[33] = TCPAck }),
+			"TCPFlags: 0x12 != 0x10",
+		},
+		{
+			"proto",
+			udpRequestBuffer,
+			icmpRequestBuffer,
+			"IPProto: UDP != ICMP, TotalLength: 43 != 39, IP checksum: 0x8c01 != 0x8c15",
+		},
+		{
+			"unparseable",
+			udpRequestBuffer[:10],
+			udpRequestBuffer[:12],
+			"length 10 != 12",
+		},
+		{
+			"one_side_unparseable",
+			udpRequestBuffer,
+			modify(udpRequestBuffer[:12], func(b []byte) { b[0] = 0x46 }),
+			"length 43 != 12, differs at offset 0 (0x45 != 0x46)",
+		},
+		{
+			"trailer",
+			udpRequestBuffer,
+			append(append([]byte(nil), udpRequestBuffer...), 0),
+			"length 43 != 44",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.a, tt.b); got != tt.want {
+				t.Errorf("got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffIgnoring(t *testing.T) {
+	volatile := append([]byte(nil), tcpPacketBuffer...)
+	put16(volatile[4:6], 0x1234) // IPID
+	volatile[8] = 17             // TTL
+	put16(volatile[10:12], ChecksumExcluding(volatile[:ipHeaderLength], 10))
+	volatile[36] ^= 0xff // TCP checksum
+
+	if d := DiffIgnoring(tcpPacketBuffer, volatile, IgnoreIPID|IgnoreTTL|IgnoreChecksums); d != "" {
+		t.Errorf("ignoring all volatile fields: got %q; want no diff", d)
+	}
+	want := "TTL: 64 != 17"
+	if d := DiffIgnoring(tcpPacketBuffer, volatile, IgnoreIPID|IgnoreChecksums); d != want {
+		t.Errorf("not ignoring TTL: got %q; want %q", d, want)
+	}
+	if d := DiffIgnoring(tcpPacketBuffer, volatile, 0); d != Diff(tcpPacketBuffer, volatile) {
+		t.Errorf("ignoring nothing: got %q; want %q", d, Diff(tcpPacketBuffer, volatile))
+	}
+
+	// Fields that matter are still compared.
+	other := append([]byte(nil), volatile...)
+	other[33] = TCPAck
+	if d := DiffIgnoring(tcpPacketBuffer, other, IgnoreIPID|IgnoreTTL|IgnoreChecksums); d != "TCPFlags: 0x12 != 0x10" {
+		t.Errorf("changed flags: got %q", d)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+// icmp4EchoHeaderLength is the length of all headers in an ICMP echo,
+// including the identifier and sequence number.
+const icmp4EchoHeaderLength = icmpAllHeadersLength + 4
+
+// PayloadKind is a way of filling the payload of a diagnostic packet.
+type PayloadKind uint8
+
+const (
+	PayloadZeros        PayloadKind = iota // all zero bytes
+	PayloadIncrementing                    // 0x00, 0x01, ..., 0xff, 0x00, ...
+	PayloadRandom                          // pseudo-random bytes derived from a seed
+)
+
+// PayloadPattern describes a recognizable packet payload, so that
+// corruption along a path can be detected by checking that an echo
+// reply still carries the pattern its request was sent with.
+type PayloadPattern struct {
+	Kind PayloadKind
+	// Seed seeds the generator for PayloadRandom.
+	// It is ignored for other kinds.
+	Seed uint64
+}
+
+// Fill fills b with the pattern.
+func (p PayloadPattern) Fill(b []byte) {
+	switch p.Kind {
+	case PayloadIncrementing:
+		for i := range b {
+			b[i] = byte(i)
+		}
+	case PayloadRandom:
+		state := p.Seed
+		for i := 0; i < len(b); i += 8 {
+			var word [8]byte
+			put64(word[:], splitmix64(&state))
+			copy(b[i:], word[:])
+		}
+	default:
+		for i := range b {
+			b[i] = 0
+		}
+	}
+}
+
+// Matches reports whether b is filled with the pattern.
+func (p PayloadPattern) Matches(b []byte) bool {
+	switch p.Kind {
+	case PayloadIncrementing:
+		for i := range b {
+			if b[i] != byte(i) {
+				return false
+			}
+		}
+	case PayloadRandom:
+		state := p.Seed
+		for i := 0; i < len(b); i += 8 {
+			var word [8]byte
+			put64(word[:], splitmix64(&state))
+			for j := 0; j < 8 && i+j < len(b); j++ {
+				if b[i+j] != word[j] {
+					return false
+				}
+			}
+		}
+	default:
+		for i := range b {
+			if b[i] != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// splitmix64 advances state and returns the next value of the
+// SplitMix64 generator. It is small, fast and fully determined by
+// its seed, which is all payload patterns need.
+func splitmix64(state *uint64) uint64 {
+	*state += 0x9e3779b97f4a7c15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// MakeICMP4EchoRequest writes to buf an ICMP echo request from src to
+// dst with the given identifier, sequence number and payload.
+// It returns the number of bytes written.
+func MakeICMP4EchoRequest(src, dst IP4, id, seq uint16, payload []byte, buf []byte) (int, error) {
+	n := icmp4EchoHeaderLength + len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	copy(buf[icmp4EchoHeaderLength:], payload)
+	return marshalICMP4Echo(src, dst, id, seq, buf[:n])
+}
+
+// errPayloadSize is returned for a negative payload size.
+var errPayloadSize = errors.New("negative payload size")
+
+// MakeICMP4EchoRequestPattern is like MakeICMP4EchoRequest, but the
+// payload is size bytes filled with pattern. The payload of the reply
+// can be checked with VerifyEchoPayload.
+func MakeICMP4EchoRequestPattern(src, dst IP4, id, seq uint16, pattern PayloadPattern, size int, buf []byte) (int, error) {
+	if size < 0 {
+		return 0, errPayloadSize
+	}
+	n := icmp4EchoHeaderLength + size
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	pattern.Fill(buf[icmp4EchoHeaderLength:n])
+	return marshalICMP4Echo(src, dst, id, seq, buf[:n])
+}
+
+// marshalICMP4Echo fills in the headers of the echo request in buf,
+// whose payload must already be in place.
+func marshalICMP4Echo(src, dst IP4, id, seq uint16, buf []byte) (int, error) {
+	h := ICMP4Header{
+		IP4Header: IP4Header{
+			SrcIP: src,
+			DstIP: dst,
+		},
+		Type: ICMP4EchoRequest,
+		Code: ICMP4NoCode,
+	}
+	put16(buf[24:26], id)
+	put16(buf[26:28], seq)
+	if err := h.Marshal(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// VerifyEchoPayload reports whether reply is an IPv4 ICMP echo reply
+// whose payload is filled with pattern. A false result for a reply to a
+// request built with MakeICMP4EchoRequestPattern means the payload was
+// corrupted in flight.
+func VerifyEchoPayload(reply []byte, pattern PayloadPattern) bool {
+	hlen, length, err := checkIP4(reply)
+	if err != nil || IP4Proto(reply[9]) != ICMP || length < hlen+8 {
+		return false
+	}
+	if ICMP4Type(reply[hlen]) != ICMP4EchoReply {
+		return false
+	}
+	return pattern.Matches(reply[hlen+8 : length])
+}
+
+// ErrRateLimited is returned by EchoResponder.Respond when a reply
+// is suppressed by its rate limiter.
+var ErrRateLimited = errors.New("reply suppressed by rate limit")
+
+// EchoResponder answers IPv4 ICMP echo requests.
+type EchoResponder struct {
+	// Limiter, if non-nil, caps the rate of replies to each source.
+	Limiter *ICMPRateLimiter
+}
+
+// Respond writes to buf an echo reply to q, if q is an echo request,
+// and returns its length. It returns 0 and a nil error if q is not an
+// echo request, or is addressed to a broadcast or multicast group
+// (RFC 1122 section 3.2.2.6 allows ignoring those, and they are what
+// makes smurf amplification work). It returns 0 and ErrRateLimited if
+// the reply is suppressed by r's limiter.
+func (r EchoResponder) Respond(q *Parsed, buf []byte) (int, error) {
+	if !q.IsEchoRequest() || q.DstIP.IsMulticast() || q.DstIP.IsBroadcast() {
+		return 0, nil
+	}
+	// The identifier, sequence number and data are echoed back as is.
+	rest := q.b[q.subofs+icmpHeaderLength : q.length]
+	n := icmpAllHeadersLength + len(rest)
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	if r.Limiter != nil && !r.Limiter.Allow(q.SrcIP) {
+		return 0, ErrRateLimited
+	}
+	h := q.ICMPHeader()
+	h.ToResponse()
+	copy(buf[icmpAllHeadersLength:n], rest)
+	if err := h.Marshal(buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
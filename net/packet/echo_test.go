@@ -0,0 +1,304 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPayloadPattern(t *testing.T) {
+	patterns := []PayloadPattern{
+		{Kind: PayloadZeros},
+		{Kind: PayloadIncrementing},
+		{Kind: PayloadRandom, Seed: 1},
+		{Kind: PayloadRandom, Seed: 2},
+	}
+	for _, p := range patterns {
+		for _, n := range []int{0, 1, 7, 8, 9, 300} {
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = 0xa5
+			}
+			p.Fill(b)
+			if !p.Matches(b) {
+				t.Errorf("%+v len %d: doesn't match own fill", p, n)
+			}
+			if n == 0 {
+				continue
+			}
+			b[n-1] ^= 0x01
+			if p.Matches(b) {
+				t.Errorf("%+v len %d: matches corrupted payload", p, n)
+			}
+		}
+	}
+
+	// Different seeds give different payloads, same seeds the same.
+	a, b, c := make([]byte, 32), make([]byte, 32), make([]byte, 32)
+	PayloadPattern{Kind: PayloadRandom, Seed: 1}.Fill(a)
+	PayloadPattern{Kind: PayloadRandom, Seed: 2}.Fill(b)
+	PayloadPattern{Kind: PayloadRandom, Seed: 1}.Fill(c)
+	if bytes.Equal(a, b) || !bytes.Equal(a, c) {
+		t.Errorf("seeded payloads: %x, %x, %x", a, b, c)
+	}
+}
+
+func TestMakeICMP4EchoRequest(t *testing.T) {
+	src, dst := icmpRequestDecode.SrcIP, icmpRequestDecode.DstIP
+	var buf [128]byte
+	n, err := MakeICMP4EchoRequest(src, dst, 0x1234, 7, []byte("ping"), buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := buf[:n]
+	var p Parsed
+	p.Decode(pkt)
+	if !p.IsEchoRequest() || p.SrcIP != src || p.DstIP != dst {
+		t.Fatalf("decoded %v; want echo request", &p)
+	}
+	if get16(pkt[24:26]) != 0x1234 || get16(pkt[26:28]) != 7 {
+		t.Errorf("id/seq = %#x/%d; want 0x1234/7", get16(pkt[24:26]), get16(pkt[26:28]))
+	}
+	if string(pkt[28:]) != "ping" {
+		t.Errorf("payload = %q; want %q", pkt[28:], "ping")
+	}
+	if ipChecksum(pkt[20:]) != 0 {
+		t.Errorf("ICMP checksum doesn't verify")
+	}
+
+	if _, err := MakeICMP4EchoRequest(src, dst, 0, 0, []byte("ping"), buf[:31]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestVerifyEchoPayload(t *testing.T) {
+	pattern := PayloadPattern{Kind: PayloadRandom, Seed: 42}
+	buf := make([]byte, 128)
+	n, err := MakeICMP4EchoRequestPattern(1, 2, 1, 1, pattern, 56, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 28+56 {
+		t.Fatalf("n = %d; want %d", n, 28+56)
+	}
+
+	// The request isn't a reply.
+	if VerifyEchoPayload(buf[:n], pattern) {
+		t.Errorf("request verified as reply")
+	}
+
+	var p Parsed
+	p.Decode(buf[:n])
+	h := p.ICMPHeader()
+	h.ToResponse()
+	reply := Generate(&h, buf[24:n])
+	if !VerifyEchoPayload(reply, pattern) {
+		t.Errorf("reply doesn't verify")
+	}
+	if VerifyEchoPayload(reply, PayloadPattern{Kind: PayloadRandom, Seed: 43}) {
+		t.Errorf("reply verifies against wrong seed")
+	}
+	reply[len(reply)-10] ^= 0x80
+	if VerifyEchoPayload(reply, pattern) {
+		t.Errorf("corrupted reply verifies")
+	}
+	if VerifyEchoPayload(reply[:20], pattern) {
+		t.Errorf("truncated reply verifies")
+	}
+
+	for _, size := range []int{-1, -5} {
+		if _, err := MakeICMP4EchoRequestPattern(1, 2, 1, 1, pattern, size, buf); err == nil {
+			t.Errorf("MakeICMP4EchoRequestPattern with size %d succeeded", size)
+		}
+	}
+}
+
+func TestEchoResponder(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	lim := NewICMPRateLimiter(time.Second, 2, 16)
+	lim.timeNow = func() time.Time { return now }
+	r := EchoResponder{Limiter: lim}
+
+	request := func(src IP4) *Parsed {
+		buf := make([]byte, 64)
+		n, err := MakeICMP4EchoRequest(src, 0x64646464, 7, 1, []byte("ping"), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(Parsed)
+		q.Decode(buf[:n])
+		return q
+	}
+
+	buf := make([]byte, 64)
+	n, err := r.Respond(request(0x01020304), buf)
+	if err != nil || n == 0 {
+		t.Fatalf("Respond = %d, %v", n, err)
+	}
+	var reply Parsed
+	reply.Decode(buf[:n])
+	if reply.SrcIP != 0x64646464 || reply.DstIP != 0x01020304 || !reply.IsEchoResponse() {
+		t.Errorf("reply is %v", &reply)
+	}
+	if !bytes.Equal(reply.Payload(), []byte{0, 7, 0, 1, 'p', 'i', 'n', 'g'}) {
+		t.Errorf("reply payload = %q", reply.Payload())
+	}
+	if ipChecksum(buf[ipHeaderLength:n]) != 0 {
+		t.Errorf("bad ICMP checksum")
+	}
+
+	// A burst from one source is throttled after the limiter's burst
+	// size; another source is unaffected.
+	if _, err := r.Respond(request(0x01020304), buf); err != nil {
+		t.Errorf("second request: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if n, err := r.Respond(request(0x01020304), buf); err != ErrRateLimited || n != 0 {
+			t.Errorf("request %d in burst: Respond = %d, %v; want 0, %v", i+3, n, err, ErrRateLimited)
+		}
+	}
+	if n, err := r.Respond(request(0x05060708), buf); err != nil || n == 0 {
+		t.Errorf("other source: Respond = %d, %v", n, err)
+	}
+	now = now.Add(time.Second)
+	if _, err := r.Respond(request(0x01020304), buf); err != nil {
+		t.Errorf("after interval: %v", err)
+	}
+
+	// Broadcast requests and non-requests get no reply, and don't use
+	// up the allowance.
+	bcast := request(0x0a000001)
+	bcast.DstIP = 0xffffffff
+	var other Parsed
+	other.Decode(udpRequestBuffer)
+	for _, q := range []*Parsed{bcast, &other} {
+		if n, err := r.Respond(q, buf); n != 0 || err != nil {
+			t.Errorf("Respond(%v) = %d, %v; want 0, nil", q, n, err)
+		}
+	}
+
+	// Without a limiter, every request gets a reply.
+	for i := 0; i < 5; i++ {
+		if _, err := (EchoResponder{}).Respond(request(0x01020304), buf); err != nil {
+			t.Errorf("unlimited: %v", err)
+		}
+	}
+}
+
+// icmp6EchoBuffer is an ICMPv6 echo request as ping sends it, with a
+// random flow label and data made of an 8-byte timestamp followed by
+// the bytes 0x10 to 0x37.
+var icmp6EchoBuffer = []byte{
+	// IPv6 header: flow label 0x5b2e1, payload length 56, ICMPv6,
+	// hop limit 64, 2001:db8::1 -> 2001:db8::2
+	0x60, 0x05, 0xb2, 0xe1, 0x00, 0x38, 0x3a, 0x40,
+	0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	// echo request, id 0x1c2b, seq 1
+	0x80, 0x00, 0xe0, 0x9d, 0x1c, 0x2b, 0x00, 0x01,
+	// data
+	0x2e, 0x1c, 0x3a, 0x5f, 0x00, 0x00, 0x00, 0x00,
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17,
+	0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+	0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27,
+	0x28, 0x29, 0x2a, 0x2b, 0x2c, 0x2d, 0x2e, 0x2f,
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+}
+
+func TestICMP6Echo(t *testing.T) {
+	src := IP6{0x20010db800000000, 1}
+	dst := IP6{0x20010db800000000, 2}
+	if got := transportChecksum6(icmp6EchoBuffer); got != 0 {
+		t.Fatalf("test packet checksum doesn't verify (%#x)", got)
+	}
+
+	var h ICMP6EchoHeader
+	data, err := h.Parse(icmp6EchoBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Type != ICMP6EchoRequest || h.Code != ICMP6NoCode || h.ID != 0x1c2b || h.Seq != 1 {
+		t.Errorf("parsed type %d code %d id %#x seq %d; want 128, 0, 0x1c2b, 1", h.Type, h.Code, h.ID, h.Seq)
+	}
+	if h.SrcIP != src || h.DstIP != dst || h.FlowLabel != 0x5b2e1 {
+		t.Errorf("parsed %v -> %v, flow label %#x", h.SrcIP, h.DstIP, h.FlowLabel)
+	}
+	if !bytes.Equal(data, icmp6EchoBuffer[48:]) {
+		t.Errorf("data = %x; want %x", data, icmp6EchoBuffer[48:])
+	}
+
+	// Re-marshaling the parsed header reproduces the packet.
+	if got := Generate(&h, data); !bytes.Equal(got, icmp6EchoBuffer) {
+		t.Errorf("re-marshaled:\n got %x\nwant %x", got, icmp6EchoBuffer)
+	}
+
+	// So does MakeICMP6EchoRequest, apart from the flow label, which
+	// the checksum doesn't cover.
+	buf := make([]byte, 128)
+	n, err := MakeICMP6EchoRequest(src, dst, 0x1c2b, 1, data, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{0x60, 0, 0, 0}, icmp6EchoBuffer[4:]...)
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("MakeICMP6EchoRequest:\n got %x\nwant %x", buf[:n], want)
+	}
+
+	// The reply uses type 129, not the ICMPv4 type 0, and a checksum
+	// over its own pseudo-header.
+	h.ToResponse()
+	reply := Generate(&h, data)
+	if ICMP6Type(reply[40]) != ICMP6EchoReply || reply[40] != 129 {
+		t.Errorf("reply type = %d; want 129", reply[40])
+	}
+	if ip6FromBytes(reply[8:24]) != dst || ip6FromBytes(reply[24:40]) != src {
+		t.Errorf("reply addresses not reversed")
+	}
+	if get16(reply[42:44]) != 0xdf9d {
+		t.Errorf("reply checksum = %#04x; want 0xdf9d", get16(reply[42:44]))
+	}
+	if got := transportChecksum6(reply); got != 0 {
+		t.Errorf("reply checksum doesn't verify (%#x)", got)
+	}
+	var rh ICMP6EchoHeader
+	if _, err := rh.Parse(reply); err != nil || rh.Type != ICMP6EchoReply || rh.ID != 0x1c2b || rh.Seq != 1 {
+		t.Errorf("parsed reply %+v, %v", rh, err)
+	}
+
+	if _, err := MakeICMP6EchoRequest(src, dst, 1, 1, []byte("ping"), buf[:51]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestICMP6EchoParseErrors(t *testing.T) {
+	modify := func(f func([]byte)) []byte {
+		b := append([]byte(nil), icmp6EchoBuffer...)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name  string
+		pkt   []byte
+		field string
+	}{
+		{"ipv4", tcpCaptureBuffer, "Version"},
+		{"udp", makeUDP6(8), "NextHeader"},
+		{"router_solicitation", ipv6PacketBuffer, "Type"},
+		{"truncated", modify(func(b []byte) { put16(b[4:6], 6) })[:46], "Length"},
+	}
+	for _, tt := range tests {
+		var h ICMP6EchoHeader
+		_, err := h.Parse(tt.pkt)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Field != tt.field {
+			t.Errorf("%s: got err %v; want %s error", tt.name, err, tt.field)
+		}
+	}
+}
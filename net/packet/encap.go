@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// IP protocols that encapsulate another IP packet. The package doesn't
+// decode them, so Decode reports them as Unknown.
+const (
+	ipProtoIPIP = 4  // IPv4 in IP (RFC 2003)
+	ipProtoIPv6 = 41 // IPv6 in IP (RFC 4213)
+	ipProtoGRE  = 47 // Generic Routing Encapsulation (RFC 2784)
+)
+
+// GRE header flags and fields, from RFC 2784 and RFC 2890. The routing
+// bit comes from the older RFC 1701.
+const (
+	greFlagChecksum = 0x8000
+	greFlagRouting  = 0x4000
+	greFlagKey      = 0x2000
+	greFlagSeq      = 0x1000
+	greVersionMask  = 0x0007
+	greHeaderLength = 4 // without the optional fields
+)
+
+// InnerPacket returns the IP packet that q encapsulates, starting with
+// its IP header, for IPv4 or IPv6 in IP and for GRE carrying IPv4 or
+// IPv6. It reports false if q's protocol doesn't carry an IP packet,
+// or if q is a fragment, whose inner packet is incomplete.
+//
+// The inner packet isn't decoded or checked: callers that want to look
+// into it should Decode it themselves, and decide for themselves how
+// many layers of nesting to follow.
+// This is a read-only view; that is, q retains the ownership of the buffer.
+func (q *Parsed) InnerPacket() ([]byte, bool) {
+	var seg []byte
+	var proto IP4Proto
+	switch q.IPVersion {
+	case 4:
+		if q.subofs == 0 || get16(q.b[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+			return nil, false
+		}
+		seg, proto = q.b[q.subofs:q.length], IP4Proto(q.b[9])
+	case 6:
+		length, err := checkIP6(q.b)
+		if err != nil {
+			return nil, false
+		}
+		if _, _, _, ok := ip6FragmentHeader(q.b[:length]); ok {
+			return nil, false
+		}
+		var off int
+		proto, off = ip6UpperProto(q.b[:length])
+		if off == 0 {
+			return nil, false
+		}
+		seg = q.b[off:length]
+	default:
+		return nil, false
+	}
+
+	switch proto {
+	case ipProtoIPIP, ipProtoIPv6:
+	case ipProtoGRE:
+		seg = greInnerPacket(seg)
+	default:
+		return nil, false
+	}
+	if len(seg) == 0 {
+		return nil, false
+	}
+	return seg, true
+}
+
+// greInnerPacket returns the payload of the GRE packet b if it is an
+// IPv4 or IPv6 packet, or nil otherwise.
+func greInnerPacket(b []byte) []byte {
+	if len(b) < greHeaderLength {
+		return nil
+	}
+	flags := get16(b[0:2])
+	// Version 1 is PPTP's, which carries PPP, and source routes
+	// can't be followed.
+	if flags&(greFlagRouting|greVersionMask) != 0 {
+		return nil
+	}
+	switch get16(b[2:4]) {
+	case EtherTypeIPv4, EtherTypeIPv6:
+	default:
+		return nil
+	}
+	n := greHeaderLength
+	for _, f := range []uint16{greFlagChecksum, greFlagKey, greFlagSeq} {
+		if flags&f != 0 {
+			n += 4
+		}
+	}
+	if len(b) < n {
+		return nil
+	}
+	return b[n:]
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInnerPacket(t *testing.T) {
+	outer4 := func(proto IP4Proto, payload []byte) []byte {
+		h := IP4Header{IPProto: proto, SrcIP: 0x0a000001, DstIP: 0x0a000002}
+		return Generate(&h, payload)
+	}
+	outer6 := func(proto IP4Proto, payload []byte) []byte {
+		h := IP6Header{IPProto: proto, SrcIP: testIP6Dst, DstIP: testIP6Src}
+		return Generate(&h, payload)
+	}
+	gre := func(flags, etherType uint16, opts int, inner []byte) []byte {
+		b := make([]byte, greHeaderLength+opts, greHeaderLength+opts+len(inner))
+		put16(b[0:2], flags)
+		put16(b[2:4], etherType)
+		return append(b, inner...)
+	}
+	udp6 := makeUDP6(4)
+	frag := outer4(ipProtoIPIP, udpRequestBuffer)
+	put16(frag[6:8], ip4FlagMF)
+	frag[10], frag[11] = 0, 0
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want []byte // nil if there is no inner packet
+	}{
+		{"ipip", outer4(ipProtoIPIP, udpRequestBuffer), udpRequestBuffer},
+		{"6in4", outer4(ipProtoIPv6, udp6), udp6},
+		{"gre_ipv4", outer4(ipProtoGRE, gre(0, EtherTypeIPv4, 0, udpRequestBuffer)), udpRequestBuffer},
+		{"gre_ipv6", outer4(ipProtoGRE, gre(0, EtherTypeIPv6, 0, udp6)), udp6},
+		{"gre_checksum", outer4(ipProtoGRE, gre(greFlagChecksum, EtherTypeIPv4, 4, udpRequestBuffer)), udpRequestBuffer},
+		{"gre_key_seq", outer4(ipProtoGRE, gre(greFlagKey|greFlagSeq, EtherTypeIPv4, 8, udpRequestBuffer)), udpRequestBuffer},
+		{"gre_options_truncated", outer4(ipProtoGRE, gre(greFlagKey|greFlagSeq, EtherTypeIPv4, 4, nil)), nil},
+		{"gre_ethernet", outer4(ipProtoGRE, gre(0, 0x6558, 0, udpRequestBuffer)), nil},
+		{"gre_pptp", outer4(ipProtoGRE, gre(greFlagKey|1, EtherTypeIPv4, 4, udpRequestBuffer)), nil},
+		{"gre_routing", outer4(ipProtoGRE, gre(greFlagRouting, EtherTypeIPv4, 0, udpRequestBuffer)), nil},
+		{"gre_short", outer4(ipProtoGRE, []byte{0, 0, 0x08}), nil},
+		{"ipip_empty", outer4(ipProtoIPIP, nil), nil},
+		{"ipip_fragment", frag, nil},
+		{"ip6_ipip", outer6(ipProtoIPIP, udpRequestBuffer), udpRequestBuffer},
+		{"ip6_ip6", outer6(ipProtoIPv6, udp6), udp6},
+		{"ip6_gre_hop_by_hop", withIP6ExtHeader(outer6(ipProtoGRE, gre(0, EtherTypeIPv4, 0, udpRequestBuffer)), ip6HopByHop, make([]byte, 8)), udpRequestBuffer},
+		{"udp", udpRequestBuffer, nil},
+		{"udp6", udp6, nil},
+		{"garbage", []byte{0x45, 0x00}, nil},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		got, ok := q.InnerPacket()
+		if ok != (tt.want != nil) || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: InnerPacket() = %x, %v; want %x", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// Only one layer is peeled off at a time.
+	var q Parsed
+	q.Decode(outer4(ipProtoIPIP, outer4(ipProtoIPIP, udpRequestBuffer)))
+	inner, _ := q.InnerPacket()
+	q.Decode(inner)
+	if q.SrcIP != 0x0a000001 {
+		t.Errorf("first inner packet from %v; want the middle header", q.SrcIP)
+	}
+	inner, ok := q.InnerPacket()
+	q.Decode(inner)
+	if !ok || q.IPProto != UDP || q.DstIP != 0x05060708 {
+		t.Errorf("innermost packet: %v", q.String())
+	}
+}
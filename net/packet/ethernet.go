@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	ethernetHeaderLength = 14
+	// ethernetFCSLength is the length of the frame check sequence, a
+	// CRC-32 some capture sources leave at the end of each frame.
+	ethernetFCSLength = 4
+	// ethernetMinFrame is the shortest Ethernet frame, without its
+	// FCS. Shorter frames are padded to it.
+	ethernetMinFrame = 60
+)
+
+// EtherType values, identifying the protocol an Ethernet frame carries.
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+	EtherTypeIPv6 = 0x86dd
+)
+
+// EthernetHeader is an Ethernet II frame header.
+type EthernetHeader struct {
+	Dst, Src  [6]byte
+	EtherType uint16
+}
+
+func (EthernetHeader) Len() int {
+	return ethernetHeaderLength
+}
+
+// Marshal writes the header to the start of buf. Unlike the IP-level
+// headers, it only writes its own bytes and doesn't look at the rest
+// of buf.
+func (h EthernetHeader) Marshal(buf []byte) error {
+	if len(buf) < ethernetHeaderLength {
+		return ErrSmallBuffer
+	}
+	copy(buf[0:6], h.Dst[:])
+	copy(buf[6:12], h.Src[:])
+	put16(buf[12:14], h.EtherType)
+	return nil
+}
+
+// ToResponse implements Header.
+func (h *EthernetHeader) ToResponse() {
+	h.Src, h.Dst = h.Dst, h.Src
+}
+
+// StripFCS returns frame, an Ethernet II frame carrying IPv4 or IPv6,
+// without its trailing frame check sequence if it has one. Frames
+// without one are returned unchanged.
+//
+// A trailer is only taken to be an FCS if it is the 4 bytes past the
+// end of the IP packet, or of the padding of a minimum-size frame, and
+// holds the CRC-32 of the rest of the frame, so payload is never
+// trimmed. Frames with a VLAN tag, or whose IP length can't be read,
+// are returned unchanged.
+func StripFCS(frame []byte) []byte {
+	if len(frame) < ethernetHeaderLength+ethernetFCSLength {
+		return frame
+	}
+	ip := frame[ethernetHeaderLength:]
+	var ipLen int
+	switch get16(frame[12:14]) {
+	case EtherTypeIPv4:
+		if len(ip) < ipHeaderLength || ip[0]>>4 != 4 {
+			return frame
+		}
+		ipLen = int(get16(ip[2:4]))
+	case EtherTypeIPv6:
+		if len(ip) < ip6HeaderLength || ip[0]>>4 != 6 {
+			return frame
+		}
+		ipLen = ip6HeaderLength + int(get16(ip[4:6]))
+	default:
+		return frame
+	}
+	n := ethernetHeaderLength + ipLen
+	if n < ethernetMinFrame {
+		n = ethernetMinFrame
+	}
+	if len(frame) != n+ethernetFCSLength {
+		return frame
+	}
+	// The FCS is sent least significant byte first.
+	if crc32.ChecksumIEEE(frame[:n]) != binary.LittleEndian.Uint32(frame[n:]) {
+		return frame
+	}
+	return frame[:n]
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "inet.af/netaddr"
+
+// HashFlow returns a hash of the given IPv4 flow, suitable for
+// consistently assigning flows to workers or queues.
+//
+// The hash is symmetric: swapping the source and destination
+// endpoints, as in the reply direction of the same flow, yields the
+// same value. It is a 32-bit FNV-1a hash of the protocol and the two
+// endpoints in a canonical order, so it's stable across processes.
+func HashFlow(src, dst IP4, proto IP4Proto, srcPort, dstPort uint16) uint32 {
+	if endpointLess(dst, dstPort, src, srcPort) {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	h := newFNV32()
+	h.add8(uint8(proto))
+	h.add32(uint32(src))
+	h.add16(srcPort)
+	h.add32(uint32(dst))
+	h.add16(dstPort)
+	return uint32(h)
+}
+
+// FlowHash returns the HashFlow of q's addresses, protocol and ports.
+// Packets in both directions of a flow have the same FlowHash.
+//
+// ICMP has no ports, so for ICMP echo requests and replies the echo
+// identifier stands in for both of them: it stays the same across a
+// ping session and is echoed back, while the sequence number changes
+// with every packet. Other ICMP messages hash with zero ports.
+//
+// IPv6 addresses are not decoded, so all IPv6 packets of a given
+// protocol currently hash to the same value.
+func (q *Parsed) FlowHash() uint32 {
+	sport, dport := q.flowPorts()
+	return HashFlow(q.SrcIP, q.DstIP, q.IPProto, sport, dport)
+}
+
+// flowPorts returns the ports identifying q's flow: its TCP or UDP
+// ports, or the echo identifier as both ports of ICMP echo requests
+// and replies.
+func (q *Parsed) flowPorts() (sport, dport uint16) {
+	if q.IsEchoRequest() || q.IsEchoResponse() {
+		id := uint16(q.ICMP4RestOfHeader() >> 16)
+		return id, id
+	}
+	return q.SrcPort, q.DstPort
+}
+
+// MatchesFlow reports whether q belongs to the IPv4 flow from src to
+// dst of protocol proto, in either direction: replies, with the
+// endpoints swapped, match too. It doesn't allocate.
+//
+// As in FlowHash, the ports of an ICMP echo flow are both its echo
+// identifier. MatchesFlow reports false for IPv6 packets, whose
+// addresses aren't decoded.
+func (q *Parsed) MatchesFlow(src, dst netaddr.IPPort, proto IP4Proto) bool {
+	if q.IPVersion != 4 || q.IPProto != proto || !src.IP.Is4() || !dst.IP.Is4() {
+		return false
+	}
+	s, d := IP4FromNetaddr(src.IP), IP4FromNetaddr(dst.IP)
+	sport, dport := q.flowPorts()
+	if q.SrcIP == s && sport == src.Port && q.DstIP == d && dport == dst.Port {
+		return true
+	}
+	return q.SrcIP == d && sport == dst.Port && q.DstIP == s && dport == src.Port
+}
+
+// FlowHashWithLabel is like FlowHash, but also mixes in q's IPv6 flow
+// label, so that IPv6 flows the sender labeled differently hash apart.
+// Each direction of a flow chooses its own label, so unlike FlowHash
+// the result is not symmetric. For IPv4 packets the label is zero and
+// the result equals FlowHash.
+func (q *Parsed) FlowHashWithLabel() uint32 {
+	h := q.FlowHash()
+	if q.FlowLabel == 0 {
+		return h
+	}
+	f := fnv32(h)
+	f.add32(q.FlowLabel)
+	return uint32(f)
+}
+
+// CanonicalFlow returns q's endpoints in a canonical order, so that
+// packets in both directions of a flow produce the same (a, b, proto).
+// a is the endpoint with the lower address, or with the lower port if
+// the addresses are equal. It is meant for use as a connection tracking
+// key that covers both directions of a connection.
+//
+// CanonicalFlow only supports IPv4; it returns zero endpoints for
+// other packets.
+func (q *Parsed) CanonicalFlow() (a, b netaddr.IPPort, proto IP4Proto) {
+	if q.IPVersion != 4 {
+		return netaddr.IPPort{}, netaddr.IPPort{}, q.IPProto
+	}
+	src, dst := q.SrcIP, q.DstIP
+	sport, dport := q.SrcPort, q.DstPort
+	if endpointLess(dst, dport, src, sport) {
+		src, dst = dst, src
+		sport, dport = dport, sport
+	}
+	a = netaddr.IPPort{IP: src.Netaddr(), Port: sport}
+	b = netaddr.IPPort{IP: dst.Netaddr(), Port: dport}
+	return a, b, q.IPProto
+}
+
+// endpointLess reports whether the endpoint a:aport orders before
+// b:bport, comparing addresses first and then ports.
+func endpointLess(a IP4, aport uint16, b IP4, bport uint16) bool {
+	if a != b {
+		return a < b
+	}
+	return aport < bport
+}
+
+// fnv32 is an allocation-free 32-bit FNV-1a hash.
+type fnv32 uint32
+
+const (
+	fnv32Offset = 2166136261
+	fnv32Prime  = 16777619
+)
+
+func newFNV32() fnv32 { return fnv32Offset }
+
+func (h *fnv32) add8(v uint8) {
+	*h = (*h ^ fnv32(v)) * fnv32Prime
+}
+
+func (h *fnv32) add16(v uint16) {
+	h.add8(uint8(v >> 8))
+	h.add8(uint8(v))
+}
+
+func (h *fnv32) add32(v uint32) {
+	h.add16(uint16(v >> 16))
+	h.add16(uint16(v))
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestFlowHash(t *testing.T) {
+	var req, resp Parsed
+	req.Decode(udpRequestBuffer)
+	resp.Decode(udpReplyBuffer)
+	if req.FlowHash() != resp.FlowHash() {
+		t.Errorf("request hash %#x != reply hash %#x", req.FlowHash(), resp.FlowHash())
+	}
+
+	a, b := IP4(0x01020304), IP4(0x05060708)
+	tests := []struct {
+		name         string
+		src, dst     IP4
+		sport, dport uint16
+		proto        IP4Proto
+	}{
+		{"other_proto", a, b, 123, 567, TCP},
+		{"other_sport", a, b, 124, 567, UDP},
+		{"other_dport", a, b, 123, 568, UDP},
+		{"other_dst", a, b + 1, 123, 567, UDP},
+		{"ports_swapped", a, b, 567, 123, UDP},
+	}
+	base := HashFlow(a, b, UDP, 123, 567)
+	for _, tt := range tests {
+		if got := HashFlow(tt.src, tt.dst, tt.proto, tt.sport, tt.dport); got == base {
+			t.Errorf("%s: collides with base flow (%#x)", tt.name, got)
+		}
+		if HashFlow(tt.src, tt.dst, tt.proto, tt.sport, tt.dport) != HashFlow(tt.dst, tt.src, tt.proto, tt.dport, tt.sport) {
+			t.Errorf("%s: not symmetric", tt.name)
+		}
+	}
+
+	// Same address on both ends orders by port.
+	if HashFlow(a, a, TCP, 1, 2) != HashFlow(a, a, TCP, 2, 1) {
+		t.Errorf("hairpin flow not symmetric")
+	}
+}
+
+func TestFlowHashWithLabel(t *testing.T) {
+	var q Parsed
+	q.Decode(udpRequestBuffer)
+	if q.FlowHashWithLabel() != q.FlowHash() {
+		t.Errorf("IPv4: FlowHashWithLabel %#x != FlowHash %#x", q.FlowHashWithLabel(), q.FlowHash())
+	}
+
+	q.Decode(ipv6PacketBuffer)
+	unlabeled := q.FlowHashWithLabel()
+	q.FlowLabel = 1
+	l1 := q.FlowHashWithLabel()
+	q.FlowLabel = 2
+	l2 := q.FlowHashWithLabel()
+	if l1 == unlabeled || l1 == l2 {
+		t.Errorf("flow labels don't affect hash: %#x, %#x, %#x", unlabeled, l1, l2)
+	}
+}
+
+func TestFNV32(t *testing.T) {
+	std := fnv.New32a()
+	std.Write([]byte{0x11, 0x01, 0x02, 0x03, 0x04, 0x00, 0x7b})
+	h := newFNV32()
+	h.add8(0x11)
+	h.add32(0x01020304)
+	h.add16(0x007b)
+	if uint32(h) != std.Sum32() {
+		t.Errorf("got %#x; want %#x", uint32(h), std.Sum32())
+	}
+}
+
+func BenchmarkFlowHash(b *testing.B) {
+	var p Parsed
+	p.Decode(tcpPacketBuffer)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.FlowHash()
+	}
+}
+
+func TestCanonicalFlow(t *testing.T) {
+	var req, resp Parsed
+	req.Decode(udpRequestBuffer)
+	resp.Decode(udpReplyBuffer)
+	a1, b1, p1 := req.CanonicalFlow()
+	a2, b2, p2 := resp.CanonicalFlow()
+	if a1 != a2 || b1 != b2 || p1 != p2 {
+		t.Errorf("request %v %v %v != reply %v %v %v", a1, b1, p1, a2, b2, p2)
+	}
+	if a1.IP != udpRequestDecode.SrcIP.Netaddr() || a1.Port != 123 {
+		t.Errorf("a = %v; want 1.2.3.4:123", a1)
+	}
+	if b1.IP != udpRequestDecode.DstIP.Netaddr() || b1.Port != 567 {
+		t.Errorf("b = %v; want 5.6.7.8:567", b1)
+	}
+
+	// Same addresses, different ports: a different flow.
+	other := req
+	other.SrcPort = 124
+	a3, b3, _ := other.CanonicalFlow()
+	if a3 == a1 && b3 == b1 {
+		t.Errorf("distinct flows canonicalize identically")
+	}
+
+	// Both endpoints on one address order by port.
+	hairpin := Parsed{IPVersion: 4, IPProto: TCP, SrcIP: 1, DstIP: 1, SrcPort: 9, DstPort: 3}
+	a4, b4, _ := hairpin.CanonicalFlow()
+	if a4.Port != 3 || b4.Port != 9 {
+		t.Errorf("hairpin: got ports %d, %d; want 3, 9", a4.Port, b4.Port)
+	}
+}
+
+func TestFlowHashICMPEcho(t *testing.T) {
+	a, b := IP4(0x01020304), IP4(0x05060708)
+	echo := func(src, dst IP4, typ ICMP4Type, id, seq uint16) *Parsed {
+		buf := make([]byte, 64)
+		n, err := MakeICMP4EchoRequest(src, dst, id, seq, []byte("ping"), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[ipHeaderLength] = uint8(typ)
+		q := new(Parsed)
+		q.Decode(buf[:n])
+		return q
+	}
+	base := echo(a, b, ICMP4EchoRequest, 7, 1).FlowHash()
+	if got := echo(b, a, ICMP4EchoReply, 7, 1).FlowHash(); got != base {
+		t.Errorf("reply hash %#x != request hash %#x", got, base)
+	}
+	if got := echo(a, b, ICMP4EchoRequest, 7, 2).FlowHash(); got != base {
+		t.Errorf("next sequence number hashes differently: %#x != %#x", got, base)
+	}
+	if got := echo(a, b, ICMP4EchoRequest, 8, 1).FlowHash(); got == base {
+		t.Errorf("different identifiers hash the same (%#x)", got)
+	}
+}
+
+func TestMatchesFlow(t *testing.T) {
+	ipp := func(ip IP4, port uint16) netaddr.IPPort {
+		return netaddr.IPPort{IP: ip.Netaddr(), Port: port}
+	}
+	var req, resp Parsed
+	req.Decode(udpRequestBuffer)
+	resp.Decode(udpReplyBuffer)
+	src, dst := ipp(req.SrcIP, req.SrcPort), ipp(req.DstIP, req.DstPort)
+
+	tests := []struct {
+		name     string
+		q        *Parsed
+		src, dst netaddr.IPPort
+		proto    IP4Proto
+		want     bool
+	}{
+		{"request", &req, src, dst, UDP, true},
+		{"reply", &resp, src, dst, UDP, true},
+		{"request_reversed_key", &req, dst, src, UDP, true},
+		{"reply_reversed_key", &resp, dst, src, UDP, true},
+		{"other_proto", &req, src, dst, TCP, false},
+		{"other_src_port", &req, ipp(req.SrcIP, req.SrcPort+1), dst, UDP, false},
+		{"other_dst_port", &req, src, ipp(req.DstIP, req.DstPort+1), UDP, false},
+		{"other_dst", &req, src, ipp(req.DstIP+1, req.DstPort), UDP, false},
+		// Each endpoint keeps its own port: swapping only the ports is
+		// a different flow.
+		{"ports_swapped", &req, ipp(req.SrcIP, req.DstPort), ipp(req.DstIP, req.SrcPort), UDP, false},
+		{"same_endpoint_twice", &req, src, src, UDP, false},
+		{"ipv6_key", &req, netaddr.IPPort{IP: netaddr.IPv6Raw([16]byte{15: 1}), Port: req.SrcPort}, dst, UDP, false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.MatchesFlow(tt.src, tt.dst, tt.proto); got != tt.want {
+			t.Errorf("%s: MatchesFlow(%v, %v, %v) = %v; want %v", tt.name, tt.src, tt.dst, tt.proto, got, tt.want)
+		}
+	}
+
+	var v6 Parsed
+	v6.Decode(ipv6PacketBuffer)
+	if v6.MatchesFlow(netaddr.IPPort{}, netaddr.IPPort{}, v6.IPProto) {
+		t.Errorf("IPv6 packet matched a flow")
+	}
+
+	// ICMP echo flows are keyed by the echo identifier.
+	a, b := IP4(0x01020304), IP4(0x05060708)
+	echo := func(src, dst IP4, typ ICMP4Type, id, seq uint16) *Parsed {
+		buf := make([]byte, 64)
+		n, err := MakeICMP4EchoRequest(src, dst, id, seq, []byte("ping"), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[ipHeaderLength] = uint8(typ)
+		q := new(Parsed)
+		q.Decode(buf[:n])
+		return q
+	}
+	key := func(x, y IP4, id uint16) (netaddr.IPPort, netaddr.IPPort) { return ipp(x, id), ipp(y, id) }
+	ka, kb := key(a, b, 7)
+	if !echo(a, b, ICMP4EchoRequest, 7, 1).MatchesFlow(ka, kb, ICMP) {
+		t.Errorf("echo request doesn't match its flow")
+	}
+	if !echo(b, a, ICMP4EchoReply, 7, 9).MatchesFlow(ka, kb, ICMP) {
+		t.Errorf("echo reply doesn't match its flow")
+	}
+	if echo(a, b, ICMP4EchoRequest, 8, 1).MatchesFlow(ka, kb, ICMP) {
+		t.Errorf("echo with another identifier matches")
+	}
+	if echo(a, b, ICMP4EchoRequest, 7, 1).MatchesFlow(ka, kb, UDP) {
+		t.Errorf("echo matches a UDP flow")
+	}
+
+	if n := testing.AllocsPerRun(100, func() { req.MatchesFlow(src, dst, UDP) }); n != 0 {
+		t.Errorf("MatchesFlow allocates %v times; want 0", n)
+	}
+}
@@ -6,6 +6,7 @@ package packet
 
 import (
 	"errors"
+	"fmt"
 	"math"
 )
 
@@ -16,10 +17,49 @@ const tcpHeaderLength = 20
 const maxPacketLength = math.MaxUint16
 
 var (
-	errSmallBuffer = errors.New("buffer too small")
-	errLargePacket = errors.New("packet too large")
+	// ErrSmallBuffer is returned when a buffer is too small to hold
+	// a packet or header, or shorter than its headers claim.
+	ErrSmallBuffer = errors.New("buffer too small")
+	// ErrLargePacket is returned when a packet would be longer than
+	// its headers can describe.
+	ErrLargePacket = errors.New("packet too large")
 )
 
+// transportChecksumOffset returns the offset of the checksum field within
+// the transport header of proto.
+func transportChecksumOffset(proto IP4Proto) (int, bool) {
+	switch proto {
+	case TCP:
+		return 16, true
+	case UDP:
+		return 6, true
+	case ICMP:
+		return 2, true
+	}
+	return 0, false
+}
+
+// ParseError reports a malformed header field found while parsing a packet.
+type ParseError struct {
+	Field  string // header field name, e.g. "IHL"
+	Offset int    // byte offset of the field within the parsed buffer
+	Value  int    // value found in the field
+	Reason string // constraint violated by Value, e.g. "< 5"
+	// Err is the sentinel error corresponding to this failure, if any.
+	// It is ErrSmallBuffer when the buffer is shorter than the header
+	// claims to be, so callers that only care about that case can
+	// check for it with errors.Is.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s=%d %s at offset %d", e.Field, e.Value, e.Reason, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 // Header is a packet header capable of marshaling itself into a byte buffer.
 type Header interface {
 	// Len returns the length of the header after marshaling.
@@ -46,3 +86,59 @@ func Generate(h Header, payload []byte) []byte {
 
 	return buf
 }
+
+// MarshalLen returns the length of the packet that marshaling h with
+// payloadLen bytes of payload produces, which is the buffer length
+// h.Marshal needs. It accounts for h's current configuration, such as
+// the TCP options a TCP4Header will write, so buffers can be sized up
+// front.
+//
+// It returns ErrLargePacket if the packet would exceed the largest
+// length an IP header can describe, as Marshal would.
+func MarshalLen(h Header, payloadLen int) (int, error) {
+	if payloadLen < 0 {
+		return 0, ErrSmallBuffer
+	}
+	n := h.Len() + payloadLen
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	return n, nil
+}
+
+// maxOptionsLength is the largest length of IPv4 or TCP options, whose
+// 4-bit header length fields count up to 15 32-bit words.
+const maxOptionsLength = 40
+
+// MaxPayload returns how many payload bytes fit in an IPv4 packet of
+// protocol proto carrying ipOptionsLen bytes of IPv4 options and, for
+// TCP, tcpOptionsLen bytes of TCP options, without the packet
+// exceeding mtu. Option lengths are rounded up to a multiple of 4, as
+// they are padded on the wire.
+//
+// The transport header counted is 20 bytes (plus options) for TCP, 8
+// bytes for UDP, and the 8-byte echo header for ICMP; other protocols
+// have only the IPv4 header counted. MaxPayload returns 0 if the
+// headers alone don't fit, or if either options length is negative or
+// more than the 40 bytes a header can describe.
+func MaxPayload(proto IP4Proto, mtu int, ipOptionsLen, tcpOptionsLen int) int {
+	if ipOptionsLen < 0 || ipOptionsLen > maxOptionsLength || tcpOptionsLen < 0 || tcpOptionsLen > maxOptionsLength {
+		return 0
+	}
+	overhead := ipHeaderLength + (ipOptionsLen+3)&^3
+	switch proto {
+	case TCP:
+		overhead += tcpHeaderLength + (tcpOptionsLen+3)&^3
+	case UDP:
+		overhead += udpHeaderLength
+	case ICMP:
+		overhead += icmp4EchoHeaderLength - ipHeaderLength
+	}
+	if mtu > maxPacketLength {
+		mtu = maxPacketLength
+	}
+	if mtu <= overhead {
+		return 0
+	}
+	return mtu - overhead
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AnnotatedHexDump returns a hex dump of q's buffer with each header
+// field labeled, one line per row of bytes:
+//
+//	0000: 45 00 00 54  IP ver=4 ihl=5 tos=0 len=84
+//	0004: 1c 46 40 00  IP id=7238 flags=DF frag=0
+//
+// IPv4 and IPv6 headers and TCP, UDP, ICMP and ICMPv6 headers are
+// annotated from the raw bytes, whatever Decode made of them, so that
+// malformed packets can be examined field by field. Annotation stops at
+// the first header that is truncated or doesn't make sense; that and
+// everything after it, including payloads and any bytes past the IP
+// packet's length, is dumped 16 bytes per line with a label saying what
+// it is.
+//
+// It is a debugging aid and makes no attempt to be fast.
+func (q *Parsed) AnnotatedHexDump() string {
+	d := &hexAnnotator{b: q.b, end: len(q.b)}
+	label := "data"
+	if len(q.b) > 0 {
+		switch q.b[0] >> 4 {
+		case 4:
+			label = d.ip4()
+		case 6:
+			label = d.ip6()
+		}
+	}
+	d.dump(d.end, label)
+	d.dump(len(d.b), "trailing bytes past IP length")
+	return strings.TrimSuffix(d.out.String(), "\n")
+}
+
+// hexAnnotator accumulates the lines of an AnnotatedHexDump.
+type hexAnnotator struct {
+	out strings.Builder
+	b   []byte
+	off int // offset of the next byte to dump
+	end int // end of the IP packet in b
+}
+
+const (
+	hexHeaderRow = 4  // bytes per header row
+	hexDataRow   = 16 // bytes per unannotated row
+)
+
+// has reports whether n more bytes of the IP packet remain to dump.
+func (d *hexAnnotator) has(n int) bool {
+	return d.off+n <= d.end
+}
+
+// row dumps the next n bytes, at most hexHeaderRow of them, annotated
+// with the formatted string. The caller must check has(n) first.
+func (d *hexAnnotator) row(n int, format string, args ...interface{}) {
+	d.line(n, hexHeaderRow, fmt.Sprintf(format, args...))
+}
+
+// rows dumps the next n bytes as rows of hexHeaderRow bytes, labeling
+// the first one. If fewer than n bytes remain, it dumps nothing and
+// returns false.
+func (d *hexAnnotator) rows(n int, label string) bool {
+	if !d.has(n) {
+		return false
+	}
+	for i := 0; i < n; i += hexHeaderRow {
+		w := n - i
+		if w > hexHeaderRow {
+			w = hexHeaderRow
+		}
+		d.line(w, hexHeaderRow, label)
+		label = ""
+	}
+	return true
+}
+
+// dump dumps the bytes up to end in rows of hexDataRow bytes,
+// labeling the first one.
+func (d *hexAnnotator) dump(end int, label string) {
+	for d.off < end {
+		n := end - d.off
+		if n > hexDataRow {
+			n = hexDataRow
+		}
+		d.line(n, hexDataRow, label)
+		label = ""
+	}
+}
+
+// line writes the next n bytes, padded to a row of width bytes, then
+// the annotation.
+func (d *hexAnnotator) line(n, width int, annotation string) {
+	fmt.Fprintf(&d.out, "%04x:", d.off)
+	for i := 0; i < width; i++ {
+		if i < n {
+			fmt.Fprintf(&d.out, " %02x", d.b[d.off+i])
+		} else if annotation != "" {
+			d.out.WriteString("   ")
+		}
+	}
+	if annotation != "" {
+		d.out.WriteString("  ")
+		d.out.WriteString(annotation)
+	}
+	d.out.WriteByte('\n')
+	d.off += n
+}
+
+// ip4 annotates the IPv4 header and the transport header after it, and
+// returns the label for the rest of the packet.
+func (d *hexAnnotator) ip4() string {
+	b := d.b
+	if !d.has(hexHeaderRow) {
+		return "truncated IP header"
+	}
+	length := int(get16(b[2:4]))
+	d.row(4, "IP ver=%d ihl=%d tos=%d len=%d", b[0]>>4, b[0]&0x0f, b[1], length)
+	if !d.has(hexHeaderRow) {
+		return "truncated IP header"
+	}
+	frag := get16(b[6:8])
+	d.row(4, "IP id=%d flags=%s frag=%d", get16(b[4:6]), ip4FlagsString(frag), int(frag&ip4FragOffsetMask)*8)
+	if !d.has(hexHeaderRow) {
+		return "truncated IP header"
+	}
+	proto := IP4Proto(b[9])
+	d.row(4, "IP ttl=%d proto=%v csum=%#04x", b[8], proto, get16(b[10:12]))
+	if !d.has(hexHeaderRow) {
+		return "truncated IP header"
+	}
+	d.row(4, "IP src=%v", IP4(get32(b[12:16])))
+	if !d.has(hexHeaderRow) {
+		return "truncated IP header"
+	}
+	d.row(4, "IP dst=%v", IP4(get32(b[16:20])))
+
+	hlen := int(b[0]&0x0f) * 4
+	if hlen < ipHeaderLength {
+		return "IP data (bad header length)"
+	}
+	if !d.rows(hlen-ipHeaderLength, "IP options") {
+		return "truncated IP options"
+	}
+	if length >= hlen && length < d.end {
+		d.end = length
+	}
+	if frag&ip4FragOffsetMask != 0 {
+		return "IP fragment data"
+	}
+	return d.transport(proto)
+}
+
+// ip6 annotates the IPv6 header, any extension headers and the
+// transport header after them, and returns the label for the rest of
+// the packet.
+func (d *hexAnnotator) ip6() string {
+	b := d.b
+	if !d.has(hexHeaderRow) {
+		return "truncated IPv6 header"
+	}
+	d.row(4, "IPv6 ver=%d tc=%d flow=%#05x", b[0]>>4, uint8(get16(b[0:2])>>4), get32(b[0:4])&0xfffff)
+	if !d.has(hexHeaderRow) {
+		return "truncated IPv6 header"
+	}
+	plen := int(get16(b[4:6]))
+	d.row(4, "IPv6 plen=%d next=%v hlim=%d", plen, IP4Proto(b[6]), b[7])
+	for _, name := range []string{"src", "dst"} {
+		if !d.has(16) {
+			return "truncated IPv6 header"
+		}
+		d.rows(16, fmt.Sprintf("IPv6 %s=%v", name, ip6FromBytes(b[d.off:d.off+16])))
+	}
+
+	if ip6HeaderLength+plen < d.end {
+		d.end = ip6HeaderLength + plen
+	}
+	proto, off := ip6UpperProto(b[:d.end])
+	switch {
+	case proto == Fragment:
+		return "IPv6 fragment"
+	case off == 0:
+		return "IPv6 payload"
+	}
+	d.dump(off, "IPv6 extension headers")
+	return d.transport(proto)
+}
+
+// transport annotates the header of the transport protocol proto,
+// starting at the offset reached so far, and returns the label for the
+// rest of the packet.
+func (d *hexAnnotator) transport(proto IP4Proto) string {
+	b := d.b[d.off:]
+	switch proto {
+	case TCP:
+		if !d.has(tcpHeaderLength) {
+			return "truncated TCP header"
+		}
+		d.row(4, "TCP sport=%d dport=%d", get16(b[0:2]), get16(b[2:4]))
+		d.row(4, "TCP seq=%d", get32(b[4:8]))
+		d.row(4, "TCP ack=%d", get32(b[8:12]))
+		doff := int(b[12]>>4) * 4
+		d.row(4, "TCP off=%d flags=%s win=%d", b[12]>>4, tcpFlagsString(b[13]), get16(b[14:16]))
+		d.row(4, "TCP csum=%#04x urg=%d", get16(b[16:18]), get16(b[18:20]))
+		if doff < tcpHeaderLength {
+			return "TCP data (bad data offset)"
+		}
+		if !d.rows(doff-tcpHeaderLength, "TCP options") {
+			return "truncated TCP options"
+		}
+		return "TCP payload"
+	case UDP:
+		if !d.has(udpHeaderLength) {
+			return "truncated UDP header"
+		}
+		d.row(4, "UDP sport=%d dport=%d", get16(b[0:2]), get16(b[2:4]))
+		d.row(4, "UDP len=%d csum=%#04x", get16(b[4:6]), get16(b[6:8]))
+		return "UDP payload"
+	case ICMP, ICMPv6:
+		if !d.has(8) {
+			return fmt.Sprintf("truncated %v header", proto)
+		}
+		var typ fmt.Stringer = ICMP4Type(b[0])
+		echo := ICMP4Type(b[0]) == ICMP4EchoRequest || ICMP4Type(b[0]) == ICMP4EchoReply
+		if proto == ICMPv6 {
+			typ = ICMP6Type(b[0])
+			echo = ICMP6Type(b[0]) == ICMP6EchoRequest || ICMP6Type(b[0]) == ICMP6EchoReply
+		}
+		d.row(4, "%v type=%d(%v) code=%d csum=%#04x", proto, b[0], typ, b[1], get16(b[2:4]))
+		if echo {
+			d.row(4, "%v id=%d seq=%d", proto, get16(b[4:6]), get16(b[6:8]))
+		} else {
+			d.row(4, "%v rest=%#08x", proto, get32(b[4:8]))
+		}
+		return fmt.Sprintf("%v data", proto)
+	}
+	return fmt.Sprintf("%v payload", proto)
+}
+
+// ip4FlagsString returns the flags set in the IPv4 flags and fragment
+// offset field v, such as "DF" or "MF", or "none".
+func ip4FlagsString(v uint16) string {
+	var flags []string
+	if v&0x8000 != 0 {
+		flags = append(flags, "RSV")
+	}
+	if v&ip4FlagDF != 0 {
+		flags = append(flags, "DF")
+	}
+	if v&ip4FlagMF != 0 {
+		flags = append(flags, "MF")
+	}
+	if len(flags) == 0 {
+		return "none"
+	}
+	return strings.Join(flags, "|")
+}
+
+// tcpFlagsString returns the TCP flags set in v, such as "SYN|ACK",
+// or "none".
+func tcpFlagsString(v uint8) string {
+	var flags []string
+	for i, name := range []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"} {
+		if v&(1<<i) != 0 {
+			flags = append(flags, name)
+		}
+	}
+	if len(flags) == 0 {
+		return "none"
+	}
+	return strings.Join(flags, "|")
+}
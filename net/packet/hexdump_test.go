@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnnotatedHexDump(t *testing.T) {
+	var q Parsed
+	// Bytes past the IP length are shown, but not as TCP payload.
+	q.Decode(append(append([]byte(nil), tcpCaptureBuffer...), 0xee, 0xff))
+	got := q.AnnotatedHexDump()
+	want := strings.Join([]string{
+		"0000: 45 00 00 3b  IP ver=4 ihl=5 tos=0 len=59",
+		"0004: 4c 2e 40 00  IP id=19502 flags=DF frag=0",
+		"0008: 40 06 f6 f4  IP ttl=64 proto=TCP csum=0xf6f4",
+		"000c: c0 a8 01 17  IP src=192.168.1.23",
+		"0010: 5d b8 d8 22  IP dst=93.184.216.34",
+		"0014: c8 22 00 50  TCP sport=51234 dport=80",
+		"0018: 8d 3a 11 f2  TCP seq=2369393138",
+		"001c: 27 c9 40 a5  TCP ack=667500709",
+		"0020: 80 18 01 f6  TCP off=8 flags=PSH|ACK win=502",
+		"0024: 70 62 00 00  TCP csum=0x7062 urg=0",
+		"0028: 01 01 08 0a  TCP options",
+		"002c: 5a 3c 1e 07",
+		"0030: 1b 2e d4 c9",
+		"0034: 47 45 54 20 2f 0d 0a                             TCP payload",
+		"003b: ee ff                                            trailing bytes past IP length",
+	}, "\n")
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestAnnotatedHexDumpMalformed(t *testing.T) {
+	badIHL := append([]byte(nil), udpRequestBuffer...)
+	badIHL[0] = 0x44
+	badOff := append([]byte(nil), tcpCaptureBuffer...)
+	badOff[32] = 0x20
+
+	tests := []struct {
+		name  string
+		pkt   []byte
+		label string // annotation of one of the lines
+		lines int
+	}{
+		{"empty", nil, "", 0},
+		{"not_ip", []byte{0x00, 0x01, 0x02}, "data", 1},
+		{"ip4_mid_header", tcpCaptureBuffer[:10], "truncated IP header", 3},
+		{"tcp_mid_header", tcpCaptureBuffer[:30], "truncated TCP header", 6},
+		{"tcp_mid_options", tcpCaptureBuffer[:46], "truncated TCP options", 11},
+		{"bad_ihl", badIHL, "IP data (bad header length)", 7},
+		{"bad_data_offset", badOff, "TCP data (bad data offset)", 12},
+		{"ip6_mid_address", ipv6PacketBuffer[:20], "truncated IPv6 header", 3},
+		{"icmp6", ipv6PacketBuffer, "ICMPv6 rest=0x00000000", 12},
+		{"udp", udpRequestBuffer, "UDP payload", 8},
+	}
+	for _, tt := range tests {
+		q := &Parsed{}
+		q.Decode(tt.pkt)
+		got := q.AnnotatedHexDump()
+		if tt.lines == 0 {
+			if got != "" {
+				t.Errorf("%s: got %q; want empty dump", tt.name, got)
+			}
+			continue
+		}
+		if n := strings.Count(got, "\n") + 1; n != tt.lines {
+			t.Errorf("%s: got %d lines; want %d:\n%s", tt.name, n, tt.lines, got)
+		}
+		if !strings.Contains(got+"\n", "  "+tt.label+"\n") {
+			t.Errorf("%s: no line annotated %q:\n%s", tt.name, tt.label, got)
+		}
+	}
+}
@@ -4,13 +4,19 @@
 
 package packet
 
+import "errors"
+
 type ICMP4Type uint8
 
 const (
 	ICMP4EchoReply    ICMP4Type = 0x00
 	ICMP4EchoRequest  ICMP4Type = 0x08
 	ICMP4Unreachable  ICMP4Type = 0x03
+	ICMP4Redirect     ICMP4Type = 0x05
 	ICMP4TimeExceeded ICMP4Type = 0x0b
+	// Address mask request and reply, from RFC 950.
+	ICMP4AddrMaskRequest ICMP4Type = 0x11
+	ICMP4AddrMaskReply   ICMP4Type = 0x12
 )
 
 func (t ICMP4Type) String() string {
@@ -21,19 +27,54 @@ func (t ICMP4Type) String() string {
 		return "EchoRequest"
 	case ICMP4Unreachable:
 		return "Unreachable"
+	case ICMP4Redirect:
+		return "Redirect"
 	case ICMP4TimeExceeded:
 		return "TimeExceeded"
+	case ICMP4AddrMaskRequest:
+		return "AddrMaskRequest"
+	case ICMP4AddrMaskReply:
+		return "AddrMaskReply"
 	default:
 		return "Unknown"
 	}
 }
 
+// KnownICMP4Types returns the ICMP types the package can identify,
+// in type number order.
+func KnownICMP4Types() []ICMP4Type {
+	return []ICMP4Type{ICMP4EchoReply, ICMP4Unreachable, ICMP4Redirect, ICMP4EchoRequest, ICMP4TimeExceeded, ICMP4AddrMaskRequest, ICMP4AddrMaskReply}
+}
+
 type ICMP4Code uint8
 
 const (
 	ICMP4NoCode ICMP4Code = 0
 )
 
+// Codes for ICMP4Unreachable.
+const (
+	ICMP4NetUnreachable   ICMP4Code = 0
+	ICMP4HostUnreachable  ICMP4Code = 1
+	ICMP4ProtoUnreachable ICMP4Code = 2
+	ICMP4PortUnreachable  ICMP4Code = 3
+	ICMP4FragNeeded       ICMP4Code = 4
+	ICMP4HostUnknown      ICMP4Code = 7
+	ICMP4NetProhibited    ICMP4Code = 9
+	ICMP4HostProhibited   ICMP4Code = 10
+	ICMP4AdminProhibited  ICMP4Code = 13
+)
+
+// Codes for ICMP4Redirect.
+const (
+	ICMP4RedirectNet     ICMP4Code = 0 // for the destination's network
+	ICMP4RedirectHost    ICMP4Code = 1 // for the destination host
+	ICMP4RedirectTOSNet  ICMP4Code = 2 // for the network and type of service
+	ICMP4RedirectTOSHost ICMP4Code = 3 // for the host and type of service
+)
+
+var errICMPCode = errors.New("invalid ICMP code")
+
 // ICMPHeader represents an ICMP packet header.
 type ICMP4Header struct {
 	IP4Header
@@ -45,6 +86,12 @@ const (
 	icmpHeaderLength = 4
 	// icmpTotalHeaderLength is the length of all headers in a ICMP packet.
 	icmpAllHeadersLength = ipHeaderLength + icmpHeaderLength
+	// icmp4ErrorHeaderLength is the length of all headers in an ICMP
+	// error, including the 4 type-specific bytes after the checksum.
+	icmp4ErrorHeaderLength = icmpAllHeadersLength + 4
+	// icmp4ErrorQuoteLength is how many bytes past the original IP
+	// header an ICMP error quotes, per RFC 792.
+	icmp4ErrorQuoteLength = 8
 )
 
 func (ICMP4Header) Len() int {
@@ -53,16 +100,17 @@ func (ICMP4Header) Len() int {
 
 func (h ICMP4Header) Marshal(buf []byte) error {
 	if len(buf) < icmpAllHeadersLength {
-		return errSmallBuffer
+		return ErrSmallBuffer
 	}
 	if len(buf) > maxPacketLength {
-		return errLargePacket
+		return ErrLargePacket
 	}
 	// The caller does not need to set this.
 	h.IPProto = ICMP
 
 	buf[20] = uint8(h.Type)
 	buf[21] = uint8(h.Code)
+	put16(buf[22:24], 0) // blank checksum
 
 	h.IP4Header.Marshal(buf)
 
@@ -78,3 +126,79 @@ func (h *ICMP4Header) ToResponse() {
 	h.Code = ICMP4NoCode
 	h.IP4Header.ToResponse()
 }
+
+// MakeICMP4FragNeeded writes to buf an ICMP "fragmentation needed"
+// error (Destination Unreachable, code 4) in response to the IPv4
+// packet orig, advertising mtu as the next-hop MTU as RFC 1191
+// requires. It returns the number of bytes written.
+//
+// The error is addressed from orig's destination back to its source.
+// Callers are responsible for only sending it in response to packets
+// that have DF set and are too large for the next hop.
+func MakeICMP4FragNeeded(orig []byte, mtu uint16, buf []byte) (int, error) {
+	return makeICMP4Error(ICMP4Unreachable, ICMP4FragNeeded, uint32(mtu), orig, buf)
+}
+
+// MakeICMP4ProtoUnreachable writes to buf an ICMP "protocol
+// unreachable" error (Destination Unreachable, code 2) in response to
+// the IPv4 packet orig, whose transport protocol isn't supported. It
+// returns the number of bytes written.
+//
+// The error is addressed from orig's destination back to its source.
+func MakeICMP4ProtoUnreachable(orig []byte, buf []byte) (int, error) {
+	return makeICMP4Error(ICMP4Unreachable, ICMP4ProtoUnreachable, 0, orig, buf)
+}
+
+// MakeICMP4Redirect writes to buf an ICMP Redirect message (RFC 792)
+// telling the sender of the IPv4 packet orig to send traffic for its
+// destination to betterGateway instead, and returns the number of
+// bytes written. code says whether the redirect is for the
+// destination's network or only its host, optionally for orig's type
+// of service; it must be one of the ICMP4Redirect codes.
+//
+// Like the package's other ICMP errors, the message is addressed from
+// orig's destination back to its source. Hosts only accept redirects
+// from the gateway they sent orig to (RFC 1122 section 3.2.2.2), so a
+// router must set the source to its own address on the host's network
+// and then fix the IP header checksum.
+func MakeICMP4Redirect(orig []byte, betterGateway IP4, code ICMP4Code, buf []byte) (int, error) {
+	if code > ICMP4RedirectTOSHost {
+		return 0, errICMPCode
+	}
+	return makeICMP4Error(ICMP4Redirect, code, uint32(betterGateway), orig, buf)
+}
+
+// makeICMP4Error writes to buf an ICMP error of type typ and code code
+// in response to the IPv4 packet orig, quoting orig's IP header and the
+// first 8 bytes of its payload. rest is the type-specific second word of
+// the ICMP header (unused, next-hop MTU, gateway address, etc.).
+// It returns the number of bytes written.
+func makeICMP4Error(typ ICMP4Type, code ICMP4Code, rest uint32, orig, buf []byte) (int, error) {
+	hlen, length, err := checkIP4(orig)
+	if err != nil {
+		return 0, err
+	}
+	quote := hlen + icmp4ErrorQuoteLength
+	if quote > length {
+		quote = length
+	}
+	n := icmp4ErrorHeaderLength + quote
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+
+	var h ICMP4Header
+	h.Type = typ
+	h.Code = code
+	h.IPID = get16(orig[4:6])
+	h.SrcIP = IP4(get32(orig[12:16]))
+	h.DstIP = IP4(get32(orig[16:20]))
+	h.IP4Header.ToResponse()
+	put32(buf[24:28], rest)
+	copy(buf[icmp4ErrorHeaderLength:], orig[:quote])
+	if err := h.Marshal(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "fmt"
+
+type ICMP6Type uint8
+
+const (
+	ICMP6Unreachable  ICMP6Type = 0x01
+	ICMP6PacketTooBig ICMP6Type = 0x02
+	ICMP6TimeExceeded ICMP6Type = 0x03
+	ICMP6ParamProblem ICMP6Type = 0x04
+	ICMP6EchoRequest  ICMP6Type = 0x80
+	ICMP6EchoReply    ICMP6Type = 0x81
+)
+
+func (t ICMP6Type) String() string {
+	switch t {
+	case ICMP6Unreachable:
+		return "Unreachable"
+	case ICMP6PacketTooBig:
+		return "PacketTooBig"
+	case ICMP6TimeExceeded:
+		return "TimeExceeded"
+	case ICMP6ParamProblem:
+		return "ParamProblem"
+	case ICMP6EchoRequest:
+		return "EchoRequest"
+	case ICMP6EchoReply:
+		return "EchoReply"
+	default:
+		return "Unknown"
+	}
+}
+
+type ICMP6Code uint8
+
+const (
+	ICMP6NoCode ICMP6Code = 0
+)
+
+// Codes for ICMP6Unreachable.
+const (
+	ICMP6NoRoute         ICMP6Code = 0
+	ICMP6AdminProhibited ICMP6Code = 1
+	ICMP6AddrUnreachable ICMP6Code = 3
+	ICMP6PortUnreachable ICMP6Code = 4
+)
+
+// ICMP6Header represents an ICMPv6 packet header.
+type ICMP6Header struct {
+	IP6Header
+	Type ICMP6Type
+	Code ICMP6Code
+}
+
+const (
+	icmp6HeaderLength = 4
+	// icmp6AllHeadersLength is the length of all headers in a ICMPv6 packet.
+	icmp6AllHeadersLength = ip6HeaderLength + icmp6HeaderLength
+	// icmp6ErrorHeaderLength is the length of all headers in an ICMPv6
+	// error, including the 4 type-specific bytes after the checksum.
+	icmp6ErrorHeaderLength = icmp6AllHeadersLength + 4
+)
+
+func (ICMP6Header) Len() int {
+	return icmp6AllHeadersLength
+}
+
+func (h ICMP6Header) Marshal(buf []byte) error {
+	if len(buf) < icmp6AllHeadersLength {
+		return ErrSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return ErrLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = ICMPv6
+
+	buf[40] = uint8(h.Type)
+	buf[41] = uint8(h.Code)
+	put16(buf[42:44], 0) // blank checksum
+
+	// ICMPv6 checksum with IPv6 pseudo header.
+	h.IP6Header.marshalPseudo(buf)
+	put16(buf[42:44], ipChecksum(buf))
+
+	h.IP6Header.Marshal(buf)
+
+	return nil
+}
+
+// ToResponse implements Header. Like ICMP4Header.ToResponse,
+// it assumes h is an echo request.
+func (h *ICMP6Header) ToResponse() {
+	h.Type = ICMP6EchoReply
+	h.Code = ICMP6NoCode
+	h.IP6Header.ToResponse()
+}
+
+// MakeICMP6Unreachable writes to buf an ICMPv6 Destination Unreachable
+// error with the given code in response to the IPv6 packet orig.
+// It returns the number of bytes written.
+//
+// As much of orig is quoted as fits without the error exceeding the
+// minimum IPv6 MTU. The error is addressed from orig's destination
+// back to its source.
+func MakeICMP6Unreachable(orig []byte, code ICMP6Code, buf []byte) (int, error) {
+	return makeICMP6Error(ICMP6Unreachable, code, 0, orig, buf)
+}
+
+// MakeICMP6PacketTooBig writes to buf an ICMPv6 Packet Too Big error
+// in response to the IPv6 packet orig, advertising mtu as the
+// next-hop MTU. It returns the number of bytes written.
+//
+// As with MakeICMP6Unreachable, as much of orig is quoted as fits
+// without the error exceeding the minimum IPv6 MTU.
+func MakeICMP6PacketTooBig(orig []byte, mtu uint32, buf []byte) (int, error) {
+	return makeICMP6Error(ICMP6PacketTooBig, ICMP6NoCode, mtu, orig, buf)
+}
+
+// makeICMP6Error writes to buf an ICMPv6 error of type typ and code
+// code in response to the IPv6 packet orig. rest is the type-specific
+// second word of the ICMPv6 header (unused, MTU, pointer).
+// It returns the number of bytes written.
+func makeICMP6Error(typ ICMP6Type, code ICMP6Code, rest uint32, orig, buf []byte) (int, error) {
+	length, err := checkIP6(orig)
+	if err != nil {
+		return 0, err
+	}
+	quote := length
+	if quote > ip6MinMTU-icmp6ErrorHeaderLength {
+		quote = ip6MinMTU - icmp6ErrorHeaderLength
+	}
+	n := icmp6ErrorHeaderLength + quote
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+
+	var h ICMP6Header
+	h.Type = typ
+	h.Code = code
+	h.SrcIP = ip6FromBytes(orig[24:40])
+	h.DstIP = ip6FromBytes(orig[8:24])
+	put32(buf[44:48], rest)
+	copy(buf[icmp6ErrorHeaderLength:], orig[:quote])
+	if err := h.Marshal(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// icmp6EchoHeaderLength is the length of all headers in an ICMPv6
+// echo, including the identifier and sequence number.
+const icmp6EchoHeaderLength = icmp6AllHeadersLength + 4
+
+// ICMP6EchoHeader is the header of an ICMPv6 Echo Request or Reply
+// (RFC 4443 section 4). Its types, 128 and 129, differ from the IPv4
+// ones, and unlike ICMPv4 its checksum covers the IPv6 pseudo-header.
+type ICMP6EchoHeader struct {
+	ICMP6Header
+	ID  uint16
+	Seq uint16
+}
+
+func (ICMP6EchoHeader) Len() int {
+	return icmp6EchoHeaderLength
+}
+
+// Marshal implements Header. The echo data, if any, must already be
+// at buf[h.Len():], since the checksum covers it.
+func (h ICMP6EchoHeader) Marshal(buf []byte) error {
+	if len(buf) < icmp6EchoHeaderLength {
+		return ErrSmallBuffer
+	}
+	put16(buf[44:46], h.ID)
+	put16(buf[46:48], h.Seq)
+	return h.ICMP6Header.Marshal(buf)
+}
+
+// ToResponse implements Header. It turns an echo request into its
+// reply, keeping the identifier and sequence number.
+func (h *ICMP6EchoHeader) ToResponse() {
+	h.ICMP6Header.ToResponse()
+}
+
+// Parse decodes the ICMPv6 echo request or reply in the IPv6 packet b
+// into h, and returns the echo data, which aliases b. It skips any
+// extension headers, and returns an error if b is not an ICMPv6 echo.
+// The checksum is not verified.
+func (h *ICMP6EchoHeader) Parse(b []byte) (data []byte, err error) {
+	length, err := checkIP6(b)
+	if err != nil {
+		return nil, err
+	}
+	b = b[:length]
+	proto, off := ip6UpperProto(b)
+	if proto != ICMPv6 {
+		return nil, &ParseError{Field: "NextHeader", Offset: 6, Value: int(proto), Reason: "!= ICMPv6"}
+	}
+	if len(b)-off < icmp6HeaderLength+4 {
+		return nil, &ParseError{
+			Field:  "Length",
+			Offset: off,
+			Value:  len(b) - off,
+			Reason: fmt.Sprintf("< %d", icmp6HeaderLength+4),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	typ := ICMP6Type(b[off])
+	if typ != ICMP6EchoRequest && typ != ICMP6EchoReply {
+		return nil, &ParseError{Field: "Type", Offset: off, Value: int(typ), Reason: "not an echo request or reply"}
+	}
+	*h = ICMP6EchoHeader{
+		ICMP6Header: ICMP6Header{
+			IP6Header: IP6Header{
+				IPProto:      ICMPv6,
+				TrafficClass: uint8(get32(b[0:4]) >> 20),
+				FlowLabel:    get32(b[0:4]) & 0xfffff,
+				SrcIP:        ip6FromBytes(b[8:24]),
+				DstIP:        ip6FromBytes(b[24:40]),
+			},
+			Type: typ,
+			Code: ICMP6Code(b[off+1]),
+		},
+		ID:  get16(b[off+4 : off+6]),
+		Seq: get16(b[off+6 : off+8]),
+	}
+	return b[off+8:], nil
+}
+
+// MakeICMP6EchoRequest writes to buf an ICMPv6 echo request from src
+// to dst with the given identifier, sequence number and payload.
+// It returns the number of bytes written.
+func MakeICMP6EchoRequest(src, dst IP6, id, seq uint16, payload []byte, buf []byte) (int, error) {
+	n := icmp6EchoHeaderLength + len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	h := ICMP6EchoHeader{
+		ICMP6Header: ICMP6Header{
+			IP6Header: IP6Header{SrcIP: src, DstIP: dst},
+			Type:      ICMP6EchoRequest,
+			Code:      ICMP6NoCode,
+		},
+		ID:  id,
+		Seq: seq,
+	}
+	copy(buf[icmp6EchoHeaderLength:n], payload)
+	if err := h.Marshal(buf[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -6,6 +6,7 @@ package packet
 
 import (
 	"fmt"
+	"math/bits"
 	"net"
 
 	"inet.af/netaddr"
@@ -26,8 +27,9 @@ func NewIP4(b net.IP) IP4 {
 
 // IPFromNetaddr converts a netaddr.IP to an IP.
 func IP4FromNetaddr(ip netaddr.IP) IP4 {
-	ipbytes := ip.As4()
-	return IP4(get32(ipbytes[:]))
+	// Not get32, which would move the array to the heap.
+	b := ip.As4()
+	return IP4(uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]))
 }
 
 // Netaddr converts an IP to a netaddr.IP.
@@ -43,10 +45,61 @@ func (ip IP4) IsMulticast() bool {
 	return byte(ip>>24)&0xf0 == 0xe0
 }
 
+// IsBroadcast reports whether ip is the limited broadcast address,
+// 255.255.255.255. Directed broadcast addresses depend on the subnet,
+// so they aren't recognized.
+func (ip IP4) IsBroadcast() bool {
+	return ip == 0xffffffff
+}
+
+// IsLocalMulticast reports whether ip is in 224.0.0.0/24, the
+// link-local multicast control block, which routers never forward.
+func (ip IP4) IsLocalMulticast() bool {
+	return ip>>8 == 0xe00000
+}
+
+// MulticastMAC returns the Ethernet multicast address that the
+// multicast group ip maps to, per RFC 1112: 01:00:5e followed by the
+// low 23 bits of ip. The upper 5 bits of the group are lost, so 32
+// groups (such as 224.1.1.1 and 225.1.1.1) share each MAC, and
+// receivers must still filter on the IP address.
+// The result is meaningless if ip is not multicast.
+func (ip IP4) MulticastMAC() [6]byte {
+	return [6]byte{0x01, 0x00, 0x5e, byte(ip>>16) & 0x7f, byte(ip >> 8), byte(ip)}
+}
+
 func (ip IP4) IsLinkLocalUnicast() bool {
 	return byte(ip>>24) == 169 && byte(ip>>16) == 254
 }
 
+// IP4Port is an IPv4 address and a TCP or UDP port.
+type IP4Port struct {
+	IP   IP4
+	Port uint16
+}
+
+func (p IP4Port) String() string {
+	return fmt.Sprintf("%v:%d", p.IP, p.Port)
+}
+
+// MaskBits returns the prefix length of the netmask mask,
+// such as 24 for 255.255.255.0. It reports false if mask is not
+// contiguous (for example, 255.255.0.255).
+func MaskBits(mask IP4) (uint8, bool) {
+	inv := ^uint32(mask)
+	if inv&(inv+1) != 0 {
+		return 0, false
+	}
+	return uint8(bits.LeadingZeros32(inv)), true
+}
+
+// WildcardToMask converts the Cisco-style wildcard mask w,
+// such as 0.0.0.255, to the equivalent netmask (255.255.255.0).
+// The result may still be non-contiguous; check it with MaskBits.
+func WildcardToMask(w IP4) IP4 {
+	return ^w
+}
+
 // IP4Proto is either a real IP protocol (TCP, UDP, ...) or an special
 // value like Unknown.  If it is a real IP protocol, its value
 // corresponds to its IP protocol number.
@@ -60,6 +113,10 @@ const (
 	ICMPv6  IP4Proto = 0x3a
 	TCP     IP4Proto = 0x06
 	UDP     IP4Proto = 0x11
+	ESP     IP4Proto = 0x32 // IPsec Encapsulating Security Payload
+	AH      IP4Proto = 0x33 // IPsec Authentication Header
+	PIM     IP4Proto = 0x67 // Protocol Independent Multicast
+	VRRP    IP4Proto = 0x70 // also used by CARP
 	// Fragment is a special value. It's not really an IPProto value
 	// so we're using the unassigned 0xFF value.
 	// TODO(dmytro): special values should be taken out of here.
@@ -72,13 +129,82 @@ func (p IP4Proto) String() string {
 		return "Frag"
 	case ICMP:
 		return "ICMP"
+	case IGMP:
+		return "IGMP"
+	case ICMPv6:
+		return "ICMPv6"
 	case UDP:
 		return "UDP"
 	case TCP:
 		return "TCP"
-	default:
+	case ESP:
+		return "ESP"
+	case AH:
+		return "AH"
+	case PIM:
+		return "PIM"
+	case VRRP:
+		return "VRRP"
+	case Unknown:
 		return "Unknown"
+	default:
+		return fmt.Sprintf("IPProto(%d)", uint8(p))
+	}
+}
+
+// IPv4 option types, from RFC 791.
+const (
+	ip4OptEOL  = 0   // end of option list
+	ip4OptNOP  = 1   // no operation
+	ip4OptLSRR = 131 // loose source and record route
+	ip4OptSSRR = 137 // strict source and record route
+)
+
+// hasSourceRoute reports whether the IPv4 options in opts contain a
+// loose or strict source route. Scanning stops at the end of the option
+// list or at the first malformed option.
+func hasSourceRoute(opts []byte) bool {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case ip4OptEOL:
+			return false
+		case ip4OptNOP:
+			opts = opts[1:]
+			continue
+		case ip4OptLSRR, ip4OptSSRR:
+			return true
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+		opts = opts[opts[1]:]
+	}
+	return false
+}
+
+// Fields of the IPv4 flags and fragment offset word.
+const (
+	ip4FlagDF         = 0x4000 // don't fragment
+	ip4FlagMF         = 0x2000 // more fragments
+	ip4FragOffsetMask = 0x1fff // fragment offset, in 8-byte units
+)
+
+// setIP4Word sets the 16-bit IPv4 header word at offset ofs of buf to
+// v, incrementally updating the header checksum.
+func setIP4Word(buf []byte, ofs int, v uint16) {
+	old := get16(buf[ofs : ofs+2])
+	if old == v {
+		return
 	}
+	put16(buf[ofs:ofs+2], v)
+	put16(buf[10:12], updateChecksum(get16(buf[10:12]), old, v))
+}
+
+// KnownProtocols returns the real IP protocols the package can
+// identify, in protocol number order. It excludes the special values
+// Unknown and Fragment.
+func KnownProtocols() []IP4Proto {
+	return []IP4Proto{ICMP, IGMP, TCP, UDP, ESP, AH, ICMPv6, PIM, VRRP}
 }
 
 // IPHeader represents an IP packet header.
@@ -87,20 +213,26 @@ type IP4Header struct {
 	IPID    uint16
 	SrcIP   IP4
 	DstIP   IP4
+	// Options holds the raw IPv4 options of a parsed header, or nil if
+	// it has none. Headers are always marshaled without options.
+	Options []byte
 }
 
 const ipHeaderLength = 20
 
+// Len returns the length of the header after marshaling. It is always
+// ipHeaderLength, even if h.Options is set, since Marshal doesn't write
+// options.
 func (IP4Header) Len() int {
 	return ipHeaderLength
 }
 
 func (h IP4Header) Marshal(buf []byte) error {
 	if len(buf) < ipHeaderLength {
-		return errSmallBuffer
+		return ErrSmallBuffer
 	}
 	if len(buf) > maxPacketLength {
-		return errLargePacket
+		return ErrLargePacket
 	}
 
 	buf[0] = 0x40 | (ipHeaderLength >> 2) // IPv4
@@ -119,15 +251,129 @@ func (h IP4Header) Marshal(buf []byte) error {
 	return nil
 }
 
+// Parse decodes the IPv4 header at the start of b into h.
+// If b does not start with a well-formed IPv4 header,
+// Parse returns a *ParseError describing the offending field.
+//
+// To avoid an allocation, h.Options aliases b rather than copying the
+// options out of it. It must not be used once b is modified or reused,
+// as happens when packet buffers are recycled; use ParseCopy if h has
+// to outlive b.
+func (h *IP4Header) Parse(b []byte) error {
+	hlen, _, err := checkIP4(b)
+	if err != nil {
+		return err
+	}
+	h.IPProto = IP4Proto(b[9])
+	h.IPID = get16(b[4:6])
+	h.SrcIP = IP4(get32(b[12:16]))
+	h.DstIP = IP4(get32(b[16:20]))
+	h.Options = nil
+	if hlen > ipHeaderLength {
+		h.Options = b[ipHeaderLength:hlen]
+	}
+	return nil
+}
+
+// ParseCopy is like Parse, but h.Options is a copy, independent of b.
+func (h *IP4Header) ParseCopy(b []byte) error {
+	if err := h.Parse(b); err != nil {
+		return err
+	}
+	if h.Options != nil {
+		h.Options = append([]byte(nil), h.Options...)
+	}
+	return nil
+}
+
+// IHL returns the length in bytes, including options, of the IPv4
+// header at the start of buf: its IHL field times 4. ok is false if
+// buf doesn't start with an IPv4 header, if IHL is less than the 5
+// words of a header without options, or if the header runs past the
+// end of buf. Unlike Decode, it doesn't look at the total length.
+func IHL(buf []byte) (n int, ok bool) {
+	if len(buf) < ipHeaderLength || buf[0]>>4 != 4 {
+		return 0, false
+	}
+	n = int(buf[0]&0x0F) << 2
+	if n < ipHeaderLength || n > len(buf) {
+		return 0, false
+	}
+	return n, true
+}
+
+// checkIP4 validates the length and version fields of the IPv4 header
+// at the start of b. It returns the header length (IHL*4) and the total
+// length of the packet, both in bytes.
+func checkIP4(b []byte) (hlen, length int, err error) {
+	if len(b) < ipHeaderLength {
+		return 0, 0, &ParseError{
+			Field:  "Length",
+			Value:  len(b),
+			Reason: fmt.Sprintf("< %d", ipHeaderLength),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	if version := b[0] >> 4; version != 4 {
+		return 0, 0, &ParseError{Field: "Version", Value: int(version), Reason: "!= 4"}
+	}
+	ihl := b[0] & 0x0F
+	if ihl < ipHeaderLength>>2 {
+		return 0, 0, &ParseError{Field: "IHL", Value: int(ihl), Reason: fmt.Sprintf("< %d", ipHeaderLength>>2)}
+	}
+	hlen = int(ihl) << 2
+	if hlen > len(b) {
+		return 0, 0, &ParseError{
+			Field:  "Options",
+			Offset: ipHeaderLength,
+			Value:  hlen - ipHeaderLength,
+			Reason: fmt.Sprintf("> %d available", len(b)-ipHeaderLength),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	length = int(get16(b[2:4]))
+	if length < hlen {
+		return 0, 0, &ParseError{Field: "TotalLength", Offset: 2, Value: length, Reason: fmt.Sprintf("< IHL*4 (%d)", hlen)}
+	}
+	if length > len(b) {
+		return 0, 0, &ParseError{
+			Field:  "TotalLength",
+			Offset: 2,
+			Value:  length,
+			Reason: fmt.Sprintf("> buffer length (%d)", len(b)),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	return hlen, length, nil
+}
+
+// pseudoSum4 returns the checksumSum of the IPv4 pseudo-header that
+// TCP, UDP and some other protocols include in their checksums.
+func pseudoSum4(src, dst IP4, proto IP4Proto, length int) uint64 {
+	return uint64(src>>16) + uint64(src&0xffff) +
+		uint64(dst>>16) + uint64(dst&0xffff) +
+		uint64(proto) + uint64(length)
+}
+
+// PseudoHeaderChecksum returns the folded one's complement sum of the
+// IPv4 pseudo-header for a transport segment of the given protocol
+// and length (RFC 793, RFC 768). It is not complemented: it is the
+// partial checksum that checksum offload expects to find in the
+// transport checksum field, leaving the hardware to add in the
+// segment itself.
+func PseudoHeaderChecksum(src, dst IP4, proto IP4Proto, length uint16) uint16 {
+	return foldChecksum(pseudoSum4(src, dst, proto, int(length)))
+}
+
 // MarshalPseudo serializes the header into buf in the "pseudo-header"
 // form required when calculating UDP checksums. Overwrites the first
 // h.Length() bytes of buf.
 func (h IP4Header) MarshalPseudo(buf []byte) error {
 	if len(buf) < ipHeaderLength {
-		return errSmallBuffer
+		return ErrSmallBuffer
 	}
 	if len(buf) > maxPacketLength {
-		return errLargePacket
+		return ErrLargePacket
 	}
 
 	length := len(buf) - ipHeaderLength
@@ -0,0 +1,363 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// IP6 is an IPv6 address.
+type IP6 struct {
+	Hi, Lo uint64
+}
+
+// IP6FromNetaddr converts a netaddr.IP to an IP6.
+// It panics if ip is not an IPv6 address.
+func IP6FromNetaddr(ip netaddr.IP) IP6 {
+	if !ip.Is6() {
+		panic(fmt.Sprintf("IP6FromNetaddr called with non-v6 addr %q", ip))
+	}
+	b := ip.As16()
+	return ip6FromBytes(b[:])
+}
+
+// ip6FromBytes returns the IPv6 address in the 16 bytes of b.
+func ip6FromBytes(b []byte) IP6 {
+	return IP6{get64(b[:8]), get64(b[8:16])}
+}
+
+// putIP6 writes ip into the 16 bytes of b.
+func putIP6(b []byte, ip IP6) {
+	put64(b[:8], ip.Hi)
+	put64(b[8:16], ip.Lo)
+}
+
+// Netaddr converts an IP6 to a netaddr.IP.
+func (ip IP6) Netaddr() netaddr.IP {
+	var b [16]byte
+	putIP6(b[:], ip)
+	return netaddr.IPFrom16(b)
+}
+
+func (ip IP6) String() string {
+	return ip.Netaddr().String()
+}
+
+func (ip IP6) IsMulticast() bool {
+	return ip.Hi>>56 == 0xff
+}
+
+func (ip IP6) IsLinkLocalUnicast() bool {
+	return ip.Hi>>54 == 0xfe80>>6
+}
+
+// NAT64WellKnownPrefix is the IPv6 prefix 64:ff9b::/96 reserved for
+// IPv4-embedded addresses by RFC 6052.
+var NAT64WellKnownPrefix = IP6{Hi: 0x0064ff9b00000000}
+
+// To64Prefix returns the IPv4-embedded IPv6 address for ip under the
+// prefixLen-bit prefix, as in RFC 6052 section 2.2. prefixLen must be
+// 32, 40, 48, 56, 64 or 96. For prefixes shorter than 64 bits, the
+// IPv4 address is split around bits 64 to 71, which are zero. Any bits
+// of prefix past prefixLen are ignored, and the suffix is zero.
+//
+// It panics if prefixLen is not one of the lengths RFC 6052 allows.
+func (ip IP4) To64Prefix(prefix IP6, prefixLen uint8) IP6 {
+	if !isNAT64PrefixLen(prefixLen) {
+		panic(fmt.Sprintf("To64Prefix called with invalid prefix length %d", prefixLen))
+	}
+	var b [16]byte
+	putIP6(b[:], prefix)
+	off := int(prefixLen / 8)
+	for i := off; i < len(b); i++ {
+		b[i] = 0
+	}
+	v4 := [4]byte{byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)}
+	for _, c := range v4 {
+		if off == 8 {
+			off++ // skip the reserved octet
+		}
+		b[off] = c
+		off++
+	}
+	return ip6FromBytes(b[:])
+}
+
+// Extract4 returns the IPv4 address embedded in ip under a prefixLen-bit
+// prefix, reversing IP4.To64Prefix. It doesn't check the prefix itself.
+// ok is false if prefixLen is not one RFC 6052 allows, or if ip's
+// reserved bits 64 to 71 aren't zero and so it isn't an IPv4-embedded
+// address.
+func (ip IP6) Extract4(prefixLen uint8) (_ IP4, ok bool) {
+	if !isNAT64PrefixLen(prefixLen) {
+		return 0, false
+	}
+	var b [16]byte
+	putIP6(b[:], ip)
+	off := int(prefixLen / 8)
+	if off <= 8 && b[8] != 0 {
+		return 0, false
+	}
+	var v4 IP4
+	for i := 0; i < 4; i++ {
+		if off == 8 {
+			off++
+		}
+		v4 = v4<<8 | IP4(b[off])
+		off++
+	}
+	return v4, true
+}
+
+// isNAT64PrefixLen reports whether n is one of the IPv4-embedding
+// prefix lengths of RFC 6052 section 2.2.
+func isNAT64PrefixLen(n uint8) bool {
+	switch n {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// IP6Header represents an IPv6 packet header.
+type IP6Header struct {
+	IPProto      IP4Proto // the Next Header field
+	TrafficClass uint8    // DSCP and ECN, as in Parsed.TrafficClass
+	FlowLabel    uint32   // only the low 20 bits are used
+	SrcIP        IP6
+	DstIP        IP6
+}
+
+const (
+	ip6HeaderLength = 40
+	// ip6MinMTU is the minimum link MTU IPv6 requires (RFC 8200).
+	ip6MinMTU = 1280
+)
+
+func (IP6Header) Len() int {
+	return ip6HeaderLength
+}
+
+func (h IP6Header) Marshal(buf []byte) error {
+	if len(buf) < ip6HeaderLength {
+		return ErrSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return ErrLargePacket
+	}
+
+	put32(buf[0:4], 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xfffff) // version, traffic class, flow label
+	put16(buf[4:6], uint16(len(buf)-ip6HeaderLength))
+	buf[6] = uint8(h.IPProto)
+	buf[7] = 64 // hop limit
+	putIP6(buf[8:24], h.SrcIP)
+	putIP6(buf[24:40], h.DstIP)
+
+	return nil
+}
+
+// marshalPseudo serializes the header into buf in the "pseudo-header"
+// form required when calculating transport checksums. The IPv6
+// pseudo-header is exactly as long as the real header, so this
+// overwrites the first h.Len() bytes of buf.
+func (h IP6Header) marshalPseudo(buf []byte) error {
+	if len(buf) < ip6HeaderLength {
+		return ErrSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return ErrLargePacket
+	}
+
+	putIP6(buf[0:16], h.SrcIP)
+	putIP6(buf[16:32], h.DstIP)
+	put32(buf[32:36], uint32(len(buf)-ip6HeaderLength))
+	buf[36] = 0
+	buf[37] = 0
+	buf[38] = 0
+	buf[39] = uint8(h.IPProto)
+
+	return nil
+}
+
+// ToResponse implements Header.
+func (h *IP6Header) ToResponse() {
+	h.SrcIP, h.DstIP = h.DstIP, h.SrcIP
+}
+
+// checkIP6 validates the IPv6 header at the start of b and returns
+// the total length of the packet (header plus payload) in bytes.
+func checkIP6(b []byte) (length int, err error) {
+	if len(b) < ip6HeaderLength {
+		return 0, &ParseError{
+			Field:  "Length",
+			Value:  len(b),
+			Reason: fmt.Sprintf("< %d", ip6HeaderLength),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	if version := b[0] >> 4; version != 6 {
+		return 0, &ParseError{Field: "Version", Value: int(version), Reason: "!= 6"}
+	}
+	length = ip6HeaderLength + int(get16(b[4:6]))
+	if length > len(b) {
+		return 0, &ParseError{
+			Field:  "PayloadLength",
+			Offset: 4,
+			Value:  length - ip6HeaderLength,
+			Reason: fmt.Sprintf("> %d available", len(b)-ip6HeaderLength),
+			Err:    ErrSmallBuffer,
+		}
+	}
+	return length, nil
+}
+
+// pseudoSum6 returns the checksumSum of the IPv6 pseudo-header
+// (RFC 8200 section 8.1).
+func pseudoSum6(src, dst IP6, proto IP4Proto, length uint32) uint64 {
+	ac := uint64(proto) + uint64(length>>16) + uint64(length&0xffff)
+	for _, v := range [4]uint64{src.Hi, src.Lo, dst.Hi, dst.Lo} {
+		ac += v>>48 + (v>>32)&0xffff + (v>>16)&0xffff + v&0xffff
+	}
+	return ac
+}
+
+// PseudoHeaderChecksum6 is like PseudoHeaderChecksum, for the IPv6
+// pseudo-header, which has a 32-bit upper-layer packet length.
+func PseudoHeaderChecksum6(src, dst IP6, proto IP4Proto, length uint32) uint16 {
+	return foldChecksum(pseudoSum6(src, dst, proto, length))
+}
+
+// IPv6 extension header types (next header values), from RFC 8200
+// and RFC 4302.
+const (
+	ip6HopByHop = 0
+	ip6Routing  = 43
+	ip6Fragment = 44
+	ip6AH       = 51
+	ip6NoNext   = 59
+	ip6DestOpts = 60
+)
+
+// ip6SkipHeader returns the type and offset of the header after the
+// extension header of type nh at offset off in b. ok is false if nh
+// is not an extension header that can be skipped (including a
+// fragment other than the first), or if it runs past the end of b.
+func ip6SkipHeader(b []byte, nh uint8, off int) (next uint8, nextOff int, ok bool) {
+	var n int
+	switch nh {
+	case ip6HopByHop, ip6Routing, ip6DestOpts:
+		if off+2 > len(b) {
+			return 0, 0, false
+		}
+		n = (int(b[off+1]) + 1) * 8
+	case ip6Fragment:
+		if off+8 > len(b) || get16(b[off+2:off+4])&^7 != 0 {
+			return 0, 0, false
+		}
+		n = 8
+	case ip6AH:
+		if off+2 > len(b) {
+			return 0, 0, false
+		}
+		n = (int(b[off+1]) + 2) * 4
+	default:
+		return 0, 0, false
+	}
+	if off+n > len(b) {
+		return 0, 0, false
+	}
+	return b[off], off + n, true
+}
+
+// ip6IsExtension reports whether nh is an IPv6 extension header that
+// ip6SkipHeader knows how to skip.
+func ip6IsExtension(nh uint8) bool {
+	switch nh {
+	case ip6HopByHop, ip6Routing, ip6DestOpts, ip6Fragment, ip6AH:
+		return true
+	}
+	return false
+}
+
+// ip6UpperProto returns the upper-layer protocol of the IPv6 packet b,
+// skipping over any extension headers, and its offset in b.
+// It returns Fragment if b is a fragment other than the first, whose
+// protocol header is elsewhere, and Unknown if there is no upper-layer
+// header or the extension headers run past the end of b.
+func ip6UpperProto(b []byte) (proto IP4Proto, off int) {
+	if len(b) < ip6HeaderLength {
+		return Unknown, 0
+	}
+	nh, off := b[6], ip6HeaderLength
+	for ip6IsExtension(nh) {
+		next, nextOff, ok := ip6SkipHeader(b, nh, off)
+		if !ok {
+			if nh == ip6Fragment && off+8 <= len(b) {
+				return Fragment, 0
+			}
+			return Unknown, 0
+		}
+		nh, off = next, nextOff
+	}
+	if nh == ip6NoNext {
+		return Unknown, 0
+	}
+	return IP4Proto(nh), off
+}
+
+// IP6FragmentHeader is an IPv6 Fragment extension header
+// (RFC 8200 section 4.5).
+type IP6FragmentHeader struct {
+	NextHeader IP4Proto // type of the first header of the fragmented part
+	Offset     int      // offset of the fragment's data, in bytes
+	More       bool     // whether more fragments follow
+	ID         uint32   // identification of the original packet
+}
+
+// ip6FragmentHeader parses the Fragment header of the IPv6 packet b.
+// It returns the offset of the Fragment header in b and the offset of
+// the next header field that points to it: b[6] or the first byte of
+// the preceding extension header. ok is false if b has no Fragment
+// header, or it couldn't be found.
+func ip6FragmentHeader(b []byte) (h IP6FragmentHeader, off, nhOff int, ok bool) {
+	if len(b) < ip6HeaderLength {
+		return h, 0, 0, false
+	}
+	nh, off, nhOff := b[6], ip6HeaderLength, 6
+	for nh != ip6Fragment {
+		next, nextOff, ok := ip6SkipHeader(b, nh, off)
+		if !ok {
+			return h, 0, 0, false
+		}
+		nh, nhOff, off = next, off, nextOff
+	}
+	if off+8 > len(b) {
+		return h, 0, 0, false
+	}
+	fragWord := get16(b[off+2 : off+4])
+	h = IP6FragmentHeader{
+		NextHeader: IP4Proto(b[off]),
+		Offset:     int(fragWord &^ 7),
+		More:       fragWord&1 != 0,
+		ID:         get32(b[off+4 : off+8]),
+	}
+	return h, off, nhOff, true
+}
+
+// IP6FragmentHeader returns the Fragment header of the IPv6 packet q.
+// ok is false if q is not an IPv6 fragment.
+func (q *Parsed) IP6FragmentHeader() (h IP6FragmentHeader, ok bool) {
+	if q.IPVersion != 6 {
+		return h, false
+	}
+	length, err := checkIP6(q.b)
+	if err != nil {
+		return h, false
+	}
+	h, _, _, ok = ip6FragmentHeader(q.b[:length])
+	return h, ok
+}
@@ -0,0 +1,330 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+var (
+	testIP6Src = IP6{0xfd7a115ca1e0ab12, 0x4843cd96626b430b}
+	testIP6Dst = IP6{0xfd7a115ca1e0ab12, 0x4843cd9662690001}
+)
+
+// makeUDP6 returns an IPv6 UDP packet from testIP6Src to testIP6Dst
+// carrying payloadLen bytes of payload. Its UDP checksum is not set.
+func makeUDP6(payloadLen int) []byte {
+	pkt := make([]byte, ip6HeaderLength+udpHeaderLength+payloadLen)
+	h := IP6Header{IPProto: UDP, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	h.Marshal(pkt)
+	put16(pkt[40:42], 123)
+	put16(pkt[42:44], 567)
+	put16(pkt[44:46], uint16(udpHeaderLength+payloadLen))
+	for i := range pkt[48:] {
+		pkt[48+i] = byte(i)
+	}
+	return pkt
+}
+
+// withIP6ExtHeader returns a copy of the IPv6 packet pkt with the
+// extension header hdr, of type nh, inserted after the fixed header.
+// hdr's next header byte is filled in.
+func withIP6ExtHeader(pkt []byte, nh uint8, hdr []byte) []byte {
+	out := make([]byte, 0, len(pkt)+len(hdr))
+	out = append(out, pkt[:ip6HeaderLength]...)
+	out = append(out, hdr...)
+	out = append(out, pkt[ip6HeaderLength:]...)
+	out[ip6HeaderLength] = pkt[6]
+	out[6] = nh
+	put16(out[4:6], uint16(len(out)-ip6HeaderLength))
+	return out
+}
+
+// transportChecksum6 returns the one's complement checksum of the
+// payload of the IPv6 packet pkt including its pseudo-header.
+// It is zero if the stored transport checksum is valid.
+func transportChecksum6(pkt []byte) uint16 {
+	payload := pkt[ip6HeaderLength:]
+	b := make([]byte, 40+len(payload))
+	copy(b[0:32], pkt[8:40])
+	put32(b[32:36], uint32(len(payload)))
+	b[39] = pkt[6]
+	copy(b[40:], payload)
+	return ipChecksum(b)
+}
+
+func TestIP6HeaderMarshal(t *testing.T) {
+	h := IP6Header{IPProto: TCP, FlowLabel: 0xfff12345, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	buf := make([]byte, 50)
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x60, 0x01, 0x23, 0x45, 0x00, 0x0a, 0x06, 0x40,
+		0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0xab, 0x12,
+		0x48, 0x43, 0xcd, 0x96, 0x62, 0x6b, 0x43, 0x0b,
+		0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 0xab, 0x12,
+		0x48, 0x43, 0xcd, 0x96, 0x62, 0x69, 0x00, 0x01,
+	}
+	if !bytes.Equal(buf[:40], want) {
+		t.Errorf("got %x; want %x", buf[:40], want)
+	}
+	if err := h.Marshal(buf[:39]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestDecodeFlowLabel(t *testing.T) {
+	// Traffic class 0xab is set too, to check that it's masked off.
+	h := IP6Header{IPProto: UDP, FlowLabel: 0xabcde, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	buf := make([]byte, 48)
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	buf[0], buf[1] = 0x6a, 0xba
+
+	var q Parsed
+	q.Decode(buf)
+	if q.IPVersion != 6 || q.FlowLabel != 0xabcde {
+		t.Fatalf("decoded version %d, flow label %#x; want 6, 0xabcde", q.IPVersion, q.FlowLabel)
+	}
+	h2 := IP6Header{IPProto: q.IPProto, FlowLabel: q.FlowLabel, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	buf2 := make([]byte, 48)
+	if err := h2.Marshal(buf2); err != nil {
+		t.Fatal(err)
+	}
+	if got := get32(buf2[0:4]); got != 0x600abcde {
+		t.Errorf("re-marshaled first word = %#x; want 0x600abcde", got)
+	}
+
+	q.Decode(udpRequestBuffer)
+	if q.FlowLabel != 0 {
+		t.Errorf("IPv4 flow label = %#x; want 0", q.FlowLabel)
+	}
+}
+
+func TestMakeICMP6Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		make     func(orig, buf []byte) (int, error)
+		typ      ICMP6Type
+		code     ICMP6Code
+		rest     uint32
+		origLen  int
+		wantSize int
+	}{
+		{
+			name:     "unreachable_small",
+			make:     func(orig, buf []byte) (int, error) { return MakeICMP6Unreachable(orig, ICMP6PortUnreachable, buf) },
+			typ:      ICMP6Unreachable,
+			code:     ICMP6PortUnreachable,
+			origLen:  100,
+			wantSize: 48 + 100,
+		},
+		{
+			name:     "too_big",
+			make:     func(orig, buf []byte) (int, error) { return MakeICMP6PacketTooBig(orig, 1400, buf) },
+			typ:      ICMP6PacketTooBig,
+			rest:     1400,
+			origLen:  1500,
+			wantSize: ip6MinMTU,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := makeUDP6(tt.origLen - ip6HeaderLength - udpHeaderLength)
+			buf := make([]byte, 2000)
+			n, err := tt.make(orig, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.wantSize {
+				t.Fatalf("n = %d; want %d", n, tt.wantSize)
+			}
+			pkt := buf[:n]
+			if got := int(get16(pkt[4:6])); got != n-ip6HeaderLength {
+				t.Errorf("payload length = %d; want %d", got, n-ip6HeaderLength)
+			}
+			if IP4Proto(pkt[6]) != ICMPv6 {
+				t.Errorf("next header = %d; want %d", pkt[6], ICMPv6)
+			}
+			if ip6FromBytes(pkt[8:24]) != testIP6Dst || ip6FromBytes(pkt[24:40]) != testIP6Src {
+				t.Errorf("addresses not reversed")
+			}
+			if ICMP6Type(pkt[40]) != tt.typ || ICMP6Code(pkt[41]) != tt.code {
+				t.Errorf("type/code = %d/%d; want %d/%d", pkt[40], pkt[41], tt.typ, tt.code)
+			}
+			if got := get32(pkt[44:48]); got != tt.rest {
+				t.Errorf("rest of header = %d; want %d", got, tt.rest)
+			}
+			if !bytes.Equal(pkt[48:], orig[:n-48]) {
+				t.Errorf("quoted packet doesn't match original")
+			}
+			if got := transportChecksum6(pkt); got != 0 {
+				t.Errorf("ICMPv6 checksum doesn't verify (%#x)", got)
+			}
+		})
+	}
+
+	var buf [64]byte
+	if _, err := MakeICMP6Unreachable(makeUDP6(10), ICMP6NoRoute, buf[:]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := MakeICMP6PacketTooBig(udpRequestBuffer, 1280, buf[:]); err == nil {
+		t.Errorf("IPv4 orig: got nil error")
+	}
+}
+
+func TestProtoName(t *testing.T) {
+	udp := makeUDP6(4)
+	hopByHop := []byte{0, 0, 1, 4, 0, 0, 0, 0} // PadN option
+	firstFrag := []byte{0, 0, 0x00, 0x01, 0, 0, 0, 1}
+	laterFrag := []byte{0, 0, 0x05, 0x00, 0, 0, 0, 1}
+	tests := []struct {
+		name string
+		pkt  []byte
+		want string
+	}{
+		{"ipv4_tcp", tcpPacketBuffer, "TCP"},
+		{"ipv4_udp", udpRequestBuffer, "UDP"},
+		{"ipv6_udp", udp, "UDP"},
+		{"ipv6_icmp", ipv6PacketBuffer, "ICMPv6"},
+		{"hop_by_hop", withIP6ExtHeader(udp, ip6HopByHop, hopByHop), "UDP"},
+		{"first_fragment", withIP6ExtHeader(withIP6ExtHeader(udp, ip6Fragment, firstFrag), ip6HopByHop, hopByHop), "UDP"},
+		{"later_fragment", withIP6ExtHeader(udp, ip6Fragment, laterFrag), "Frag"},
+		{"no_next_header", withIP6ExtHeader(udp, ip6NoNext, nil), "Unknown"},
+		{"truncated", withIP6ExtHeader(udp, ip6HopByHop, nil)[:ip6HeaderLength+1], "Unknown"},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.ProtoName(); got != tt.want {
+			t.Errorf("%s: ProtoName = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecrementHopLimit(t *testing.T) {
+	pkt := makeUDP6(4)
+	var q Parsed
+	q.Decode(pkt)
+	if q.HopLimit != 64 {
+		t.Fatalf("HopLimit = %d; want 64", q.HopLimit)
+	}
+	orig := append([]byte(nil), pkt...)
+	if !q.DecrementHopLimit(pkt) {
+		t.Fatalf("DecrementHopLimit = false at hop limit 64")
+	}
+	if pkt[7] != 63 || q.HopLimit != 63 {
+		t.Errorf("hop limit = %d (Parsed %d); want 63", pkt[7], q.HopLimit)
+	}
+	orig[7] = 63
+	if !bytes.Equal(pkt, orig) {
+		t.Errorf("bytes other than the hop limit changed")
+	}
+
+	for _, hl := range []uint8{1, 0} {
+		pkt[7] = hl
+		q.Decode(pkt)
+		if q.DecrementHopLimit(pkt) {
+			t.Errorf("DecrementHopLimit = true at hop limit %d", hl)
+		}
+		if pkt[7] != hl {
+			t.Errorf("hop limit %d changed to %d", hl, pkt[7])
+		}
+	}
+
+	buf := append([]byte(nil), udpRequestBuffer...)
+	q.Decode(buf)
+	if q.DecrementHopLimit(buf) || !bytes.Equal(buf, udpRequestBuffer) {
+		t.Errorf("DecrementHopLimit acted on an IPv4 packet")
+	}
+}
+
+func TestIP6FragmentHeader(t *testing.T) {
+	part := makeUDP6(20)[ip6HeaderLength:]
+	var p Parsed
+	p.Decode(fragment6(0xdeadbeef, 24, true, part[:8]))
+	h, ok := p.IP6FragmentHeader()
+	want := IP6FragmentHeader{NextHeader: UDP, Offset: 24, More: true, ID: 0xdeadbeef}
+	if !ok || h != want {
+		t.Errorf("IP6FragmentHeader() = %+v, %v; want %+v, true", h, ok, want)
+	}
+
+	// The Fragment header is found behind other extension headers.
+	p.Decode(withIP6ExtHeader(fragment6(1, 0, false, part), ip6DestOpts, make([]byte, 8)))
+	if h, ok := p.IP6FragmentHeader(); !ok || h.ID != 1 || h.More || h.NextHeader != UDP {
+		t.Errorf("behind DestOpts: IP6FragmentHeader() = %+v, %v", h, ok)
+	}
+
+	p.Decode(makeUDP6(20))
+	if _, ok := p.IP6FragmentHeader(); ok {
+		t.Errorf("unfragmented packet has a Fragment header")
+	}
+}
+
+func TestNAT64Prefix(t *testing.T) {
+	ip6 := func(s string) IP6 {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return IP6FromNetaddr(ip)
+	}
+	v4 := IP4(0xc0000221) // 192.0.2.33
+
+	// The examples of RFC 6052 section 2.4.
+	tests := []struct {
+		prefix    string
+		prefixLen uint8
+		want      string
+	}{
+		{"2001:db8::", 32, "2001:db8:c000:221::"},
+		{"2001:db8:100::", 40, "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::", 48, "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::", 56, "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::", 64, "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::", 96, "2001:db8:122:344::c000:221"},
+		{"64:ff9b::", 96, "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		got := v4.To64Prefix(ip6(tt.prefix), tt.prefixLen)
+		if want := ip6(tt.want); got != want {
+			t.Errorf("%s/%d: To64Prefix = %v; want %v", tt.prefix, tt.prefixLen, got, want)
+		}
+		if back, ok := got.Extract4(tt.prefixLen); !ok || back != v4 {
+			t.Errorf("%s/%d: Extract4 = %v, %v; want %v, true", tt.prefix, tt.prefixLen, back, ok, v4)
+		}
+	}
+
+	if got := v4.To64Prefix(NAT64WellKnownPrefix, 96); got != ip6("64:ff9b::c000:221") {
+		t.Errorf("well-known prefix: got %v", got)
+	}
+	// Bits of the prefix past its length don't leak into the address.
+	if got := v4.To64Prefix(ip6("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), 32); got != ip6("2001:db8:c000:221::") {
+		t.Errorf("unmasked prefix: got %v", got)
+	}
+
+	if _, ok := ip6("2001:db8:122:344:c0:2:2100:0").Extract4(33); ok {
+		t.Errorf("Extract4 accepted prefix length 33")
+	}
+	if _, ok := ip6("2001:db8:122:344:ffc0:2:2100:0").Extract4(64); ok {
+		t.Errorf("Extract4 accepted a nonzero reserved octet")
+	}
+	// The reserved octet is part of a /96 prefix, so anything goes.
+	if got, ok := ip6("2001:db8:122:344:ff00::c000:221").Extract4(96); !ok || got != v4 {
+		t.Errorf("/96 with nonzero bits 64-71: got %v, %v", got, ok)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("To64Prefix didn't panic on prefix length 100")
+		}
+	}()
+	v4.To64Prefix(NAT64WellKnownPrefix, 100)
+}
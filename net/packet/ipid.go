@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "sync/atomic"
+
+// FlowIPID returns the IPv4 identification for datagram number counter
+// of the flow whose hash is flowHash, such as from HashFlow.
+//
+// The ID is the counter offset by the flow hash, so consecutive
+// datagrams of a flow get distinct IDs until the counter wraps after
+// 65536 of them, while different flows start from unrelated offsets.
+// All fragments of one datagram must share its counter value.
+func FlowIPID(flowHash uint32, counter uint16) uint16 {
+	return uint16(flowHash>>16) + counter
+}
+
+// ipidBuckets is the number of per-flow counters an IPIDGenerator
+// keeps. Flows whose hashes share a bucket share a counter, which
+// costs them nothing but some of their wraparound window.
+const ipidBuckets = 1 << 11
+
+// IPIDGenerator assigns IPv4 identifications to originated datagrams
+// per flow, following the hash-based algorithm of RFC 7739 section
+// 5.3: each flow hash selects one of a fixed table of counters, and
+// the ID is that counter offset by the hash (see FlowIPID). Unlike a
+// global counter, this reveals nothing about the traffic of other
+// flows, and memory use doesn't grow with the number of flows.
+//
+// An IPIDGenerator is safe for concurrent use. Its zero value is
+// ready to use, but see Key.
+type IPIDGenerator struct {
+	// Key is a secret mixed into flow hashes. With a zero Key, the ID
+	// offset of a flow can be predicted from its addresses and ports;
+	// callers that care should set it to a random value.
+	Key uint32
+
+	counters [ipidBuckets]uint32
+}
+
+// Next returns the identification for the next datagram of the flow
+// whose hash is flowHash, such as from Parsed.FlowHash. Call it once
+// per datagram, before fragmenting, and give every fragment the ID.
+func (g *IPIDGenerator) Next(flowHash uint32) uint16 {
+	h := fmix32(flowHash ^ g.Key)
+	c := atomic.AddUint32(&g.counters[h%ipidBuckets], 1)
+	return FlowIPID(h, uint16(c))
+}
+
+// fmix32 is the MurmurHash3 finalizer. It spreads every input bit
+// over all output bits, so that the bucket and the offset chosen by
+// Next, which come from different bits of its result, are unrelated.
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFlowIPID(t *testing.T) {
+	flow := HashFlow(0x01020304, 0x05060708, UDP, 123, 567)
+	if FlowIPID(flow, 7) != FlowIPID(flow, 7) {
+		t.Errorf("same datagram got different IDs")
+	}
+	seen := make(map[uint16]bool)
+	for c := 0; c < 1<<16; c++ {
+		id := FlowIPID(flow, uint16(c))
+		if seen[id] {
+			t.Fatalf("ID %#04x repeated within a flow after %d datagrams", id, c)
+		}
+		seen[id] = true
+	}
+	other := HashFlow(0x01020304, 0x05060709, UDP, 123, 567)
+	if FlowIPID(flow, 0) == FlowIPID(other, 0) {
+		t.Errorf("flows start at the same offset")
+	}
+}
+
+func TestIPIDGenerator(t *testing.T) {
+	var g IPIDGenerator
+	flow := HashFlow(0x01020304, 0x05060708, TCP, 1000, 443)
+	seen := make(map[uint16]bool)
+	for i := 0; i < 1000; i++ {
+		id := g.Next(flow)
+		if seen[id] {
+			t.Fatalf("ID %#04x repeated after %d datagrams", id, i)
+		}
+		seen[id] = true
+	}
+
+	// Other flows don't advance this flow's sequence, unless they
+	// share its bucket.
+	var a, b IPIDGenerator
+	a.Next(flow)
+	b.Next(flow)
+	for i := uint32(0); i < 100; i++ {
+		if h := fmix32(i); h%ipidBuckets != fmix32(flow)%ipidBuckets {
+			b.Next(i)
+		}
+	}
+	if a.Next(flow) != b.Next(flow) {
+		t.Errorf("unrelated flows changed a flow's IDs")
+	}
+
+	// The key changes the IDs.
+	keyed := IPIDGenerator{Key: 0x5eed}
+	var zero IPIDGenerator
+	if keyed.Next(flow) == zero.Next(flow) {
+		t.Errorf("Key doesn't affect IDs")
+	}
+}
+
+func TestIPIDGeneratorConcurrent(t *testing.T) {
+	var g IPIDGenerator
+	var mu sync.Mutex
+	seen := make(map[uint16]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := g.Next(42)
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("ID %#04x handed out twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+const (
+	// espHeaderLength is the length of the cleartext part of an ESP
+	// packet: the SPI and sequence number. Everything after it is
+	// encrypted.
+	espHeaderLength = 8
+	// ahMinHeaderLength is the length of an AH header without
+	// authentication data.
+	ahMinHeaderLength = 12
+)
+
+// ESPHeader is the cleartext header of an IPsec Encapsulating
+// Security Payload packet (RFC 4303). The rest of the packet,
+// including the protocol it carries, is encrypted.
+type ESPHeader struct {
+	SPI uint32 // security parameters index, identifying the SA
+	Seq uint32 // sequence number
+}
+
+// AHHeader is an IPsec Authentication Header (RFC 4302).
+type AHHeader struct {
+	NextHeader IP4Proto // protocol of the header after AH
+	// Length is the length of the AH header in bytes, including its
+	// authentication data. The next header follows at this offset
+	// from the start of AH.
+	Length int
+	SPI    uint32 // security parameters index, identifying the SA
+	Seq    uint32 // sequence number
+}
+
+// ESPHeader returns the ESP header of q. ok is false if q is not an
+// IPv4 ESP packet.
+func (q *Parsed) ESPHeader() (h ESPHeader, ok bool) {
+	if q.IPVersion != 4 || q.IPProto != ESP || q.TransportSkipped || q.length < q.subofs+espHeaderLength {
+		return ESPHeader{}, false
+	}
+	b := q.b[q.subofs:q.length]
+	return ESPHeader{SPI: get32(b[0:4]), Seq: get32(b[4:8])}, true
+}
+
+// AHHeader returns the AH header of q. ok is false if q is not an IPv4
+// AH packet. The header AH protects starts h.Length bytes into q's IP
+// payload, and is what q.Payload returns.
+func (q *Parsed) AHHeader() (h AHHeader, ok bool) {
+	if q.IPVersion != 4 || q.IPProto != AH || q.TransportSkipped || q.length < q.subofs+ahMinHeaderLength {
+		return AHHeader{}, false
+	}
+	b := q.b[q.subofs:q.length]
+	if len(b) < ahHeaderLength(b) {
+		return AHHeader{}, false
+	}
+	return AHHeader{
+		NextHeader: IP4Proto(b[0]),
+		Length:     ahHeaderLength(b),
+		SPI:        get32(b[4:8]),
+		Seq:        get32(b[8:12]),
+	}, true
+}
+
+// ahHeaderLength returns the length in bytes of the AH header at the
+// start of b, from its payload length field. Unlike IPv6 extension
+// headers, AH counts its length in 32-bit words, minus 2.
+func ahHeaderLength(b []byte) int {
+	return (int(b[1]) + 2) * 4
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// makeIPsec returns an IPv4 packet of protocol proto from 1.2.3.4 to
+// 5.6.7.8 carrying body.
+func makeIPsec(proto IP4Proto, body []byte) []byte {
+	h := IP4Header{IPProto: proto, SrcIP: 0x01020304, DstIP: 0x05060708}
+	return Generate(&h, body)
+}
+
+func TestESPHeader(t *testing.T) {
+	pkt := makeIPsec(ESP, []byte{
+		0x00, 0x00, 0x12, 0x34, // SPI
+		0x00, 0x00, 0x00, 0x2a, // sequence number
+		0xde, 0xad, 0xbe, 0xef, // encrypted payload
+	})
+	var q Parsed
+	q.Decode(pkt)
+	if q.IPProto != ESP {
+		t.Fatalf("IPProto = %v; want ESP", q.IPProto)
+	}
+	h, ok := q.ESPHeader()
+	if !ok || h != (ESPHeader{SPI: 0x1234, Seq: 42}) {
+		t.Errorf("ESPHeader() = %+v, %v; want SPI 0x1234, Seq 42", h, ok)
+	}
+	if !bytes.Equal(q.Payload(), []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("Payload() = %x; want the encrypted payload", q.Payload())
+	}
+	if _, ok := q.AHHeader(); ok {
+		t.Errorf("ESP packet has an AH header")
+	}
+
+	q.Decode(makeIPsec(ESP, []byte{0, 0, 0x12, 0x34, 0, 0, 0}))
+	if q.IPProto != Unknown {
+		t.Errorf("truncated ESP: IPProto = %v; want Unknown", q.IPProto)
+	}
+	if _, ok := q.ESPHeader(); ok {
+		t.Errorf("truncated ESP: got header")
+	}
+	// DecodeIPOnly doesn't check the ESP header, so ESPHeader must.
+	if err := DecodeIPOnly(makeIPsec(ESP, []byte{0, 0, 0x12, 0x34, 0, 0, 0}), &q); err != nil || q.IPProto != ESP {
+		t.Fatalf("DecodeIPOnly: %v, proto %v", err, q.IPProto)
+	}
+	if _, ok := q.ESPHeader(); ok {
+		t.Errorf("truncated ESP after DecodeIPOnly: got header")
+	}
+}
+
+func TestAHHeader(t *testing.T) {
+	udp := udpRequestBuffer[ipHeaderLength:]
+	ah := []byte{
+		uint8(UDP), 4, 0, 0, // next header; (24/4)-2 payload length
+		0xc0, 0xff, 0xee, 0x00, // SPI
+		0x00, 0x00, 0x00, 0x07, // sequence number
+	}
+	ah = append(ah, bytes.Repeat([]byte{0xaa}, 12)...) // ICV (HMAC-SHA1-96)
+	ah = append(ah, udp...)
+	pkt := makeIPsec(AH, ah)
+
+	var q Parsed
+	q.Decode(pkt)
+	if q.IPProto != AH {
+		t.Fatalf("IPProto = %v; want AH", q.IPProto)
+	}
+	h, ok := q.AHHeader()
+	want := AHHeader{NextHeader: UDP, Length: 24, SPI: 0xc0ffee00, Seq: 7}
+	if !ok || h != want {
+		t.Errorf("AHHeader() = %+v, %v; want %+v", h, ok, want)
+	}
+	// The protected transport header follows the AH header.
+	if !bytes.Equal(q.Payload(), udp) {
+		t.Errorf("Payload() = %x; want the UDP datagram %x", q.Payload(), udp)
+	}
+	if _, ok := q.ESPHeader(); ok {
+		t.Errorf("AH packet has an ESP header")
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"short", ah[:ahMinHeaderLength-1]},
+		{"icv_past_end", ah[:20]},
+	}
+	for _, tt := range tests {
+		q.Decode(makeIPsec(AH, tt.body))
+		if q.IPProto != Unknown {
+			t.Errorf("%s: IPProto = %v; want Unknown", tt.name, q.IPProto)
+		}
+		// DecodeIPOnly doesn't check the AH header, so AHHeader must.
+		if err := DecodeIPOnly(makeIPsec(AH, tt.body), &q); err != nil || q.IPProto != AH {
+			t.Fatalf("%s: DecodeIPOnly: %v, proto %v", tt.name, err, q.IPProto)
+		}
+		if _, ok := q.AHHeader(); ok {
+			t.Errorf("%s: AHHeader ok after DecodeIPOnly", tt.name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// MetaFlags are flags recording how a packet has been processed.
+type MetaFlags uint8
+
+const (
+	// MetaNATed is set on packets whose addresses or ports have been
+	// rewritten, so that NAT isn't applied twice.
+	MetaNATed MetaFlags = 1 << iota
+	// MetaInjected is set on packets generated locally or re-injected
+	// into the pipeline, rather than read from the wire.
+	MetaInjected
+	// MetaFiltered is set on packets that have already passed the
+	// packet filter.
+	MetaFiltered
+)
+
+// PacketMeta is metadata about a packet that travels alongside it
+// through a processing pipeline, out of band of the packet bytes.
+// It gives subsystems a shared place to record what they've done to
+// a packet, such as to avoid reprocessing packets that loop back
+// after re-injection. The zero value describes a fresh packet.
+type PacketMeta struct {
+	Flags MetaFlags
+	// Generation counts how many times the packet has been
+	// re-injected. It saturates at 255.
+	Generation uint8
+}
+
+// Meta returns the metadata attached to q's packet.
+func (q *Parsed) Meta() PacketMeta {
+	return q.meta
+}
+
+// SetMeta attaches m to q's packet. The metadata survives later calls
+// to Decode, such as when the packet is decoded again after looping
+// back, until it is replaced or q is Reset.
+func (q *Parsed) SetMeta(m PacketMeta) {
+	q.meta = m
+}
+
+// Has reports whether all of flags are set in m.
+func (m PacketMeta) Has(flags MetaFlags) bool {
+	return m.Flags&flags == flags
+}
+
+// Set sets flags in m.
+func (m *PacketMeta) Set(flags MetaFlags) {
+	m.Flags |= flags
+}
+
+// Reinjected returns the metadata for m's packet being fed back into
+// the pipeline: the same flags plus MetaInjected, one generation on.
+func (m PacketMeta) Reinjected() PacketMeta {
+	m.Flags |= MetaInjected
+	if m.Generation < 255 {
+		m.Generation++
+	}
+	return m
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestPacketMeta(t *testing.T) {
+	var m PacketMeta
+	if m.Has(MetaNATed) {
+		t.Errorf("zero PacketMeta has MetaNATed")
+	}
+	m.Set(MetaNATed)
+	if !m.Has(MetaNATed) || m.Has(MetaNATed|MetaFiltered) {
+		t.Errorf("after Set(MetaNATed): flags %#x", m.Flags)
+	}
+
+	r := m.Reinjected()
+	if !r.Has(MetaNATed|MetaInjected) || r.Generation != 1 {
+		t.Errorf("Reinjected() = %+v", r)
+	}
+	if m.Generation != 0 || m.Has(MetaInjected) {
+		t.Errorf("Reinjected modified its receiver: %+v", m)
+	}
+	r.Generation = 255
+	if g := r.Reinjected().Generation; g != 255 {
+		t.Errorf("generation overflowed to %d", g)
+	}
+
+	// A packet looping back keeps its metadata when decoded again.
+	var q Parsed
+	q.Decode(udpRequestBuffer)
+	m = q.Meta()
+	m.Set(MetaNATed)
+	q.SetMeta(m.Reinjected())
+	q.Decode(udpRequestBuffer)
+	if got := q.Meta(); !got.Has(MetaNATed|MetaInjected) || got.Generation != 1 {
+		t.Errorf("after decoding again: Meta() = %+v", got)
+	}
+	q.SetMeta(q.Meta().Reinjected())
+	q.Decode(udpRequestBuffer)
+	if got := q.Meta(); got.Generation != 2 {
+		t.Errorf("after decoding a third time: Meta() = %+v", got)
+	}
+	if err := DecodeIPOnly(udpRequestBuffer, &q); err != nil || q.Meta().Generation != 2 {
+		t.Errorf("DecodeIPOnly: Meta() = %+v, err %v", q.Meta(), err)
+	}
+
+	q.Reset()
+	if q.Meta() != (PacketMeta{}) {
+		t.Errorf("Reset kept metadata %+v", q.Meta())
+	}
+}
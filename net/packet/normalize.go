@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// NormalizeFlags selects the IPv4 header fields Normalize canonicalizes.
+type NormalizeFlags uint8
+
+const (
+	// NormalizeTOS clears the DSCP and ECN bits.
+	NormalizeTOS NormalizeFlags = 1 << iota
+	// NormalizeIPID zeroes the identification field of unfragmented
+	// packets. Fragments keep theirs, as it ties them together.
+	NormalizeIPID
+	// NormalizeTTL sets the TTL to 64.
+	NormalizeTTL
+
+	// NormalizeAll normalizes every field Normalize knows about.
+	NormalizeAll = NormalizeTOS | NormalizeIPID | NormalizeTTL
+)
+
+// Normalize canonicalizes, in place, the fields of the IPv4 packet in
+// buf that are selected by flags and that can vary between otherwise
+// identical packets, then recomputes the IP header checksum. Two
+// packets differing only in those fields are byte-for-byte equal
+// after normalizing, which makes the result suitable for hashing and
+// de-duplication.
+//
+// None of the normalized fields are covered by transport checksums,
+// so those are left alone.
+func Normalize(buf []byte, flags NormalizeFlags) error {
+	hlen, _, err := checkIP4(buf)
+	if err != nil {
+		return err
+	}
+	if flags&NormalizeTOS != 0 {
+		buf[1] = 0
+	}
+	if flags&NormalizeIPID != 0 {
+		fragFlags := get16(buf[6:8])
+		moreFrags := fragFlags&0x2000 != 0
+		fragOfs := fragFlags & 0x1FFF
+		if !moreFrags && fragOfs == 0 {
+			put16(buf[4:6], 0)
+		}
+	}
+	if flags&NormalizeTTL != 0 {
+		buf[8] = 64
+	}
+	put16(buf[10:12], ChecksumExcluding(buf[:hlen], 10))
+	return nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	// The same datagram, sent twice with different TOS, IPID and TTL.
+	a := append([]byte(nil), udpRequestBuffer...)
+	b := append([]byte(nil), udpRequestBuffer...)
+	b[1] = 0xb8 // DSCP EF
+	put16(b[4:6], 0xbeef)
+	b[8] = 63
+
+	if err := Normalize(a, NormalizeAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := Normalize(b, NormalizeAll); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a, b) {
+		t.Errorf("normalized packets differ: %s", Diff(a, b))
+	}
+	if ipChecksum(a[:20]) != 0 {
+		t.Errorf("IP checksum doesn't verify after Normalize")
+	}
+	if !bytes.Equal(a[20:], udpRequestBuffer[20:]) {
+		t.Errorf("Normalize modified the UDP segment")
+	}
+
+	// Only the selected fields are touched.
+	c := append([]byte(nil), udpRequestBuffer...)
+	c[1] = 0xb8
+	c[8] = 63
+	if err := Normalize(c, NormalizeTTL); err != nil {
+		t.Fatal(err)
+	}
+	if c[1] != 0xb8 || get16(c[4:6]) != 0xdead || c[8] != 64 {
+		t.Errorf("NormalizeTTL: tos=%#x ipid=%#x ttl=%d; want 0xb8, 0xdead, 64", c[1], get16(c[4:6]), c[8])
+	}
+
+	// Fragments keep their IPID.
+	frag := append([]byte(nil), udpRequestBuffer...)
+	frag[6] = 0x20 // MF
+	if err := Normalize(frag, NormalizeIPID); err != nil {
+		t.Fatal(err)
+	}
+	if got := get16(frag[4:6]); got != 0xdead {
+		t.Errorf("fragment IPID = %#x; want 0xdead", got)
+	}
+
+	if err := Normalize(ipv6PacketBuffer[:], NormalizeAll); err == nil {
+		t.Errorf("IPv6: got nil error")
+	}
+}
@@ -7,6 +7,7 @@ package packet
 import (
 	"encoding/binary"
 	"fmt"
+	"math/bits"
 	"strings"
 
 	"tailscale.com/types/strbuilder"
@@ -16,17 +17,23 @@ import (
 const minFrag = 60 + 20 // max IPv4 header + basic TCP header
 
 const (
+	TCPFin    = 0x01
 	TCPSyn    = 0x02
+	TCPRst    = 0x04
+	TCPPsh    = 0x08
 	TCPAck    = 0x10
+	TCPUrg    = 0x20
 	TCPSynAck = TCPSyn | TCPAck
 )
 
 var (
 	get16 = binary.BigEndian.Uint16
 	get32 = binary.BigEndian.Uint32
+	get64 = binary.BigEndian.Uint64
 
 	put16 = binary.BigEndian.PutUint16
 	put32 = binary.BigEndian.PutUint32
+	put64 = binary.BigEndian.PutUint64
 )
 
 // Parsed is a minimal decoding of a packet suitable for use in filters.
@@ -47,14 +54,66 @@ type Parsed struct {
 	IPProto   IP4Proto // IP subprotocol (UDP, TCP, etc); the NextHeader field for IPv6
 	SrcIP     IP4      // IP source address (not used for IPv6)
 	DstIP     IP4      // IP destination address (not used for IPv6)
+	IPID      uint16   // IPv4 identification, for matching up fragments
 	SrcPort   uint16   // TCP/UDP source port
 	DstPort   uint16   // TCP/UDP destination port
 	TCPFlags  uint8    // TCP flags (SYN, ACK, etc)
+	FlowLabel uint32   // IPv6 flow label (low 20 bits); zero for IPv4
+	HopLimit  uint8    // IPv6 hop limit; zero for IPv4
+
+	// TrafficClass is the IPv6 traffic class, which carries DSCP and
+	// ECN like the IPv4 type of service byte; zero for IPv4. See DSCP
+	// and ECN for accessors that work for both.
+	TrafficClass uint8
+
+	// HasIPOptions is whether the IPv4 header carries options (IHL > 5).
+	// It is set regardless of whether the options themselves are valid.
+	HasIPOptions bool
+	// HasSourceRoute is whether the IPv4 options include a loose or
+	// strict source route (LSRR or SSRR).
+	HasSourceRoute bool
+	// TransportSkipped is whether q was decoded by DecodeIPOnly, so
+	// that its transport fields (ports, TCP flags) are zero rather
+	// than decoded. Call q.Decode(q.Buffer()) to decode them.
+	TransportSkipped bool
+
+	// meta is out-of-band metadata about the packet, which Decode
+	// keeps. See Meta and SetMeta.
+	meta PacketMeta
 }
 
 // NextHeader
 type NextHeader uint8
 
+// ProtoName returns the name of q's protocol, such as "TCP", or its
+// number, such as "IPProto(47)", if the package doesn't know it.
+// For IPv6, it names the upper-layer protocol that follows any
+// extension headers, rather than the first next header value.
+func (q *Parsed) ProtoName() string {
+	if q.IPVersion == 6 {
+		proto, _ := ip6UpperProto(q.b)
+		return proto.String()
+	}
+	if q.IPProto == Unknown {
+		return q.RawIPProto().String()
+	}
+	return q.IPProto.String()
+}
+
+// RawIPProto returns the protocol field of q's IPv4 header, or the
+// next header field of its IPv6 header. Unlike q.IPProto, it keeps
+// the values of protocols Decode doesn't support, rather than mapping
+// them to Unknown. It returns Unknown if q is not an IP packet.
+func (q *Parsed) RawIPProto() IP4Proto {
+	switch q.IPVersion {
+	case 4:
+		return IP4Proto(q.b[9])
+	case 6:
+		return IP4Proto(q.b[6])
+	}
+	return Unknown
+}
+
 func (p *Parsed) String() string {
 	if p.IPVersion == 6 {
 		return fmt.Sprintf("IPv6{Proto=%d}", p.IPProto)
@@ -86,65 +145,198 @@ func writeIPPort(sb *strbuilder.Builder, ip IP4, port uint16) {
 }
 
 // based on https://tools.ietf.org/html/rfc1071
+//
+// It sums 32-bit words into a 64-bit accumulator and only folds the
+// carries back into 16 bits at the end. Since 2^16 ≡ 1 (mod 2^16-1),
+// this gives the same one's complement sum as adding 16-bit words, in
+// fewer, cheaper iterations.
 func ipChecksum(b []byte) uint16 {
-	var ac uint32
-	i := 0
-	n := len(b)
-	for n >= 2 {
-		ac += uint32(get16(b[i : i+2]))
-		n -= 2
-		i += 2
+	return ^foldChecksum(checksumSum(b))
+}
+
+// ChecksumExcluding returns the RFC 1071 checksum of buf as if the
+// 16-bit field at fieldOff were zero, without modifying buf. The
+// result is what a sender would store in that field, so a checksum
+// at fieldOff verifies if it equals the returned value.
+// fieldOff may be odd; buf[fieldOff:fieldOff+2] must be within buf.
+func ChecksumExcluding(buf []byte, fieldOff int) uint16 {
+	rest := buf[fieldOff+2:]
+	ac := checksumSum(buf[:fieldOff])
+	if fieldOff%2 == 0 {
+		ac += checksumSum(rest)
+	} else {
+		// rest starts in the middle of a 16-bit word, so its sum
+		// comes out byte-swapped (RFC 1071 section 2(B)).
+		ac += uint64(bits.ReverseBytes16(foldChecksum(checksumSum(rest))))
 	}
-	if n == 1 {
-		ac += uint32(b[i]) << 8
+	return ^foldChecksum(ac)
+}
+
+// checksumSum returns the one's complement sum of b, without the
+// final folding into 16 bits. A trailing odd byte is treated as the
+// high byte of a 16-bit word.
+func checksumSum(b []byte) uint64 {
+	var ac uint64
+	for len(b) >= 16 {
+		ac += uint64(get32(b[0:4])) + uint64(get32(b[4:8])) +
+			uint64(get32(b[8:12])) + uint64(get32(b[12:16]))
+		b = b[16:]
+	}
+	for len(b) >= 4 {
+		ac += uint64(get32(b[0:4]))
+		b = b[4:]
+	}
+	if len(b) >= 2 {
+		ac += uint64(get16(b[0:2]))
+		b = b[2:]
 	}
+	if len(b) == 1 {
+		ac += uint64(b[0]) << 8
+	}
+	return ac
+}
+
+// foldChecksum folds the carries of a checksumSum back into 16 bits.
+func foldChecksum(ac uint64) uint16 {
 	for (ac >> 16) > 0 {
 		ac = (ac >> 16) + (ac & 0xffff)
 	}
-	return uint16(^ac)
+	return uint16(ac)
+}
+
+// updateChecksum returns the checksum csum, updated for a 16-bit word
+// it covers changing from old to new, without resumming the data.
+// It uses equation 3 of https://tools.ietf.org/html/rfc1624.
+func updateChecksum(csum, old, new uint16) uint16 {
+	ac := uint32(^csum) + uint32(^old) + uint32(new)
+	ac = (ac >> 16) + (ac & 0xffff)
+	ac = (ac >> 16) + (ac & 0xffff)
+	return ^uint16(ac)
+}
+
+// IPVersion returns the IP version of the packet in buf, 4 or 6, from
+// the top nibble of its first byte. It returns 0 if the version is
+// neither, or if buf is too short to hold the fixed IP header of that
+// version.
+//
+// IPVersion expects the IP header at the start of buf and only looks
+// at the version nibble, so a buffer that starts with a link-layer
+// header, such as an Ethernet frame, can be misreported. Use DecodeAt
+// for packets inside a larger frame.
+func IPVersion(buf []byte) int {
+	if len(buf) == 0 {
+		return 0
+	}
+	switch buf[0] >> 4 {
+	case 4:
+		if len(buf) >= ipHeaderLength {
+			return 4
+		}
+	case 6:
+		if len(buf) >= ip6HeaderLength {
+			return 6
+		}
+	}
+	return 0
 }
 
 // Decode extracts data from the packet in b into q.
 // It performs extremely simple packet decoding for basic IPv4 packet types.
 // It extracts only the subprotocol id, IP addresses, and (if any) ports,
 // and shouldn't need any memory allocation.
+//
+// Decode overwrites every field of q except its metadata, which stays
+// attached so that a packet re-decoded after being rewritten or
+// re-injected is still recognized (see Meta). So a single Parsed can be
+// reused across packets without state from one leaking into the next,
+// as long as its metadata is cleared with Reset or SetMeta for each new
+// packet.
 func (q *Parsed) Decode(b []byte) {
-	q.b = b
+	q.decode(b, false)
+}
 
-	if len(b) < ipHeaderLength {
-		q.IPVersion = 0
-		q.IPProto = Unknown
-		return
-	}
+// DecodeGSO decodes b into q like Decode, except that an IPv4 packet
+// whose total length field is zero is taken to be len(b) bytes long,
+// rather than rejected as shorter than its own header. Linux leaves
+// the field zero in TCP packets handed to a TUN device with
+// segmentation offload when they are too large for it to hold (BIG
+// TCP), implying the length from the buffer instead.
+//
+// Only that exact case is affected: any other total length is checked
+// as usual, and the rest of the IPv4 header must still be valid and fit
+// in b. IPv6 packets decode as with Decode. Callers
+// should only use DecodeGSO for packets read from a device with
+// offloads enabled, since elsewhere a zero total length means a
+// malformed packet.
+func DecodeGSO(b []byte, q *Parsed) {
+	q.decode(b, true)
+}
 
-	// Check that it's IPv4.
-	// TODO(apenwarr): consider IPv6 support
-	q.IPVersion = (b[0] & 0xF0) >> 4
+// decode implements Decode and DecodeGSO. impliedLength is whether a
+// zero IPv4 total length means len(b).
+func (q *Parsed) decode(b []byte, impliedLength bool) {
+	*q = Parsed{b: b, meta: q.meta}
+
+	q.IPVersion = uint8(IPVersion(b))
 	switch q.IPVersion {
 	case 4:
 		q.IPProto = IP4Proto(b[9])
+		q.HasIPOptions = b[0]&0x0F > ipHeaderLength>>2
 	case 6:
 		q.IPProto = IP4Proto(b[6]) // "Next Header" field
+		q.TrafficClass = uint8(get32(b[0:4]) >> 20)
+		q.FlowLabel = get32(b[0:4]) & 0xfffff
+		q.HopLimit = b[7]
 		return
 	default:
-		q.IPVersion = 0
 		q.IPProto = Unknown
 		return
 	}
 
-	q.length = int(get16(b[2:4]))
-	if len(b) < q.length {
-		// Packet was cut off before full IPv4 length.
-		q.IPProto = Unknown
-		return
+	var hlen, length int
+	if b[0]&0x0F == ipHeaderLength>>2 {
+		// Fast path for the usual 20-byte header, which is known to
+		// fit in b, so only the total length needs checking.
+		// It must accept exactly what checkIP4 does.
+		hlen, length = ipHeaderLength, int(get16(b[2:4]))
+		if length == 0 && impliedLength {
+			length = len(b)
+		}
+		if length < ipHeaderLength || length > len(b) {
+			q.IPProto = Unknown
+			return
+		}
+	} else {
+		var err error
+		if get16(b[2:4]) == 0 && impliedLength {
+			var ok bool
+			if hlen, ok = IHL(b); !ok {
+				q.IPProto = Unknown
+				return
+			}
+			length = len(b)
+		} else {
+			hlen, length, err = checkIP4(b)
+		}
+		if err != nil {
+			// Packet was cut off before full IPv4 length,
+			// or its length fields are inconsistent.
+			q.IPProto = Unknown
+			return
+		}
+		if q.HasIPOptions {
+			q.HasSourceRoute = hasSourceRoute(b[ipHeaderLength:hlen])
+		}
 	}
+	q.length = length
 
 	// If it's valid IPv4, then the IP addresses are valid
 	q.SrcIP = IP4(get32(b[12:16]))
 	q.DstIP = IP4(get32(b[16:20]))
+	q.IPID = get16(b[4:6])
 
-	q.subofs = int((b[0] & 0x0F) << 2)
-	sub := b[q.subofs:]
+	q.subofs = hlen
+	sub := b[q.subofs:q.length]
 
 	// We don't care much about IP fragmentation, except insofar as it's
 	// used for firewall bypass attacks. The trick is make the first
@@ -201,6 +393,34 @@ func (q *Parsed) Decode(b []byte) {
 			q.DstPort = get16(sub[2:4])
 			q.dataofs = q.subofs + udpHeaderLength
 			return
+		case VRRP:
+			if len(sub) < vrrpHeaderLength {
+				q.IPProto = Unknown
+				return
+			}
+			q.dataofs = q.subofs + vrrpHeaderLength
+			return
+		case ESP:
+			if len(sub) < espHeaderLength {
+				q.IPProto = Unknown
+				return
+			}
+			q.dataofs = q.subofs + espHeaderLength
+			return
+		case AH:
+			if len(sub) < ahMinHeaderLength || len(sub) < ahHeaderLength(sub) {
+				q.IPProto = Unknown
+				return
+			}
+			q.dataofs = q.subofs + ahHeaderLength(sub)
+			return
+		case PIM:
+			if len(sub) < pimHeaderLength {
+				q.IPProto = Unknown
+				return
+			}
+			q.dataofs = q.subofs + pimHeaderLength
+			return
 		default:
 			q.IPProto = Unknown
 			return
@@ -224,10 +444,189 @@ func (q *Parsed) Decode(b []byte) {
 	}
 }
 
+// FiveTuple extracts the addresses, protocol and ports of the IPv4
+// packet in b without decoding anything else. It is a cheaper
+// alternative to Decode for callers, such as flow hashing, that need
+// nothing more.
+//
+// Ports are zero for protocols other than TCP and UDP, and for
+// fragments other than the first, whose protocol is reported as
+// Fragment. ok is false if b is too short to hold those fields.
+func FiveTuple(b []byte) (src, dst IP4, proto IP4Proto, srcPort, dstPort uint16, ok bool) {
+	if len(b) < ipHeaderLength || b[0]>>4 != 4 {
+		return 0, 0, Unknown, 0, 0, false
+	}
+	src = IP4(get32(b[12:16]))
+	dst = IP4(get32(b[16:20]))
+	proto = IP4Proto(b[9])
+	if get16(b[6:8])&0x1FFF != 0 {
+		return src, dst, Fragment, 0, 0, true
+	}
+	switch proto {
+	case TCP, UDP:
+		ofs := int(b[0]&0x0F) << 2
+		if len(b) < ofs+4 {
+			return 0, 0, Unknown, 0, 0, false
+		}
+		srcPort = get16(b[ofs : ofs+2])
+		dstPort = get16(b[ofs+2 : ofs+4])
+	}
+	return src, dst, proto, srcPort, dstPort, true
+}
+
+// DecodeAt decodes the packet starting at offset off of buf into q,
+// as q.Decode(buf[off:]) would. It is meant for packets that sit
+// inside a larger frame, such as after a 14-byte Ethernet header.
+//
+// Unlike Decode, DecodeAt returns an error if buf doesn't hold a valid
+// IPv4 or IPv6 header at off. Offsets in a returned *ParseError are
+// relative to the start of buf, not to off.
+func DecodeAt(buf []byte, off int, q *Parsed) error {
+	if off < 0 || off > len(buf) {
+		q.Decode(nil)
+		return ErrSmallBuffer
+	}
+	b := buf[off:]
+	q.Decode(b)
+
+	var err error
+	if len(b) > 0 && b[0]>>4 == 6 {
+		_, err = checkIP6(b)
+	} else {
+		_, _, err = checkIP4(b)
+	}
+	if perr, ok := err.(*ParseError); ok {
+		perr.Offset += off
+	}
+	return err
+}
+
+// DecodeBatch decodes the packets in bufs into out, as out[i].Decode(bufs[i])
+// would, for callers that read several packets at once. It reuses the
+// Parsed values in out, keeping their metadata as Decode does, and
+// doesn't allocate. Like Decode, it marks malformed packets Unknown
+// rather than stopping at them.
+//
+// It returns the number of packets decoded. If out is shorter than
+// bufs, that is len(out), and the caller can decode the rest with
+// bufs[n:].
+func DecodeBatch(bufs [][]byte, out []Parsed) int {
+	if len(out) < len(bufs) {
+		bufs = bufs[:len(out)]
+	}
+	for i, b := range bufs {
+		out[i].Decode(b)
+	}
+	return len(bufs)
+}
+
+// DecodeIPOnly decodes only the IP header of the packet in b into q,
+// for callers such as routing that need nothing past the addresses and
+// protocol. It sets q.TransportSkipped and leaves the transport fields
+// zero. For IPv4, q.Payload returns the whole IP payload. Accessors for
+// transport headers, such as TCPHeader, ICMPHeader and VRRPHeader,
+// return their zero value or report false, since the headers haven't
+// been checked.
+//
+// q.IPProto is the protocol declared by the IPv4 header, or the next
+// header field of the IPv6 header. Unlike with Decode, it isn't mapped
+// to Unknown for unsupported protocols or truncated transport headers,
+// nor to Fragment for fragments other than the first.
+//
+// Like DecodeAt, DecodeIPOnly returns an error if b doesn't start with
+// a valid IPv4 or IPv6 header, in which case q.IPProto is Unknown.
+func DecodeIPOnly(b []byte, q *Parsed) error {
+	*q = Parsed{b: b, TransportSkipped: true, meta: q.meta}
+	switch IPVersion(b) {
+	case 4:
+		q.IPVersion = 4
+		hlen, length, err := checkIP4(b)
+		if err != nil {
+			return err
+		}
+		q.IPProto = IP4Proto(b[9])
+		q.HasIPOptions = hlen > ipHeaderLength
+		if q.HasIPOptions {
+			q.HasSourceRoute = hasSourceRoute(b[ipHeaderLength:hlen])
+		}
+		q.length = length
+		q.SrcIP = IP4(get32(b[12:16]))
+		q.DstIP = IP4(get32(b[16:20]))
+		q.IPID = get16(b[4:6])
+		q.subofs = hlen
+		q.dataofs = hlen
+		return nil
+	case 6:
+		q.IPVersion = 6
+		if _, err := checkIP6(b); err != nil {
+			return err
+		}
+		q.IPProto = IP4Proto(b[6])
+		q.TrafficClass = uint8(get32(b[0:4]) >> 20)
+		q.FlowLabel = get32(b[0:4]) & 0xfffff
+		q.HopLimit = b[7]
+		return nil
+	}
+	_, _, err := checkIP4(b)
+	return err
+}
+
+// DecodeStrict decodes b into q like Decode, but returns an error if
+// the length fields in the packet disagree with each other or with
+// len(b), instead of trusting one of them. Specifically, the IPv4
+// total length (or IPv6 payload length) must describe exactly len(b)
+// bytes, with no trailing bytes, and the UDP length of an unfragmented
+// UDP datagram must match the IP payload length.
+//
+// On error, q.IPProto is set to Unknown. DecodeStrict is meant for
+// callers that must not interpret a packet differently than another
+// stack might, such as an IDS.
+func DecodeStrict(b []byte, q *Parsed) error {
+	q.Decode(b)
+	err := checkStrictLengths(b)
+	if err != nil {
+		q.IPProto = Unknown
+	}
+	return err
+}
+
+func checkStrictLengths(b []byte) error {
+	if len(b) > 0 && b[0]>>4 == 6 {
+		length, err := checkIP6(b)
+		if err != nil {
+			return err
+		}
+		if length != len(b) {
+			return &ParseError{Field: "PayloadLength", Offset: 4, Value: length - ip6HeaderLength, Reason: fmt.Sprintf("!= %d available", len(b)-ip6HeaderLength)}
+		}
+		return nil
+	}
+
+	hlen, length, err := checkIP4(b)
+	if err != nil {
+		return err
+	}
+	if length != len(b) {
+		return &ParseError{Field: "TotalLength", Offset: 2, Value: length, Reason: fmt.Sprintf("!= buffer length (%d)", len(b))}
+	}
+	fragFlags := get16(b[6:8])
+	if IP4Proto(b[9]) == UDP && fragFlags&0x3FFF == 0 && length >= hlen+udpHeaderLength {
+		if ulen := int(get16(b[hlen+4 : hlen+6])); ulen != length-hlen {
+			return &ParseError{Field: "UDPLength", Offset: hlen + 4, Value: ulen, Reason: fmt.Sprintf("!= IP payload length (%d)", length-hlen)}
+		}
+	}
+	return nil
+}
+
+// Reset clears q, including its metadata, releasing its reference to
+// the last decoded buffer.
+func (q *Parsed) Reset() {
+	*q = Parsed{}
+}
+
 func (q *Parsed) IPHeader() IP4Header {
-	ipid := get16(q.b[4:6])
 	return IP4Header{
-		IPID:    ipid,
+		IPID:    q.IPID,
 		IPProto: q.IPProto,
 		SrcIP:   q.SrcIP,
 		DstIP:   q.DstIP,
@@ -235,6 +634,9 @@ func (q *Parsed) IPHeader() IP4Header {
 }
 
 func (q *Parsed) ICMPHeader() ICMP4Header {
+	if q.TransportSkipped {
+		return ICMP4Header{IP4Header: q.IPHeader()}
+	}
 	return ICMP4Header{
 		IP4Header: q.IPHeader(),
 		Type:      ICMP4Type(q.b[q.subofs+0]),
@@ -242,6 +644,41 @@ func (q *Parsed) ICMPHeader() ICMP4Header {
 	}
 }
 
+// ICMP4RestOfHeader returns the second 32-bit word of q's ICMP header,
+// which follows the type, code and checksum (bytes 24-27 of a packet
+// without IP options). How to interpret it depends on the ICMP type
+// and code: echo messages carry their identifier and sequence number
+// there, redirects a gateway address, "fragmentation needed" errors
+// the next-hop MTU in the low 16 bits, and parameter problems a
+// pointer in the high byte. For other errors it is usually zero.
+// It returns 0 if q is not ICMP or is too short to hold the word.
+func (q *Parsed) ICMP4RestOfHeader() uint32 {
+	if q.IPProto != ICMP || q.TransportSkipped || q.length < q.subofs+8 {
+		return 0
+	}
+	return get32(q.b[q.subofs+4 : q.subofs+8])
+}
+
+func (q *Parsed) TCPHeader() TCP4Header {
+	if q.TransportSkipped {
+		return TCP4Header{IP4Header: q.IPHeader()}
+	}
+	sub := q.b[q.subofs:]
+	h := TCP4Header{
+		IP4Header: q.IPHeader(),
+		SrcPort:   q.SrcPort,
+		DstPort:   q.DstPort,
+		Seq:       get32(sub[4:8]),
+		Ack:       get32(sub[8:12]),
+		Flags:     q.TCPFlags,
+		Window:    get16(sub[14:16]),
+	}
+	if q.HasUrgent() {
+		h.Urgent = get16(sub[18:20])
+	}
+	return h
+}
+
 func (q *Parsed) UDPHeader() UDP4Header {
 	return UDP4Header{
 		IP4Header: q.IPHeader(),
@@ -256,6 +693,28 @@ func (q *Parsed) Buffer() []byte {
 	return q.b
 }
 
+// IPHeaderBytes returns the full IPv4 header of the packet, including
+// any options, exactly as it appeared on the wire. It returns nil if q
+// is not a valid IPv4 packet.
+// The returned slice aliases the decoded buffer; that is, q retains
+// the ownership of the buffer, and modifying it modifies the packet.
+func (q *Parsed) IPHeaderBytes() []byte {
+	if q.IPVersion != 4 || q.subofs == 0 {
+		return nil
+	}
+	return q.b[:q.subofs]
+}
+
+// IPHeaderLen returns the length in bytes of q's IPv4 header, including
+// any options, as IHL computes it. Unlike HeaderLen, it doesn't count
+// the transport header. It returns 0 if q is not a valid IPv4 packet.
+func (q *Parsed) IPHeaderLen() int {
+	if q.IPVersion != 4 {
+		return 0
+	}
+	return q.subofs
+}
+
 // Sub returns the IP subprotocol section.
 // This is a read-only view; that is, q retains the ownership of the buffer.
 func (q *Parsed) Sub(begin, n int) []byte {
@@ -264,10 +723,168 @@ func (q *Parsed) Sub(begin, n int) []byte {
 
 // Payload returns the payload of the IP subprotocol section.
 // This is a read-only view; that is, q retains the ownership of the buffer.
+// It is empty if the subprotocol header claims to extend past the end
+// of the packet.
 func (q *Parsed) Payload() []byte {
+	if q.dataofs > q.length {
+		return nil
+	}
 	return q.b[q.dataofs:q.length]
 }
 
+// TransportConsistent reports whether q's IP payload is long enough
+// to hold the fixed transport header of the protocol its IP header
+// declares: 20 bytes for TCP, 8 for UDP, ICMP, ICMPv6, IGMP, VRRP and
+// ESP, 4 for PIM, and 12 plus the authentication data for AH. It looks
+// at the declared protocol even if Decode mapped it to Unknown, so it
+// catches a packet claiming to be TCP with only a UDP-sized header.
+//
+// Protocols without a known header size, and fragments other than the
+// first, which carry no transport header, are consistent. Packets that
+// aren't valid IP, or whose IPv6 extension headers can't be followed,
+// are not.
+func (q *Parsed) TransportConsistent() bool {
+	var proto IP4Proto
+	var seg []byte
+	switch q.IPVersion {
+	case 4:
+		hlen, length, err := checkIP4(q.b)
+		if err != nil {
+			return false
+		}
+		if get16(q.b[6:8])&ip4FragOffsetMask != 0 {
+			return true
+		}
+		proto, seg = IP4Proto(q.b[9]), q.b[hlen:length]
+	case 6:
+		length, err := checkIP6(q.b)
+		if err != nil {
+			return false
+		}
+		var off int
+		proto, off = ip6UpperProto(q.b[:length])
+		switch proto {
+		case Fragment:
+			return true
+		case Unknown:
+			return false
+		}
+		seg = q.b[off:length]
+	default:
+		return false
+	}
+	switch proto {
+	case TCP:
+		return len(seg) >= tcpHeaderLength
+	case UDP, ICMP, ICMPv6, IGMP, VRRP, ESP:
+		return len(seg) >= 8
+	case AH:
+		return len(seg) >= ahMinHeaderLength && len(seg) >= ahHeaderLength(seg)
+	case PIM:
+		return len(seg) >= pimHeaderLength
+	}
+	return true
+}
+
+// TransportChecksumOffset returns the offset in q's buffer of the
+// checksum field of its TCP, UDP, ICMP or ICMPv6 header, past any IPv4
+// options or IPv6 extension headers, for callers that update the
+// checksum themselves after changing the packet. ok is false for other
+// protocols, for fragments other than the first, if the checksum field
+// lies past the end of the packet, and if q was decoded by DecodeIPOnly.
+func (q *Parsed) TransportChecksumOffset() (_ int, ok bool) {
+	if q.TransportSkipped {
+		return 0, false
+	}
+	var sub, length int
+	var proto IP4Proto
+	switch q.IPVersion {
+	case 4:
+		if q.subofs == 0 {
+			return 0, false
+		}
+		sub, length, proto = q.subofs, q.length, q.IPProto
+	case 6:
+		l, err := checkIP6(q.b)
+		if err != nil {
+			return 0, false
+		}
+		length = l
+		proto, sub = ip6UpperProto(q.b[:length])
+	default:
+		return 0, false
+	}
+	var ofs int
+	switch proto {
+	case TCP, UDP, ICMP:
+		ofs, _ = transportChecksumOffset(proto)
+	case ICMPv6:
+		ofs = 2
+	default:
+		return 0, false
+	}
+	if sub+ofs+2 > length {
+		return 0, false
+	}
+	return sub + ofs, true
+}
+
+// HeaderLen returns the total length of q's IP and transport headers,
+// including IP extension headers and IPv4 or TCP options: the offset
+// of the application data in the packet. ICMP messages are counted as
+// having an 8-byte header, including the identifier and sequence
+// number of echo messages or the type-specific word of errors, which
+// Payload includes. For other protocols only the IP headers are
+// counted. HeaderLen is never more than the packet length, and is 0
+// if q couldn't be decoded or was decoded by DecodeIPOnly.
+func (q *Parsed) HeaderLen() int {
+	if q.TransportSkipped {
+		return 0
+	}
+	var n, length int
+	var proto IP4Proto
+	switch q.IPVersion {
+	case 4:
+		if q.IPProto == Unknown || q.subofs == 0 {
+			return 0
+		}
+		n, length, proto = q.subofs, q.length, q.IPProto
+	case 6:
+		l, err := checkIP6(q.b)
+		if err != nil {
+			return 0
+		}
+		length = l
+		proto, n = ip6UpperProto(q.b[:length])
+		switch proto {
+		case Unknown:
+			return 0
+		case Fragment:
+			_, fragOff, _, ok := ip6FragmentHeader(q.b[:length])
+			if !ok {
+				return 0
+			}
+			n = fragOff + 8
+		}
+	default:
+		return 0
+	}
+	switch proto {
+	case TCP:
+		if n+tcpHeaderLength <= length {
+			n += int(q.b[n+12]>>4) << 2
+		}
+	case UDP:
+		n += udpHeaderLength
+	case ICMP, ICMPv6:
+		n += 8
+	}
+	if n > length {
+		n = length
+	}
+	return n
+}
+
 // Trim trims the buffer to its IPv4 length.
 // Sometimes packets arrive from an interface with extra bytes on the end.
 // This removes them.
@@ -275,15 +892,279 @@ func (q *Parsed) Trim() []byte {
 	return q.b[:q.length]
 }
 
+// HasValidPorts reports whether q's SrcPort and DstPort were read from
+// a transport header: that is, whether q is a TCP or UDP packet (or
+// first fragment) that holds at least the four bytes of ports.
+// For all other packets Decode leaves the ports zero.
+// SCTP is not decoded, so SCTP packets report false.
+func (q *Parsed) HasValidPorts() bool {
+	return (q.IPProto == TCP || q.IPProto == UDP) && !q.TransportSkipped && q.length >= q.subofs+4
+}
+
+// TCPPayloadLen returns the number of data bytes in the TCP segment
+// q: the IP total length, minus the IP header including options
+// (IHL*4), minus the TCP header including options (data offset*4).
+// It returns 0 if q is not TCP, or if its data offset is out of range.
+func (q *Parsed) TCPPayloadLen() int {
+	if q.IPProto != TCP || q.dataofs < q.subofs+tcpHeaderLength || q.dataofs > q.length {
+		return 0
+	}
+	return q.length - q.dataofs
+}
+
+// IsTCPData reports whether q is a TCP segment carrying data, rather
+// than pure control such as a bare ACK, SYN or FIN.
+func (q *Parsed) IsTCPData() bool {
+	return q.TCPPayloadLen() > 0
+}
+
 // IsTCPSyn reports whether q is a TCP SYN packet
 // (i.e. the first packet in a new connection).
 func (q *Parsed) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
+// IsTCPFin reports whether q is a TCP FIN packet
+// (i.e. the sender has finished sending on the connection).
+func (q *Parsed) IsTCPFin() bool {
+	return q.IPProto == TCP && (q.TCPFlags&TCPFin) != 0
+}
+
+// IsTCPRst reports whether q is a TCP RST packet
+// (i.e. the connection is being aborted).
+func (q *Parsed) IsTCPRst() bool {
+	return q.IPProto == TCP && (q.TCPFlags&TCPRst) != 0
+}
+
+// HasUrgent reports whether q is a TCP packet carrying urgent data
+// (i.e. with the URG flag set).
+func (q *Parsed) HasUrgent() bool {
+	return q.IPProto == TCP && (q.TCPFlags&TCPUrg) != 0
+}
+
+// IsTCPFlagsAnomalous reports whether q is a TCP packet whose flags no
+// conforming TCP stack sends, and which port scanners and evasion
+// tools use to probe systems. The combinations are:
+//
+//   - NULL: no flags at all.
+//   - FIN without ACK. Every segment after the initial SYN must have
+//     ACK set, so this covers FIN scans and XMAS scans (FIN+PSH+URG).
+//   - SYN+FIN, which both opens and closes a connection.
+//   - SYN+RST and FIN+RST, which abort a connection while opening or
+//     closing it.
+func (q *Parsed) IsTCPFlagsAnomalous() bool {
+	if q.IPProto != TCP || q.TransportSkipped {
+		return false
+	}
+	f := q.TCPFlags
+	switch {
+	case f == 0:
+		return true
+	case f&TCPFin != 0 && f&TCPAck == 0:
+		return true
+	case f&(TCPSyn|TCPFin) == TCPSyn|TCPFin:
+		return true
+	case f&(TCPSyn|TCPRst) == TCPSyn|TCPRst:
+		return true
+	case f&(TCPFin|TCPRst) == TCPFin|TCPRst:
+		return true
+	}
+	return false
+}
+
+// ClearDF clears the "don't fragment" bit in the header of the IPv4
+// packet buf that q was decoded from, allowing it to be fragmented
+// downstream. The header checksum is updated incrementally.
+// It does nothing if q is not IPv4 or DF is already clear.
+func (q *Parsed) ClearDF(buf []byte) {
+	if q.IPVersion != 4 || len(buf) < ipHeaderLength {
+		return
+	}
+	setIP4Word(buf, 6, get16(buf[6:8])&^ip4FlagDF)
+}
+
+// SetDF sets the "don't fragment" bit, as ClearDF clears it.
+func (q *Parsed) SetDF(buf []byte) {
+	if q.IPVersion != 4 || len(buf) < ipHeaderLength {
+		return
+	}
+	setIP4Word(buf, 6, get16(buf[6:8])|ip4FlagDF)
+}
+
+// SwapAddresses swaps the source and destination addresses in the
+// header of the packet buf that q was decoded from, leaving ports and
+// payload alone, and swaps q.SrcIP and q.DstIP to match.
+//
+// No checksum needs updating: the IPv4 header checksum and the
+// transport pseudo-header checksums are sums, which don't change when
+// two of their terms are exchanged. It does nothing if q is neither
+// IPv4 nor IPv6.
+func (q *Parsed) SwapAddresses(buf []byte) {
+	switch q.IPVersion {
+	case 4:
+		if len(buf) < ipHeaderLength {
+			return
+		}
+		put32(buf[12:16], uint32(q.DstIP))
+		put32(buf[16:20], uint32(q.SrcIP))
+		q.SrcIP, q.DstIP = q.DstIP, q.SrcIP
+	case 6:
+		if len(buf) < ip6HeaderLength {
+			return
+		}
+		var tmp [16]byte
+		copy(tmp[:], buf[8:24])
+		copy(buf[8:24], buf[24:40])
+		copy(buf[24:40], tmp[:])
+	}
+}
+
+// FixIPChecksum recomputes the header checksum of the IPv4 packet buf
+// that q was decoded from, over its full IHL-length header, and
+// stores it. Unlike ClearDF and SetDF it doesn't trust the existing
+// checksum, so it repairs headers whose checksum was zeroed or left to
+// offload. It does nothing if q is not IPv4 or the header doesn't fit
+// in buf.
+func (q *Parsed) FixIPChecksum(buf []byte) {
+	if q.IPVersion != 4 || len(buf) < ipHeaderLength {
+		return
+	}
+	hlen := int(buf[0]&0x0F) << 2
+	if hlen < ipHeaderLength || hlen > len(buf) {
+		return
+	}
+	put16(buf[10:12], ChecksumExcluding(buf[:hlen], 10))
+}
+
+// FinalizeChecksums recomputes from scratch the IPv4 header checksum
+// and the TCP, UDP, ICMP or ICMPv6 checksum of the packet in buf, for
+// callers that made edits too involved to track incrementally, such as
+// rewriting addresses and payload together. buf is usually the buffer
+// q was decoded from; the checksums are computed from its current
+// contents, including its addresses and length fields, not from q.
+//
+// A UDP checksum that computes to zero is sent as 0xffff, since zero
+// means no checksum. Fragments only get their IPv4 header checksum
+// fixed: their transport checksum covers data in other fragments.
+// Packets of other protocols are left alone past the IP header. It
+// returns an error if buf doesn't hold a valid IP header, or holds too
+// little of its transport header to include the checksum.
+func (q *Parsed) FinalizeChecksums(buf []byte) error {
+	var seg []byte
+	var proto IP4Proto
+	var pseudo uint64
+	if len(buf) > 0 && buf[0]>>4 == 6 {
+		length, err := checkIP6(buf)
+		if err != nil {
+			return err
+		}
+		if _, _, _, ok := ip6FragmentHeader(buf[:length]); ok {
+			return nil
+		}
+		var off int
+		proto, off = ip6UpperProto(buf[:length])
+		if off == 0 {
+			return nil
+		}
+		seg = buf[off:length]
+		pseudo = pseudoSum6(ip6FromBytes(buf[8:24]), ip6FromBytes(buf[24:40]), proto, uint32(len(seg)))
+	} else {
+		hlen, length, err := checkIP4(buf)
+		if err != nil {
+			return err
+		}
+		put16(buf[10:12], ChecksumExcluding(buf[:hlen], 10))
+		if get16(buf[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+			return nil
+		}
+		seg, proto = buf[hlen:length], IP4Proto(buf[9])
+		if proto != ICMP {
+			pseudo = pseudoSum4(IP4(get32(buf[12:16])), IP4(get32(buf[16:20])), proto, len(seg))
+		}
+	}
+
+	var ofs int
+	switch proto {
+	case TCP, UDP, ICMP:
+		ofs, _ = transportChecksumOffset(proto)
+	case ICMPv6:
+		ofs = 2
+	default:
+		return nil
+	}
+	if len(seg) < ofs+2 {
+		return ErrSmallBuffer
+	}
+	put16(seg[ofs:ofs+2], 0)
+	csum := ^foldChecksum(checksumSum(seg) + pseudo)
+	if proto == UDP {
+		csum = udpChecksum(csum)
+	}
+	put16(seg[ofs:ofs+2], csum)
+	return nil
+}
+
+// ip4AllHosts is 224.0.0.1, the all-hosts multicast group
+// (RFC 1112) that every multicast-capable host is a member of.
+const ip4AllHosts = IP4(0xe0000001)
+
+// IsForLocalIP reports whether the IPv4 packet q is destined to this
+// host rather than to be forwarded: its destination is one that local
+// reports as a local address, the limited broadcast address, or the
+// all-hosts multicast group. A PrefixSet's Contains method can serve
+// as local. It returns false for non-IPv4 packets.
+func (q *Parsed) IsForLocalIP(local func(IP4) bool) bool {
+	if q.IPVersion != 4 {
+		return false
+	}
+	return q.DstIP.IsBroadcast() || q.DstIP == ip4AllHosts || local(q.DstIP)
+}
+
+// DecrementHopLimit decrements the hop limit of the IPv6 packet buf
+// that q was decoded from, as a router does when forwarding it, and
+// updates q.HopLimit to match. IPv6 has no header checksum, and the
+// hop limit isn't part of the transport pseudo-header, so no checksum
+// needs updating.
+//
+// It returns false, leaving buf unchanged, if the hop limit is 1 or
+// less and the packet must not be forwarded; the caller should send
+// an ICMPv6 Time Exceeded instead. It also returns false if q is not
+// IPv6.
+func (q *Parsed) DecrementHopLimit(buf []byte) bool {
+	if q.IPVersion != 6 || len(buf) < ip6HeaderLength || buf[7] <= 1 {
+		return false
+	}
+	buf[7]--
+	q.HopLimit = buf[7]
+	return true
+}
+
+// ClampTTL lowers the TTL of the IPv4 packet buf that q was decoded
+// from, or the hop limit of an IPv6 one, to max if it is higher, as a
+// policy cap on how far forwarded packets may go. Unlike decrementing,
+// it leaves packets already at or below max untouched. The IPv4
+// header checksum is updated incrementally; for IPv6, q.HopLimit is
+// updated to match.
+func (q *Parsed) ClampTTL(max uint8, buf []byte) {
+	switch q.IPVersion {
+	case 4:
+		if len(buf) < ipHeaderLength || buf[8] <= max {
+			return
+		}
+		// The TTL shares a checksummed word with the protocol.
+		setIP4Word(buf, 8, uint16(max)<<8|uint16(buf[9]))
+	case 6:
+		if len(buf) < ip6HeaderLength || buf[7] <= max {
+			return
+		}
+		buf[7] = max
+		q.HopLimit = max
+	}
+}
+
 // IsError reports whether q is an IPv4 ICMP "Error" packet.
 func (q *Parsed) IsError() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if q.IPProto == ICMP && !q.TransportSkipped && len(q.b) >= q.subofs+8 {
 		switch ICMP4Type(q.b[q.subofs]) {
 		case ICMP4Unreachable, ICMP4TimeExceeded:
 			return true
@@ -292,9 +1173,72 @@ func (q *Parsed) IsError() bool {
 	return false
 }
 
+// ICMPInnerPacket returns the original datagram quoted in the body of
+// the ICMP error q, starting with its IP header. It reports false if q
+// is not an ICMP error or its body is too short to hold the IP header
+// and 8 bytes of payload that RFC 792 requires. Routers following RFC
+// 1812 may quote more, in which case all of it is returned.
+//
+// The quoted datagram is usually truncated, so its own total length
+// field may exceed the length of the returned slice.
+// This is a read-only view; that is, q retains the ownership of the buffer.
+func (q *Parsed) ICMPInnerPacket() ([]byte, bool) {
+	// IsError checks the buffer length, which may run past q.length.
+	if !q.IsError() || q.length < q.subofs+8 {
+		return nil, false
+	}
+	inner := q.b[q.subofs+8 : q.length]
+	if len(inner) < ipHeaderLength || inner[0]>>4 != 4 {
+		return nil, false
+	}
+	if len(inner) < int(inner[0]&0x0F)<<2+8 {
+		return nil, false
+	}
+	return inner, true
+}
+
+// ICMPTerminatesFlow reports whether q is an IPv4 ICMP error that
+// means the flow it quotes is dead, so that connection tracking state
+// for it can be torn down. The flow is the one in ICMPInnerPacket,
+// and ICMPTerminatesFlow reports false if that isn't available.
+//
+// Destination Unreachable errors are classified by code:
+//
+//   - Protocol and port unreachable mean the destination host itself
+//     rejected the flow (RFC 1122 section 4.2.3.9 calls them hard
+//     errors), so they terminate it.
+//   - Host unreachable and host unknown come from the last-hop router
+//     failing to reach the host, which is gone or was never there, and
+//     also terminate the flow.
+//   - The administratively prohibited codes (net, host, and
+//     communication prohibited) report a filtering policy that
+//     retrying won't get past, and terminate the flow.
+//   - Net unreachable is often a transient routing failure, and
+//     fragmentation needed is part of path MTU discovery, after which
+//     the flow continues with smaller packets. Neither terminates it,
+//     nor do the remaining, rarely seen, codes.
+//
+// Time Exceeded is transient, typically a routing loop or a
+// traceroute probe, and never terminates a flow.
+func (q *Parsed) ICMPTerminatesFlow() bool {
+	if _, ok := q.ICMPInnerPacket(); !ok {
+		return false
+	}
+	if ICMP4Type(q.b[q.subofs]) != ICMP4Unreachable {
+		return false
+	}
+	switch ICMP4Code(q.b[q.subofs+1]) {
+	case ICMP4ProtoUnreachable, ICMP4PortUnreachable,
+		ICMP4HostUnreachable, ICMP4HostUnknown,
+		ICMP4NetProhibited, ICMP4HostProhibited, ICMP4AdminProhibited:
+		return true
+	}
+	return false
+}
+
 // IsEchoRequest reports whether q is an IPv4 ICMP Echo Request.
 func (q *Parsed) IsEchoRequest() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if q.IPProto == ICMP && !q.TransportSkipped && len(q.b) >= q.subofs+8 {
 		return ICMP4Type(q.b[q.subofs]) == ICMP4EchoRequest &&
 			ICMP4Code(q.b[q.subofs+1]) == ICMP4NoCode
 	}
@@ -303,7 +1247,7 @@ func (q *Parsed) IsEchoRequest() bool {
 
 // IsEchoRequest reports whether q is an IPv4 ICMP Echo Response.
 func (q *Parsed) IsEchoResponse() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if q.IPProto == ICMP && !q.TransportSkipped && len(q.b) >= q.subofs+8 {
 		return ICMP4Type(q.b[q.subofs]) == ICMP4EchoReply &&
 			ICMP4Code(q.b[q.subofs+1]) == ICMP4NoCode
 	}
@@ -6,6 +6,8 @@ package packet
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"testing"
@@ -51,6 +53,7 @@ var icmpRequestDecode = Parsed{
 	IPProto:   ICMP,
 	SrcIP:     NewIP4(net.ParseIP("1.2.3.4")),
 	DstIP:     NewIP4(net.ParseIP("5.6.7.8")),
+	IPID:      0xdead,
 	SrcPort:   0,
 	DstPort:   0,
 }
@@ -77,6 +80,7 @@ var icmpReplyDecode = Parsed{
 	IPProto:   ICMP,
 	SrcIP:     NewIP4(net.ParseIP("1.2.3.4")),
 	DstIP:     NewIP4(net.ParseIP("5.6.7.8")),
+	IPID:      0x2152,
 	SrcPort:   0,
 	DstPort:   0,
 }
@@ -95,6 +99,7 @@ var ipv6PacketDecode = Parsed{
 	b:         ipv6PacketBuffer,
 	IPVersion: 6,
 	IPProto:   ICMPv6,
+	HopLimit:  255,
 }
 
 // This is a malformed IPv4 packet.
@@ -133,6 +138,7 @@ var tcpPacketDecode = Parsed{
 	IPProto:   TCP,
 	SrcIP:     NewIP4(net.ParseIP("1.2.3.4")),
 	DstIP:     NewIP4(net.ParseIP("5.6.7.8")),
+	IPID:      0xdead,
 	SrcPort:   123,
 	DstPort:   567,
 	TCPFlags:  TCPSynAck,
@@ -161,6 +167,7 @@ var udpRequestDecode = Parsed{
 	IPProto:   UDP,
 	SrcIP:     NewIP4(net.ParseIP("1.2.3.4")),
 	DstIP:     NewIP4(net.ParseIP("5.6.7.8")),
+	IPID:      0xdead,
 	SrcPort:   123,
 	DstPort:   567,
 }
@@ -187,6 +194,7 @@ var udpReplyDecode = Parsed{
 	IPProto: UDP,
 	SrcIP:   NewIP4(net.ParseIP("1.2.3.4")),
 	DstIP:   NewIP4(net.ParseIP("5.6.7.8")),
+	IPID:    0x2152,
 	SrcPort: 567,
 	DstPort: 123,
 }
@@ -275,6 +283,101 @@ func BenchmarkDecode(b *testing.B) {
 	}
 }
 
+func BenchmarkDecodeIPOnly(b *testing.B) {
+	benches := []struct {
+		name string
+		buf  []byte
+	}{
+		{"udp", udpRequestBuffer},
+		{"tcp", tcpPacketBuffer},
+		{"tcp_ip_options", withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00})},
+	}
+	for _, bench := range benches {
+		b.Run(bench.name+"/full", func(b *testing.B) {
+			b.ReportAllocs()
+			var p Parsed
+			for i := 0; i < b.N; i++ {
+				p.Decode(bench.buf)
+			}
+		})
+		b.Run(bench.name+"/ip_only", func(b *testing.B) {
+			b.ReportAllocs()
+			var p Parsed
+			for i := 0; i < b.N; i++ {
+				DecodeIPOnly(bench.buf, &p)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeBatch(b *testing.B) {
+	bufs := make([][]byte, 32)
+	for i := range bufs {
+		switch i % 3 {
+		case 0:
+			bufs[i] = tcpPacketBuffer
+		case 1:
+			bufs[i] = udpRequestBuffer
+		default:
+			bufs[i] = ipv6PacketBuffer
+		}
+	}
+	out := make([]Parsed, len(bufs))
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			DecodeBatch(bufs, out)
+		}
+	})
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j, buf := range bufs {
+				out[j].Decode(buf)
+			}
+		}
+	})
+}
+
+func BenchmarkDecodeIPOptions(b *testing.B) {
+	benches := []struct {
+		name string
+		buf  []byte
+	}{
+		{"none", tcpPacketBuffer},
+		{"nops", withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00})},
+	}
+	for _, bench := range benches {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			var p Parsed
+			for i := 0; i < b.N; i++ {
+				p.Decode(bench.buf)
+			}
+		})
+	}
+}
+
+// TestDecodeFastPath checks that Decode's fast path for headers
+// without options accepts and rejects the same packets as checkIP4.
+func TestDecodeFastPath(t *testing.T) {
+	for _, ihl := range []byte{0, 4, 5, 6} {
+		for length := 0; length <= len(udpRequestBuffer)+1; length++ {
+			buf := append([]byte(nil), udpRequestBuffer...)
+			buf[0] = 0x40 | ihl
+			put16(buf[2:4], uint16(length))
+			// Decode leaves length zero if it rejects the IP header,
+			// as checkIP4 does.
+			_, wantLength, err := checkIP4(buf)
+			var p Parsed
+			p.Decode(buf)
+			if p.length != wantLength {
+				t.Errorf("IHL %d, length %d: decoded length %d; checkIP4 gave %d, %v", ihl, length, p.length, wantLength, err)
+			}
+		}
+	}
+}
+
 func TestMarshalRequest(t *testing.T) {
 	// Too small to hold our packets, but only barely.
 	var small [20]byte
@@ -294,8 +397,8 @@ func TestMarshalRequest(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			err := tt.header.Marshal(small[:])
-			if err != errSmallBuffer {
-				t.Errorf("got err: nil; want: %s", errSmallBuffer)
+			if err != ErrSmallBuffer {
+				t.Errorf("got err: nil; want: %s", ErrSmallBuffer)
 			}
 
 			dataOffset := tt.header.Len()
@@ -348,3 +451,2351 @@ func TestMarshalResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestIP4HeaderParse(t *testing.T) {
+	var h IP4Header
+	if err := h.Parse(udpRequestBuffer); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if want := udpRequestDecode.IPHeader(); !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v; want %+v", h, want)
+	}
+
+	withByte := func(b []byte, i int, v byte) []byte {
+		b = append([]byte(nil), b...)
+		b[i] = v
+		return b
+	}
+	tests := []struct {
+		name      string
+		buf       []byte
+		want      string
+		wantSmall bool
+	}{
+		{"short", udpRequestBuffer[:12], "Length=12 < 20 at offset 0", true},
+		{"version", withByte(udpRequestBuffer, 0, 0x75), "Version=7 != 4 at offset 0", false},
+		{"ihl", withByte(udpRequestBuffer, 0, 0x43), "IHL=3 < 5 at offset 0", false},
+		{"options", withByte(udpRequestBuffer, 0, 0x4f), "Options=40 > 23 available at offset 20", true},
+		{"total_length_small", withByte(udpRequestBuffer, 3, 0x10), "TotalLength=16 < IHL*4 (20) at offset 2", false},
+		{"total_length_large", withByte(udpRequestBuffer, 3, 0x40), "TotalLength=64 > buffer length (43) at offset 2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.Parse(tt.buf)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got err %v; want *ParseError", err)
+			}
+			if got := err.Error(); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+			if got := errors.Is(err, ErrSmallBuffer); got != tt.wantSmall {
+				t.Errorf("errors.Is(err, ErrSmallBuffer) = %v; want %v", got, tt.wantSmall)
+			}
+		})
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+		{0xfffffff0, 0x10, true},
+		{0x10, 0xfffffff0, false},
+	}
+	for _, tt := range tests {
+		if got := SeqLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("SeqLess(%#x, %#x) = %v; want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSeqInWindow(t *testing.T) {
+	tests := []struct {
+		seq, start, end uint32
+		want            bool
+	}{
+		{100, 100, 200, true},
+		{199, 100, 200, true},
+		{200, 100, 200, false},
+		{99, 100, 200, false},
+		{100, 100, 100, false},
+		// Window spanning the wrap.
+		{0xfffffffe, 0xfffffff0, 0x10, true},
+		{0x5, 0xfffffff0, 0x10, true},
+		{0x10, 0xfffffff0, 0x10, false},
+		{0xffffffe0, 0xfffffff0, 0x10, false},
+	}
+	for _, tt := range tests {
+		if got := SeqInWindow(tt.seq, tt.start, tt.end); got != tt.want {
+			t.Errorf("SeqInWindow(%#x, %#x, %#x) = %v; want %v", tt.seq, tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestMakeICMP4FragNeeded(t *testing.T) {
+	orig := append([]byte(nil), udpRequestBuffer...)
+	orig[6] = 0x40 // DF
+
+	var buf [128]byte
+	n, err := MakeICMP4FragNeeded(orig, 1280, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 28 + 20 + 8; n != want {
+		t.Fatalf("n = %d; want %d", n, want)
+	}
+	pkt := buf[:n]
+	if got := ipChecksum(pkt[:20]); got != 0 {
+		t.Errorf("IP checksum doesn't verify (%#x)", got)
+	}
+	if got := ipChecksum(pkt[20:]); got != 0 {
+		t.Errorf("ICMP checksum doesn't verify (%#x)", got)
+	}
+	if got, want := ICMP4Type(pkt[20]), ICMP4Unreachable; got != want {
+		t.Errorf("type = %v; want %v", got, want)
+	}
+	if got, want := ICMP4Code(pkt[21]), ICMP4FragNeeded; got != want {
+		t.Errorf("code = %v; want %v", got, want)
+	}
+	if got := get16(pkt[24:26]); got != 0 {
+		t.Errorf("unused = %#x; want 0", got)
+	}
+	if got := get16(pkt[26:28]); got != 1280 {
+		t.Errorf("mtu = %d; want 1280", got)
+	}
+	if !bytes.Equal(pkt[28:], orig[:28]) {
+		t.Errorf("quoted %x; want %x", pkt[28:], orig[:28])
+	}
+
+	var p Parsed
+	p.Decode(pkt)
+	if !p.IsError() {
+		t.Errorf("result is not an ICMP error")
+	}
+	if p.SrcIP != udpRequestDecode.DstIP || p.DstIP != udpRequestDecode.SrcIP {
+		t.Errorf("got %v > %v; want reversed addresses", p.SrcIP, p.DstIP)
+	}
+
+	if _, err := MakeICMP4FragNeeded(orig, 1280, buf[:40]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := MakeICMP4FragNeeded(orig[:10], 1280, buf[:]); err == nil {
+		t.Errorf("truncated orig: got nil error")
+	}
+}
+
+func TestMakeICMP4ProtoUnreachable(t *testing.T) {
+	// An SCTP packet, with IPv4 options, which must be quoted too.
+	orig := withIP4Options(udpRequestBuffer, []byte{0x01, 0x01, 0x01, 0x00})
+	orig[9] = 132
+	put16(orig[10:12], 0)
+	put16(orig[10:12], ipChecksum(orig[:24]))
+
+	var buf [128]byte
+	n, err := MakeICMP4ProtoUnreachable(orig, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 28 + 24 + 8; n != want {
+		t.Fatalf("n = %d; want %d", n, want)
+	}
+	pkt := buf[:n]
+	if got := ipChecksum(pkt[:20]); got != 0 {
+		t.Errorf("IP checksum doesn't verify (%#x)", got)
+	}
+	if got := ipChecksum(pkt[20:]); got != 0 {
+		t.Errorf("ICMP checksum doesn't verify (%#x)", got)
+	}
+	if got, want := ICMP4Type(pkt[20]), ICMP4Unreachable; got != want {
+		t.Errorf("type = %v; want %v", got, want)
+	}
+	if got, want := ICMP4Code(pkt[21]), ICMP4ProtoUnreachable; got != want {
+		t.Errorf("code = %v; want %v", got, want)
+	}
+	if got := get32(pkt[24:28]); got != 0 {
+		t.Errorf("unused = %#x; want 0", got)
+	}
+	if !bytes.Equal(pkt[28:], orig[:24+8]) {
+		t.Errorf("quoted %x; want %x", pkt[28:], orig[:24+8])
+	}
+
+	var p Parsed
+	p.Decode(pkt)
+	if !p.IsError() {
+		t.Errorf("result is not an ICMP error")
+	}
+	if p.SrcIP != udpRequestDecode.DstIP || p.DstIP != udpRequestDecode.SrcIP {
+		t.Errorf("got %v > %v; want reversed addresses", p.SrcIP, p.DstIP)
+	}
+
+	if _, err := MakeICMP4ProtoUnreachable(orig, buf[:40]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := MakeICMP4ProtoUnreachable(orig[:10], buf[:]); err == nil {
+		t.Errorf("truncated orig: got nil error")
+	}
+}
+
+func TestMakeICMP4Redirect(t *testing.T) {
+	const gw = IP4(0xc0a80101) // 192.168.1.1
+	var buf [128]byte
+	for _, code := range []ICMP4Code{ICMP4RedirectNet, ICMP4RedirectHost, ICMP4RedirectTOSNet, ICMP4RedirectTOSHost} {
+		n, err := MakeICMP4Redirect(tcpPacketBuffer, gw, code, buf[:])
+		if err != nil {
+			t.Fatalf("code %d: %v", code, err)
+		}
+		if want := 28 + 20 + 8; n != want {
+			t.Fatalf("code %d: n = %d; want %d", code, n, want)
+		}
+		pkt := buf[:n]
+		if got := ipChecksum(pkt[:20]); got != 0 {
+			t.Errorf("code %d: IP checksum doesn't verify (%#x)", code, got)
+		}
+		if got := ipChecksum(pkt[20:]); got != 0 {
+			t.Errorf("code %d: ICMP checksum doesn't verify (%#x)", code, got)
+		}
+		if got := ICMP4Type(pkt[20]); got != ICMP4Redirect {
+			t.Errorf("code %d: type = %v; want Redirect", code, got)
+		}
+		if got := ICMP4Code(pkt[21]); got != code {
+			t.Errorf("code = %d; want %d", got, code)
+		}
+		if got := IP4(get32(pkt[24:28])); got != gw {
+			t.Errorf("code %d: gateway = %v; want %v", code, got, gw)
+		}
+		if !bytes.Equal(pkt[28:], tcpPacketBuffer[:28]) {
+			t.Errorf("code %d: quoted %x; want %x", code, pkt[28:], tcpPacketBuffer[:28])
+		}
+	}
+
+	if _, err := MakeICMP4Redirect(tcpPacketBuffer, gw, 4, buf[:]); err != errICMPCode {
+		t.Errorf("code 4: got err %v; want %v", err, errICMPCode)
+	}
+	if _, err := MakeICMP4Redirect(tcpPacketBuffer, gw, ICMP4RedirectHost, buf[:40]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := MakeICMP4Redirect(tcpPacketBuffer[:10], gw, ICMP4RedirectHost, buf[:]); err == nil {
+		t.Errorf("truncated orig: got nil error")
+	}
+}
+
+func TestFiveTuple(t *testing.T) {
+	for _, buf := range [][]byte{icmpRequestBuffer, tcpPacketBuffer, udpRequestBuffer} {
+		var want Parsed
+		want.Decode(buf)
+		src, dst, proto, sport, dport, ok := FiveTuple(buf)
+		if !ok {
+			t.Errorf("%v: not ok", &want)
+			continue
+		}
+		if src != want.SrcIP || dst != want.DstIP || proto != want.IPProto || sport != want.SrcPort || dport != want.DstPort {
+			t.Errorf("got %v %v:%d > %v:%d; want %v", proto, src, sport, dst, dport, &want)
+		}
+	}
+
+	frag := append([]byte(nil), tcpPacketBuffer...)
+	frag[6], frag[7] = 0x00, 0x20
+	if _, _, proto, sport, dport, ok := FiveTuple(frag); !ok || proto != Fragment || sport != 0 || dport != 0 {
+		t.Errorf("fragment: got %v %d > %d (ok=%v); want Frag with no ports", proto, sport, dport, ok)
+	}
+
+	for _, buf := range [][]byte{nil, unknownPacketBuffer, ipv6PacketBuffer, tcpPacketBuffer[:22]} {
+		if _, _, _, _, _, ok := FiveTuple(buf); ok {
+			t.Errorf("FiveTuple(%x) ok; want !ok", buf)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		FiveTuple(tcpPacketBuffer)
+	})
+	if allocs != 0 {
+		t.Errorf("allocs = %v; want 0", allocs)
+	}
+}
+
+func BenchmarkFiveTuple(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		FiveTuple(tcpPacketBuffer)
+	}
+}
+
+// withIP4Options returns a copy of the IPv4 packet pkt with opts
+// inserted as IP options, adjusting IHL, total length and checksum.
+// len(opts) must be a multiple of 4.
+func withIP4Options(pkt, opts []byte) []byte {
+	hlen := int(pkt[0]&0x0F) << 2
+	out := make([]byte, 0, len(pkt)+len(opts))
+	out = append(out, pkt[:hlen]...)
+	out = append(out, opts...)
+	out = append(out, pkt[hlen:]...)
+	out[0] = 0x40 | byte((hlen+len(opts))>>2)
+	put16(out[2:4], uint16(len(out)))
+	put16(out[10:12], ChecksumExcluding(out[:hlen+len(opts)], 10))
+	return out
+}
+
+func TestDecodeIPOptions(t *testing.T) {
+	var p Parsed
+	p.Decode(tcpPacketBuffer)
+	if p.HasIPOptions {
+		t.Errorf("HasIPOptions set on packet without options")
+	}
+
+	// NOP, NOP, NOP, EOL.
+	withOpts := withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00})
+	p.Decode(withOpts)
+	if !p.HasIPOptions {
+		t.Errorf("HasIPOptions not set on packet with options")
+	}
+	if p.IPProto != TCP || p.SrcPort != 123 || p.DstPort != 567 {
+		t.Errorf("decoded %v; want TCP{1.2.3.4:123 > 5.6.7.8:567}", &p)
+	}
+
+	// Presence is detected even when the packet is otherwise unusable.
+	p.Decode(withOpts[:30])
+	if !p.HasIPOptions || p.IPProto != Unknown {
+		t.Errorf("truncated: HasIPOptions = %v, IPProto = %v; want true, Unknown", p.HasIPOptions, p.IPProto)
+	}
+
+	p.Decode(ipv6PacketBuffer)
+	if p.HasIPOptions {
+		t.Errorf("HasIPOptions left set after decoding IPv6")
+	}
+}
+
+func TestDecodeSourceRoute(t *testing.T) {
+	route := func(typ byte) []byte {
+		// Option type, length 7, pointer, one address, then EOL.
+		return []byte{typ, 0x07, 0x04, 0x0a, 0x00, 0x00, 0x01, 0x00}
+	}
+	tests := []struct {
+		name string
+		opts []byte
+		want bool
+	}{
+		{"none", nil, false},
+		{"nops", []byte{0x01, 0x01, 0x01, 0x00}, false},
+		{"lsrr", route(ip4OptLSRR), true},
+		{"ssrr", route(ip4OptSSRR), true},
+		{"nop_then_lsrr", append([]byte{0x01, 0x01, 0x01, 0x01}, route(ip4OptLSRR)...), true},
+		// Record route (7) and timestamp (68) are benign.
+		{"record_route", route(0x07), false},
+		{"timestamp_then_eol", []byte{0x44, 0x04, 0x05, 0x00}, false},
+		// A source route type byte after EOL or inside another
+		// option's data is not an option.
+		{"after_eol", []byte{0x00, ip4OptLSRR, 0x00, 0x00}, false},
+		{"inside_option", []byte{0x07, 0x04, ip4OptSSRR, 0x00}, false},
+		{"malformed_length", []byte{0x07, 0x00, ip4OptSSRR, 0x00}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := tcpPacketBuffer
+			if tt.opts != nil {
+				buf = withIP4Options(buf, tt.opts)
+			}
+			var p Parsed
+			p.Decode(buf)
+			if p.HasSourceRoute != tt.want {
+				t.Errorf("HasSourceRoute = %v; want %v", p.HasSourceRoute, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReuse(t *testing.T) {
+	bufs := [][]byte{
+		withIP4Options(tcpPacketBuffer, []byte{ip4OptLSRR, 0x03, 0x04, 0x00}),
+		udpRequestBuffer,
+		icmpRequestBuffer,
+		ipv6PacketBuffer,
+		unknownPacketBuffer,
+		tcpPacketBuffer,
+	}
+	var reused Parsed
+	for i, buf := range bufs {
+		reused.Decode(buf)
+		var fresh Parsed
+		fresh.Decode(buf)
+		if !reflect.DeepEqual(reused, fresh) {
+			t.Errorf("packet %d: reused decode differs from fresh\n got: %#v\nwant: %#v", i, reused, fresh)
+		}
+	}
+
+	reused.Decode(tcpPacketBuffer)
+	reused.Decode(udpRequestBuffer)
+	if reused.TCPFlags != 0 {
+		t.Errorf("TCPFlags = %#x left over from TCP packet", reused.TCPFlags)
+	}
+
+	reused.Reset()
+	if !reflect.DeepEqual(reused, Parsed{}) {
+		t.Errorf("after Reset: %#v; want zero Parsed", reused)
+	}
+}
+
+func TestMaskBits(t *testing.T) {
+	tests := []struct {
+		mask   string
+		want   uint8
+		wantOK bool
+	}{
+		{"0.0.0.0", 0, true},
+		{"128.0.0.0", 1, true},
+		{"255.0.0.0", 8, true},
+		{"255.255.255.0", 24, true},
+		{"255.255.255.254", 31, true},
+		{"255.255.255.255", 32, true},
+		{"255.255.0.255", 0, false},
+		{"0.255.255.255", 0, false},
+		{"255.255.255.1", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := MaskBits(NewIP4(net.ParseIP(tt.mask)))
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("MaskBits(%s) = %d, %v; want %d, %v", tt.mask, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestWildcardToMask(t *testing.T) {
+	tests := []struct {
+		wildcard, want string
+	}{
+		{"0.0.0.255", "255.255.255.0"},
+		{"0.0.0.0", "255.255.255.255"},
+		{"255.255.255.255", "0.0.0.0"},
+		{"0.0.255.0", "255.255.0.255"},
+	}
+	for _, tt := range tests {
+		got := WildcardToMask(NewIP4(net.ParseIP(tt.wildcard)))
+		if got.String() != tt.want {
+			t.Errorf("WildcardToMask(%s) = %v; want %s", tt.wildcard, got, tt.want)
+		}
+	}
+}
+
+// transportChecksum4 returns the one's complement checksum of the
+// transport segment of the IPv4 packet pkt including its pseudo-header.
+// It is zero if the stored transport checksum is valid.
+func transportChecksum4(pkt []byte) uint16 {
+	hlen := int(pkt[0]&0x0F) << 2
+	seg := pkt[hlen:get16(pkt[2:4])]
+	b := make([]byte, 12+len(seg))
+	copy(b[0:8], pkt[12:20])
+	b[9] = pkt[9]
+	put16(b[10:12], uint16(len(seg)))
+	copy(b[12:], seg)
+	return ipChecksum(b)
+}
+
+func TestMakeUDP4(t *testing.T) {
+	src := IP4Port{IP: udpRequestDecode.SrcIP, Port: 123}
+	dst := IP4Port{IP: udpRequestDecode.DstIP, Port: 567}
+	payload := []byte("request_payload")
+
+	var buf [64]byte
+	n, err := MakeUDP4(src, dst, payload, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := buf[:n]
+	if n != len(udpRequestBuffer) {
+		t.Fatalf("n = %d; want %d", n, len(udpRequestBuffer))
+	}
+	var p Parsed
+	p.Decode(pkt)
+	if p.String() != "UDP{1.2.3.4:123 > 5.6.7.8:567}" {
+		t.Errorf("decoded %v", &p)
+	}
+	if !bytes.Equal(p.Payload(), payload) {
+		t.Errorf("payload = %q; want %q", p.Payload(), payload)
+	}
+	if got := get16(pkt[24:26]); got != uint16(8+len(payload)) {
+		t.Errorf("UDP length = %d; want %d", got, 8+len(payload))
+	}
+	if got := ipChecksum(pkt[:20]); got != 0 {
+		t.Errorf("IP checksum doesn't verify (%#x)", got)
+	}
+	if got := transportChecksum4(pkt); got != 0 {
+		t.Errorf("UDP checksum doesn't verify (%#x)", got)
+	}
+
+	// Pick a payload whose checksum computes to zero,
+	// which must be transmitted as 0xffff.
+	MakeUDP4(src, dst, []byte{0, 0}, buf[:])
+	zeroing := []byte{buf[26], buf[27]}
+	n, err = MakeUDP4(src, dst, zeroing, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get16(buf[26:28]); got != 0xffff {
+		t.Errorf("checksum = %#x; want 0xffff", got)
+	}
+	if got := transportChecksum4(buf[:n]); got != 0 {
+		t.Errorf("all-ones UDP checksum doesn't verify (%#x)", got)
+	}
+
+	if _, err := MakeUDP4(src, dst, payload, buf[:30]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if _, err := MakeUDP4(src, dst, make([]byte, maxPacketLength), nil); err != ErrLargePacket {
+		t.Errorf("huge payload: got err %v; want %v", err, ErrLargePacket)
+	}
+}
+
+func TestMakeTCP4(t *testing.T) {
+	src := IP4Port{IP: tcpPacketDecode.SrcIP, Port: 123}
+	dst := IP4Port{IP: tcpPacketDecode.DstIP, Port: 567}
+
+	tests := []struct {
+		name    string
+		flags   uint8
+		payload string
+	}{
+		{"syn", TCPSyn, ""},
+		{"synack", TCPSynAck, ""},
+		{"data", TCPAck | TCPPsh, "request_payload"},
+		{"odd_data", TCPAck, "odd"},
+		{"fin", TCPFin | TCPAck, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf [128]byte
+			n, err := MakeTCP4(src, dst, 0x1234, 0x5678, tt.flags, 0x100, []byte(tt.payload), buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt := buf[:n]
+			var p Parsed
+			p.Decode(pkt)
+			if p.String() != "TCP{1.2.3.4:123 > 5.6.7.8:567}" || p.TCPFlags != tt.flags {
+				t.Errorf("decoded %v flags %#x; want flags %#x", &p, p.TCPFlags, tt.flags)
+			}
+			if string(p.Payload()) != tt.payload {
+				t.Errorf("payload = %q; want %q", p.Payload(), tt.payload)
+			}
+			if got := get32(pkt[24:28]); got != 0x1234 {
+				t.Errorf("seq = %#x; want 0x1234", got)
+			}
+			if got := get32(pkt[28:32]); got != 0x5678 {
+				t.Errorf("ack = %#x; want 0x5678", got)
+			}
+			if got := get16(pkt[34:36]); got != 0x100 {
+				t.Errorf("window = %#x; want 0x100", got)
+			}
+			if got := ipChecksum(pkt[:20]); got != 0 {
+				t.Errorf("IP checksum doesn't verify (%#x)", got)
+			}
+			if got := transportChecksum4(pkt); got != 0 {
+				t.Errorf("TCP checksum doesn't verify (%#x)", got)
+			}
+		})
+	}
+
+	var buf [64]byte
+	if _, err := MakeTCP4(src, dst, 0, 0, TCPFin, 0, []byte("x"), buf[:]); err != errTCPFlags {
+		t.Errorf("data without ACK: got err %v; want %v", err, errTCPFlags)
+	}
+	if _, err := MakeTCP4(src, dst, 0, 0, 0x40|TCPAck, 0, nil, buf[:]); err != errTCPFlags {
+		t.Errorf("reserved flag: got err %v; want %v", err, errTCPFlags)
+	}
+	if _, err := MakeTCP4(src, dst, 0, 0, TCPSyn, 0, nil, buf[:39]); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+// tcpCaptureBuffer is an HTTP request segment as captured on the wire,
+// with TCP timestamps and an odd-length (7-byte) payload.
+var tcpCaptureBuffer = []byte{
+	// IPv4 header, DF set
+	0x45, 0x00, 0x00, 0x3b, 0x4c, 0x2e, 0x40, 0x00,
+	0x40, 0x06, 0xf6, 0xf4, 0xc0, 0xa8, 0x01, 0x17,
+	0x5d, 0xb8, 0xd8, 0x22,
+	// TCP header: 51234 -> 80, PSH|ACK
+	0xc8, 0x22, 0x00, 0x50, 0x8d, 0x3a, 0x11, 0xf2,
+	0x27, 0xc9, 0x40, 0xa5, 0x80, 0x18, 0x01, 0xf6,
+	0x70, 0x62, 0x00, 0x00,
+	// NOP, NOP, timestamps
+	0x01, 0x01, 0x08, 0x0a, 0x5a, 0x3c, 0x1e, 0x07,
+	0x1b, 0x2e, 0xd4, 0xc9,
+	// "GET /\r\n"
+	0x47, 0x45, 0x54, 0x20, 0x2f, 0x0d, 0x0a,
+}
+
+func TestMakeTCPKeepalive(t *testing.T) {
+	src := IP4Port{IP: 0x64400001, Port: 51234}
+	dst := IP4Port{IP: 0x64400002, Port: 22}
+	segment := func(seq uint32, flags uint8, payload string) *Parsed {
+		buf := make([]byte, 128)
+		n, err := MakeTCP4(src, dst, seq, 5000, flags, 502, []byte(payload), buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(Parsed)
+		q.Decode(buf[:n])
+		return q
+	}
+	// withTCPOptions leaves the checksum stale, which doesn't matter
+	// for building the probe.
+	withOpts := new(Parsed)
+	withOpts.Decode(withTCPOptions(segment(1000, TCPAck, "0123456789abcdef").Buffer(), []byte{0x01, 0x01, 0x08, 0x0a, 0, 0, 0, 1, 0, 0, 0, 2}))
+
+	tests := []struct {
+		name    string
+		q       *Parsed
+		wantSeq uint32
+	}{
+		{"pure_ack", segment(1000, TCPAck, ""), 999},
+		{"data", segment(1000, TCPAck|TCPPsh, "hello"), 1004},
+		{"fin", segment(1000, TCPAck|TCPFin, ""), 1000},
+		{"wraparound", segment(0, TCPAck, ""), 0xffffffff},
+		// TCP options don't count as data.
+		{"data_with_options", withOpts, 1015},
+	}
+
+	for _, tt := range tests {
+		buf := make([]byte, 64)
+		n, err := tt.q.MakeTCPKeepalive(buf)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		pkt := buf[:n]
+		if n != tcpTotalHeaderLength {
+			t.Errorf("%s: length %d; want %d, with no data", tt.name, n, tcpTotalHeaderLength)
+		}
+		if ipChecksum(pkt[:ipHeaderLength]) != 0 || !VerifyTCP4Checksum(pkt) {
+			t.Errorf("%s: bad checksums", tt.name)
+		}
+		var ka Parsed
+		ka.Decode(pkt)
+		h := ka.TCPHeader()
+		if ka.SrcIP != src.IP || ka.SrcPort != src.Port || ka.DstIP != dst.IP || ka.DstPort != dst.Port {
+			t.Errorf("%s: probe is %v; want the original direction", tt.name, &ka)
+		}
+		if h.Seq != tt.wantSeq || h.Ack != 5000 || h.Flags != TCPAck || h.Window != 502 {
+			t.Errorf("%s: seq %d ack %d flags %#x window %d; want seq %d ack 5000 flags ACK window 502",
+				tt.name, h.Seq, h.Ack, h.Flags, h.Window, tt.wantSeq)
+		}
+	}
+
+	for _, q := range []*Parsed{
+		segment(1000, TCPSyn, ""),
+		segment(1000, TCPSynAck, ""),
+		segment(1000, TCPRst|TCPAck, ""),
+		segment(1000, TCPFin, ""),
+		&udpRequestDecode,
+	} {
+		if _, err := q.MakeTCPKeepalive(make([]byte, 64)); err != errNotEstablished {
+			t.Errorf("%v: got err %v; want %v", q, err, errNotEstablished)
+		}
+	}
+	if _, err := segment(1000, TCPAck, "").MakeTCPKeepalive(make([]byte, 39)); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestVerifyTCP4Checksum(t *testing.T) {
+	modify := func(pkt []byte, f func([]byte)) []byte {
+		b := append([]byte(nil), pkt...)
+		f(b)
+		return b
+	}
+	// withIP4Options leaves the IPv4 checksum stale, which
+	// VerifyTCP4Checksum doesn't look at.
+	withOpts := withIP4Options(tcpCaptureBuffer, []byte{0x01, 0x01, 0x01, 0x00})
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"capture", tcpCaptureBuffer, true},
+		{"ip_options", withOpts, true},
+		{"padded", append(append([]byte(nil), tcpCaptureBuffer...), 0, 0, 0, 0, 0xff), true},
+		{"odd_byte_flipped", modify(tcpCaptureBuffer, func(b []byte) { b[len(b)-1] ^= 0x01 }), false},
+		{"payload_flipped", modify(tcpCaptureBuffer, func(b []byte) { b[52] ^= 0x80 }), false},
+		{"address_changed", modify(tcpCaptureBuffer, func(b []byte) { b[19]++ }), false},
+		{"checksum_zeroed", modify(tcpCaptureBuffer, func(b []byte) { put16(b[36:38], 0) }), false},
+		// Dropping the odd byte from the IPv4 total length changes
+		// the pseudo-header and the data summed.
+		{"short_total_length", modify(tcpCaptureBuffer, func(b []byte) { put16(b[2:4], 58) }), false},
+		{"fragment", modify(tcpCaptureBuffer, func(b []byte) { put16(b[6:8], ip4FlagMF) }), false},
+		{"truncated_tcp", tcpCaptureBuffer[:30], false},
+		{"udp", udpRequestBuffer, false},
+		{"ipv6", ipv6PacketBuffer, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := VerifyTCP4Checksum(tt.pkt); got != tt.want {
+			t.Errorf("%s: VerifyTCP4Checksum = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// udpCaptureBuffer is a DNS query for example.com as captured on the
+// wire, with an odd-length (29-byte) payload.
+var udpCaptureBuffer = []byte{
+	// IPv4 header
+	0x45, 0x00, 0x00, 0x39, 0x9b, 0xd1, 0x00, 0x00,
+	0x40, 0x11, 0x4b, 0x4e, 0x64, 0x65, 0x66, 0x67,
+	0x64, 0x64, 0x64, 0x64,
+	// UDP header: 54321 -> 53
+	0xd4, 0x31, 0x00, 0x35, 0x00, 0x25, 0x9c, 0xbc,
+	// DNS query
+	0x2b, 0x7e, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x07, 0x65, 0x78, 0x61,
+	0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d,
+	0x00, 0x00, 0x01, 0x00, 0x01,
+}
+
+func TestVerifyUDP4Checksum(t *testing.T) {
+	modify := func(pkt []byte, f func([]byte)) []byte {
+		b := append([]byte(nil), pkt...)
+		f(b)
+		return b
+	}
+	noChecksum := modify(udpCaptureBuffer, func(b []byte) { put16(b[26:28], 0) })
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"capture", udpCaptureBuffer, true},
+		{"generated", udpRequestBuffer, true},
+		{"padded", append(append([]byte(nil), udpCaptureBuffer...), 0, 0, 0xff), true},
+		{"zero_checksum", noChecksum, true},
+		// Without a checksum, nothing else is checked either.
+		{"zero_checksum_corrupted", modify(noChecksum, func(b []byte) { b[40] ^= 0x20 }), true},
+		{"payload_flipped", modify(udpCaptureBuffer, func(b []byte) { b[40] ^= 0x20 }), false},
+		{"odd_byte_flipped", modify(udpCaptureBuffer, func(b []byte) { b[len(b)-1] ^= 0x01 }), false},
+		{"address_changed", modify(udpCaptureBuffer, func(b []byte) { b[15]++ }), false},
+		{"checksum_ffff", modify(udpCaptureBuffer, func(b []byte) { put16(b[26:28], 0xffff) }), false},
+		{"udp_length_too_long", modify(udpCaptureBuffer, func(b []byte) { put16(b[24:26], 38) }), false},
+		{"udp_length_too_short", modify(udpCaptureBuffer, func(b []byte) { put16(b[24:26], 7) }), false},
+		{"fragment", modify(udpCaptureBuffer, func(b []byte) { put16(b[6:8], ip4FlagMF) }), false},
+		{"tcp", tcpCaptureBuffer, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		if got := VerifyUDP4Checksum(tt.pkt); got != tt.want {
+			t.Errorf("%s: VerifyUDP4Checksum = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Datagrams from MakeUDP4 verify, over a spread of checksums.
+	var buf [64]byte
+	for i := 0; i < 256; i++ {
+		n, err := MakeUDP4(IP4Port{IP: 0x01020304, Port: 1}, IP4Port{IP: 0x05060708, Port: uint16(i)}, []byte("x"), buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyUDP4Checksum(buf[:n]) {
+			t.Errorf("MakeUDP4 to port %d: checksum %#04x doesn't verify", i, get16(buf[26:28]))
+		}
+	}
+}
+
+func TestTCP4HeaderToResponse(t *testing.T) {
+	h := TCP4Header{
+		IP4Header: IP4Header{SrcIP: 1, DstIP: 2, IPID: 7},
+		SrcPort:   10,
+		DstPort:   20,
+		Seq:       100,
+		Ack:       200,
+	}
+	h.ToResponse()
+	want := TCP4Header{
+		IP4Header: IP4Header{SrcIP: 2, DstIP: 1, IPID: ^uint16(7)},
+		SrcPort:   20,
+		DstPort:   10,
+		Seq:       200,
+		Ack:       100,
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %+v; want %+v", h, want)
+	}
+}
+
+func TestTCPTeardownFlags(t *testing.T) {
+	withFlags := func(flags uint8) []byte {
+		b := withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00})
+		b[24+13] = flags
+		return b
+	}
+	tests := []struct {
+		name    string
+		buf     []byte
+		wantFin bool
+		wantRst bool
+	}{
+		{"synack", withFlags(TCPSynAck), false, false},
+		{"fin", withFlags(TCPFin | TCPAck), true, false},
+		{"rst", withFlags(TCPRst), false, true},
+		{"rst_ack", withFlags(TCPRst | TCPAck), false, true},
+		// UDP has no flags, whatever is at the TCP flags offset.
+		{"udp", udpRequestBuffer, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Parsed
+			p.Decode(tt.buf)
+			if got := p.IsTCPFin(); got != tt.wantFin {
+				t.Errorf("IsTCPFin = %v; want %v", got, tt.wantFin)
+			}
+			if got := p.IsTCPRst(); got != tt.wantRst {
+				t.Errorf("IsTCPRst = %v; want %v", got, tt.wantRst)
+			}
+		})
+	}
+}
+
+func TestICMPInnerPacket(t *testing.T) {
+	var buf [128]byte
+	n, err := MakeICMP4FragNeeded(udpRequestBuffer, 1280, buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Parsed
+	p.Decode(buf[:n])
+	inner, ok := p.ICMPInnerPacket()
+	if !ok {
+		t.Fatal("no inner packet")
+	}
+	if !bytes.Equal(inner, udpRequestBuffer[:28]) {
+		t.Errorf("inner = %x; want %x", inner, udpRequestBuffer[:28])
+	}
+
+	// An RFC 1812 style error quoting the whole datagram.
+	long := append([]byte(nil), buf[:28]...)
+	long = append(long, udpRequestBuffer...)
+	put16(long[2:4], uint16(len(long)))
+	p.Decode(long)
+	if inner, ok := p.ICMPInnerPacket(); !ok || !bytes.Equal(inner, udpRequestBuffer) {
+		t.Errorf("long form: got %x, %v; want %x", inner, ok, udpRequestBuffer)
+	}
+
+	// Quoting less than the IP header and 8 bytes is invalid.
+	short := append([]byte(nil), buf[:n-1]...)
+	put16(short[2:4], uint16(len(short)))
+	p.Decode(short)
+	if _, ok := p.ICMPInnerPacket(); ok {
+		t.Errorf("short quote: got ok")
+	}
+
+	// A 4-byte ICMP header, followed by bytes past the IP length.
+	trailing := append([]byte(nil), buf[:ipHeaderLength+4]...)
+	put16(trailing[2:4], uint16(len(trailing)))
+	trailing = append(trailing, 0, 0, 0, 0)
+	p.Decode(trailing)
+	if _, ok := p.ICMPInnerPacket(); ok {
+		t.Errorf("trailing bytes: got ok")
+	}
+
+	p.Decode(icmpRequestBuffer)
+	if _, ok := p.ICMPInnerPacket(); ok {
+		t.Errorf("echo request: got ok")
+	}
+}
+
+func TestICMPTerminatesFlow(t *testing.T) {
+	icmpError := func(typ ICMP4Type, code ICMP4Code) []byte {
+		var buf [128]byte
+		n, err := makeICMP4Error(typ, code, 0, udpRequestBuffer, buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	// Quoting only the IP header isn't enough to identify the flow.
+	noQuote := icmpError(ICMP4Unreachable, ICMP4PortUnreachable)[:icmp4ErrorHeaderLength+ipHeaderLength]
+	put16(noQuote[2:4], uint16(len(noQuote)))
+	// A 4-byte ICMP header, followed by bytes past the IP length.
+	trailing := append([]byte(nil), icmpError(ICMP4Unreachable, ICMP4PortUnreachable)[:ipHeaderLength+4]...)
+	put16(trailing[2:4], uint16(len(trailing)))
+	trailing = append(trailing, 0, 0, 0, 0)
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"port_unreachable", icmpError(ICMP4Unreachable, ICMP4PortUnreachable), true},
+		{"proto_unreachable", icmpError(ICMP4Unreachable, ICMP4ProtoUnreachable), true},
+		{"host_unreachable", icmpError(ICMP4Unreachable, ICMP4HostUnreachable), true},
+		{"host_unknown", icmpError(ICMP4Unreachable, ICMP4HostUnknown), true},
+		{"admin_prohibited", icmpError(ICMP4Unreachable, ICMP4AdminProhibited), true},
+		{"host_prohibited", icmpError(ICMP4Unreachable, ICMP4HostProhibited), true},
+		{"net_unreachable", icmpError(ICMP4Unreachable, ICMP4NetUnreachable), false},
+		{"frag_needed", icmpError(ICMP4Unreachable, ICMP4FragNeeded), false},
+		{"source_route_failed", icmpError(ICMP4Unreachable, 5), false},
+		{"ttl_exceeded", icmpError(ICMP4TimeExceeded, 0), false},
+		{"reassembly_time_exceeded", icmpError(ICMP4TimeExceeded, 1), false},
+		{"no_quote", noQuote, false},
+		{"trailing_bytes", trailing, false},
+		{"echo_request", icmpRequestBuffer, false},
+		{"udp", udpRequestBuffer, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.ICMPTerminatesFlow(); got != tt.want {
+			t.Errorf("%s: ICMPTerminatesFlow = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want int
+	}{
+		{"nil", nil, 0},
+		{"empty", []byte{}, 0},
+		{"ipv4", udpRequestBuffer, 4},
+		{"ipv6", ipv6PacketBuffer, 6},
+		{"short_ipv4", udpRequestBuffer[:ipHeaderLength-1], 0},
+		{"short_ipv6", ipv6PacketBuffer[:ip6HeaderLength-1], 0},
+		{"min_ipv4", udpRequestBuffer[:ipHeaderLength], 4},
+		{"one_byte", []byte{0x45}, 0},
+		{"version_5", append([]byte{0x55}, udpRequestBuffer[1:]...), 0},
+		// An Ethernet frame is only recognized by accident of its
+		// destination MAC, so this one, like most, isn't.
+		{"ethernet", append([]byte{0x02, 0, 0, 0, 0, 1, 0x02, 0, 0, 0, 0, 2, 0x08, 0x00}, udpRequestBuffer...), 0},
+	}
+	for _, tt := range tests {
+		if got := IPVersion(tt.buf); got != tt.want {
+			t.Errorf("%s: IPVersion = %d; want %d", tt.name, got, tt.want)
+		}
+		var q Parsed
+		q.Decode(tt.buf)
+		if int(q.IPVersion) != tt.want {
+			t.Errorf("%s: Decode set IPVersion %d; want %d", tt.name, q.IPVersion, tt.want)
+		}
+	}
+}
+
+func TestDecodeGSO(t *testing.T) {
+	zeroLength := func(pkt []byte) []byte {
+		pkt = append([]byte(nil), pkt...)
+		put16(pkt[2:4], 0)
+		return pkt
+	}
+	big := make([]byte, 70000)
+	copy(big, tcpCaptureBuffer[:52]) // IP and TCP headers
+	badIHL := zeroLength(tcpCaptureBuffer)
+	badIHL[0] = 0x44
+	shortLength := append([]byte(nil), tcpCaptureBuffer...)
+	put16(shortLength[2:4], 10)
+
+	tests := []struct {
+		name       string
+		pkt        []byte
+		wantProto  IP4Proto // from DecodeGSO; Decode must say Unknown
+		payloadLen int
+	}{
+		{"zero_length", zeroLength(tcpCaptureBuffer), TCP, 7},
+		{"zero_length_ip_options", zeroLength(withIP4Options(tcpCaptureBuffer, []byte{0x01, 0x01, 0x01, 0x00})), TCP, 7},
+		{"over_64k", zeroLength(big), TCP, len(big) - 52},
+		{"zero_length_bad_ihl", badIHL, Unknown, 0},
+		{"short_length", shortLength, Unknown, 0},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if q.IPProto != Unknown {
+			t.Errorf("%s: Decode IPProto = %v; want Unknown", tt.name, q.IPProto)
+		}
+		DecodeGSO(tt.pkt, &q)
+		if q.IPProto != tt.wantProto || len(q.Payload()) != tt.payloadLen {
+			t.Errorf("%s: DecodeGSO IPProto = %v, %d bytes of payload; want %v, %d", tt.name, q.IPProto, len(q.Payload()), tt.wantProto, tt.payloadLen)
+		}
+	}
+
+	// Other packets decode exactly as with Decode.
+	for _, pkt := range [][]byte{tcpCaptureBuffer, udpRequestBuffer, ipv6PacketBuffer, unknownPacketBuffer, {0x45, 0x00}} {
+		var got, want Parsed
+		DecodeGSO(pkt, &got)
+		want.Decode(pkt)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%x: DecodeGSO = %v; Decode = %v", pkt, got.String(), want.String())
+		}
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	bufs := [][]byte{tcpPacketBuffer, udpRequestBuffer, ipv6PacketBuffer, unknownPacketBuffer, {0x45, 0x00}, icmpRequestBuffer}
+	check := func(name string, out []Parsed, bufs [][]byte) {
+		t.Helper()
+		for i, b := range bufs {
+			var want Parsed
+			want.Decode(b)
+			if !reflect.DeepEqual(out[i], want) {
+				t.Errorf("%s: packet %d decoded as %v; want %v", name, i, out[i].String(), want.String())
+			}
+		}
+	}
+
+	out := make([]Parsed, len(bufs)+2)
+	// Leftovers from an earlier batch must not survive.
+	for i := range out {
+		out[i].Decode(tcpPacketBuffer)
+	}
+	if n := DecodeBatch(bufs, out); n != len(bufs) {
+		t.Fatalf("DecodeBatch = %d; want %d", n, len(bufs))
+	}
+	check("full", out, bufs)
+
+	short := make([]Parsed, 4)
+	n := DecodeBatch(bufs, short)
+	if n != len(short) {
+		t.Fatalf("short out: DecodeBatch = %d; want %d", n, len(short))
+	}
+	check("short", short, bufs[:n])
+	n = DecodeBatch(bufs[n:], short)
+	if n != len(bufs)-len(short) {
+		t.Fatalf("rest: DecodeBatch = %d; want %d", n, len(bufs)-len(short))
+	}
+	check("rest", short, bufs[len(short):])
+
+	if n := DecodeBatch(nil, out); n != 0 {
+		t.Errorf("empty batch: DecodeBatch = %d", n)
+	}
+
+	if n := testing.AllocsPerRun(100, func() { DecodeBatch(bufs, out) }); n != 0 {
+		t.Errorf("DecodeBatch allocates %v times; want 0", n)
+	}
+}
+
+func TestDecodeIPOnly(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		buf  []byte
+	}{
+		{"tcp", tcpPacketBuffer},
+		{"udp", udpRequestBuffer},
+		{"icmp", icmpRequestBuffer},
+		{"ip_options", withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00})},
+	} {
+		var full, ipOnly Parsed
+		full.Decode(tt.buf)
+		if err := DecodeIPOnly(tt.buf, &ipOnly); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !ipOnly.TransportSkipped || full.TransportSkipped {
+			t.Errorf("%s: TransportSkipped = %v, %v for DecodeIPOnly, Decode", tt.name, ipOnly.TransportSkipped, full.TransportSkipped)
+		}
+		if ipOnly.IPVersion != 4 || ipOnly.IPProto != full.IPProto || ipOnly.SrcIP != full.SrcIP || ipOnly.DstIP != full.DstIP ||
+			ipOnly.IPID != full.IPID || ipOnly.HasIPOptions != full.HasIPOptions {
+			t.Errorf("%s: IP fields %+v; want those of %+v", tt.name, ipOnly, full)
+		}
+		if ipOnly.SrcPort != 0 || ipOnly.DstPort != 0 || ipOnly.TCPFlags != 0 {
+			t.Errorf("%s: transport fields set: ports %d, %d, flags %#x", tt.name, ipOnly.SrcPort, ipOnly.DstPort, ipOnly.TCPFlags)
+		}
+		hlen := int(tt.buf[0]&0x0F) << 2
+		if !bytes.Equal(ipOnly.Payload(), tt.buf[hlen:]) {
+			t.Errorf("%s: Payload() = %x; want the IP payload", tt.name, ipOnly.Payload())
+		}
+
+		// Decoding the rest later gives the full result.
+		ipOnly.Decode(ipOnly.Buffer())
+		if !reflect.DeepEqual(ipOnly, full) {
+			t.Errorf("%s: redecoded %+v; want %+v", tt.name, ipOnly, full)
+		}
+	}
+
+	// The declared protocol is kept, even where Decode would report
+	// Unknown or Fragment.
+	gre := append([]byte(nil), udpRequestBuffer...)
+	gre[9] = 47
+	frag := append([]byte(nil), tcpPacketBuffer...)
+	put16(frag[6:8], 185)
+	shortTCP := append([]byte(nil), udpRequestBuffer...)
+	shortTCP[9] = uint8(TCP)
+	for _, tt := range []struct {
+		name string
+		buf  []byte
+		want IP4Proto
+	}{
+		{"gre", gre, 47},
+		{"later_fragment", frag, TCP},
+		{"tcp_with_udp_sized_header", shortTCP, TCP},
+	} {
+		var q Parsed
+		if err := DecodeIPOnly(tt.buf, &q); err != nil || q.IPProto != tt.want {
+			t.Errorf("%s: IPProto = %v, err %v; want %v, nil", tt.name, q.IPProto, err, tt.want)
+		}
+	}
+
+	var q Parsed
+	if err := DecodeIPOnly(ipv6PacketBuffer, &q); err != nil || q.IPVersion != 6 || q.IPProto != ICMPv6 || q.HopLimit != 255 {
+		t.Errorf("IPv6: got %+v, %v", q, err)
+	}
+	bad := append([]byte(nil), udpRequestBuffer...)
+	bad[0] = 0x43
+	for _, buf := range [][]byte{nil, bad, udpRequestBuffer[:25], ipv6PacketBuffer[:44]} {
+		if err := DecodeIPOnly(buf, &q); err == nil || q.IPProto != Unknown || !q.TransportSkipped {
+			t.Errorf("DecodeIPOnly(%x) = %v, IPProto %v; want error, Unknown", buf, err, q.IPProto)
+		}
+	}
+	if n := testing.AllocsPerRun(100, func() { DecodeIPOnly(tcpPacketBuffer, &q) }); n != 0 {
+		t.Errorf("DecodeIPOnly allocates %v times; want 0", n)
+	}
+}
+
+// TestDecodeIPOnlyAccessors checks that transport header accessors
+// don't read headers DecodeIPOnly didn't check.
+func TestDecodeIPOnlyAccessors(t *testing.T) {
+	var pkts [][]byte
+	for _, proto := range []IP4Proto{TCP, UDP, ICMP, VRRP, ESP, AH, PIM} {
+		h := IP4Header{IPProto: proto, SrcIP: 0x01020304, DstIP: 0x05060708}
+		pkts = append(pkts, Generate(&h, nil))
+	}
+	// A later fragment, whose data isn't a transport header.
+	frag := make([]byte, 48)
+	copy(frag, tcpPacketBuffer[:ipHeaderLength])
+	put16(frag[2:4], uint16(len(frag)))
+	put16(frag[6:8], 185)
+	frag[ipHeaderLength+13] = TCPSyn | TCPFin
+	pkts = append(pkts, frag)
+
+	for _, pkt := range pkts {
+		var q Parsed
+		if err := DecodeIPOnly(pkt, &q); err != nil {
+			t.Fatalf("DecodeIPOnly(%x): %v", pkt, err)
+		}
+		name := q.IPProto.String()
+		if h := q.ICMPHeader(); h.Type != 0 || h.Code != 0 {
+			t.Errorf("%s: ICMPHeader = %+v", name, h)
+		}
+		if h := q.TCPHeader(); h.SrcPort != 0 || h.DstPort != 0 || h.Seq != 0 || h.Flags != 0 {
+			t.Errorf("%s: TCPHeader = %+v", name, h)
+		}
+		if v := q.ICMP4RestOfHeader(); v != 0 {
+			t.Errorf("%s: ICMP4RestOfHeader = %#x", name, v)
+		}
+		if _, ok := q.VRRPHeader(); ok {
+			t.Errorf("%s: VRRPHeader ok", name)
+		}
+		if q.VRRPChecksumValid() {
+			t.Errorf("%s: VRRPChecksumValid", name)
+		}
+		if _, ok := q.ESPHeader(); ok {
+			t.Errorf("%s: ESPHeader ok", name)
+		}
+		if _, ok := q.AHHeader(); ok {
+			t.Errorf("%s: AHHeader ok", name)
+		}
+		if _, ok := q.PIMHeader(); ok {
+			t.Errorf("%s: PIMHeader ok", name)
+		}
+		if _, ok := q.AddrMaskHeader(); ok {
+			t.Errorf("%s: AddrMaskHeader ok", name)
+		}
+		if _, ok := q.ICMPInnerPacket(); ok || q.IsError() || q.ICMPTerminatesFlow() || q.IsEchoRequest() || q.IsEchoResponse() {
+			t.Errorf("%s: classified as an ICMP error or echo", name)
+		}
+		if _, ok := q.TransportChecksumOffset(); ok {
+			t.Errorf("%s: TransportChecksumOffset ok", name)
+		}
+		if n := q.HeaderLen(); n != 0 {
+			t.Errorf("%s: HeaderLen = %d", name, n)
+		}
+		if q.HasValidPorts() || q.IsTCPFlagsAnomalous() || q.TCPPayloadLen() != 0 {
+			t.Errorf("%s: TCP or port state reported", name)
+		}
+		if _, ok := q.TCPMSS(); ok {
+			t.Errorf("%s: TCPMSS ok", name)
+		}
+		if _, _, ok := q.TCPTimestamps(); ok {
+			t.Errorf("%s: TCPTimestamps ok", name)
+		}
+		if _, ok := q.TCPWindowScale(); ok {
+			t.Errorf("%s: TCPWindowScale ok", name)
+		}
+		if q.IsDHCP() {
+			t.Errorf("%s: IsDHCP", name)
+		}
+		if _, err := q.MakeTCPKeepalive(make([]byte, 64)); err == nil {
+			t.Errorf("%s: MakeTCPKeepalive succeeded", name)
+		}
+	}
+}
+
+func TestDecodeAt(t *testing.T) {
+	// A UDP packet after a 14-byte Ethernet header.
+	frame := append(make([]byte, 14), udpRequestBuffer...)
+	var got Parsed
+	if err := DecodeAt(frame, 14, &got); err != nil {
+		t.Fatal(err)
+	}
+	var want Parsed
+	want.Decode(udpRequestBuffer)
+	if got.String() != want.String() || !bytes.Equal(got.Payload(), want.Payload()) {
+		t.Errorf("got %v %q; want %v %q", &got, got.Payload(), &want, want.Payload())
+	}
+
+	if err := DecodeAt(append(make([]byte, 18), ipv6PacketBuffer...), 18, &got); err != nil {
+		t.Errorf("IPv6: %v", err)
+	}
+	if got.IPVersion != 6 {
+		t.Errorf("IPv6: IPVersion = %d; want 6", got.IPVersion)
+	}
+
+	bad := append([]byte(nil), frame...)
+	bad[14] = 0x43
+	err := DecodeAt(bad, 14, &got)
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Field != "IHL" || perr.Offset != 14 {
+		t.Errorf("bad IHL: got err %v; want IHL error at offset 14", err)
+	}
+	if got.IPProto != Unknown {
+		t.Errorf("bad IHL: IPProto = %v; want Unknown", got.IPProto)
+	}
+
+	if err := DecodeAt(frame, len(frame)+1, &got); err != ErrSmallBuffer {
+		t.Errorf("offset past end: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	if err := DecodeAt(frame, -1, &got); err != ErrSmallBuffer {
+		t.Errorf("negative offset: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestDecodeInconsistentLengths(t *testing.T) {
+	modify := func(f func([]byte)) []byte {
+		b := append([]byte(nil), tcpPacketBuffer...)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"ihl_too_small", modify(func(b []byte) { b[0] = 0x43 })},
+		{"ihl_past_end", modify(func(b []byte) { b[0] = 0x4f; put16(b[2:4], 50) })},
+		{"total_length_in_header", modify(func(b []byte) { put16(b[2:4], 20) })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Parsed
+			p.Decode(tt.buf)
+			if p.IPProto != Unknown {
+				t.Errorf("IPProto = %v; want Unknown", p.IPProto)
+			}
+		})
+	}
+}
+
+func TestTCPUrgent(t *testing.T) {
+	h := TCP4Header{
+		IP4Header: IP4Header{SrcIP: 1, DstIP: 2},
+		SrcPort:   10,
+		DstPort:   20,
+		Seq:       100,
+		Ack:       200,
+		Flags:     TCPAck,
+		Window:    1000,
+		Urgent:    5,
+	}
+	buf := make([]byte, h.Len()+10)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := get16(buf[38:40]); got != 0 {
+		t.Errorf("urgent pointer = %d with URG clear; want 0", got)
+	}
+	var p Parsed
+	p.Decode(buf)
+	if p.HasUrgent() {
+		t.Errorf("HasUrgent with URG clear")
+	}
+	want := h
+	want.Urgent = 0
+	want.IPProto = TCP
+	if got := p.TCPHeader(); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v; want %+v", got, want)
+	}
+
+	h.Flags |= TCPUrg
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := get16(buf[38:40]); got != 5 {
+		t.Errorf("urgent pointer = %d; want 5", got)
+	}
+	if got := transportChecksum4(buf); got != 0 {
+		t.Errorf("TCP checksum doesn't verify (%#x)", got)
+	}
+	p.Decode(buf)
+	if !p.HasUrgent() {
+		t.Errorf("HasUrgent false with URG set")
+	}
+	want = h
+	want.IPProto = TCP
+	if got := p.TCPHeader(); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v; want %+v", got, want)
+	}
+}
+
+func TestIPHeaderBytes(t *testing.T) {
+	opts := []byte{0x07, 0x03, 0x04, 0x00} // record route, then EOL
+	buf := withIP4Options(udpRequestBuffer, opts)
+	var p Parsed
+	p.Decode(buf)
+	hdr := p.IPHeaderBytes()
+	if !bytes.Equal(hdr, buf[:24]) {
+		t.Errorf("got %x; want %x", hdr, buf[:24])
+	}
+
+	// Reassemble the packet verbatim from its parts.
+	re := append(append([]byte(nil), hdr...), p.Sub(0, 8)...)
+	re = append(re, p.Payload()...)
+	if !bytes.Equal(re, buf) {
+		t.Errorf("reassembled %x; want %x", re, buf)
+	}
+
+	for _, b := range [][]byte{ipv6PacketBuffer, unknownPacketBuffer, udpRequestBuffer[:25]} {
+		p.Decode(b)
+		if hdr := p.IPHeaderBytes(); hdr != nil {
+			t.Errorf("IPHeaderBytes(%x) = %x; want nil", b, hdr)
+		}
+	}
+}
+
+func TestIHL(t *testing.T) {
+	opts := withIP4Options(udpRequestBuffer, []byte{0x07, 0x03, 0x04, 0x00})
+	ihl4 := append([]byte(nil), udpRequestBuffer...)
+	ihl4[0] = 0x44
+	badLength := append([]byte(nil), udpRequestBuffer...)
+	put16(badLength[2:4], 1000)
+
+	tests := []struct {
+		name string
+		buf  []byte
+		want int
+		ok   bool
+		// parsed is Parsed.IPHeaderLen, which is 0 unless Decode
+		// accepts the whole IP header.
+		parsed int
+	}{
+		{"no_options", udpRequestBuffer, 20, true, 20},
+		{"options", opts, 24, true, 24},
+		{"header_only", udpRequestBuffer[:20], 20, true, 0},
+		{"options_truncated", opts[:22], 0, false, 0},
+		{"ihl_4", ihl4, 0, false, 0},
+		// IHL doesn't check the total length; Decode does.
+		{"bad_total_length", badLength, 20, true, 0},
+		{"short", udpRequestBuffer[:19], 0, false, 0},
+		{"ipv6", ipv6PacketBuffer, 0, false, 0},
+		{"empty", nil, 0, false, 0},
+	}
+	for _, tt := range tests {
+		n, ok := IHL(tt.buf)
+		if n != tt.want || ok != tt.ok {
+			t.Errorf("%s: IHL = %d, %v; want %d, %v", tt.name, n, ok, tt.want, tt.ok)
+		}
+		var q Parsed
+		q.Decode(tt.buf)
+		if got := q.IPHeaderLen(); got != tt.parsed {
+			t.Errorf("%s: IPHeaderLen = %d; want %d", tt.name, got, tt.parsed)
+		}
+	}
+
+	// The TCP header is HeaderLen's business, not IPHeaderLen's.
+	var q Parsed
+	q.Decode(tcpPacketBuffer)
+	if q.IPHeaderLen() != ipHeaderLength || q.HeaderLen() == ipHeaderLength {
+		t.Errorf("TCP: IPHeaderLen = %d, HeaderLen = %d", q.IPHeaderLen(), q.HeaderLen())
+	}
+}
+
+func TestIP4Multicast(t *testing.T) {
+	tests := []struct {
+		ip    string
+		mcast bool
+		local bool
+		mac   [6]byte
+	}{
+		{"224.0.0.1", true, true, [6]byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}},
+		{"224.0.0.251", true, true, [6]byte{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}},
+		{"224.0.1.1", true, false, [6]byte{0x01, 0x00, 0x5e, 0x00, 0x01, 0x01}},
+		{"239.255.255.250", true, false, [6]byte{0x01, 0x00, 0x5e, 0x7f, 0xff, 0xfa}},
+		// The high bit of the second octet is dropped, so these
+		// share a MAC with 224.1.1.1.
+		{"224.129.1.1", true, false, [6]byte{0x01, 0x00, 0x5e, 0x01, 0x01, 0x01}},
+		{"225.1.1.1", true, false, [6]byte{0x01, 0x00, 0x5e, 0x01, 0x01, 0x01}},
+		{"223.0.0.1", false, false, [6]byte{}},
+	}
+	for _, tt := range tests {
+		ip := NewIP4(net.ParseIP(tt.ip))
+		if got := ip.IsMulticast(); got != tt.mcast {
+			t.Errorf("%s: IsMulticast = %v; want %v", tt.ip, got, tt.mcast)
+		}
+		if got := ip.IsLocalMulticast(); got != tt.local {
+			t.Errorf("%s: IsLocalMulticast = %v; want %v", tt.ip, got, tt.local)
+		}
+		if tt.mcast {
+			if got := ip.MulticastMAC(); got != tt.mac {
+				t.Errorf("%s: MulticastMAC = % x; want % x", tt.ip, got, tt.mac)
+			}
+		}
+	}
+}
+
+func TestIsForLocalIP(t *testing.T) {
+	if !IP4(0xffffffff).IsBroadcast() || IP4(0xfffffffe).IsBroadcast() {
+		t.Errorf("IsBroadcast wrong for 255.255.255.255 or 255.255.255.254")
+	}
+
+	locals := NewPrefixSet([]Prefix{mustPrefix("5.6.7.8/32"), mustPrefix("100.64.0.0/10")})
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"5.6.7.8", true},
+		{"5.6.7.9", false},
+		{"100.101.102.103", true},
+		{"255.255.255.255", true},
+		{"224.0.0.1", true},
+		{"224.0.0.2", false},
+		{"8.8.8.8", false},
+	}
+	for _, tt := range tests {
+		buf := append([]byte(nil), udpRequestBuffer...)
+		put32(buf[16:20], uint32(NewIP4(net.ParseIP(tt.dst))))
+		var q Parsed
+		q.Decode(buf)
+		if got := q.IsForLocalIP(locals.Contains); got != tt.want {
+			t.Errorf("%s: IsForLocalIP = %v; want %v", tt.dst, got, tt.want)
+		}
+	}
+
+	var q Parsed
+	q.Decode(ipv6PacketBuffer)
+	if q.IsForLocalIP(func(IP4) bool { return true }) {
+		t.Errorf("IsForLocalIP true for IPv6 packet")
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	modify := func(b []byte, f func([]byte)) []byte {
+		b = append([]byte(nil), b...)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name      string
+		buf       []byte
+		wantField string // empty if no error expected
+	}{
+		{"tcp", tcpPacketBuffer, ""},
+		{"udp", udpRequestBuffer, ""},
+		{"ipv6", ipv6PacketBuffer, ""},
+		{"trailer", append(append([]byte(nil), udpRequestBuffer...), 0, 0), "TotalLength"},
+		{"truncated", udpRequestBuffer[:40], "TotalLength"},
+		{"udp_length", modify(udpRequestBuffer, func(b []byte) { put16(b[24:26], 20) }), "UDPLength"},
+		// The UDP length of a first fragment covers the whole datagram.
+		{"udp_first_fragment", modify(udpRequestBuffer, func(b []byte) { put16(b[24:26], 2000); b[6] = 0x20 }), ""},
+		{"ipv6_trailer", append(append([]byte(nil), ipv6PacketBuffer...), 0), "PayloadLength"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Parsed
+			err := DecodeStrict(tt.buf, &p)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var lenient Parsed
+				lenient.Decode(tt.buf)
+				if !reflect.DeepEqual(p, lenient) {
+					t.Errorf("got %#v; want same as Decode: %#v", p, lenient)
+				}
+				return
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Field != tt.wantField {
+				t.Fatalf("got err %v; want %s error", err, tt.wantField)
+			}
+			if p.IPProto != Unknown {
+				t.Errorf("IPProto = %v; want Unknown", p.IPProto)
+			}
+		})
+	}
+
+	// Lenient decoding still accepts the trailer.
+	var p Parsed
+	p.Decode(tests[3].buf)
+	if p.IPProto != UDP {
+		t.Errorf("Decode with trailer: IPProto = %v; want UDP", p.IPProto)
+	}
+}
+
+func TestHeaderOnly(t *testing.T) {
+	src := IP4Port{IP: 0x01020304, Port: 123}
+	dst := IP4Port{IP: 0x05060708, Port: 567}
+
+	t.Run("tcp_ack", func(t *testing.T) {
+		buf := make([]byte, tcpTotalHeaderLength)
+		n, err := MakeTCP4(src, dst, 100, 200, TCPAck, 1024, nil, buf)
+		if err != nil || n != tcpTotalHeaderLength {
+			t.Fatalf("MakeTCP4 = %d, %v; want %d, nil", n, err, tcpTotalHeaderLength)
+		}
+		if transportChecksum4(buf) != 0 || ipChecksum(buf[:20]) != 0 {
+			t.Errorf("bad checksums in %x", buf)
+		}
+		var q Parsed
+		q.Decode(buf)
+		if q.IPProto != TCP || q.TCPFlags != TCPAck || len(q.Payload()) != 0 {
+			t.Fatalf("decoded %v flags %#x payload %x", q.IPProto, q.TCPFlags, q.Payload())
+		}
+		h := q.TCPHeader()
+		out := make([]byte, h.Len())
+		if err := h.Marshal(out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, buf) {
+			t.Errorf("round trip: %s", Diff(buf, out))
+		}
+		if err := DecodeStrict(buf, &q); err != nil {
+			t.Errorf("DecodeStrict: %v", err)
+		}
+	})
+	t.Run("udp_empty", func(t *testing.T) {
+		buf := make([]byte, udpTotalHeaderLength)
+		n, err := MakeUDP4(src, dst, nil, buf)
+		if err != nil || n != udpTotalHeaderLength {
+			t.Fatalf("MakeUDP4 = %d, %v; want %d, nil", n, err, udpTotalHeaderLength)
+		}
+		if get16(buf[24:26]) != udpHeaderLength {
+			t.Errorf("UDP length = %d; want %d", get16(buf[24:26]), udpHeaderLength)
+		}
+		if transportChecksum4(buf) != 0 || ipChecksum(buf[:20]) != 0 {
+			t.Errorf("bad checksums in %x", buf)
+		}
+		var q Parsed
+		q.Decode(buf)
+		if q.IPProto != UDP || q.SrcPort != 123 || q.DstPort != 567 || len(q.Payload()) != 0 {
+			t.Fatalf("decoded %v", &q)
+		}
+		h := q.UDPHeader()
+		out := Generate(&h, nil)
+		if !bytes.Equal(out, buf) {
+			t.Errorf("round trip: %s", Diff(buf, out))
+		}
+		if err := DecodeStrict(buf, &q); err != nil {
+			t.Errorf("DecodeStrict: %v", err)
+		}
+	})
+	t.Run("icmp", func(t *testing.T) {
+		h := ICMP4Header{IP4Header: IP4Header{SrcIP: src.IP, DstIP: dst.IP}, Type: ICMP4EchoRequest}
+		buf := Generate(&h, nil)
+		if len(buf) != icmpAllHeadersLength || ipChecksum(buf[20:]) != 0 {
+			t.Fatalf("bad header-only ICMP %x", buf)
+		}
+		var q Parsed
+		q.Decode(buf)
+		if q.IPProto != ICMP || len(q.Payload()) != 0 {
+			t.Fatalf("decoded %v payload %x", &q, q.Payload())
+		}
+	})
+	t.Run("tcp_bad_data_offset", func(t *testing.T) {
+		buf := make([]byte, tcpTotalHeaderLength)
+		MakeTCP4(src, dst, 100, 200, TCPAck, 1024, nil, buf)
+		buf[32] = 0xf0 // 60-byte TCP header in a 20-byte segment
+		var q Parsed
+		q.Decode(buf)
+		if len(q.Payload()) != 0 {
+			t.Errorf("Payload = %x; want empty", q.Payload())
+		}
+	})
+	t.Run("ip_only", func(t *testing.T) {
+		h := IP4Header{IPProto: UDP, SrcIP: src.IP, DstIP: dst.IP}
+		buf := Generate(&h, nil)
+		var q Parsed
+		q.Decode(buf)
+		if q.IPProto != Unknown {
+			t.Errorf("UDP without UDP header decoded as %v", q.IPProto)
+		}
+		var ih IP4Header
+		if err := ih.Parse(buf); err != nil || !reflect.DeepEqual(ih, h) {
+			t.Errorf("Parse = %+v, %v; want %+v", ih, err, h)
+		}
+	})
+}
+
+func TestICMP4RestOfHeader(t *testing.T) {
+	var q Parsed
+	q.Decode(icmpRequestBuffer)
+	want := get32(icmpRequestBuffer[24:28])
+	if got := q.ICMP4RestOfHeader(); got != want {
+		t.Errorf("echo request: got %#08x; want %#08x", got, want)
+	}
+
+	buf := make([]byte, 128)
+	n, err := MakeICMP4FragNeeded(udpRequestBuffer, 1400, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Decode(buf[:n])
+	if got := q.ICMP4RestOfHeader(); got != 1400 {
+		t.Errorf("frag needed: got %#08x; want MTU 1400", got)
+	}
+
+	q.Decode(udpRequestBuffer)
+	if got := q.ICMP4RestOfHeader(); got != 0 {
+		t.Errorf("UDP: got %#08x; want 0", got)
+	}
+	short := Generate(&ICMP4Header{Type: ICMP4EchoRequest}, nil)
+	q.Decode(short)
+	if got := q.ICMP4RestOfHeader(); got != 0 {
+		t.Errorf("header-only ICMP: got %#08x; want 0", got)
+	}
+}
+
+func TestDecodeIPID(t *testing.T) {
+	buf := append([]byte(nil), udpRequestBuffer...)
+	put16(buf[4:6], 0xbeef)
+	var p Parsed
+	p.Decode(buf)
+	if p.IPID != 0xbeef {
+		t.Fatalf("IPID = %#04x; want 0xbeef", p.IPID)
+	}
+
+	h := p.UDPHeader()
+	if h.IPID != 0xbeef {
+		t.Errorf("UDPHeader().IPID = %#04x; want 0xbeef", h.IPID)
+	}
+	out := make([]byte, len(buf))
+	if err := h.Marshal(out); err != nil {
+		t.Fatal(err)
+	}
+	var p2 Parsed
+	p2.Decode(out)
+	if p2.IPID != 0xbeef {
+		t.Errorf("after re-marshal, IPID = %#04x; want 0xbeef", p2.IPID)
+	}
+}
+
+func TestHasValidPorts(t *testing.T) {
+	frag := append([]byte(nil), udpRequestBuffer...)
+	put16(frag[6:8], 0x20) // offset 256 bytes
+	put16(frag[10:12], ChecksumExcluding(frag[:20], 10))
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"tcp", tcpPacketBuffer, true},
+		{"udp", udpRequestBuffer, true},
+		{"icmp", icmpRequestBuffer, false},
+		{"ipv6", ipv6PacketBuffer, false},
+		{"fragment", frag, false},
+		{"unknown", unknownPacketBuffer, false},
+		{"truncated_udp", udpRequestBuffer[:24], false},
+	}
+	for _, tt := range tests {
+		// Decode a packet with ports first, to check that they
+		// don't leak into the next packet.
+		var q Parsed
+		q.Decode(udpRequestBuffer)
+		q.Decode(tt.pkt)
+		if got := q.HasValidPorts(); got != tt.want {
+			t.Errorf("%s: HasValidPorts = %v; want %v", tt.name, got, tt.want)
+		}
+		if !tt.want && (q.SrcPort != 0 || q.DstPort != 0) {
+			t.Errorf("%s: ports %d, %d; want zero", tt.name, q.SrcPort, q.DstPort)
+		}
+	}
+}
+
+func TestSwapAddresses(t *testing.T) {
+	src := IP4Port{IP: 0x01020304, Port: 123}
+	dst := IP4Port{IP: 0x05060708, Port: 567}
+	tcp := make([]byte, 64)
+	n, err := MakeTCP4(src, dst, 1, 2, TCPAck, 100, []byte("tcp payload"), tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp = tcp[:n]
+	udp := make([]byte, 64)
+	n, err = MakeUDP4(src, dst, []byte("udp payload"), udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp = udp[:n]
+
+	for _, pkt := range [][]byte{tcp, udp} {
+		var q Parsed
+		q.Decode(pkt)
+		q.SwapAddresses(pkt)
+		if q.SrcIP != dst.IP || q.DstIP != src.IP {
+			t.Errorf("%v: Parsed addresses %v > %v after swap", q.IPProto, q.SrcIP, q.DstIP)
+		}
+		var q2 Parsed
+		q2.Decode(pkt)
+		if q2.SrcIP != dst.IP || q2.DstIP != src.IP || q2.SrcPort != src.Port || q2.DstPort != dst.Port {
+			t.Errorf("%v: swapped packet decodes as %v", q.IPProto, &q2)
+		}
+		if ipChecksum(pkt[:20]) != 0 || transportChecksum4(pkt) != 0 {
+			t.Errorf("%v: bad checksum after swap", q.IPProto)
+		}
+	}
+
+	udp6 := makeUDP6(4)
+	put16(udp6[46:48], transportChecksum6(udp6))
+	var q Parsed
+	q.Decode(udp6)
+	q.SwapAddresses(udp6)
+	if ip6FromBytes(udp6[8:24]) != testIP6Dst || ip6FromBytes(udp6[24:40]) != testIP6Src {
+		t.Errorf("IPv6 addresses not swapped")
+	}
+	if transportChecksum6(udp6) != 0 {
+		t.Errorf("IPv6: bad checksum after swap")
+	}
+}
+
+func TestFixIPChecksum(t *testing.T) {
+	var p Parsed
+	p.Decode(udpRequestBuffer)
+	want := make([]byte, len(udpRequestBuffer))
+	h := p.UDPHeader()
+	if err := h.Marshal(want); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[udpHeaderLength+ipHeaderLength:], p.Payload())
+
+	for _, csum := range []uint16{0, 0xffff, get16(want[10:12]) ^ 0x0100} {
+		buf := append([]byte(nil), want...)
+		put16(buf[10:12], csum)
+		p.Decode(buf)
+		p.FixIPChecksum(buf)
+		if !bytes.Equal(buf, want) {
+			t.Errorf("checksum %#04x: %s", csum, Diff(want, buf))
+		}
+	}
+
+	// Options are covered too.
+	opts := withIP4Options(udpRequestBuffer, []byte{0x01, 0x01, 0x01, 0x00})
+	buf := append([]byte(nil), opts...)
+	put16(buf[10:12], 0)
+	p.Decode(buf)
+	p.FixIPChecksum(buf)
+	if !bytes.Equal(buf, opts) {
+		t.Errorf("with options: %s", Diff(opts, buf))
+	}
+
+	// Non-IPv4 packets are left alone.
+	buf = append([]byte(nil), ipv6PacketBuffer...)
+	p.Decode(buf)
+	p.FixIPChecksum(buf)
+	if !bytes.Equal(buf, ipv6PacketBuffer) {
+		t.Errorf("IPv6 packet changed")
+	}
+}
+
+func TestDF(t *testing.T) {
+	buf := append([]byte(nil), udpRequestBuffer...)
+	var p Parsed
+	p.Decode(buf)
+
+	p.ClearDF(buf)
+	if !bytes.Equal(buf, udpRequestBuffer) {
+		t.Errorf("ClearDF on packet without DF changed it: %s", Diff(udpRequestBuffer, buf))
+	}
+
+	p.SetDF(buf)
+	if buf[6]&0x40 == 0 {
+		t.Errorf("SetDF didn't set DF")
+	}
+	if ipChecksum(buf[:20]) != 0 {
+		t.Errorf("IP checksum doesn't verify after SetDF")
+	}
+	h := p.UDPHeader()
+	want := append([]byte(nil), buf...)
+	h.Marshal(want)
+	want[6] |= 0x40
+	put16(want[10:12], ChecksumExcluding(want[:20], 10))
+	if !bytes.Equal(buf[:20], want[:20]) {
+		t.Errorf("SetDF header %x; want %x", buf[:20], want[:20])
+	}
+
+	withDF := append([]byte(nil), buf...)
+	p.SetDF(buf)
+	if !bytes.Equal(buf, withDF) {
+		t.Errorf("SetDF on packet with DF changed it")
+	}
+
+	p.ClearDF(buf)
+	if !bytes.Equal(buf, udpRequestBuffer) {
+		t.Errorf("ClearDF didn't restore original: %s", Diff(udpRequestBuffer, buf))
+	}
+
+	v6 := append([]byte(nil), ipv6PacketBuffer...)
+	p.Decode(v6)
+	p.SetDF(v6)
+	if !bytes.Equal(v6, ipv6PacketBuffer) {
+		t.Errorf("SetDF modified IPv6 packet")
+	}
+}
+
+func TestClampTTL(t *testing.T) {
+	var q Parsed
+	for _, max := range []uint8{64, 65, 255} {
+		buf := append([]byte(nil), udpRequestBuffer...)
+		q.Decode(buf)
+		q.ClampTTL(max, buf)
+		if !bytes.Equal(buf, udpRequestBuffer) {
+			t.Errorf("ClampTTL(%d) on TTL 64 changed the packet: %s", max, Diff(udpRequestBuffer, buf))
+		}
+	}
+
+	for _, max := range []uint8{63, 1, 0} {
+		buf := append([]byte(nil), udpRequestBuffer...)
+		q.Decode(buf)
+		q.ClampTTL(max, buf)
+		if buf[8] != max {
+			t.Errorf("ClampTTL(%d): TTL = %d", max, buf[8])
+		}
+		if ipChecksum(buf[:ipHeaderLength]) != 0 {
+			t.Errorf("ClampTTL(%d): IP checksum doesn't verify", max)
+		}
+		want := append([]byte(nil), udpRequestBuffer...)
+		want[8] = max
+		put16(want[10:12], ChecksumExcluding(want[:ipHeaderLength], 10))
+		if !bytes.Equal(buf, want) {
+			t.Errorf("ClampTTL(%d): %s", max, Diff(want, buf))
+		}
+	}
+
+	pkt := makeUDP6(4)
+	q.Decode(pkt)
+	q.ClampTTL(64, pkt)
+	if pkt[7] != 64 || q.HopLimit != 64 {
+		t.Errorf("ClampTTL(64) changed hop limit 64 to %d", pkt[7])
+	}
+	q.ClampTTL(8, pkt)
+	if pkt[7] != 8 || q.HopLimit != 8 {
+		t.Errorf("ClampTTL(8): hop limit = %d (Parsed %d); want 8", pkt[7], q.HopLimit)
+	}
+	if want := makeUDP6(4); !bytes.Equal(pkt[8:], want[8:]) || !bytes.Equal(pkt[:7], want[:7]) {
+		t.Errorf("ClampTTL changed bytes other than the hop limit")
+	}
+
+	garbage := []byte{0x45, 0x00}
+	q.Decode(garbage)
+	q.ClampTTL(0, garbage)
+}
+
+func TestKnownProtocols(t *testing.T) {
+	protos := KnownProtocols()
+	seen := map[IP4Proto]bool{}
+	for i, p := range protos {
+		if p == Unknown || p == Fragment {
+			t.Errorf("special value %v listed", p)
+		}
+		if name := p.String(); name == "Unknown" || name == fmt.Sprintf("IPProto(%d)", uint8(p)) {
+			t.Errorf("protocol %d has no name", p)
+		}
+		if seen[p] {
+			t.Errorf("%v listed twice", p)
+		}
+		seen[p] = true
+		if i > 0 && protos[i-1] >= p {
+			t.Errorf("not in protocol number order: %v before %v", protos[i-1], p)
+		}
+	}
+	for _, p := range []IP4Proto{ICMP, TCP, UDP} {
+		if !seen[p] {
+			t.Errorf("%v not listed", p)
+		}
+	}
+
+	// Callers own the returned slice.
+	protos[0] = Unknown
+	if KnownProtocols()[0] == Unknown {
+		t.Errorf("KnownProtocols returned shared slice")
+	}
+}
+
+func TestKnownICMP4Types(t *testing.T) {
+	types := KnownICMP4Types()
+	for i, typ := range types {
+		if typ.String() == "Unknown" {
+			t.Errorf("type %d has no name", typ)
+		}
+		if i > 0 && types[i-1] >= typ {
+			t.Errorf("not in type number order: %v before %v", types[i-1], typ)
+		}
+	}
+	if len(types) < 4 {
+		t.Errorf("got %v; want at least echo, echo reply, unreachable and time exceeded", types)
+	}
+}
+
+func TestIP4HeaderParseOptions(t *testing.T) {
+	opts := []byte{0x94, 0x04, 0x00, 0x00} // router alert
+	pkt := withIP4Options(udpRequestBuffer, opts)
+
+	var h IP4Header
+	if err := h.Parse(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Options, opts) {
+		t.Fatalf("Options = %x; want %x", h.Options, opts)
+	}
+	var hc IP4Header
+	if err := hc.ParseCopy(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hc.Options, opts) {
+		t.Fatalf("ParseCopy: Options = %x; want %x", hc.Options, opts)
+	}
+
+	// Parse aliases the packet; ParseCopy doesn't.
+	pkt[ipHeaderLength] = 0x01
+	if h.Options[0] != 0x01 {
+		t.Errorf("Parse copied the options")
+	}
+	if hc.Options[0] != 0x94 {
+		t.Errorf("ParseCopy options alias the packet")
+	}
+
+	// Options from an earlier parse don't linger.
+	if err := h.Parse(udpRequestBuffer); err != nil || h.Options != nil {
+		t.Errorf("Parse without options: Options = %x, %v; want nil", h.Options, err)
+	}
+	if n := testing.AllocsPerRun(100, func() { h.Parse(pkt) }); n != 0 {
+		t.Errorf("Parse allocates %v times; want 0", n)
+	}
+}
+
+func TestIsTCPFlagsAnomalous(t *testing.T) {
+	withFlags := func(flags uint8) []byte {
+		b := append([]byte(nil), tcpPacketBuffer...)
+		b[33] = flags
+		return b
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		want bool
+	}{
+		{"syn", withFlags(TCPSyn), false},
+		{"synack", withFlags(TCPSynAck), false},
+		{"ack", withFlags(TCPAck), false},
+		{"psh_ack", withFlags(TCPPsh | TCPAck), false},
+		{"fin_ack", withFlags(TCPFin | TCPAck), false},
+		{"rst", withFlags(TCPRst), false},
+		{"rst_ack", withFlags(TCPRst | TCPAck), false},
+		{"urg_ack", withFlags(TCPUrg | TCPAck), false},
+		{"null", withFlags(0), true},
+		{"fin", withFlags(TCPFin), true},
+		{"xmas", withFlags(TCPFin | TCPPsh | TCPUrg), true},
+		{"syn_fin", withFlags(TCPSyn | TCPFin), true},
+		{"syn_fin_ack", withFlags(TCPSyn | TCPFin | TCPAck), true},
+		{"syn_rst", withFlags(TCPSyn | TCPRst), true},
+		{"fin_rst_ack", withFlags(TCPFin | TCPRst | TCPAck), true},
+		{"udp", udpRequestBuffer, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.buf)
+		if got := q.IsTCPFlagsAnomalous(); got != tt.want {
+			t.Errorf("%s: IsTCPFlagsAnomalous = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIP4ProtoString(t *testing.T) {
+	for p, want := range map[IP4Proto]string{
+		TCP:      "TCP",
+		VRRP:     "VRRP",
+		Fragment: "Frag",
+		Unknown:  "Unknown",
+		ESP:      "ESP",
+		AH:       "AH",
+		PIM:      "PIM",
+		47:       "IPProto(47)",
+		0x34:     "IPProto(52)",
+	} {
+		if got := p.String(); got != want {
+			t.Errorf("IP4Proto(%d).String() = %q; want %q", uint8(p), got, want)
+		}
+	}
+
+	gre := append([]byte(nil), udpRequestBuffer...)
+	gre[9] = 47
+	var q Parsed
+	q.Decode(gre)
+	if q.IPProto != Unknown || q.RawIPProto() != 47 {
+		t.Errorf("GRE: IPProto = %v, RawIPProto = %v", q.IPProto, q.RawIPProto())
+	}
+	if got := q.ProtoName(); got != "IPProto(47)" {
+		t.Errorf("GRE: ProtoName = %q; want %q", got, "IPProto(47)")
+	}
+	q.Decode(ipv6PacketBuffer)
+	if q.RawIPProto() != ICMPv6 {
+		t.Errorf("IPv6: RawIPProto = %v; want ICMPv6", q.RawIPProto())
+	}
+	q.Decode([]byte{0x45})
+	if q.RawIPProto() != Unknown {
+		t.Errorf("garbage: RawIPProto = %v; want Unknown", q.RawIPProto())
+	}
+}
+
+func TestTransportConsistent(t *testing.T) {
+	// withProto returns an IPv4 packet declaring proto, with n bytes
+	// of IP payload.
+	withProto := func(proto IP4Proto, n int) []byte {
+		h := IP4Header{IPProto: proto, SrcIP: 1, DstIP: 2}
+		return Generate(&h, make([]byte, n))
+	}
+	laterFrag := withProto(TCP, 8)
+	put16(laterFrag[6:8], 185) // offset 1480
+	firstFrag := withProto(TCP, 8)
+	put16(firstFrag[6:8], ip4FlagMF)
+	tcp6 := makeUDP6(4)
+	tcp6[6] = uint8(TCP)
+	frag6 := withIP6ExtHeader(makeUDP6(4), ip6Fragment, []byte{0, 0, 0x05, 0xc9, 0, 0, 0, 1})
+	truncatedTotal := append([]byte(nil), tcpPacketBuffer...)
+	put16(truncatedTotal[2:4], 28) // only 8 bytes of TCP header
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"tcp", tcpPacketBuffer, true},
+		{"tcp_with_udp_sized_header", withProto(TCP, 8), false},
+		{"tcp_min", withProto(TCP, 20), true},
+		{"tcp_19", withProto(TCP, 19), false},
+		{"tcp_truncated_total_length", truncatedTotal, false},
+		{"tcp_ip_options", withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00}), true},
+		{"udp", udpRequestBuffer, true},
+		{"udp_7", withProto(UDP, 7), false},
+		{"udp_empty", withProto(UDP, 8), true},
+		{"icmp", icmpRequestBuffer, true},
+		{"icmp_4", withProto(ICMP, 4), false},
+		{"esp_short", withProto(ESP, 7), false},
+		{"ah_short", withProto(AH, 11), false},
+		{"gre_empty", withProto(47, 0), true},
+		{"later_fragment", laterFrag, true},
+		{"short_first_fragment", firstFrag, false},
+		{"udp6", makeUDP6(0), true},
+		{"tcp6_with_udp_sized_header", tcp6, false},
+		{"ipv6_fragment", frag6, true},
+		{"garbage", []byte{0x45, 0x00}, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.TransportConsistent(); got != tt.want {
+			t.Errorf("%s: TransportConsistent = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFinalizeChecksums(t *testing.T) {
+	var q Parsed
+
+	// Rewrite several fields at once, as a NAT would, and fix up
+	// everything in one go.
+	buf := append([]byte(nil), udpRequestBuffer...)
+	q.Decode(buf)
+	buf[8] = 17                   // TTL
+	put32(buf[12:16], 0x0a010203) // source address
+	put16(buf[20:22], 4242)       // source port
+	buf[len(buf)-1] ^= 0xff       // payload
+	if err := q.FinalizeChecksums(buf); err != nil {
+		t.Fatalf("udp: %v", err)
+	}
+	if ipChecksum(buf[:ipHeaderLength]) != 0 {
+		t.Errorf("udp: IP checksum doesn't verify")
+	}
+	if !VerifyUDP4Checksum(buf) {
+		t.Errorf("udp: UDP checksum doesn't verify")
+	}
+
+	tcp := append([]byte(nil), tcpCaptureBuffer...)
+	q.Decode(tcp)
+	put32(tcp[16:20], 0x0a090807)                             // destination address
+	put32(tcp[ipHeaderLength+4:ipHeaderLength+8], 0x12345678) // sequence number
+	if err := q.FinalizeChecksums(tcp); err != nil {
+		t.Fatalf("tcp: %v", err)
+	}
+	if ipChecksum(tcp[:ipHeaderLength]) != 0 || !VerifyTCP4Checksum(tcp) {
+		t.Errorf("tcp: checksums don't verify")
+	}
+
+	// ICMP has no pseudo-header.
+	icmp := append([]byte(nil), icmpRequestBuffer...)
+	q.Decode(icmp)
+	put32(icmp[12:16], 0x0a010203)
+	put16(icmp[ipHeaderLength+6:ipHeaderLength+8], 99) // echo sequence
+	if err := q.FinalizeChecksums(icmp); err != nil {
+		t.Fatalf("icmp: %v", err)
+	}
+	if ipChecksum(icmp[:ipHeaderLength]) != 0 || ipChecksum(icmp[ipHeaderLength:]) != 0 {
+		t.Errorf("icmp: checksums don't verify")
+	}
+
+	udp6 := makeUDP6(5)
+	q.Decode(udp6)
+	udp6[23] ^= 0x01 // source address
+	if err := q.FinalizeChecksums(udp6); err != nil {
+		t.Fatalf("udp6: %v", err)
+	}
+	if transportChecksum6(udp6) != 0 {
+		t.Errorf("udp6: UDP checksum doesn't verify")
+	}
+
+	icmp6 := append([]byte(nil), ipv6PacketBuffer...)
+	q.Decode(icmp6)
+	icmp6[7] = 1 // hop limit, not covered
+	icmp6[39] ^= 0x01
+	if err := q.FinalizeChecksums(icmp6); err != nil {
+		t.Fatalf("icmp6: %v", err)
+	}
+	if transportChecksum6(icmp6) != 0 {
+		t.Errorf("icmp6: ICMPv6 checksum doesn't verify")
+	}
+
+	// A UDP checksum that computes to zero is sent as 0xffff. Adding
+	// the correct checksum to a payload word makes the sum 0xffff.
+	zero := append([]byte(nil), udpRequestBuffer...)
+	q.Decode(zero)
+	if err := q.FinalizeChecksums(zero); err != nil {
+		t.Fatalf("udp_zero: %v", err)
+	}
+	w := uint32(get16(zero[28:30])) + uint32(get16(zero[26:28]))
+	put16(zero[28:30], uint16(w+w>>16))
+	if err := q.FinalizeChecksums(zero); err != nil {
+		t.Fatalf("udp_zero: %v", err)
+	}
+	if got := get16(zero[26:28]); got != 0xffff {
+		t.Errorf("udp_zero: checksum = %#04x; want 0xffff", got)
+	}
+	if !VerifyUDP4Checksum(zero) {
+		t.Errorf("udp_zero: UDP checksum doesn't verify")
+	}
+
+	// Fragments only get their IP checksum fixed, since the transport
+	// checksum covers data in other fragments.
+	frag := append([]byte(nil), udpRequestBuffer...)
+	q.Decode(frag)
+	put16(frag[6:8], ip4FlagMF)
+	frag[8] = 3
+	want := append([]byte(nil), frag...)
+	put16(want[10:12], ChecksumExcluding(want[:ipHeaderLength], 10))
+	if err := q.FinalizeChecksums(frag); err != nil {
+		t.Fatalf("fragment: %v", err)
+	}
+	if !bytes.Equal(frag, want) {
+		t.Errorf("fragment: %s", Diff(want, frag))
+	}
+
+	shortUDP := append([]byte(nil), udpRequestBuffer...)
+	put16(shortUDP[2:4], ipHeaderLength+6) // ends before the checksum
+	put16(shortUDP[10:12], 0)
+	for _, pkt := range [][]byte{{0x45, 0x00}, {0x60}, shortUDP} {
+		if err := q.FinalizeChecksums(pkt); err == nil {
+			t.Errorf("FinalizeChecksums(% x) succeeded", pkt)
+		}
+	}
+}
+
+func TestTransportChecksumOffset(t *testing.T) {
+	esp := append([]byte(nil), udpRequestBuffer...)
+	esp[9] = uint8(ESP)
+	frag := append([]byte(nil), udpRequestBuffer...)
+	put16(frag[6:8], 0x0100) // offset 2048
+	shortUDP := append([]byte(nil), udpRequestBuffer...)
+	put16(shortUDP[2:4], ipHeaderLength+6) // ends before the checksum
+
+	tests := []struct {
+		name   string
+		pkt    []byte
+		want   int
+		wantOK bool
+	}{
+		{"tcp", tcpPacketBuffer, ipHeaderLength + 16, true},
+		{"udp", udpRequestBuffer, ipHeaderLength + 6, true},
+		{"icmp", icmpRequestBuffer, ipHeaderLength + 2, true},
+		{"tcp_ip_options", withIP4Options(tcpPacketBuffer, []byte{0x01, 0x01, 0x01, 0x00}), ipHeaderLength + 4 + 16, true},
+		{"udp6", makeUDP6(4), ip6HeaderLength + 6, true},
+		{"udp6_hop_by_hop", withIP6ExtHeader(makeUDP6(4), ip6HopByHop, make([]byte, 8)), ip6HeaderLength + 8 + 6, true},
+		{"icmp6", ipv6PacketBuffer, ip6HeaderLength + 2, true},
+		{"esp", esp, 0, false},
+		{"later_fragment", frag, 0, false},
+		{"udp_truncated", shortUDP, 0, false},
+		{"garbage", []byte{0x45, 0x00}, 0, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		got, ok := q.TransportChecksumOffset()
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: TransportChecksumOffset() = %d, %v; want %d, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	// Callers can use it to fix up the checksum after a rewrite.
+	buf := append([]byte(nil), udpRequestBuffer...)
+	var q Parsed
+	q.Decode(buf)
+	ofs, _ := q.TransportChecksumOffset()
+	old := get16(buf[28:30])
+	put16(buf[28:30], 0x5858)
+	put16(buf[ofs:ofs+2], updateChecksum(get16(buf[ofs:ofs+2]), old, 0x5858))
+	if !VerifyUDP4Checksum(buf) {
+		t.Errorf("checksum doesn't verify after update at offset %d", ofs)
+	}
+}
+
+func TestHeaderLen(t *testing.T) {
+	tsOpts := []byte{0x01, 0x01, 0x08, 0x0a, 0, 0, 0, 1, 0, 0, 0, 2}
+	ipOpts := []byte{0x01, 0x01, 0x01, 0x00}
+	udp6 := makeUDP6(10)
+	laterFrag := []byte{0, 0, 0x05, 0x00, 0, 0, 0, 1}
+	tests := []struct {
+		name string
+		pkt  []byte
+		want int
+	}{
+		{"tcp", tcpPacketBuffer, 40},
+		{"tcp_options", withTCPOptions(tcpPacketBuffer, tsOpts), 52},
+		{"ip_and_tcp_options", withIP4Options(withTCPOptions(tcpPacketBuffer, tsOpts), ipOpts), 56},
+		{"udp", udpRequestBuffer, 28},
+		{"udp_ip_options", withIP4Options(udpRequestBuffer, ipOpts), 32},
+		{"icmp_echo", icmpRequestBuffer, 28},
+		{"fragment", makeFragment(1, 1480, false, testPayload(8)), 20},
+		{"udp6", udp6, 48},
+		{"udp6_hop_by_hop", withIP6ExtHeader(udp6, ip6HopByHop, make([]byte, 8)), 56},
+		{"ipv6_later_fragment", withIP6ExtHeader(udp6, ip6Fragment, laterFrag), 48},
+		{"ipv6_icmp", ipv6PacketBuffer, 48},
+		{"garbage", []byte{0x45, 0}, 0},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.HeaderLen(); got != tt.want {
+			t.Errorf("%s: HeaderLen = %d; want %d", tt.name, got, tt.want)
+		}
+		if q.IPVersion == 4 && q.IPProto != ICMP && q.IPProto != Fragment {
+			if got := q.HeaderLen() + len(q.Payload()); got != int(get16(tt.pkt[2:4])) {
+				t.Errorf("%s: HeaderLen + len(Payload) = %d; want packet length", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestMarshalLen(t *testing.T) {
+	tcp := &TCP4Header{
+		IP4Header: IP4Header{SrcIP: 1, DstIP: 2},
+		SrcPort:   1000,
+		DstPort:   80,
+		Flags:     TCPSyn,
+	}
+	withWS := *tcp
+	withWS.HasWindowScale = true
+	withWS.WindowScale = 7
+	withOpts := IP4Header{IPProto: UDP, SrcIP: 1, DstIP: 2, Options: []byte{0x01, 0x01, 0x01, 0x00}}
+
+	tests := []struct {
+		name       string
+		h          Header
+		payloadLen int
+		want       int
+	}{
+		{"ip4", &IP4Header{IPProto: UDP}, 10, ipHeaderLength + 10},
+		// Options aren't marshaled, so don't count.
+		{"ip4_options", &withOpts, 10, ipHeaderLength + 10},
+		{"udp4", &UDP4Header{}, 15, udpTotalHeaderLength + 15},
+		{"tcp4", tcp, 5, tcpTotalHeaderLength + 5},
+		{"tcp4_window_scale", &withWS, 5, tcpTotalHeaderLength + tcpWindowScaleLength + 5},
+		{"ip6", &IP6Header{IPProto: UDP}, 0, ip6HeaderLength},
+	}
+	for _, tt := range tests {
+		n, err := MarshalLen(tt.h, tt.payloadLen)
+		if err != nil || n != tt.want {
+			t.Errorf("%s: MarshalLen = %d, %v; want %d, nil", tt.name, n, err, tt.want)
+			continue
+		}
+		// Marshal accepts a buffer of that size, and fills it exactly.
+		buf := make([]byte, n)
+		if err := tt.h.Marshal(buf); err != nil {
+			t.Errorf("%s: Marshal into %d bytes: %v", tt.name, n, err)
+		}
+		if got := len(Generate(tt.h, make([]byte, tt.payloadLen))); got != n {
+			t.Errorf("%s: Generate made %d bytes; want %d", tt.name, got, n)
+		}
+	}
+
+	if _, err := MarshalLen(tcp, maxPacketLength); err != ErrLargePacket {
+		t.Errorf("oversized: got err %v; want %v", err, ErrLargePacket)
+	}
+	if _, err := MarshalLen(&withWS, maxPacketLength-tcpTotalHeaderLength-tcpWindowScaleLength); err != nil {
+		t.Errorf("largest: got err %v; want nil", err)
+	}
+	if _, err := MarshalLen(tcp, -1); err == nil {
+		t.Errorf("negative payload length: got nil error")
+	}
+}
+
+func TestMaxPayload(t *testing.T) {
+	tests := []struct {
+		name            string
+		proto           IP4Proto
+		mtu             int
+		ipOpts, tcpOpts int
+		want            int
+	}{
+		{"tcp", TCP, 1500, 0, 0, 1460},
+		{"tcp_timestamps", TCP, 1500, 0, 12, 1448},
+		{"tcp_padded_options", TCP, 1500, 0, 10, 1448},
+		{"tcp_ip_options", TCP, 1500, 4, 12, 1444},
+		{"udp", UDP, 1500, 0, 0, 1472},
+		{"udp_tailscale", UDP, 1280, 0, 0, 1252},
+		// TCP options don't apply to UDP.
+		{"udp_ignores_tcp_options", UDP, 1500, 0, 12, 1472},
+		{"udp_ip_options", UDP, 1500, 3, 0, 1468},
+		{"icmp", ICMP, 1500, 0, 0, 1472},
+		{"other", VRRP, 1500, 0, 0, 1480},
+		{"max_options", TCP, 1500, 40, 40, 1380},
+		{"too_many_ip_options", TCP, 1500, 41, 0, 0},
+		{"too_many_tcp_options", TCP, 1500, 0, 44, 0},
+		{"negative_options", UDP, 1500, -4, 0, 0},
+		{"headers_only", UDP, 28, 0, 0, 0},
+		{"tiny_mtu", TCP, 10, 0, 0, 0},
+		{"huge_mtu", UDP, 1 << 20, 0, 0, maxPacketLength - 28},
+	}
+	for _, tt := range tests {
+		if got := MaxPayload(tt.proto, tt.mtu, tt.ipOpts, tt.tcpOpts); got != tt.want {
+			t.Errorf("%s: MaxPayload(%v, %d, %d, %d) = %d; want %d", tt.name, tt.proto, tt.mtu, tt.ipOpts, tt.tcpOpts, got, tt.want)
+		}
+	}
+
+	// A UDP packet with the largest payload fills the MTU exactly.
+	const mtu = 1280
+	n := MaxPayload(UDP, mtu, 0, 0)
+	buf := make([]byte, mtu+1)
+	size, err := MakeUDP4(IP4Port{IP: 1, Port: 1}, IP4Port{IP: 2, Port: 2}, make([]byte, n), buf)
+	if err != nil || size != mtu {
+		t.Errorf("MakeUDP4 with %d bytes of payload = %d, %v; want %d, nil", n, size, err, mtu)
+	}
+}
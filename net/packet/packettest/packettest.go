@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package packettest contains test helpers for code that builds or
+// rewrites packets.
+package packettest
+
+import (
+	"testing"
+
+	"tailscale.com/net/packet"
+)
+
+// AssertEqualPacket fails t if got and want differ in any field not
+// selected by ignore, with a field-by-field description of the
+// differences. Pass 0 as ignore for a byte-exact comparison, and
+// ignore fields such as the IPID or TTL that the code under test may
+// legitimately vary.
+func AssertEqualPacket(t testing.TB, got, want []byte, ignore packet.DiffIgnore) {
+	t.Helper()
+	if d := packet.DiffIgnoring(got, want, ignore); d != "" {
+		t.Errorf("packet mismatch (got != want): %s", d)
+	}
+}
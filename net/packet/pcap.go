@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic numbers of pcap files, as written by the capturing machine:
+// one for microsecond and one for nanosecond timestamps.
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+)
+
+// Link-layer header types of pcap files (see
+// https://www.tcpdump.org/linktypes.html).
+const (
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101 // raw IPv4 or IPv6, as captured on a TUN device
+	pcapLinkIPv4     = 228
+	pcapLinkIPv6     = 229
+)
+
+const (
+	pcapFileHeaderLength   = 24
+	pcapRecordHeaderLength = 16
+	// pcapMaxRecord is the largest record ReadPcap accepts, as
+	// tcpdump does, to avoid allocating huge buffers for a corrupt
+	// length.
+	pcapMaxRecord = 256 << 10
+)
+
+var (
+	errPcapMagic  = errors.New("not a pcap file")
+	errPcapRecord = errors.New("pcap record too large")
+)
+
+// ReadPcap reads a capture in the classic libpcap file format from r,
+// in either byte order, and returns the IP packets it holds, for use as
+// test fixtures and in offline analysis. pcapng files aren't supported.
+//
+// Captures of raw IP, such as from a TUN device, are returned as is.
+// For Ethernet captures, the Ethernet header is removed, and frames
+// that don't carry IPv4 or IPv6 are skipped, so that every returned
+// packet starts with its IP header either way. Other link types are an
+// error. Packets are as long as they were captured, which may be less
+// than their IP length if the capture had a small snapshot length.
+func ReadPcap(r io.Reader) ([][]byte, error) {
+	var hdr [pcapFileHeaderLength]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = errPcapMagic
+		}
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(hdr[0:4]) {
+	case pcapMagicMicros, pcapMagicNanos:
+		order = binary.LittleEndian
+	default:
+		switch binary.BigEndian.Uint32(hdr[0:4]) {
+		case pcapMagicMicros, pcapMagicNanos:
+			order = binary.BigEndian
+		default:
+			return nil, errPcapMagic
+		}
+	}
+	// The upper 16 bits of the link type may hold an FCS length, which
+	// doesn't matter here.
+	link := order.Uint32(hdr[20:24]) & 0xffff
+	switch link {
+	case pcapLinkEthernet, pcapLinkRaw, pcapLinkIPv4, pcapLinkIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported pcap link type %d", link)
+	}
+
+	var pkts [][]byte
+	for {
+		var rec [pcapRecordHeaderLength]byte
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			if err == io.EOF {
+				return pkts, nil
+			}
+			return nil, err
+		}
+		n := order.Uint32(rec[8:12]) // captured length
+		if n > pcapMaxRecord {
+			return nil, errPcapRecord
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if link == pcapLinkEthernet {
+			if len(b) < ethernetHeaderLength {
+				continue
+			}
+			switch get16(b[12:14]) {
+			case EtherTypeIPv4, EtherTypeIPv6:
+				b = b[ethernetHeaderLength:]
+			default:
+				continue
+			}
+		}
+		pkts = append(pkts, b)
+	}
+}
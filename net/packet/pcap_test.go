@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// makePcap returns a pcap file in byte order order with the given
+// magic number and link type, holding recs.
+func makePcap(order binary.ByteOrder, magic, link uint32, recs ...[]byte) []byte {
+	var b []byte
+	u16 := func(v uint16) { b = append(b, 0, 0); order.PutUint16(b[len(b)-2:], v) }
+	u32 := func(v uint32) { b = append(b, 0, 0, 0, 0); order.PutUint32(b[len(b)-4:], v) }
+	u32(magic)
+	u16(2) // version 2.4
+	u16(4)
+	u32(0) // timezone
+	u32(0) // timestamp accuracy
+	u32(65535)
+	u32(link)
+	for i, rec := range recs {
+		u32(1600000000 + uint32(i))
+		u32(0)
+		u32(uint32(len(rec)))
+		u32(uint32(len(rec)))
+		b = append(b, rec...)
+	}
+	return b
+}
+
+func TestReadPcap(t *testing.T) {
+	ether := func(etherType uint16, pkt []byte) []byte {
+		f := make([]byte, ethernetHeaderLength, ethernetHeaderLength+len(pkt))
+		EthernetHeader{Src: [6]byte{0x02}, Dst: [6]byte{0x02, 1}, EtherType: etherType}.Marshal(f)
+		return append(f, pkt...)
+	}
+	udp6 := makeUDP6(4)
+	raw := [][]byte{tcpCaptureBuffer, udpRequestBuffer, udp6}
+
+	tests := []struct {
+		name string
+		file []byte
+		want [][]byte
+	}{
+		{"raw_little_endian", makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkRaw, raw...), raw},
+		{"raw_big_endian", makePcap(binary.BigEndian, pcapMagicMicros, pcapLinkRaw, raw...), raw},
+		{"raw_nanoseconds", makePcap(binary.LittleEndian, pcapMagicNanos, pcapLinkRaw, raw...), raw},
+		{"ipv4_link_type", makePcap(binary.BigEndian, pcapMagicMicros, pcapLinkIPv4, udpRequestBuffer), [][]byte{udpRequestBuffer}},
+		{"ethernet", makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkEthernet,
+			ether(EtherTypeIPv4, tcpCaptureBuffer),
+			ether(EtherTypeARP, make([]byte, 28)),
+			ether(EtherTypeIPv6, udp6),
+			[]byte{1, 2, 3},
+		), [][]byte{tcpCaptureBuffer, udp6}},
+		// The FCS length in the link type's upper bits is ignored.
+		{"ethernet_with_fcs_length", makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkEthernet|1<<28|4<<16, ether(EtherTypeIPv4, udpRequestBuffer)), [][]byte{udpRequestBuffer}},
+		{"empty", makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkRaw), nil},
+	}
+	for _, tt := range tests {
+		got, err := ReadPcap(bytes.NewReader(tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %x\nwant %x", tt.name, got, tt.want)
+		}
+	}
+
+	// The packets can be decoded straight away.
+	pkts, _ := ReadPcap(bytes.NewReader(makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkEthernet, ether(EtherTypeIPv4, tcpCaptureBuffer))))
+	var q Parsed
+	q.Decode(pkts[0])
+	if q.IPProto != TCP || q.DstPort != 80 {
+		t.Errorf("decoded %v; want TCP to port 80", q.String())
+	}
+}
+
+func TestReadPcapErrors(t *testing.T) {
+	good := makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkRaw, udpRequestBuffer)
+	huge := makePcap(binary.LittleEndian, pcapMagicMicros, pcapLinkRaw, udpRequestBuffer)
+	binary.LittleEndian.PutUint32(huge[pcapFileHeaderLength+8:], 1<<30)
+
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr error // nil for any error
+	}{
+		{"empty", nil, errPcapMagic},
+		{"short_header", good[:10], io.ErrUnexpectedEOF},
+		{"pcapng", append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, good[4:]...), errPcapMagic},
+		{"link_type", makePcap(binary.LittleEndian, pcapMagicMicros, 105, udpRequestBuffer), nil},
+		{"short_record_header", good[:pcapFileHeaderLength+8], io.ErrUnexpectedEOF},
+		{"short_record", good[:len(good)-1], io.ErrUnexpectedEOF},
+		{"huge_record", huge, errPcapRecord},
+	}
+	for _, tt := range tests {
+		pkts, err := ReadPcap(bytes.NewReader(tt.file))
+		if err == nil || (tt.wantErr != nil && err != tt.wantErr) {
+			t.Errorf("%s: got %d packets, err %v; want err %v", tt.name, len(pkts), err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "fmt"
+
+// pimHeaderLength is the length of the header common to all PIM
+// messages.
+const pimHeaderLength = 4
+
+// PIMType is a PIM version 2 message type (RFC 7761 section 4.9).
+type PIMType uint8
+
+const (
+	PIMHello           PIMType = 0
+	PIMRegister        PIMType = 1
+	PIMRegisterStop    PIMType = 2
+	PIMJoinPrune       PIMType = 3
+	PIMBootstrap       PIMType = 4
+	PIMAssert          PIMType = 5
+	PIMGraft           PIMType = 6 // PIM-DM only
+	PIMGraftAck        PIMType = 7 // PIM-DM only
+	PIMCandidateRPAdvt PIMType = 8
+)
+
+func (t PIMType) String() string {
+	switch t {
+	case PIMHello:
+		return "Hello"
+	case PIMRegister:
+		return "Register"
+	case PIMRegisterStop:
+		return "RegisterStop"
+	case PIMJoinPrune:
+		return "JoinPrune"
+	case PIMBootstrap:
+		return "Bootstrap"
+	case PIMAssert:
+		return "Assert"
+	case PIMGraft:
+		return "Graft"
+	case PIMGraftAck:
+		return "GraftAck"
+	case PIMCandidateRPAdvt:
+		return "CandidateRPAdvt"
+	default:
+		return fmt.Sprintf("PIMType(%d)", uint8(t))
+	}
+}
+
+// PIMHeader is the header common to all Protocol Independent Multicast
+// messages (RFC 7761 section 4.9). Its checksum isn't verified.
+type PIMHeader struct {
+	Version  uint8 // 2 for current PIM
+	Type     PIMType
+	Checksum uint16
+}
+
+// PIMHeader returns the PIM header of q. ok is false if q is not an
+// IPv4 PIM packet, or was decoded by DecodeIPOnly.
+func (q *Parsed) PIMHeader() (h PIMHeader, ok bool) {
+	if q.IPVersion != 4 || q.IPProto != PIM || q.TransportSkipped || q.length < q.subofs+pimHeaderLength {
+		return PIMHeader{}, false
+	}
+	b := q.b[q.subofs:q.length]
+	return PIMHeader{
+		Version:  b[0] >> 4,
+		Type:     PIMType(b[0] & 0x0f),
+		Checksum: get16(b[2:4]),
+	}, true
+}
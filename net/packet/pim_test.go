@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPIMHeader(t *testing.T) {
+	hello := []byte{
+		0x20, 0x00, 0x8b, 0x2f, // version 2, Hello; checksum
+		0x00, 0x01, 0x00, 0x02, 0x00, 0x69, // holdtime option: 105s
+	}
+	ip := IP4Header{IPProto: PIM, SrcIP: 0x0a000001, DstIP: 0xe000000d} // to ALL-PIM-ROUTERS
+	var q Parsed
+	q.Decode(Generate(&ip, hello))
+	if q.IPProto != PIM {
+		t.Fatalf("IPProto = %v; want PIM", q.IPProto)
+	}
+	h, ok := q.PIMHeader()
+	if want := (PIMHeader{Version: 2, Type: PIMHello, Checksum: 0x8b2f}); !ok || h != want {
+		t.Errorf("PIMHeader() = %+v, %v; want %+v", h, ok, want)
+	}
+	if !bytes.Equal(q.Payload(), hello[pimHeaderLength:]) {
+		t.Errorf("Payload() = %x; want the Hello options", q.Payload())
+	}
+	if !q.TransportConsistent() {
+		t.Errorf("Hello not TransportConsistent")
+	}
+
+	joinPrune := append([]byte(nil), hello...)
+	joinPrune[0] = 0x23
+	q.Decode(Generate(&ip, joinPrune))
+	if h, _ := q.PIMHeader(); h.Type != PIMJoinPrune {
+		t.Errorf("Type = %v; want JoinPrune", h.Type)
+	}
+
+	q.Decode(Generate(&ip, hello[:3]))
+	if q.IPProto != Unknown {
+		t.Errorf("truncated PIM: IPProto = %v; want Unknown", q.IPProto)
+	}
+	if _, ok := q.PIMHeader(); ok {
+		t.Errorf("truncated PIM: got header")
+	}
+
+	// DecodeIPOnly doesn't decode the PIM header, so PIMHeader must
+	// not report one, whether or not it's there.
+	for _, body := range [][]byte{nil, hello} {
+		if err := DecodeIPOnly(Generate(&ip, body), &q); err != nil || q.IPProto != PIM {
+			t.Fatalf("DecodeIPOnly(%d-byte body): %v, proto %v", len(body), err, q.IPProto)
+		}
+		if _, ok := q.PIMHeader(); ok {
+			t.Errorf("DecodeIPOnly(%d-byte body): got header", len(body))
+		}
+	}
+
+	q.Decode(udpRequestBuffer)
+	if _, ok := q.PIMHeader(); ok {
+		t.Errorf("UDP packet has a PIM header")
+	}
+}
+
+func TestPIMTypeString(t *testing.T) {
+	for typ, want := range map[PIMType]string{
+		PIMHello:           "Hello",
+		PIMRegisterStop:    "RegisterStop",
+		PIMJoinPrune:       "JoinPrune",
+		PIMCandidateRPAdvt: "CandidateRPAdvt",
+		9:                  "PIMType(9)",
+	} {
+		if got := typ.String(); got != want {
+			t.Errorf("PIMType(%d).String() = %q; want %q", uint8(typ), got, want)
+		}
+	}
+}
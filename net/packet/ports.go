@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "strconv"
+
+// ProtoPort is a port of a given transport protocol.
+type ProtoPort struct {
+	Proto IP4Proto
+	Port  uint16
+}
+
+// PortNames maps ports to names, for use in logs and configuration.
+type PortNames map[ProtoPort]string
+
+// wellKnownPorts is a curated subset of the IANA service name
+// registry, using its names. Only ports common enough to be worth
+// recognizing in logs are included.
+var wellKnownPorts = PortNames{
+	{TCP, 20}:   "ftp-data",
+	{TCP, 21}:   "ftp",
+	{TCP, 22}:   "ssh",
+	{TCP, 23}:   "telnet",
+	{TCP, 25}:   "smtp",
+	{TCP, 53}:   "domain",
+	{TCP, 80}:   "http",
+	{TCP, 110}:  "pop3",
+	{TCP, 143}:  "imap",
+	{TCP, 179}:  "bgp",
+	{TCP, 389}:  "ldap",
+	{TCP, 443}:  "https",
+	{TCP, 445}:  "microsoft-ds",
+	{TCP, 514}:  "shell",
+	{TCP, 587}:  "submission",
+	{TCP, 636}:  "ldaps",
+	{TCP, 993}:  "imaps",
+	{TCP, 995}:  "pop3s",
+	{TCP, 3306}: "mysql",
+	{TCP, 3389}: "ms-wbt-server",
+	{TCP, 5432}: "postgresql",
+	{TCP, 8080}: "http-alt",
+
+	{UDP, 53}:   "domain",
+	{UDP, 67}:   "bootps",
+	{UDP, 68}:   "bootpc",
+	{UDP, 69}:   "tftp",
+	{UDP, 123}:  "ntp",
+	{UDP, 137}:  "netbios-ns",
+	{UDP, 161}:  "snmp",
+	{UDP, 162}:  "snmptrap",
+	{UDP, 443}:  "https",
+	{UDP, 500}:  "isakmp",
+	{UDP, 514}:  "syslog",
+	{UDP, 1900}: "ssdp",
+	{UDP, 3478}: "stun",
+	{UDP, 4500}: "ipsec-nat-t",
+	{UDP, 5353}: "mdns",
+}
+
+// PortName returns the IANA service name of the well-known port of
+// the given protocol, such as "https" for TCP port 443, or the port
+// number in decimal if it has no name. Names can differ between TCP
+// and UDP: port 514 is "shell" over TCP but "syslog" over UDP.
+func PortName(proto IP4Proto, port uint16) string {
+	if name, ok := wellKnownPorts[ProtoPort{proto, port}]; ok {
+		return name
+	}
+	return strconv.Itoa(int(port))
+}
+
+// Name is like PortName, but names in n take precedence over the
+// built-in ones, so callers can add or rename ports.
+func (n PortNames) Name(proto IP4Proto, port uint16) string {
+	if name, ok := n[ProtoPort{proto, port}]; ok {
+		return name
+	}
+	return PortName(proto, port)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestPortName(t *testing.T) {
+	tests := []struct {
+		proto IP4Proto
+		port  uint16
+		want  string
+	}{
+		{TCP, 443, "https"},
+		{UDP, 53, "domain"},
+		{TCP, 22, "ssh"},
+		{TCP, 514, "shell"},
+		{UDP, 514, "syslog"},
+		{UDP, 22, "22"},
+		{TCP, 41641, "41641"},
+		{ICMP, 80, "80"},
+	}
+	for _, tt := range tests {
+		if got := PortName(tt.proto, tt.port); got != tt.want {
+			t.Errorf("PortName(%v, %d) = %q; want %q", tt.proto, tt.port, got, tt.want)
+		}
+	}
+
+	names := PortNames{
+		{UDP, 41641}: "tailscale",
+		{TCP, 8080}:  "proxy",
+	}
+	for _, tt := range []struct {
+		proto IP4Proto
+		port  uint16
+		want  string
+	}{
+		{UDP, 41641, "tailscale"},
+		{TCP, 8080, "proxy"},
+		{TCP, 443, "https"},
+		{TCP, 41641, "41641"},
+	} {
+		if got := names.Name(tt.proto, tt.port); got != tt.want {
+			t.Errorf("Name(%v, %d) = %q; want %q", tt.proto, tt.port, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "fmt"
+
+// Prefix is an IPv4 address prefix, such as 10.0.0.0/8.
+type Prefix struct {
+	IP   IP4
+	Bits uint8 // 0-32
+}
+
+// Mask returns the netmask of p, such as 255.0.0.0 for a /8.
+// Lengths above 32 are treated as /32, as in NewPrefixSet.
+func (p Prefix) Mask() IP4 {
+	switch {
+	case p.Bits == 0:
+		return 0
+	case p.Bits > 32:
+		return ^IP4(0)
+	}
+	return IP4(^uint32(0) << (32 - p.Bits))
+}
+
+// Contains reports whether ip is within p.
+func (p Prefix) Contains(ip IP4) bool {
+	return (ip^p.IP)&p.Mask() == 0
+}
+
+// Overlaps reports whether p and other have any address in common.
+// Two prefixes either are disjoint or one contains the other, so this
+// is whether either contains the other's network address.
+func (p Prefix) Overlaps(other Prefix) bool {
+	return p.Contains(other.IP) || other.Contains(p.IP)
+}
+
+func (p Prefix) String() string {
+	return fmt.Sprintf("%v/%d", p.IP, p.Bits)
+}
+
+// PrefixSet is an immutable set of Prefixes that supports fast
+// membership tests. Lookups take time proportional to the number of
+// address bits, not to the number of prefixes in the set.
+type PrefixSet struct {
+	// nodes is a binary trie over address bits, most significant
+	// first. nodes[0] is the root, which represents 0.0.0.0/0.
+	nodes []prefixNode
+}
+
+type prefixNode struct {
+	// child holds the indexes of the children for a 0 and 1 bit,
+	// or 0 if there is none (the root is never a child).
+	child [2]int32
+	// end is whether a prefix in the set ends at this node.
+	end bool
+}
+
+// NewPrefixSet returns a PrefixSet containing prefixes.
+// Bits of a prefix's IP beyond its length are ignored.
+func NewPrefixSet(prefixes []Prefix) *PrefixSet {
+	s := &PrefixSet{nodes: make([]prefixNode, 1, len(prefixes)+1)}
+	for _, p := range prefixes {
+		bits := p.Bits
+		if bits > 32 {
+			bits = 32
+		}
+		n := int32(0)
+		for i := uint8(0); i < bits && !s.nodes[n].end; i++ {
+			bit := (p.IP >> (31 - i)) & 1
+			if s.nodes[n].child[bit] == 0 {
+				s.nodes = append(s.nodes, prefixNode{})
+				s.nodes[n].child[bit] = int32(len(s.nodes) - 1)
+			}
+			n = s.nodes[n].child[bit]
+		}
+		// Prefixes under this one are now redundant, but leaving
+		// their nodes in place is harmless: lookups stop here.
+		s.nodes[n].end = true
+	}
+	return s
+}
+
+// Contains reports whether ip is within any prefix in s.
+func (s *PrefixSet) Contains(ip IP4) bool {
+	n := int32(0)
+	for i := uint(0); ; i++ {
+		if s.nodes[n].end {
+			return true
+		}
+		if i == 32 {
+			return false
+		}
+		n = s.nodes[n].child[(ip>>(31-i))&1]
+		if n == 0 {
+			return false
+		}
+	}
+}
+
+// SrcIn reports whether q's IPv4 source address is in s.
+func (q *Parsed) SrcIn(s *PrefixSet) bool {
+	return q.IPVersion == 4 && s.Contains(q.SrcIP)
+}
+
+// DstIn reports whether q's IPv4 destination address is in s.
+func (q *Parsed) DstIn(s *PrefixSet) bool {
+	return q.IPVersion == 4 && s.Contains(q.DstIP)
+}
+
+// SourceMatchesPrefixes reports whether q passes a reverse path check
+// (RFC 3704) against allowed, the prefixes expected as sources on the
+// interface q arrived on: its IPv4 source address must be in allowed,
+// and must not be a multicast or broadcast address, which RFC 1812
+// section 5.3.7 says are never valid sources. A false result marks q
+// as possibly spoofed. IPv6 packets always fail the check.
+func (q *Parsed) SourceMatchesPrefixes(allowed *PrefixSet) bool {
+	if q.SrcIP.IsMulticast() || q.SrcIP.IsBroadcast() {
+		return false
+	}
+	return q.SrcIn(allowed)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func mustPrefix(s string) Prefix {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	bits, _ := ipnet.Mask.Size()
+	return Prefix{IP: NewIP4(ip), Bits: uint8(bits)}
+}
+
+func TestPrefix(t *testing.T) {
+	p := mustPrefix("10.1.0.0/16")
+	if p.String() != "10.1.0.0/16" {
+		t.Errorf("String = %q", p.String())
+	}
+	if p.Mask().String() != "255.255.0.0" {
+		t.Errorf("Mask = %v", p.Mask())
+	}
+	for ip, want := range map[string]bool{
+		"10.1.0.0":     true,
+		"10.1.255.255": true,
+		"10.2.0.0":     false,
+		"9.1.0.0":      false,
+	} {
+		if got := p.Contains(NewIP4(net.ParseIP(ip))); got != want {
+			t.Errorf("Contains(%s) = %v; want %v", ip, got, want)
+		}
+	}
+	if !mustPrefix("0.0.0.0/0").Contains(0xffffffff) {
+		t.Errorf("/0 doesn't contain 255.255.255.255")
+	}
+
+	// Lengths past 32 are clamped to a host route, as NewPrefixSet
+	// does, rather than wrapping to a mask that matches everything.
+	host := Prefix{IP: 0x0a010203, Bits: 33}
+	if host.Mask() != 0xffffffff {
+		t.Errorf("/33 Mask = %v", host.Mask())
+	}
+	set := NewPrefixSet([]Prefix{host})
+	for _, ip := range []IP4{0x0a010203, 0x0a010204, 0} {
+		if got, want := host.Contains(ip), ip == host.IP; got != want {
+			t.Errorf("/33 Contains(%v) = %v; want %v", ip, got, want)
+		}
+		if got, want := set.Contains(ip), host.Contains(ip); got != want {
+			t.Errorf("/33 set Contains(%v) = %v; want %v", ip, got, want)
+		}
+	}
+}
+
+func TestPrefixOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10.0.0.0/8", "10.1.2.0/24", true},       // nested
+		{"10.1.2.0/24", "10.0.0.0/8", true},       // nested, other way
+		{"10.1.2.0/24", "10.1.2.0/24", true},      // identical
+		{"10.1.2.5/32", "10.1.2.5/32", true},      // identical hosts
+		{"0.0.0.0/0", "192.168.1.1/32", true},     // default route
+		{"10.1.2.0/24", "10.1.3.0/24", false},     // adjacent
+		{"10.1.2.0/25", "10.1.2.128/25", false},   // adjacent halves
+		{"10.0.0.0/8", "192.168.0.0/16", false},   // disjoint
+		{"10.1.2.5/32", "10.1.2.6/32", false},     // distinct hosts
+		{"172.16.0.0/12", "172.32.0.0/11", false}, // disjoint, similar bits
+	}
+	for _, tt := range tests {
+		a, b := mustPrefix(tt.a), mustPrefix(tt.b)
+		if got := a.Overlaps(b); got != tt.want {
+			t.Errorf("%v.Overlaps(%v) = %v; want %v", a, b, got, tt.want)
+		}
+	}
+
+	// Host bits past the prefix length don't matter.
+	p := Prefix{IP: 0x0a010203, Bits: 16} // 10.1.2.3/16
+	if !p.Overlaps(mustPrefix("10.1.200.0/24")) {
+		t.Errorf("%v doesn't overlap 10.1.200.0/24", p)
+	}
+}
+
+func TestPrefixSet(t *testing.T) {
+	set := NewPrefixSet([]Prefix{
+		mustPrefix("10.0.0.0/8"),
+		mustPrefix("10.1.0.0/16"), // redundant with the /8
+		mustPrefix("192.168.1.0/24"),
+		mustPrefix("100.64.0.1/32"),
+		mustPrefix("172.16.0.0/12"),
+	})
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.255.255.255", true},
+		{"11.0.0.0", false},
+		{"192.168.1.77", true},
+		{"192.168.2.1", false},
+		{"100.64.0.1", true},
+		{"100.64.0.2", false},
+		{"172.31.255.255", true},
+		{"172.32.0.0", false},
+		{"0.0.0.0", false},
+	}
+	for _, tt := range tests {
+		if got := set.Contains(NewIP4(net.ParseIP(tt.ip))); got != tt.want {
+			t.Errorf("Contains(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if NewPrefixSet(nil).Contains(1) {
+		t.Errorf("empty set contains 0.0.0.1")
+	}
+	if !NewPrefixSet([]Prefix{{Bits: 0}}).Contains(0x01020304) {
+		t.Errorf("/0 set doesn't contain 1.2.3.4")
+	}
+}
+
+func randomPrefixes(rnd *rand.Rand, n int) []Prefix {
+	prefixes := make([]Prefix, n)
+	for i := range prefixes {
+		prefixes[i] = Prefix{IP: IP4(rnd.Uint32()), Bits: uint8(8 + rnd.Intn(25))}
+	}
+	return prefixes
+}
+
+func TestPrefixSetMatchesLinear(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	prefixes := randomPrefixes(rnd, 1000)
+	set := NewPrefixSet(prefixes)
+	for i := 0; i < 10000; i++ {
+		ip := IP4(rnd.Uint32())
+		if i%2 == 0 {
+			// Pick an address inside a random prefix.
+			p := prefixes[rnd.Intn(len(prefixes))]
+			ip = p.IP&p.Mask() | ip&^p.Mask()
+		}
+		want := false
+		for _, p := range prefixes {
+			if p.Contains(ip) {
+				want = true
+				break
+			}
+		}
+		if got := set.Contains(ip); got != want {
+			t.Fatalf("Contains(%v) = %v; want %v", ip, got, want)
+		}
+	}
+}
+
+func BenchmarkPrefixSet(b *testing.B) {
+	for _, n := range []int{10, 10000} {
+		rnd := rand.New(rand.NewSource(1))
+		prefixes := randomPrefixes(rnd, n)
+		set := NewPrefixSet(prefixes)
+		ip := IP4(rnd.Uint32())
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.Contains(ip)
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, p := range prefixes {
+					if p.Contains(ip) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParsedSrcDstIn(t *testing.T) {
+	var q Parsed
+	q.Decode(tcpPacketBuffer) // 1.2.3.4 -> 5.6.7.8
+	set := NewPrefixSet([]Prefix{mustPrefix("1.2.0.0/16")})
+	if !q.SrcIn(set) {
+		t.Errorf("SrcIn = false; want true")
+	}
+	if q.DstIn(set) {
+		t.Errorf("DstIn = true; want false")
+	}
+
+	q.Decode(ipv6PacketBuffer)
+	if q.SrcIn(NewPrefixSet([]Prefix{{Bits: 0}})) {
+		t.Errorf("SrcIn matched an IPv6 packet")
+	}
+}
+
+func TestSourceMatchesPrefixes(t *testing.T) {
+	allowed := NewPrefixSet([]Prefix{mustPrefix("1.2.3.0/24"), mustPrefix("10.0.0.0/8")})
+	all := NewPrefixSet([]Prefix{{Bits: 0}})
+	withSrc := func(src IP4) []byte {
+		b := append([]byte(nil), tcpPacketBuffer...)
+		put32(b[12:16], uint32(src))
+		return b
+	}
+	tests := []struct {
+		name    string
+		pkt     []byte
+		allowed *PrefixSet
+		want    bool
+	}{
+		{"legitimate", tcpPacketBuffer, allowed, true},
+		{"other_allowed_prefix", withSrc(0x0a141e28), allowed, true},
+		{"spoofed", withSrc(0x01020404), allowed, false},
+		{"multicast_source", withSrc(0xe0000001), all, false},
+		{"broadcast_source", withSrc(0xffffffff), all, false},
+		{"ipv6", ipv6PacketBuffer, all, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.SourceMatchesPrefixes(tt.allowed); got != tt.want {
+			t.Errorf("%s: SourceMatchesPrefixes = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ICMPRateLimiter limits how often ICMP messages are sent to each
+// source address, so that responders can't be used for amplification
+// or to scan for live hosts at line rate.
+//
+// Each source may be sent one message every interval on average, in
+// bursts of up to burst messages. Up to maxSources sources are tracked
+// at a time; the least recently seen are forgotten first, which only
+// ever makes the limiter more permissive. It is safe for concurrent
+// use.
+type ICMPRateLimiter struct {
+	interval   time.Duration
+	burst      int
+	maxSources int
+	timeNow    func() time.Time // time.Now, or a fake clock in tests
+
+	mu      sync.Mutex
+	sources map[IP4]*icmpSource
+	lru     *list.List // of IP4, most recently seen first
+}
+
+type icmpSource struct {
+	// tat is the theoretical arrival time of the next message, as in
+	// the generic cell rate algorithm: a message may be sent while tat
+	// is less than a burst's worth of intervals in the future.
+	tat time.Time
+	ele *list.Element // element of ICMPRateLimiter.lru for this source
+}
+
+// NewICMPRateLimiter returns a limiter allowing one message every
+// interval to each source, in bursts of up to burst messages, and
+// tracking up to maxSources sources. burst and maxSources are at
+// least 1.
+func NewICMPRateLimiter(interval time.Duration, burst, maxSources int) *ICMPRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if maxSources < 1 {
+		// Tracking no sources would forget each one as soon as it
+		// was seen, and allow everything.
+		maxSources = 1
+	}
+	return &ICMPRateLimiter{
+		interval:   interval,
+		burst:      burst,
+		maxSources: maxSources,
+		timeNow:    time.Now,
+		sources:    make(map[IP4]*icmpSource),
+		lru:        list.New(),
+	}
+}
+
+// Allow reports whether a message may be sent to src now, and if so,
+// counts it against src's allowance.
+func (l *ICMPRateLimiter) Allow(src IP4) bool {
+	now := l.timeNow()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sources[src]
+	if ok {
+		l.lru.MoveToFront(s.ele)
+	} else {
+		s = &icmpSource{tat: now, ele: l.lru.PushFront(src)}
+		l.sources[src] = s
+		if l.lru.Len() > l.maxSources {
+			delete(l.sources, l.lru.Back().Value.(IP4))
+			l.lru.Remove(l.lru.Back())
+		}
+	}
+	if s.tat.Before(now) {
+		s.tat = now
+	}
+	if s.tat.Sub(now) > l.interval*time.Duration(l.burst-1) {
+		return false
+	}
+	s.tat = s.tat.Add(l.interval)
+	return true
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestICMPRateLimiter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	l := NewICMPRateLimiter(time.Second, 3, 2)
+	l.timeNow = func() time.Time { return now }
+
+	allowed := func(src IP4, n int) int {
+		got := 0
+		for i := 0; i < n; i++ {
+			if l.Allow(src) {
+				got++
+			}
+		}
+		return got
+	}
+	if got := allowed(1, 10); got != 3 {
+		t.Errorf("burst: %d allowed; want 3", got)
+	}
+	if got := allowed(2, 10); got != 3 {
+		t.Errorf("other source: %d allowed; want 3", got)
+	}
+
+	// Allowance comes back at one message per interval.
+	now = now.Add(1500 * time.Millisecond)
+	if got := allowed(1, 10); got != 1 {
+		t.Errorf("after 1.5 intervals: %d allowed; want 1", got)
+	}
+	now = now.Add(time.Hour)
+	if got := allowed(1, 10); got != 3 {
+		t.Errorf("after idle: %d allowed; want 3", got)
+	}
+
+	// Only maxSources sources are remembered. Source 2 is the least
+	// recently seen, so 3 pushes it out.
+	allowed(1, 1)
+	allowed(3, 1)
+	if len(l.sources) != 2 || l.lru.Len() != 2 {
+		t.Fatalf("tracking %d (%d) sources; want 2", len(l.sources), l.lru.Len())
+	}
+	if _, ok := l.sources[2]; ok {
+		t.Errorf("least recently seen source not evicted")
+	}
+}
+
+func TestICMPRateLimiterNoSources(t *testing.T) {
+	// Limiters tracking no sources must still limit.
+	for _, maxSources := range []int{0, -1} {
+		l := NewICMPRateLimiter(time.Hour, 1, maxSources)
+		got := 0
+		for i := 0; i < 10; i++ {
+			if l.Allow(1) {
+				got++
+			}
+		}
+		if got != 1 {
+			t.Errorf("maxSources %d: %d of 10 allowed; want 1", maxSources, got)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrFragmentOverlap is returned by Reassembler.Add when a fragment
+// overlaps data already received for its datagram, and the
+// Reassembler's policy is OverlapDrop.
+var ErrFragmentOverlap = errors.New("overlapping fragments")
+
+// OverlapPolicy is what a Reassembler does when a fragment overlaps
+// part of its datagram that was already received.
+type OverlapPolicy uint8
+
+const (
+	// OverlapDrop discards the whole datagram when a fragment overlaps
+	// one already received, even if their bytes agree, along with any
+	// of its fragments that arrive later. It is the default, following
+	// RFC 5722, which requires this for IPv6: overlapping fragments
+	// have no legitimate use, and resolving them in any particular
+	// way lets an attacker show a filter different bytes than the
+	// destination host will reassemble. Exact duplicates of a fragment
+	// already received, which the network can create, are ignored
+	// instead, as RFC 8200 section 4.5 permits.
+	OverlapDrop OverlapPolicy = iota
+	// OverlapFirst keeps the bytes that arrived first. Overlaps whose
+	// bytes agree are accepted.
+	OverlapFirst
+	// OverlapLast overwrites earlier bytes with later ones. Overlaps
+	// whose bytes agree are accepted.
+	OverlapLast
+)
+
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapDrop:
+		return "drop"
+	case OverlapFirst:
+		return "first"
+	case OverlapLast:
+		return "last"
+	default:
+		return fmt.Sprintf("OverlapPolicy(%d)", uint8(p))
+	}
+}
+
+// DefaultMaxDatagrams is the number of datagrams a Reassembler holds
+// under reassembly at once if its MaxDatagrams is zero.
+const DefaultMaxDatagrams = 64
+
+// Reassembler reassembles fragmented IPv4 and IPv6 datagrams.
+//
+// Each datagram under reassembly holds at most 64KiB, and at most
+// MaxDatagrams datagrams are held at once, so memory use is bounded.
+// A Reassembler is not safe for concurrent use.
+type Reassembler struct {
+	// Policy is how overlapping fragments are handled.
+	Policy OverlapPolicy
+	// MaxDatagrams is the maximum number of datagrams under
+	// reassembly at once, across both IP versions. When a fragment of
+	// a new datagram arrives and MaxDatagrams are already pending, the
+	// oldest is discarded. Zero means DefaultMaxDatagrams.
+	MaxDatagrams int
+
+	pending map[fragKey]*fragDatagram
+	seq     uint64 // incremented for each new datagram, for eviction
+}
+
+// fragKey identifies the fragments of one datagram: by source,
+// destination, identification and protocol for IPv4 (RFC 791), and by
+// source, destination and identification for IPv6 (RFC 8200). IPv4
+// addresses are stored in the low bits of src and dst.
+type fragKey struct {
+	v6       bool
+	src, dst IP6
+	id       uint32
+	proto    IP4Proto // IPv4 only
+}
+
+type fragDatagram struct {
+	seq uint64
+	// header is the header of the fragment at offset 0, once seen:
+	// the IPv4 header, or the IPv6 header and the extension headers
+	// before the Fragment header.
+	header []byte
+	// For IPv6, nhOff is the offset in header of the next header field
+	// that pointed to the Fragment header, and nextHeader is the value
+	// it takes in the reassembled datagram.
+	nhOff      int
+	nextHeader uint8
+	data       []byte      // payload received so far
+	have       []fragRange // received parts of data, sorted and merged
+	total      int         // payload length, or -1 until the last fragment is seen
+	// frags are the fragments received, under the OverlapDrop policy
+	// only, to recognize exact duplicates.
+	frags []fragRange
+	// dropped is whether the datagram was discarded because of an
+	// overlap. It is kept, without data, so that its remaining
+	// fragments are discarded too.
+	dropped bool
+}
+
+// fragRange is a range [start, end) of datagram payload bytes.
+type fragRange struct {
+	start, end int
+}
+
+// Add adds the IPv4 or IPv6 packet pkt to r.
+//
+// If pkt is not a fragment, Add returns it unchanged. If pkt completes
+// a datagram, Add returns the reassembled datagram, with a fresh
+// header based on that of its first fragment; IPv6 datagrams lose
+// their Fragment header. Otherwise, it returns nil. pkt is copied as
+// needed, so the caller may reuse it.
+//
+// Add returns ErrFragmentOverlap for fragments of a datagram dropped
+// by the OverlapDrop policy, and ErrLargePacket, discarding the
+// datagram, if it would reassemble to more than 64KiB.
+func (r *Reassembler) Add(pkt []byte) ([]byte, error) {
+	if len(pkt) > 0 && pkt[0]>>4 == 6 {
+		return r.add6(pkt)
+	}
+	return r.add4(pkt)
+}
+
+// add4 implements Add for IPv4 packets.
+func (r *Reassembler) add4(pkt []byte) ([]byte, error) {
+	hlen, length, err := checkIP4(pkt)
+	if err != nil {
+		return nil, err
+	}
+	pkt = pkt[:length]
+	fragWord := get16(pkt[6:8])
+	more := fragWord&ip4FlagMF != 0
+	off := int(fragWord&ip4FragOffsetMask) * 8
+	if !more && off == 0 {
+		return pkt, nil
+	}
+	payload := pkt[hlen:]
+	if more && len(payload)%8 != 0 {
+		return nil, &ParseError{
+			Field:  "TotalLength",
+			Offset: 2,
+			Value:  length,
+			Reason: "leaves non-final fragment payload not a multiple of 8",
+		}
+	}
+
+	key := fragKey{
+		src:   IP6{Lo: uint64(get32(pkt[12:16]))},
+		dst:   IP6{Lo: uint64(get32(pkt[16:20]))},
+		id:    uint32(get16(pkt[4:6])),
+		proto: IP4Proto(pkt[9]),
+	}
+	d, err := r.addFragment(key, off, more, payload, maxPacketLength-ipHeaderLength)
+	if d == nil {
+		return nil, err
+	}
+	if off == 0 && (d.header == nil || r.Policy != OverlapFirst) {
+		d.header = append(d.header[:0], pkt[:hlen]...)
+	}
+	return r.finish(key, d)
+}
+
+// add6 implements Add for IPv6 packets.
+func (r *Reassembler) add6(pkt []byte) ([]byte, error) {
+	length, err := checkIP6(pkt)
+	if err != nil {
+		return nil, err
+	}
+	pkt = pkt[:length]
+	fh, fragOff, nhOff, ok := ip6FragmentHeader(pkt)
+	if !ok {
+		return pkt, nil
+	}
+	payload := pkt[fragOff+8:]
+	if !fh.More && fh.Offset == 0 {
+		// An atomic fragment, which RFC 6946 says to process in
+		// isolation from other fragments with the same ID.
+		return ip6Unfragment(pkt[:fragOff], nhOff, uint8(fh.NextHeader), payload), nil
+	}
+	if fh.More && len(payload)%8 != 0 {
+		return nil, &ParseError{
+			Field:  "PayloadLength",
+			Offset: 4,
+			Value:  length - ip6HeaderLength,
+			Reason: "leaves non-final fragment payload not a multiple of 8",
+		}
+	}
+
+	key := fragKey{
+		v6:  true,
+		src: ip6FromBytes(pkt[8:24]),
+		dst: ip6FromBytes(pkt[24:40]),
+		id:  fh.ID,
+	}
+	d, err := r.addFragment(key, fh.Offset, fh.More, payload, maxPacketLength-(fragOff-ip6HeaderLength))
+	if d == nil {
+		return nil, err
+	}
+	if fh.Offset == 0 && (d.header == nil || r.Policy != OverlapFirst) {
+		d.header = append(d.header[:0], pkt[:fragOff]...)
+		d.nhOff = nhOff
+		d.nextHeader = uint8(fh.NextHeader)
+	}
+	return r.finish(key, d)
+}
+
+// addFragment adds payload, found at byte offset off of the datagram
+// identified by key, to the datagram's pending data. maxEnd is the
+// most payload the datagram can hold given its header. It returns the
+// datagram if the fragment was accepted, or nil and the error, if
+// any, for Add to return.
+func (r *Reassembler) addFragment(key fragKey, off int, more bool, payload []byte, maxEnd int) (*fragDatagram, error) {
+	end := off + len(payload)
+	d := r.datagram(key)
+	if d.dropped {
+		return nil, ErrFragmentOverlap
+	}
+	if end > maxEnd {
+		delete(r.pending, key)
+		return nil, ErrLargePacket
+	}
+	if r.Policy == OverlapDrop && d.overlaps(off, end) {
+		if d.duplicate(off, more, payload) {
+			return nil, nil
+		}
+		*d = fragDatagram{seq: d.seq, dropped: true}
+		return nil, ErrFragmentOverlap
+	}
+
+	// A last fragment fixes the datagram length, which must agree
+	// with everything else received.
+	badLength := false
+	if !more {
+		badLength = (d.total >= 0 && d.total != end) || (len(d.have) > 0 && d.have[len(d.have)-1].end > end)
+	} else {
+		badLength = d.total >= 0 && end > d.total
+	}
+	keepOld := false
+	if badLength || d.differs(off, payload) {
+		switch r.Policy {
+		case OverlapFirst:
+			if badLength {
+				return nil, nil
+			}
+			keepOld = true
+		case OverlapLast:
+			if badLength {
+				if more {
+					d.total = -1
+				} else {
+					d.truncate(end)
+				}
+			}
+		default:
+			*d = fragDatagram{seq: d.seq, dropped: true}
+			return nil, ErrFragmentOverlap
+		}
+	}
+
+	d.grow(end)
+	if keepOld {
+		d.fillGaps(off, payload)
+	} else {
+		copy(d.data[off:end], payload)
+	}
+	d.add(fragRange{off, end})
+	if r.Policy == OverlapDrop {
+		d.frags = append(d.frags, fragRange{off, end})
+	}
+	if !more {
+		d.total = end
+	}
+	return d, nil
+}
+
+// finish returns the reassembled datagram for key if d is complete,
+// and removes it from r.
+func (r *Reassembler) finish(key fragKey, d *fragDatagram) ([]byte, error) {
+	if d.header == nil || d.total < 0 || len(d.have) != 1 || d.have[0] != (fragRange{0, d.total}) {
+		return nil, nil
+	}
+	delete(r.pending, key)
+	hlen := len(d.header)
+	if key.v6 {
+		if hlen-ip6HeaderLength+d.total > maxPacketLength {
+			return nil, ErrLargePacket
+		}
+		return ip6Unfragment(d.header, d.nhOff, d.nextHeader, d.data[:d.total]), nil
+	}
+	if hlen+d.total > maxPacketLength {
+		return nil, ErrLargePacket
+	}
+	out := make([]byte, hlen+d.total)
+	copy(out, d.header)
+	copy(out[hlen:], d.data[:d.total])
+	put16(out[2:4], uint16(len(out)))
+	put16(out[6:8], get16(out[6:8])&^(ip4FlagMF|ip4FragOffsetMask))
+	put16(out[10:12], ChecksumExcluding(out[:hlen], 10))
+	return out, nil
+}
+
+// ip6Unfragment returns the IPv6 datagram made of the headers before
+// its Fragment header, unfrag, followed by payload. The next header
+// field at nhOff in unfrag is set to nh, in place of the Fragment
+// header type.
+func ip6Unfragment(unfrag []byte, nhOff int, nh uint8, payload []byte) []byte {
+	out := make([]byte, len(unfrag)+len(payload))
+	copy(out, unfrag)
+	copy(out[len(unfrag):], payload)
+	out[nhOff] = nh
+	put16(out[4:6], uint16(len(out)-ip6HeaderLength))
+	return out
+}
+
+// datagram returns the pending datagram for key, creating it and
+// evicting the oldest pending datagram if needed.
+func (r *Reassembler) datagram(key fragKey) *fragDatagram {
+	if d, ok := r.pending[key]; ok {
+		return d
+	}
+	if r.pending == nil {
+		r.pending = make(map[fragKey]*fragDatagram)
+	}
+	max := r.MaxDatagrams
+	if max <= 0 {
+		max = DefaultMaxDatagrams
+	}
+	for len(r.pending) >= max {
+		var oldest fragKey
+		var oldestSeq uint64
+		first := true
+		for k, d := range r.pending {
+			if first || d.seq < oldestSeq {
+				oldest, oldestSeq, first = k, d.seq, false
+			}
+		}
+		delete(r.pending, oldest)
+	}
+	r.seq++
+	d := &fragDatagram{seq: r.seq, total: -1}
+	r.pending[key] = d
+	return d
+}
+
+// differs reports whether payload, placed at off, disagrees with any
+// bytes already received.
+func (d *fragDatagram) differs(off int, payload []byte) bool {
+	end := off + len(payload)
+	for _, h := range d.have {
+		lo, hi := h.start, h.end
+		if lo < off {
+			lo = off
+		}
+		if hi > end {
+			hi = end
+		}
+		for i := lo; i < hi; i++ {
+			if d.data[i] != payload[i-off] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// overlaps reports whether any of [off, end) was already received.
+func (d *fragDatagram) overlaps(off, end int) bool {
+	for _, h := range d.have {
+		if h.start < end && off < h.end {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicate reports whether payload, placed at off, with more
+// fragments to follow if more is set, exactly repeats a fragment
+// already received.
+func (d *fragDatagram) duplicate(off int, more bool, payload []byte) bool {
+	end := off + len(payload)
+	if more == (d.total == end) {
+		return false
+	}
+	for _, f := range d.frags {
+		if f == (fragRange{off, end}) {
+			return !d.differs(off, payload)
+		}
+	}
+	return false
+}
+
+// fillGaps copies the parts of payload, placed at off, that fall
+// outside the ranges already received.
+func (d *fragDatagram) fillGaps(off int, payload []byte) {
+	end := off + len(payload)
+	pos := off
+	for _, h := range d.have {
+		if h.end <= pos {
+			continue
+		}
+		if h.start >= end {
+			break
+		}
+		if h.start > pos {
+			copy(d.data[pos:h.start], payload[pos-off:])
+		}
+		pos = h.end
+	}
+	if pos < end {
+		copy(d.data[pos:end], payload[pos-off:])
+	}
+}
+
+// grow extends d.data to at least n bytes.
+func (d *fragDatagram) grow(n int) {
+	if len(d.data) < n {
+		d.data = append(d.data, make([]byte, n-len(d.data))...)
+	}
+}
+
+// truncate discards any received data at or beyond end.
+func (d *fragDatagram) truncate(end int) {
+	have := d.have[:0]
+	for _, h := range d.have {
+		if h.start >= end {
+			continue
+		}
+		if h.end > end {
+			h.end = end
+		}
+		have = append(have, h)
+	}
+	d.have = have
+	if len(d.data) > end {
+		d.data = d.data[:end]
+	}
+}
+
+// add records nr as received, merging it with adjacent or
+// overlapping ranges.
+func (d *fragDatagram) add(nr fragRange) {
+	have := d.have[:0:0]
+	inserted := false
+	for _, h := range d.have {
+		switch {
+		case h.end < nr.start:
+			have = append(have, h)
+		case h.start > nr.end:
+			if !inserted {
+				have = append(have, nr)
+				inserted = true
+			}
+			have = append(have, h)
+		default:
+			if h.start < nr.start {
+				nr.start = h.start
+			}
+			if h.end > nr.end {
+				nr.end = h.end
+			}
+		}
+	}
+	if !inserted {
+		have = append(have, nr)
+	}
+	d.have = have
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// makeFragment returns an IPv4 UDP fragment of datagram id, carrying
+// payload at byte offset off.
+func makeFragment(id uint16, off int, more bool, payload []byte) []byte {
+	buf := make([]byte, ipHeaderLength+len(payload))
+	h := IP4Header{IPProto: UDP, IPID: id, SrcIP: 0x01020304, DstIP: 0x05060708}
+	if err := h.Marshal(buf); err != nil {
+		panic(err)
+	}
+	fragWord := uint16(off / 8)
+	if more {
+		fragWord |= ip4FlagMF
+	}
+	put16(buf[6:8], fragWord)
+	put16(buf[10:12], ChecksumExcluding(buf[:ipHeaderLength], 10))
+	copy(buf[ipHeaderLength:], payload)
+	return buf
+}
+
+// testPayload returns n bytes of distinct-ish content.
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + 1)
+	}
+	return b
+}
+
+func checkReassembled(t *testing.T, got, wantPayload []byte) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("datagram not reassembled")
+	}
+	if !bytes.Equal(got[ipHeaderLength:], wantPayload) {
+		t.Errorf("payload = %x; want %x", got[ipHeaderLength:], wantPayload)
+	}
+	if int(get16(got[2:4])) != len(got) {
+		t.Errorf("total length = %d; want %d", get16(got[2:4]), len(got))
+	}
+	if get16(got[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+		t.Errorf("reassembled datagram still marked as a fragment: %#04x", get16(got[6:8]))
+	}
+	if ipChecksum(got[:ipHeaderLength]) != 0 {
+		t.Errorf("bad header checksum")
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	payload := testPayload(40)
+	frags := [][]byte{
+		makeFragment(1, 0, true, payload[0:16]),
+		makeFragment(1, 16, true, payload[16:32]),
+		makeFragment(1, 32, false, payload[32:40]),
+	}
+	orders := [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}, {0, 0, 2, 1}}
+	for _, order := range orders {
+		var r Reassembler
+		var got []byte
+		for i, fi := range order {
+			out, err := r.Add(frags[fi])
+			if err != nil {
+				t.Fatalf("order %v: %v", order, err)
+			}
+			if i < len(order)-1 && out != nil {
+				t.Fatalf("order %v: datagram completed early", order)
+			}
+			got = out
+		}
+		checkReassembled(t, got, payload)
+		if len(r.pending) != 0 {
+			t.Errorf("order %v: %d datagrams left pending", order, len(r.pending))
+		}
+	}
+
+	// Unfragmented packets pass straight through.
+	var r Reassembler
+	if out, err := r.Add(udpRequestBuffer); err != nil || !bytes.Equal(out, udpRequestBuffer) {
+		t.Errorf("unfragmented: got %x, %v", out, err)
+	}
+}
+
+func TestReassembleOverlap(t *testing.T) {
+	payload := testPayload(32)
+	evil := append([]byte(nil), payload[8:24]...)
+	for i := range evil {
+		evil[i] ^= 0xff
+	}
+	// The first fragment covers [0, 16); the second [8, 24) with
+	// different bytes; the last [16, 32).
+	first := makeFragment(7, 0, true, payload[0:16])
+	overlap := makeFragment(7, 8, true, evil)
+	last := makeFragment(7, 16, false, payload[16:32])
+
+	t.Run("drop", func(t *testing.T) {
+		var r Reassembler // OverlapDrop is the zero value
+		if _, err := r.Add(first); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Add(overlap); err != ErrFragmentOverlap {
+			t.Fatalf("overlap: got err %v; want %v", err, ErrFragmentOverlap)
+		}
+		if out, err := r.Add(last); out != nil || err != ErrFragmentOverlap {
+			t.Fatalf("later fragment: got %x, %v; want nil, %v", out, err, ErrFragmentOverlap)
+		}
+	})
+	t.Run("first", func(t *testing.T) {
+		r := Reassembler{Policy: OverlapFirst}
+		r.Add(first)
+		r.Add(overlap)
+		out, err := r.Add(last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// [16, 24) came from overlap, before last.
+		want := append(append([]byte(nil), payload[:16]...), evil[8:]...)
+		want = append(want, payload[24:]...)
+		checkReassembled(t, out, want)
+	})
+	t.Run("last", func(t *testing.T) {
+		r := Reassembler{Policy: OverlapLast}
+		r.Add(first)
+		r.Add(overlap)
+		out, err := r.Add(last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte(nil), payload[:8]...), evil[:8]...)
+		want = append(want, payload[16:]...)
+		checkReassembled(t, out, want)
+	})
+
+	// Identical overlapping data is fine under the other policies,
+	// but RFC 5722 drops even that.
+	for _, p := range []OverlapPolicy{OverlapFirst, OverlapLast} {
+		r := Reassembler{Policy: p}
+		r.Add(makeFragment(8, 0, true, payload[0:16]))
+		r.Add(makeFragment(8, 8, true, payload[8:24]))
+		out, err := r.Add(makeFragment(8, 16, false, payload[16:32]))
+		if err != nil {
+			t.Fatalf("%v: %v", p, err)
+		}
+		checkReassembled(t, out, payload)
+	}
+	var r Reassembler
+	r.Add(makeFragment(8, 0, true, payload[0:16]))
+	if _, err := r.Add(makeFragment(8, 8, true, payload[8:24])); err != ErrFragmentOverlap {
+		t.Errorf("identical partial overlap: got err %v; want %v", err, ErrFragmentOverlap)
+	}
+}
+
+func TestReassembleDuplicate(t *testing.T) {
+	payload := testPayload(32)
+	first := makeFragment(1, 0, true, payload[0:16])
+	last := makeFragment(1, 16, false, payload[16:32])
+
+	// Exact duplicates are ignored, as RFC 8200 allows.
+	var r Reassembler
+	for _, pkt := range [][]byte{first, first, last} {
+		out, err := r.Add(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			checkReassembled(t, out, payload)
+		}
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("datagram not completed")
+	}
+	r.Add(last)
+	if out, err := r.Add(last); out != nil || err != nil {
+		t.Errorf("duplicate last fragment: got %x, %v; want nil, nil", out, err)
+	}
+
+	// Fragments with the same range but different bytes or flags
+	// aren't duplicates.
+	mid := makeFragment(2, 8, true, payload[8:16])
+	evil := append([]byte(nil), mid...)
+	evil[len(evil)-1] ^= 0xff
+	for name, pkt := range map[string][]byte{
+		"bytes":     evil,
+		"more_flag": makeFragment(2, 8, false, payload[8:16]),
+	} {
+		r := Reassembler{}
+		r.Add(mid)
+		if _, err := r.Add(pkt); err != ErrFragmentOverlap {
+			t.Errorf("%s: got err %v; want %v", name, err, ErrFragmentOverlap)
+		}
+	}
+}
+
+func TestReassembleInconsistentLength(t *testing.T) {
+	payload := testPayload(32)
+	var r Reassembler
+	r.Add(makeFragment(1, 0, true, payload[:16]))
+	r.Add(makeFragment(1, 16, false, payload[16:]))
+	// A second "last" fragment ending elsewhere.
+	if _, err := r.Add(makeFragment(1, 8, false, payload[8:16])); err != nil {
+		// Already complete and gone, so this starts a new datagram.
+		t.Fatalf("after completion: %v", err)
+	}
+
+	r = Reassembler{}
+	r.Add(makeFragment(2, 16, false, payload[16:]))
+	if _, err := r.Add(makeFragment(2, 8, false, payload[8:16])); err != ErrFragmentOverlap {
+		t.Errorf("conflicting last fragments: got err %v; want %v", err, ErrFragmentOverlap)
+	}
+
+	r = Reassembler{Policy: OverlapFirst}
+	r.Add(makeFragment(3, 16, false, payload[16:]))
+	if out, _ := r.Add(makeFragment(3, 0, true, testPayload(40))); out != nil {
+		t.Errorf("OverlapFirst: accepted fragment reaching past the end")
+	}
+	if out, _ := r.Add(makeFragment(3, 0, true, payload[:16])); out == nil {
+		t.Errorf("OverlapFirst: datagram not completed by its first fragment")
+	} else {
+		checkReassembled(t, out, payload)
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	r := Reassembler{MaxDatagrams: 2}
+	payload := testPayload(16)
+	for id := uint16(1); id <= 3; id++ {
+		r.Add(makeFragment(id, 0, true, payload[:8]))
+	}
+	if len(r.pending) != 2 {
+		t.Fatalf("%d datagrams pending; want 2", len(r.pending))
+	}
+	// Datagram 1 was evicted, so its last fragment completes nothing.
+	if out, _ := r.Add(makeFragment(1, 8, false, payload[8:])); out != nil {
+		t.Errorf("evicted datagram was reassembled")
+	}
+	if out, _ := r.Add(makeFragment(3, 8, false, payload[8:])); out == nil {
+		t.Errorf("newest datagram was evicted")
+	}
+
+	// Fragments reaching past 64KiB are rejected.
+	r = Reassembler{}
+	big := makeFragment(9, 65528, false, payload)
+	if _, err := r.Add(big); err != ErrLargePacket {
+		t.Errorf("oversized fragment: got err %v; want %v", err, ErrLargePacket)
+	}
+
+	// Non-final fragments must carry a multiple of 8 bytes.
+	if _, err := r.Add(makeFragment(10, 0, true, payload[:5])); err == nil {
+		t.Errorf("odd-sized non-final fragment accepted")
+	}
+}
+
+func TestOverlapPolicyString(t *testing.T) {
+	for p, want := range map[OverlapPolicy]string{
+		OverlapDrop:  "drop",
+		OverlapFirst: "first",
+		OverlapLast:  "last",
+		9:            "OverlapPolicy(9)",
+	} {
+		if got := p.String(); got != want {
+			t.Errorf("%d.String() = %q; want %q", uint8(p), got, want)
+		}
+	}
+}
+
+// fragment6 returns an IPv6 fragment of datagram id, carrying part, a
+// slice of the fragmentable part of the datagram, at byte offset off.
+func fragment6(id uint32, off int, more bool, part []byte) []byte {
+	pkt := make([]byte, ip6HeaderLength+len(part))
+	h := IP6Header{IPProto: UDP, SrcIP: testIP6Src, DstIP: testIP6Dst}
+	h.Marshal(pkt)
+	copy(pkt[ip6HeaderLength:], part)
+	fh := make([]byte, 8)
+	fragWord := uint16(off)
+	if more {
+		fragWord |= 1
+	}
+	put16(fh[2:4], fragWord)
+	put32(fh[4:8], id)
+	return withIP6ExtHeader(pkt, ip6Fragment, fh)
+}
+
+func TestReassemble6(t *testing.T) {
+	orig := makeUDP6(100)
+	part := orig[ip6HeaderLength:]
+	frags := [][]byte{
+		fragment6(7, 0, true, part[0:48]),
+		fragment6(7, 48, true, part[48:96]),
+		fragment6(7, 96, false, part[96:]),
+	}
+	for _, order := range [][]int{{0, 1, 2}, {2, 0, 1}, {1, 1, 2, 0}} {
+		var r Reassembler
+		var got []byte
+		for _, fi := range order {
+			out, err := r.Add(frags[fi])
+			if err != nil {
+				t.Fatalf("order %v: %v", order, err)
+			}
+			got = out
+		}
+		if !bytes.Equal(got, orig) {
+			t.Errorf("order %v: reassembled\n%x\nwant\n%x", order, got, orig)
+		}
+	}
+
+	// Extension headers before the Fragment header are kept, and the
+	// last of them is made to point at the reassembled payload.
+	hbh := []byte{0, 0, 1, 4, 0, 0, 0, 0} // PadN
+	var r Reassembler
+	var got []byte
+	for _, f := range frags {
+		out, err := r.Add(withIP6ExtHeader(f, ip6HopByHop, hbh))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = out
+	}
+	want := withIP6ExtHeader(orig, ip6HopByHop, hbh)
+	if !bytes.Equal(got, want) {
+		t.Errorf("with hop-by-hop: reassembled\n%x\nwant\n%x", got, want)
+	}
+
+	// Datagrams are told apart by ID, and IPv4 fragments don't mix
+	// with IPv6 ones.
+	r = Reassembler{}
+	r.Add(frags[0])
+	r.Add(frags[1])
+	r.Add(makeFragment(7, 0, true, part[0:48]))
+	if out, _ := r.Add(fragment6(8, 96, false, part[96:])); out != nil {
+		t.Errorf("fragment with another ID completed the datagram")
+	}
+	if len(r.pending) != 3 {
+		t.Errorf("%d datagrams pending; want 3", len(r.pending))
+	}
+}
+
+func TestReassemble6Hardening(t *testing.T) {
+	orig := makeUDP6(100)
+	part := orig[ip6HeaderLength:]
+
+	// Atomic fragments pass through on their own (RFC 6946), even
+	// with other fragments of the same ID pending.
+	var r Reassembler
+	r.Add(fragment6(1, 0, true, part[0:48]))
+	got, err := r.Add(fragment6(1, 0, false, part))
+	if err != nil || !bytes.Equal(got, orig) {
+		t.Errorf("atomic fragment = %x, %v; want %x", got, err, orig)
+	}
+	if len(r.pending) != 1 {
+		t.Errorf("atomic fragment changed pending datagrams")
+	}
+
+	// Overlapping fragments with different bytes are dropped.
+	r = Reassembler{}
+	r.Add(fragment6(2, 0, true, part[0:48]))
+	bad := append([]byte(nil), part[40:96]...)
+	bad[0] ^= 0xff
+	if _, err := r.Add(fragment6(2, 40, true, bad)); err != ErrFragmentOverlap {
+		t.Errorf("overlap: got err %v; want %v", err, ErrFragmentOverlap)
+	}
+	if _, err := r.Add(fragment6(2, 96, false, part[96:])); err != ErrFragmentOverlap {
+		t.Errorf("after overlap: got err %v; want %v", err, ErrFragmentOverlap)
+	}
+
+	// Fragments reaching past 64KiB of payload are rejected.
+	r = Reassembler{}
+	if _, err := r.Add(fragment6(3, 65528, false, part[:16])); err != ErrLargePacket {
+		t.Errorf("oversized fragment: got err %v; want %v", err, ErrLargePacket)
+	}
+
+	// Non-final fragments must carry a multiple of 8 bytes.
+	if _, err := r.Add(fragment6(4, 0, true, part[:5])); err == nil {
+		t.Errorf("odd-sized non-final fragment accepted")
+	}
+
+	// Eviction counts datagrams of both versions.
+	r = Reassembler{MaxDatagrams: 2}
+	r.Add(fragment6(5, 0, true, part[:8]))
+	r.Add(makeFragment(5, 0, true, part[:8]))
+	r.Add(fragment6(6, 0, true, part[:8]))
+	if len(r.pending) != 2 {
+		t.Errorf("%d datagrams pending; want 2", len(r.pending))
+	}
+}
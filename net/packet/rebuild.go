@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+var errNotRebuildable = errors.New("packet can't be rebuilt")
+
+// Rebuild writes to buf the IPv4 packet q was decoded from, with its
+// payload replaced by payload, and returns the number of bytes
+// written. The IP header, including its TTL, flags, DSCP and options,
+// and the transport header are copied as decoded; only the lengths
+// and checksums are recomputed.
+//
+// Rebuild supports unfragmented TCP, UDP and ICMP packets, for which
+// the payload is what Payload returns. payload may alias q's buffer
+// but not buf.
+func (q *Parsed) Rebuild(payload []byte, buf []byte) (int, error) {
+	if q.IPVersion != 4 || q.dataofs > q.length {
+		return 0, errNotRebuildable
+	}
+	fragWord := get16(q.b[6:8])
+	if fragWord&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+		return 0, errNotRebuildable
+	}
+	csumOfs, ok := transportChecksumOffset(q.IPProto)
+	if !ok || q.dataofs < q.subofs+csumOfs+2 {
+		return 0, errNotRebuildable
+	}
+
+	n := q.dataofs + len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+	copy(buf, q.b[:q.dataofs])
+	copy(buf[q.dataofs:], payload)
+
+	put16(buf[2:4], uint16(n))
+	put16(buf[10:12], ChecksumExcluding(buf[:q.subofs], 10))
+
+	seg := buf[q.subofs:]
+	if q.IPProto == UDP {
+		put16(seg[4:6], uint16(len(seg)))
+	}
+	ac := checksumSum(seg[:csumOfs]) + checksumSum(seg[csumOfs+2:])
+	if q.IPProto != ICMP {
+		ac += pseudoSum4(q.SrcIP, q.DstIP, q.IPProto, len(seg))
+	}
+	csum := ^foldChecksum(ac)
+	if q.IPProto == UDP && csum == 0 {
+		csum = 0xffff
+	}
+	put16(seg[csumOfs:csumOfs+2], csum)
+	return n, nil
+}
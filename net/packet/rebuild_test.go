@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRebuild(t *testing.T) {
+	src := IP4Port{IP: 0x01020304, Port: 123}
+	dst := IP4Port{IP: 0x05060708, Port: 567}
+	payload := []byte("request_payload")
+	build := func(f func(buf []byte) (int, error)) []byte {
+		buf := make([]byte, 128)
+		n, err := f(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	udp := build(func(buf []byte) (int, error) { return MakeUDP4(src, dst, payload, buf) })
+	tcp := build(func(buf []byte) (int, error) {
+		return MakeTCP4(src, dst, 1000, 2000, TCPAck|TCPPsh, 512, payload, buf)
+	})
+	icmp := build(func(buf []byte) (int, error) { return MakeICMP4EchoRequest(src.IP, dst.IP, 1, 2, payload, buf) })
+	// Options, a non-default TOS and TTL, and DF must all survive.
+	udpOpts := withIP4Options(udp, []byte{0x01, 0x01, 0x01, 0x00})
+	udpOpts[1] = 0xb8
+	udpOpts[6] |= 0x40
+	udpOpts[8] = 3
+	put16(udpOpts[10:12], ChecksumExcluding(udpOpts[:24], 10))
+
+	for _, tt := range []struct {
+		name string
+		pkt  []byte
+	}{
+		{"udp", udp},
+		{"tcp", tcp},
+		{"icmp", icmp},
+		{"udp_options", udpOpts},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Parsed
+			q.Decode(tt.pkt)
+			buf := make([]byte, 128)
+			n, err := q.Rebuild(q.Payload(), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], tt.pkt) {
+				t.Errorf("same payload: %s", Diff(tt.pkt, buf[:n]))
+			}
+
+			newPayload := []byte("a different, longer payload")
+			n, err = q.Rebuild(newPayload, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := buf[:n]
+			var q2 Parsed
+			q2.Decode(out)
+			if !bytes.Equal(q2.Payload(), newPayload) {
+				t.Errorf("payload = %q; want %q", q2.Payload(), newPayload)
+			}
+			if !bytes.Equal(q2.IPHeaderBytes()[4:10], q.IPHeaderBytes()[4:10]) || q2.IPHeaderBytes()[1] != q.IPHeaderBytes()[1] {
+				t.Errorf("IP header fields not preserved: %s", Diff(tt.pkt, out))
+			}
+			if ipChecksum(out[:q2.subofs]) != 0 {
+				t.Errorf("bad IP checksum")
+			}
+			if q2.IPProto == ICMP {
+				if ipChecksum(out[q2.subofs:]) != 0 {
+					t.Errorf("bad ICMP checksum")
+				}
+			} else if transportChecksum4(out) != 0 {
+				t.Errorf("bad %v checksum", q2.IPProto)
+			}
+			if q2.IPProto == UDP && int(get16(out[q2.subofs+4:])) != n-q2.subofs {
+				t.Errorf("UDP length = %d; want %d", get16(out[q2.subofs+4:]), n-q2.subofs)
+			}
+		})
+	}
+
+	var q Parsed
+	q.Decode(udp)
+	if _, err := q.Rebuild(payload, make([]byte, len(udp)-1)); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+	frag := append([]byte(nil), udp...)
+	frag[6] |= 0x20 // more fragments
+	q.Decode(frag)
+	if _, err := q.Rebuild(payload, make([]byte, 128)); err == nil {
+		t.Errorf("rebuilt a fragment")
+	}
+	q.Decode(ipv6PacketBuffer)
+	if _, err := q.Rebuild(nil, make([]byte, 128)); err == nil {
+		t.Errorf("rebuilt an IPv6 packet")
+	}
+}
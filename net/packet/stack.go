@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// Stack builds a packet out of several consecutive headers and a
+// payload, such as an Ethernet frame holding a UDP datagram:
+//
+//	n, err := NewStack(buf).Add(&eth).Add(&udp).Finish(payload)
+//
+// Each IP-level header in this package marshals its IP header along
+// with its transport header, so a UDP datagram is one UDP4Header, not
+// an IP4Header followed by one. Adding an IP4Header before another
+// IP-level header encapsulates it, as in IP-in-IP.
+type Stack struct {
+	buf     []byte
+	headers []Header
+}
+
+// NewStack returns a Stack that builds a packet in buf.
+func NewStack(buf []byte) *Stack {
+	return &Stack{buf: buf}
+}
+
+// Add appends h to the headers of the packet and returns s.
+func (s *Stack) Add(h Header) *Stack {
+	s.headers = append(s.headers, h)
+	return s
+}
+
+// Finish lays out the headers consecutively, in the order they were
+// added, followed by payload, and returns the total length.
+//
+// Headers are marshaled from the innermost out, each given the buffer
+// from its own offset to the end of the packet. So every length field
+// covers the headers and payload that follow, and every checksum is
+// computed over contents that are already final: a transport checksum
+// before the IP header checksum, and an inner packet entirely before
+// the header that encapsulates it.
+func (s *Stack) Finish(payload []byte) (int, error) {
+	offsets := make([]int, len(s.headers))
+	n := 0
+	for i, h := range s.headers {
+		offsets[i] = n
+		n += h.Len()
+	}
+	n += len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(s.buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf := s.buf[:n]
+	copy(buf[n-len(payload):], payload)
+	for i := len(s.headers) - 1; i >= 0; i-- {
+		if err := s.headers[i].Marshal(buf[offsets[i]:]); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
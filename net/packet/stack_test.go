@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func TestStack(t *testing.T) {
+	eth := EthernetHeader{
+		Dst:       [6]byte{0x02, 0, 0, 0, 0, 0x01},
+		Src:       [6]byte{0x02, 0, 0, 0, 0, 0x02},
+		EtherType: EtherTypeIPv4,
+	}
+	udp := UDP4Header{
+		IP4Header: IP4Header{SrcIP: 0x01020304, DstIP: 0x05060708},
+		SrcPort:   123,
+		DstPort:   567,
+	}
+	payload := []byte("request_payload")
+
+	buf := make([]byte, 128)
+	n, err := NewStack(buf).Add(&eth).Add(&udp).Finish(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ethernetHeaderLength + udpTotalHeaderLength + len(payload); n != want {
+		t.Fatalf("length = %d; want %d", n, want)
+	}
+	frame := buf[:n]
+	wantEth := []byte{0x02, 0, 0, 0, 0, 0x01, 0x02, 0, 0, 0, 0, 0x02, 0x08, 0x00}
+	if !bytes.Equal(frame[:14], wantEth) {
+		t.Errorf("Ethernet header %x; want %x", frame[:14], wantEth)
+	}
+	// The IP part must be exactly what marshaling alone produces.
+	if want := Generate(&udp, payload); !bytes.Equal(frame[14:], want) {
+		t.Errorf("IP packet: %s", Diff(want, frame[14:]))
+	}
+
+	// IP-in-IP: the outer header covers the whole inner packet.
+	outer := IP4Header{IPProto: 4, SrcIP: 0x0a000001, DstIP: 0x0a000002}
+	n, err = NewStack(buf).Add(&outer).Add(&udp).Finish(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := buf[:n]
+	if int(get16(pkt[2:4])) != n || ipChecksum(pkt[:20]) != 0 {
+		t.Errorf("bad outer header %x", pkt[:20])
+	}
+	inner := pkt[20:]
+	if int(get16(inner[2:4])) != len(inner) || ipChecksum(inner[:20]) != 0 || transportChecksum4(inner) != 0 {
+		t.Errorf("bad inner packet %x", inner)
+	}
+
+	if _, err := NewStack(buf[:n-1]).Add(&outer).Add(&udp).Finish(payload); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestEthernetHeader(t *testing.T) {
+	h := EthernetHeader{Dst: [6]byte{1}, Src: [6]byte{2}, EtherType: EtherTypeIPv6}
+	h.ToResponse()
+	if h.Dst != [6]byte{2} || h.Src != [6]byte{1} {
+		t.Errorf("ToResponse didn't swap addresses: %+v", h)
+	}
+	if err := h.Marshal(make([]byte, 13)); err != ErrSmallBuffer {
+		t.Errorf("short buffer: got err %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestStripFCS(t *testing.T) {
+	frame := func(etherType uint16, pkt []byte) []byte {
+		eth := EthernetHeader{Dst: [6]byte{0x02, 0, 0, 0, 0, 0x01}, Src: [6]byte{0x02, 0, 0, 0, 0, 0x02}, EtherType: etherType}
+		f := make([]byte, ethernetHeaderLength, ethernetHeaderLength+len(pkt)+ethernetMinFrame)
+		eth.Marshal(f)
+		f = append(f, pkt...)
+		for len(f) < ethernetMinFrame {
+			f = append(f, 0)
+		}
+		return f
+	}
+	withFCS := func(f []byte) []byte {
+		out := append([]byte(nil), f...)
+		crc := crc32.ChecksumIEEE(f)
+		return append(out, byte(crc), byte(crc>>8), byte(crc>>16), byte(crc>>24))
+	}
+
+	large := frame(EtherTypeIPv4, tcpCaptureBuffer)
+	small := frame(EtherTypeIPv4, icmpRequestBuffer)
+	if len(small) != ethernetMinFrame {
+		t.Fatalf("small frame is %d bytes; want padding to %d", len(small), ethernetMinFrame)
+	}
+	v6 := frame(EtherTypeIPv6, makeUDP6(40))
+	arp := frame(EtherTypeARP, make([]byte, 28))
+	badFCS := withFCS(large)
+	badFCS[len(badFCS)-1] ^= 0xff
+	// IP bytes past the total length that aren't an FCS stay put.
+	extra := append(append([]byte(nil), large...), 1, 2, 3, 4)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []byte
+	}{
+		{"fcs", withFCS(large), large},
+		{"no_fcs", large, large},
+		{"bad_fcs", badFCS, badFCS},
+		{"trailing_bytes", extra, extra},
+		{"padded_fcs", withFCS(small), small},
+		{"padded_no_fcs", small, small},
+		{"ipv6_fcs", withFCS(v6), v6},
+		{"arp_fcs", withFCS(arp), withFCS(arp)},
+		{"short", large[:16], large[:16]},
+	}
+	for _, tt := range tests {
+		if got := StripFCS(tt.frame); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes; want %d", tt.name, len(got), len(tt.want))
+		}
+	}
+}
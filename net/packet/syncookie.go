@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"time"
+)
+
+// SYN cookies follow D. J. Bernstein's layout: the top 5 bits of the
+// initial sequence number are a coarse timestamp, the next 3 an index
+// into synCookieMSS, and the low 24 a keyed hash of the connection,
+// the timestamp and the MSS index.
+const (
+	synCookiePeriod = 64 * time.Second
+	// synCookieMaxAge is how many periods old a cookie may be, so a
+	// client has between 2 and 3 minutes to complete the handshake.
+	synCookieMaxAge   = 2
+	synCookieHashMask = 1<<24 - 1
+)
+
+// synCookieMSS are the MSS values a SYN cookie can encode, lowest
+// first. They include the MSS of IPv4 and IPv6 TCP over a 1280-byte
+// MTU, as on Tailscale links, and of a 1500-byte Ethernet MTU.
+var synCookieMSS = [8]uint16{536, 1220, 1240, 1300, 1360, 1400, 1440, 1460}
+
+// SynCookie returns the initial sequence number to reply with to a SYN
+// from src to dst with sequence number clientSeq and MSS option mss,
+// so that the connection can be recognized from the client's ACK by
+// VerifySynCookie without keeping any state. The cookie encodes mss
+// rounded down to one of a few common values, or 536, the default for
+// IPv4, if mss is smaller than all of them.
+//
+// secret must be kept from clients and be the same for both calls;
+// now is the current time, and cookies expire after 2 to 3 minutes.
+func SynCookie(src, dst IP4Port, clientSeq uint32, mss uint16, secret []byte, now time.Time) uint32 {
+	idx := 0
+	for i, m := range synCookieMSS {
+		if m <= mss {
+			idx = i
+		}
+	}
+	t := synCookieTime(now)
+	return t<<27 | uint32(idx)<<24 | synCookieHash(src, dst, clientSeq, t, idx, secret)
+}
+
+// VerifySynCookie reports whether ack, the acknowledgment number of a
+// segment from src to dst with sequence number seq, acknowledges a SYN
+// cookie that SynCookie returned for the same connection within the
+// last 2 to 3 minutes. If it does, it also returns the MSS the cookie
+// encodes, which the client's SYN offered or exceeded.
+func VerifySynCookie(src, dst IP4Port, seq, ack uint32, secret []byte, now time.Time) (mss uint16, ok bool) {
+	// The client's ACK is one past both initial sequence numbers.
+	cookie, clientSeq := ack-1, seq-1
+	t := cookie >> 27
+	if age := (synCookieTime(now) - t) & 0x1f; age > synCookieMaxAge {
+		return 0, false
+	}
+	idx := int(cookie>>24) & 0x7
+	want := synCookieHash(src, dst, clientSeq, t, idx, secret)
+	if cookie&synCookieHashMask != want {
+		return 0, false
+	}
+	return synCookieMSS[idx], true
+}
+
+// synCookieTime returns the 5-bit timestamp a SYN cookie made at now
+// carries: the number of periods since the Unix epoch, modulo 32.
+func synCookieTime(now time.Time) uint32 {
+	return uint32(now.Unix()/int64(synCookiePeriod/time.Second)) & 0x1f
+}
+
+// synCookieHash returns the 24-bit keyed hash of a SYN cookie for the
+// given connection, client sequence number, 5-bit time t and MSS index.
+// Since t wraps every 32 periods, an ACK seen on the wire validates
+// again about half an hour later, but only for the same connection and
+// client sequence number.
+func synCookieHash(src, dst IP4Port, clientSeq, t uint32, idx int, secret []byte) uint32 {
+	var b [21]byte
+	put32(b[0:4], uint32(src.IP))
+	put16(b[4:6], src.Port)
+	put32(b[6:10], uint32(dst.IP))
+	put16(b[10:12], dst.Port)
+	put32(b[12:16], clientSeq)
+	put32(b[16:20], t)
+	b[20] = uint8(idx)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(b[:])
+	sum := mac.Sum(nil)
+	return uint32(sum[0])<<16 | uint32(sum[1])<<8 | uint32(sum[2])
+}
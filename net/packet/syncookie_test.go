@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSynCookie(t *testing.T) {
+	client := IP4Port{IP: 0x01020304, Port: 51234}
+	server := IP4Port{IP: 0x05060708, Port: 443}
+	secret := []byte("correct horse battery staple")
+	const clientSeq = 0xfffffff0
+	now := time.Unix(1600000000, 0)
+
+	cookie := SynCookie(client, server, clientSeq, 1460, secret, now)
+	mss, ok := VerifySynCookie(client, server, clientSeq+1, cookie+1, secret, now.Add(time.Second))
+	if !ok || mss != 1460 {
+		t.Fatalf("VerifySynCookie = %d, %v; want 1460, true", mss, ok)
+	}
+
+	for _, tt := range []struct {
+		offered, want uint16
+	}{
+		{9000, 1460},
+		{1460, 1460},
+		{1459, 1440},
+		{1240, 1240},
+		{1220, 1220},
+		{1000, 536},
+		{536, 536},
+		{100, 536},
+	} {
+		c := SynCookie(client, server, clientSeq, tt.offered, secret, now)
+		if mss, ok := VerifySynCookie(client, server, clientSeq+1, c+1, secret, now); !ok || mss != tt.want {
+			t.Errorf("MSS %d: VerifySynCookie = %d, %v; want %d, true", tt.offered, mss, ok, tt.want)
+		}
+	}
+
+	// Cookies made at different times or for different connections
+	// should differ.
+	if c := SynCookie(client, server, clientSeq, 1460, secret, now.Add(synCookiePeriod)); c == cookie {
+		t.Errorf("cookie didn't change with time")
+	}
+
+	other := IP4Port{IP: client.IP, Port: client.Port + 1}
+	for _, tt := range []struct {
+		name     string
+		src, dst IP4Port
+		seq, ack uint32
+		secret   string
+		at       time.Duration
+		want     bool
+	}{
+		{"just_made", client, server, clientSeq + 1, cookie + 1, string(secret), 0, true},
+		{"two_minutes", client, server, clientSeq + 1, cookie + 1, string(secret), 2 * time.Minute, true},
+		{"four_minutes", client, server, clientSeq + 1, cookie + 1, string(secret), 4 * time.Minute, false},
+		{"from_the_future", client, server, clientSeq + 1, cookie + 1, string(secret), -synCookiePeriod, false},
+		{"other_client_port", other, server, clientSeq + 1, cookie + 1, string(secret), 0, false},
+		{"reversed", server, client, clientSeq + 1, cookie + 1, string(secret), 0, false},
+		{"other_seq", client, server, clientSeq + 2, cookie + 1, string(secret), 0, false},
+		{"unacknowledged", client, server, clientSeq + 1, cookie, string(secret), 0, false},
+		{"other_mss", client, server, clientSeq + 1, cookie ^ 1<<24 + 1, string(secret), 0, false},
+		{"other_secret", client, server, clientSeq + 1, cookie + 1, "hunter2", 0, false},
+	} {
+		_, ok := VerifySynCookie(tt.src, tt.dst, tt.seq, tt.ack, []byte(tt.secret), now.Add(tt.at))
+		if ok != tt.want {
+			t.Errorf("%s: VerifySynCookie ok = %v; want %v", tt.name, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+var (
+	errTCPFlags       = errors.New("invalid TCP flags")
+	errNotEstablished = errors.New("not a TCP segment of an established connection")
+)
+
+// TCP4Header represents a TCP packet header.
+type TCP4Header struct {
+	IP4Header
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8 // TCPSyn, TCPAck, etc
+	Window  uint16
+	// Urgent is the urgent pointer. It is only meaningful, and only
+	// marshaled, when Flags has TCPUrg set.
+	Urgent uint16
+	// HasWindowScale is whether to send a window scale option
+	// (RFC 7323) with shift count WindowScale. The option is only
+	// legal, and only marshaled, when Flags has TCPSyn set.
+	HasWindowScale bool
+	WindowScale    uint8
+}
+
+const (
+	// tcpTotalHeaderLength is the length of all headers in a TCP packet.
+	tcpTotalHeaderLength = ipHeaderLength + tcpHeaderLength
+	// tcpWindowScaleLength is the length of a window scale option,
+	// padded with a NOP to the 4-byte alignment of TCP options.
+	tcpWindowScaleLength = 4
+)
+
+// sendsWindowScale reports whether h marshals a window scale option.
+func (h TCP4Header) sendsWindowScale() bool {
+	return h.HasWindowScale && h.Flags&TCPSyn != 0
+}
+
+func (h TCP4Header) Len() int {
+	if h.sendsWindowScale() {
+		return tcpTotalHeaderLength + tcpWindowScaleLength
+	}
+	return tcpTotalHeaderLength
+}
+
+func (h TCP4Header) Marshal(buf []byte) error {
+	hlen := h.Len()
+	if len(buf) < hlen {
+		return ErrSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return ErrLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = TCP
+
+	put16(buf[20:22], h.SrcPort)
+	put16(buf[22:24], h.DstPort)
+	put32(buf[24:28], h.Seq)
+	put32(buf[28:32], h.Ack)
+	buf[32] = uint8(hlen-ipHeaderLength) >> 2 << 4 // data offset
+	buf[33] = h.Flags
+	put16(buf[34:36], h.Window)
+	put16(buf[36:38], 0) // blank checksum
+	if h.Flags&TCPUrg != 0 {
+		put16(buf[38:40], h.Urgent)
+	} else {
+		put16(buf[38:40], 0)
+	}
+	if h.sendsWindowScale() {
+		buf[40] = tcpOptNOP
+		buf[41] = tcpOptWindowScale
+		buf[42] = 3
+		buf[43] = h.WindowScale
+	}
+
+	h.IP4Header.MarshalPseudo(buf)
+
+	// TCP checksum with IP pseudo header.
+	put16(buf[36:38], ipChecksum(buf[8:]))
+
+	h.IP4Header.Marshal(buf)
+
+	return nil
+}
+
+// ToResponse implements Header. It swaps the ports and the sequence
+// and acknowledgment numbers; callers replying to a segment that
+// carried data or SYN/FIN must still advance Ack past it.
+func (h *TCP4Header) ToResponse() {
+	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
+	h.Seq, h.Ack = h.Ack, h.Seq
+	h.IP4Header.ToResponse()
+}
+
+// MakeTCP4 writes to buf a complete IPv4 TCP segment from src to dst
+// carrying payload, with lengths and checksums filled in.
+// It returns the number of bytes written.
+//
+// flags must only contain TCP flag bits, and a segment carrying
+// payload must have ACK or SYN set.
+func MakeTCP4(src, dst IP4Port, seq, ack uint32, flags uint8, window uint16, payload []byte, buf []byte) (int, error) {
+	if flags&^0x3F != 0 || (len(payload) > 0 && flags&(TCPAck|TCPSyn) == 0) {
+		return 0, errTCPFlags
+	}
+	n := tcpTotalHeaderLength + len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+
+	h := TCP4Header{
+		IP4Header: IP4Header{
+			SrcIP: src.IP,
+			DstIP: dst.IP,
+		},
+		SrcPort: src.Port,
+		DstPort: dst.Port,
+		Seq:     seq,
+		Ack:     ack,
+		Flags:   flags,
+		Window:  window,
+	}
+	copy(buf[tcpTotalHeaderLength:], payload)
+	if err := h.Marshal(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// MakeTCPKeepalive writes to buf a TCP keepalive probe for the flow of
+// the IPv4 TCP segment q, in the same direction as q, and returns its
+// length. q is taken to be the last segment sent in that direction,
+// and to have been acknowledged, as is the case on an idle connection.
+//
+// The probe is a bare ACK whose sequence number is one less than the
+// next one the sender would use (SND.NXT-1, which equals SND.UNA-1 on
+// an idle connection), as RFC 1122 section 4.2.3.6 describes. That
+// byte has already been acknowledged, so the peer discards it and
+// answers with an ACK, proving the connection is still alive. The
+// acknowledgment number and window are copied from q.
+//
+// It returns an error if q is not a segment of an established
+// connection: a SYN, a RST, or a segment without ACK.
+func (q *Parsed) MakeTCPKeepalive(buf []byte) (int, error) {
+	if q.IPVersion != 4 || q.IPProto != TCP || q.TCPFlags&(TCPSyn|TCPRst) != 0 || q.TCPFlags&TCPAck == 0 {
+		return 0, errNotEstablished
+	}
+	h := q.TCPHeader()
+	next := h.Seq + uint32(q.TCPPayloadLen())
+	if q.TCPFlags&TCPFin != 0 {
+		next++ // FIN occupies a sequence number
+	}
+	src := IP4Port{IP: q.SrcIP, Port: q.SrcPort}
+	dst := IP4Port{IP: q.DstIP, Port: q.DstPort}
+	return MakeTCP4(src, dst, next-1, h.Ack, TCPAck, h.Window, nil, buf)
+}
+
+// VerifyTCP4Checksum reports whether buf holds an IPv4 TCP segment
+// whose checksum is correct. The checksum covers the IPv4
+// pseudo-header, whose length is the TCP segment length: the IPv4 total
+// length minus the IPv4 header length, as TCP has no length field of
+// its own. Bytes after the total length, such as link-layer padding,
+// are ignored.
+//
+// Fragments are reported as invalid, since their checksum can only be
+// verified after reassembly.
+func VerifyTCP4Checksum(buf []byte) bool {
+	hlen, length, err := checkIP4(buf)
+	if err != nil || IP4Proto(buf[9]) != TCP {
+		return false
+	}
+	if get16(buf[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+		return false
+	}
+	seg := buf[hlen:length]
+	if len(seg) < tcpHeaderLength {
+		return false
+	}
+	ac := checksumSum(seg) + pseudoSum4(IP4(get32(buf[12:16])), IP4(get32(buf[16:20])), TCP, len(seg))
+	return foldChecksum(ac) == 0xffff
+}
+
+// SeqLess reports whether TCP sequence number a precedes b.
+// Sequence numbers are compared modulo 2^32 as described in RFC 1982,
+// so the comparison remains correct across wraparound.
+func SeqLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// SeqInWindow reports whether TCP sequence number seq lies within
+// the half-open window [start, end), taking wraparound into account.
+// An empty window (start == end) contains no sequence numbers.
+func SeqInWindow(seq, start, end uint32) bool {
+	return seq-start < end-start
+}
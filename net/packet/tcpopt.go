@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// TCP option kinds, per RFC 793, RFC 7323 and RFC 2018.
+const (
+	tcpOptEOL           = 0
+	tcpOptNOP           = 1
+	tcpOptMSS           = 2
+	tcpOptWindowScale   = 3
+	tcpOptSACKPermitted = 4
+	tcpOptSACK          = 5
+	tcpOptTimestamp     = 8
+)
+
+// tcpOptions returns the options area of q's TCP header, or nil if q
+// is not a TCP packet or has no options. A data offset pointing past
+// the end of the packet is clamped to the packet.
+func (q *Parsed) tcpOptions() []byte {
+	if q.IPProto != TCP || q.TransportSkipped {
+		return nil
+	}
+	start := q.subofs + tcpHeaderLength
+	end := q.dataofs
+	if end > q.length {
+		end = q.length
+	}
+	if end <= start {
+		return nil
+	}
+	return q.b[start:end]
+}
+
+// findTCPOption returns the payload (without the kind and length
+// bytes) of the first option of the given kind in opts. It reports
+// false if there is no such option, or if the options are malformed
+// before one is found.
+func findTCPOption(opts []byte, kind uint8) (data []byte, ok bool) {
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEOL:
+			return nil, false
+		case tcpOptNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return nil, false
+		}
+		n := int(opts[i+1])
+		if n < 2 || i+n > len(opts) {
+			return nil, false
+		}
+		if opts[i] == kind {
+			return opts[i+2 : i+n], true
+		}
+		i += n
+	}
+	return nil, false
+}
+
+// TCPTimestamps returns the TSval and TSecr fields of q's TCP
+// timestamp option (RFC 7323). ok is false if q is not TCP or carries
+// no well-formed timestamp option.
+func (q *Parsed) TCPTimestamps() (tsval, tsecr uint32, ok bool) {
+	data, ok := findTCPOption(q.tcpOptions(), tcpOptTimestamp)
+	if !ok || len(data) != 8 {
+		return 0, 0, false
+	}
+	return get32(data[0:4]), get32(data[4:8]), true
+}
+
+// TCPMSS returns the maximum segment size advertised by q's TCP MSS
+// option (RFC 793), which is normally only present on SYN segments.
+// ok is false if q is not TCP or carries no well-formed MSS option.
+func (q *Parsed) TCPMSS() (mss uint16, ok bool) {
+	data, ok := findTCPOption(q.tcpOptions(), tcpOptMSS)
+	if !ok || len(data) != 2 {
+		return 0, false
+	}
+	return get16(data), true
+}
+
+// PathMTUHint returns the MTU implied by q's advertised MSS: the MSS
+// plus the fixed IP and TCP header lengths, which RFC 6691 says the
+// MSS excludes. It is the largest packet the sender expects to receive
+// without fragmentation, so a value below the link MTU points at a
+// tunnel or clamping middlebox on the path. PathMTUHint returns 0 if q
+// carries no MSS option.
+func (q *Parsed) PathMTUHint() int {
+	mss, ok := q.TCPMSS()
+	if !ok {
+		return 0
+	}
+	ipLen := ipHeaderLength
+	if q.IPVersion == 6 {
+		ipLen = ip6HeaderLength
+	}
+	return int(mss) + ipLen + tcpHeaderLength
+}
+
+// tcpMaxWindowScale is the largest window scale shift count allowed
+// by RFC 7323 section 2.3.
+const tcpMaxWindowScale = 14
+
+// TCPWindowScale returns the shift count of q's TCP window scale
+// option (RFC 7323). The option is only meaningful in SYN segments, so
+// ok is false for any other segment, as well as when the option is
+// absent or malformed. Shift counts above 14 are reported as 14, as
+// RFC 7323 requires receivers to treat them.
+func (q *Parsed) TCPWindowScale() (shift uint8, ok bool) {
+	if q.TCPFlags&TCPSyn == 0 {
+		return 0, false
+	}
+	data, ok := findTCPOption(q.tcpOptions(), tcpOptWindowScale)
+	if !ok || len(data) != 1 {
+		return 0, false
+	}
+	if data[0] > tcpMaxWindowScale {
+		return tcpMaxWindowScale, true
+	}
+	return data[0], true
+}
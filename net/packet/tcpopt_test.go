@@ -0,0 +1,203 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+// withTCPOptions returns a copy of the IPv4 TCP packet pkt with opts
+// inserted after its 20-byte TCP header. len(opts) must be a multiple
+// of 4. Checksums are not updated.
+func withTCPOptions(pkt, opts []byte) []byte {
+	hlen := int(pkt[0]&0x0F) << 2
+	thlen := hlen + tcpHeaderLength
+	out := make([]byte, 0, len(pkt)+len(opts))
+	out = append(out, pkt[:thlen]...)
+	out = append(out, opts...)
+	out = append(out, pkt[thlen:]...)
+	put16(out[2:4], uint16(len(out)))
+	out[hlen+12] = byte((tcpHeaderLength+len(opts))>>2) << 4
+	return out
+}
+
+func TestTCPTimestamps(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []byte
+		tsval, tsecr uint32
+		ok           bool
+	}{
+		{
+			// A typical Linux SYN: MSS, SACK permitted, timestamp,
+			// NOP, window scale.
+			name: "syn",
+			opts: []byte{
+				0x02, 0x04, 0x05, 0xb4,
+				0x04, 0x02,
+				0x08, 0x0a, 0x00, 0x01, 0xe2, 0x40, 0x00, 0x00, 0x00, 0x00,
+				0x01,
+				0x03, 0x03, 0x07,
+			},
+			tsval: 123456, tsecr: 0, ok: true,
+		},
+		{
+			// A typical established segment: NOP, NOP, timestamp.
+			name:  "nop_padded",
+			opts:  []byte{0x01, 0x01, 0x08, 0x0a, 0xde, 0xad, 0xbe, 0xef, 0x01, 0x02, 0x03, 0x04},
+			tsval: 0xdeadbeef, tsecr: 0x01020304, ok: true,
+		},
+		{
+			name: "absent",
+			opts: []byte{0x02, 0x04, 0x05, 0xb4},
+		},
+		{
+			name: "after_eol",
+			opts: []byte{0x00, 0x00, 0x08, 0x0a, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 0},
+		},
+		{
+			name: "bad_length",
+			opts: []byte{0x08, 0x08, 0, 0, 0, 1, 0, 0},
+		},
+		{
+			name: "truncated",
+			opts: []byte{0x01, 0x01, 0x01, 0x08, 0x0a, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Parsed
+			q.Decode(withTCPOptions(tcpPacketBuffer, tt.opts))
+			tsval, tsecr, ok := q.TCPTimestamps()
+			if tsval != tt.tsval || tsecr != tt.tsecr || ok != tt.ok {
+				t.Errorf("got (%d, %d, %v); want (%d, %d, %v)", tsval, tsecr, ok, tt.tsval, tt.tsecr, tt.ok)
+			}
+		})
+	}
+
+	var q Parsed
+	q.Decode(tcpPacketBuffer)
+	if _, _, ok := q.TCPTimestamps(); ok {
+		t.Errorf("found timestamps in packet without options")
+	}
+	q.Decode(udpRequestBuffer)
+	if _, _, ok := q.TCPTimestamps(); ok {
+		t.Errorf("found timestamps in UDP packet")
+	}
+}
+
+func TestTCPPayloadLen(t *testing.T) {
+	const payloadLen = 15 // "request_payload" in tcpPacketBuffer
+	tsOpts := []byte{0x01, 0x01, 0x08, 0x0a, 0, 0, 0, 1, 0, 0, 0, 2}
+	ipOpts := []byte{0x01, 0x01, 0x01, 0x00}
+	bare := make([]byte, tcpTotalHeaderLength)
+	MakeTCP4(IP4Port{IP: 1, Port: 1}, IP4Port{IP: 2, Port: 2}, 1, 2, TCPAck, 100, nil, bare)
+	badOffset := append([]byte(nil), tcpPacketBuffer...)
+	badOffset[32] = 0x40 // 16-byte TCP header
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		want int
+	}{
+		{"plain", tcpPacketBuffer, payloadLen},
+		{"tcp_options", withTCPOptions(tcpPacketBuffer, tsOpts), payloadLen},
+		{"ip_options", withIP4Options(tcpPacketBuffer, ipOpts), payloadLen},
+		{"both_options", withIP4Options(withTCPOptions(tcpPacketBuffer, tsOpts), ipOpts), payloadLen},
+		{"pure_ack", bare, 0},
+		{"pure_ack_options", withIP4Options(withTCPOptions(bare, tsOpts), ipOpts), 0},
+		{"bad_data_offset", badOffset, 0},
+		{"udp", udpRequestBuffer, 0},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if got := q.TCPPayloadLen(); got != tt.want {
+			t.Errorf("%s: TCPPayloadLen = %d; want %d", tt.name, got, tt.want)
+		}
+		if got := q.IsTCPData(); got != (tt.want > 0) {
+			t.Errorf("%s: IsTCPData = %v", tt.name, got)
+		}
+	}
+}
+
+func TestTCPMSS(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []byte
+		mss     uint16
+		ok      bool
+		mtuHint int
+	}{
+		{"ethernet", []byte{0x02, 0x04, 0x05, 0xb4}, 1460, true, 1500},
+		{"tailscale", []byte{0x01, 0x01, 0x01, 0x01, 0x02, 0x04, 0x04, 0xd8}, 1240, true, 1280},
+		{"no_mss", []byte{0x01, 0x01, 0x04, 0x02}, 0, false, 0},
+		{"bad_length", []byte{0x02, 0x03, 0x05, 0x00}, 0, false, 0},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(withTCPOptions(tcpPacketBuffer, tt.opts))
+		mss, ok := q.TCPMSS()
+		if mss != tt.mss || ok != tt.ok {
+			t.Errorf("%s: TCPMSS() = %d, %v; want %d, %v", tt.name, mss, ok, tt.mss, tt.ok)
+		}
+		if got := q.PathMTUHint(); got != tt.mtuHint {
+			t.Errorf("%s: PathMTUHint() = %d; want %d", tt.name, got, tt.mtuHint)
+		}
+	}
+}
+
+func TestTCPWindowScale(t *testing.T) {
+	build := func(flags uint8, hasWS bool, ws uint8) []byte {
+		h := TCP4Header{
+			IP4Header:      IP4Header{SrcIP: 1, DstIP: 2},
+			SrcPort:        1000,
+			DstPort:        80,
+			Flags:          flags,
+			Window:         65535,
+			HasWindowScale: hasWS,
+			WindowScale:    ws,
+		}
+		return Generate(&h, []byte("x"))
+	}
+	tests := []struct {
+		name  string
+		pkt   []byte
+		shift uint8
+		ok    bool
+	}{
+		{"syn", build(TCPSyn, true, 7), 7, true},
+		{"synack", build(TCPSynAck, true, 0), 0, true},
+		{"syn_without", build(TCPSyn, false, 7), 0, false},
+		// Not marshaled without SYN, and ignored in non-SYN segments.
+		{"ack", build(TCPAck, true, 7), 0, false},
+		{"ack_with_option", func() []byte {
+			b := build(TCPSyn, true, 7)
+			b[33] = TCPAck
+			return b
+		}(), 0, false},
+		{"clamped", build(TCPSyn, true, 20), 14, true},
+		{"bad_length", func() []byte {
+			b := build(TCPSyn, true, 7)
+			b[42] = 4
+			return b
+		}(), 0, false},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		shift, ok := q.TCPWindowScale()
+		if shift != tt.shift || ok != tt.ok {
+			t.Errorf("%s: TCPWindowScale() = %d, %v; want %d, %v", tt.name, shift, ok, tt.shift, tt.ok)
+		}
+		if q.TCPPayloadLen() != 1 {
+			t.Errorf("%s: payload length %d; want 1", tt.name, q.TCPPayloadLen())
+		}
+	}
+
+	// The option is covered by the checksum.
+	pkt := build(TCPSyn, true, 7)
+	if c := transportChecksum4(pkt); c != 0 {
+		t.Errorf("bad TCP checksum (residue %#04x)", c)
+	}
+}
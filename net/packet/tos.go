@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "fmt"
+
+// The second byte of the IPv4 header has two overlapping definitions.
+// RFC 2474 and RFC 3168 split it into a 6-bit DSCP and a 2-bit ECN
+// field; the older RFC 791 and RFC 1349 split it into a 3-bit
+// precedence and 4 type of service flags. Both views below read the
+// same byte, and which one applies depends on the equipment that set
+// it. Class selector DSCPs (RFC 2474 section 4.2.2) keep the
+// precedence bits compatible between the two.
+//
+// IPv6 has only the newer view: its traffic class byte is split into
+// DSCP and ECN exactly as the IPv4 byte is (RFC 8200 section 7), so
+// DSCP and ECN work for both versions.
+
+// Legacy type of service flags, from RFC 1349. They occupy the bits
+// that DSCP and ECN now use.
+const (
+	TOSLowDelay        = 0x10
+	TOSHighThroughput  = 0x08
+	TOSHighReliability = 0x04
+	TOSLowCost         = 0x02
+)
+
+// TOS returns the raw type of service byte of q's IPv4 header, or 0
+// if q is not IPv4.
+func (q *Parsed) TOS() uint8 {
+	if q.IPVersion != 4 {
+		return 0
+	}
+	return q.b[1]
+}
+
+// dsField returns q's differentiated services field: the IPv4 type of
+// service byte or the IPv6 traffic class.
+func (q *Parsed) dsField() uint8 {
+	if q.IPVersion == 6 {
+		return q.TrafficClass
+	}
+	return q.TOS()
+}
+
+// DSCPClass is a differentiated services code point (RFC 2474), the
+// 6-bit traffic class carried by both IPv4 and IPv6.
+type DSCPClass uint8
+
+// Commonly used DSCPs. Class selectors (CSn) and assured forwarding
+// classes (AFxy) are only named by String.
+const (
+	DSCPDefault        DSCPClass = 0  // default forwarding, best effort
+	DSCPLowEffort      DSCPClass = 1  // lower effort (RFC 8622)
+	DSCPEF             DSCPClass = 46 // expedited forwarding (RFC 3246)
+	DSCPNetworkControl DSCPClass = 48 // class selector 6 (RFC 4594)
+)
+
+func (c DSCPClass) String() string {
+	switch {
+	case c == DSCPDefault:
+		return "Default"
+	case c == DSCPEF:
+		return "EF"
+	case c == DSCPLowEffort:
+		return "LE"
+	case c&0x07 == 0 && c <= 56:
+		return fmt.Sprintf("CS%d", c>>3)
+	case c&0x01 == 0 && c>>3 >= 1 && c>>3 <= 4 && (c>>1)&0x03 != 0:
+		// Assured forwarding (RFC 2597): class in the top 3 bits,
+		// drop precedence in the next 2.
+		return fmt.Sprintf("AF%d%d", c>>3, (c>>1)&0x03)
+	default:
+		return fmt.Sprintf("DSCP(%d)", uint8(c))
+	}
+}
+
+// DSCP returns the differentiated services code point of q, the top 6
+// bits of the IPv4 type of service byte or IPv6 traffic class
+// (RFC 2474).
+func (q *Parsed) DSCP() DSCPClass {
+	return DSCPClass(q.dsField() >> 2)
+}
+
+// ECN returns the explicit congestion notification codepoint of q,
+// the bottom 2 bits of the IPv4 type of service byte or IPv6 traffic
+// class (RFC 3168).
+func (q *Parsed) ECN() uint8 {
+	return q.dsField() & 0x03
+}
+
+// Precedence returns the legacy precedence of q, the top 3 bits of
+// the type of service byte (RFC 791), from 0 (routine) to 7 (network
+// control).
+func (q *Parsed) Precedence() uint8 {
+	return q.TOS() >> 5
+}
+
+// LegacyTOSFlags returns the legacy type of service flags of q
+// (TOSLowDelay, etc), as RFC 1349 defines them.
+func (q *Parsed) LegacyTOSFlags() uint8 {
+	return q.TOS() & (TOSLowDelay | TOSHighThroughput | TOSHighReliability | TOSLowCost)
+}
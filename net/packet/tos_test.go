@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestTOS(t *testing.T) {
+	tests := []struct {
+		name       string
+		tos        uint8
+		dscp       DSCPClass
+		ecn        uint8
+		precedence uint8
+		flags      uint8
+	}{
+		{"zero", 0x00, 0, 0, 0, 0},
+		{"ef_ect1", 0xb9, 46, 1, 5, TOSLowDelay | TOSHighThroughput},
+		{"cs6", 0xc0, 48, 0, 6, 0},
+		{"legacy_low_delay", 0x10, 4, 0, 0, TOSLowDelay},
+		{"legacy_all", 0xfe, 63, 2, 7, TOSLowDelay | TOSHighThroughput | TOSHighReliability | TOSLowCost},
+	}
+	for _, tt := range tests {
+		pkt := append([]byte(nil), tcpPacketBuffer...)
+		pkt[1] = tt.tos
+		var q Parsed
+		q.Decode(pkt)
+		if got := q.TOS(); got != tt.tos {
+			t.Errorf("%s: TOS() = %#02x; want %#02x", tt.name, got, tt.tos)
+		}
+		if got := q.DSCP(); got != tt.dscp {
+			t.Errorf("%s: DSCP() = %d; want %d", tt.name, got, tt.dscp)
+		}
+		if got := q.ECN(); got != tt.ecn {
+			t.Errorf("%s: ECN() = %d; want %d", tt.name, got, tt.ecn)
+		}
+		if got := q.Precedence(); got != tt.precedence {
+			t.Errorf("%s: Precedence() = %d; want %d", tt.name, got, tt.precedence)
+		}
+		if got := q.LegacyTOSFlags(); got != tt.flags {
+			t.Errorf("%s: LegacyTOSFlags() = %#02x; want %#02x", tt.name, got, tt.flags)
+		}
+	}
+
+	var q Parsed
+	q.Decode(makeUDP6(8))
+	if got := q.TOS(); got != 0 {
+		t.Errorf("IPv6: TOS() = %#02x; want 0", got)
+	}
+}
+
+func TestTrafficClass6(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   uint8
+		dscp DSCPClass
+		ecn  uint8
+	}{
+		{"zero", 0x00, DSCPDefault, 0},
+		{"ef_ect1", 0xb9, DSCPEF, 1},
+		{"af41_ce", 0x8b, 34, 3},
+		{"all", 0xff, 63, 3},
+	}
+	for _, tt := range tests {
+		h := IP6Header{IPProto: UDP, TrafficClass: tt.tc, FlowLabel: 0xfffff, SrcIP: testIP6Src, DstIP: testIP6Dst}
+		buf := make([]byte, 48)
+		if err := h.Marshal(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := get32(buf[0:4]), 6<<28|uint32(tt.tc)<<20|0xfffff; got != want {
+			t.Errorf("%s: first word %#08x; want %#08x", tt.name, got, want)
+		}
+
+		var q Parsed
+		q.Decode(buf)
+		if q.TrafficClass != tt.tc || q.FlowLabel != 0xfffff {
+			t.Errorf("%s: decoded traffic class %#02x, flow label %#x; want %#02x, 0xfffff", tt.name, q.TrafficClass, q.FlowLabel, tt.tc)
+		}
+		if got := q.DSCP(); got != tt.dscp {
+			t.Errorf("%s: DSCP() = %v; want %v", tt.name, got, tt.dscp)
+		}
+		if got := q.ECN(); got != tt.ecn {
+			t.Errorf("%s: ECN() = %d; want %d", tt.name, got, tt.ecn)
+		}
+		if got := q.Precedence(); got != 0 {
+			t.Errorf("%s: Precedence() = %d for IPv6; want 0", tt.name, got)
+		}
+
+		// Re-marshaling the decoded values preserves them.
+		h2 := IP6Header{IPProto: q.IPProto, TrafficClass: q.TrafficClass, FlowLabel: q.FlowLabel, SrcIP: testIP6Src, DstIP: testIP6Dst}
+		buf2 := make([]byte, 48)
+		if err := h2.Marshal(buf2); err != nil {
+			t.Fatal(err)
+		}
+		if get32(buf2[0:4]) != get32(buf[0:4]) {
+			t.Errorf("%s: re-marshaled first word %#08x; want %#08x", tt.name, get32(buf2[0:4]), get32(buf[0:4]))
+		}
+	}
+
+	var q Parsed
+	q.Decode(tcpPacketBuffer)
+	if q.TrafficClass != 0 {
+		t.Errorf("IPv4: TrafficClass = %#02x; want 0", q.TrafficClass)
+	}
+}
+
+func TestDSCPClassString(t *testing.T) {
+	tests := []struct {
+		c    DSCPClass
+		want string
+	}{
+		{DSCPDefault, "Default"},
+		{DSCPLowEffort, "LE"},
+		{DSCPEF, "EF"},
+		{DSCPNetworkControl, "CS6"},
+		{8, "CS1"},
+		{10, "AF11"},
+		{34, "AF41"},
+		{38, "AF43"},
+		{44, "DSCP(44)"},
+		{42, "DSCP(42)"},
+		{63, "DSCP(63)"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.want {
+			t.Errorf("DSCPClass(%d).String() = %q; want %q", uint8(tt.c), got, tt.want)
+		}
+	}
+}
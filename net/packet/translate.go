@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "errors"
+
+var errNotTranslatable = errors.New("packet can't be translated")
+
+// Translate6to4 writes to buf the IPv4 translation of the IPv6 packet
+// pkt, following the stateless IP/ICMP translation algorithm of
+// RFC 6145 (now RFC 7915), and returns its length. The IPv4 addresses
+// src and dst replace pkt's: address mapping is up to the caller.
+//
+// The hop limit is copied to the TTL unchanged; a translator acting as
+// a router must decrement one of them. The traffic class is copied to
+// the type of service, and extension headers are dropped. TCP and UDP
+// checksums are adjusted for the new pseudo-header.
+//
+// Only TCP, UDP and ICMPv6 echo messages are translated; other
+// payloads, and fragments, are rejected. buf must not overlap pkt.
+func Translate6to4(pkt []byte, src, dst IP4, buf []byte) (int, error) {
+	length, err := checkIP6(pkt)
+	if err != nil {
+		return 0, err
+	}
+	pkt = pkt[:length]
+	if _, _, _, ok := ip6FragmentHeader(pkt); ok {
+		return 0, errNotTranslatable
+	}
+	proto, off := ip6UpperProto(pkt)
+	seg := pkt[off:]
+	n := ipHeaderLength + len(seg)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+	out := buf[ipHeaderLength:]
+	copy(out, seg)
+
+	switch proto {
+	case TCP, UDP:
+		oldPseudo := pseudoSum6(ip6FromBytes(pkt[8:24]), ip6FromBytes(pkt[24:40]), proto, uint32(len(seg)))
+		if err := adjustTransportChecksum(proto, out, oldPseudo, pseudoSum4(src, dst, proto, len(seg))); err != nil {
+			return 0, err
+		}
+	case ICMPv6:
+		if len(out) < icmp4EchoHeaderLength-ipHeaderLength {
+			return 0, errNotTranslatable
+		}
+		switch ICMP6Type(out[0]) {
+		case ICMP6EchoRequest:
+			out[0] = uint8(ICMP4EchoRequest)
+		case ICMP6EchoReply:
+			out[0] = uint8(ICMP4EchoReply)
+		default:
+			return 0, errNotTranslatable
+		}
+		// ICMPv4 has no pseudo-header, so recompute the checksum.
+		put16(out[2:4], 0)
+		put16(out[2:4], ipChecksum(out))
+		proto = ICMP
+	default:
+		return 0, errNotTranslatable
+	}
+
+	buf[0] = 0x40 | (ipHeaderLength >> 2)
+	buf[1] = uint8(get16(pkt[0:2]) >> 4) // traffic class
+	put16(buf[2:4], uint16(n))
+	// Without a Fragment header there is nothing to identify, and
+	// RFC 6145 section 5.1 sets DF so that path MTU discovery keeps
+	// working end to end.
+	put16(buf[4:6], 0)
+	put16(buf[6:8], ip4FlagDF)
+	buf[8] = pkt[7] // hop limit
+	buf[9] = uint8(proto)
+	put16(buf[10:12], 0)
+	put32(buf[12:16], uint32(src))
+	put32(buf[16:20], uint32(dst))
+	put16(buf[10:12], ipChecksum(buf[:ipHeaderLength]))
+	return n, nil
+}
+
+// Translate4to6 writes to buf the IPv6 translation of the IPv4 packet
+// pkt, as Translate6to4 does in the other direction, and returns its
+// length. The IPv6 addresses src and dst replace pkt's.
+//
+// The TTL is copied to the hop limit, the type of service to the
+// traffic class, and IPv4 options are dropped; packets carrying a
+// source route are rejected. UDP packets without a checksum, which
+// IPv6 doesn't allow, get one computed. ICMP echo requests and replies
+// become ICMPv6 ones, with a checksum that now covers the IPv6
+// pseudo-header.
+func Translate4to6(pkt []byte, src, dst IP6, buf []byte) (int, error) {
+	hlen, length, err := checkIP4(pkt)
+	if err != nil {
+		return 0, err
+	}
+	if get16(pkt[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+		return 0, errNotTranslatable
+	}
+	// A source route can't be honored once the options are gone, so
+	// RFC 7915 section 4.1 has such packets dropped.
+	if hasSourceRoute(pkt[ipHeaderLength:hlen]) {
+		return 0, errNotTranslatable
+	}
+	proto := IP4Proto(pkt[9])
+	seg := pkt[hlen:length]
+	n := ip6HeaderLength + len(seg)
+	if len(seg) > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+	out := buf[ip6HeaderLength:]
+	copy(out, seg)
+
+	switch proto {
+	case TCP, UDP:
+		newPseudo := pseudoSum6(src, dst, proto, uint32(len(seg)))
+		if proto == UDP && len(out) >= udpHeaderLength && get16(out[6:8]) == 0 {
+			put16(out[6:8], udpChecksum(^foldChecksum(checksumSum(out)+newPseudo)))
+			break
+		}
+		oldPseudo := pseudoSum4(IP4(get32(pkt[12:16])), IP4(get32(pkt[16:20])), proto, len(seg))
+		if err := adjustTransportChecksum(proto, out, oldPseudo, newPseudo); err != nil {
+			return 0, err
+		}
+	case ICMP:
+		if len(out) < icmp4EchoHeaderLength-ipHeaderLength {
+			return 0, errNotTranslatable
+		}
+		switch ICMP4Type(out[0]) {
+		case ICMP4EchoRequest:
+			out[0] = uint8(ICMP6EchoRequest)
+		case ICMP4EchoReply:
+			out[0] = uint8(ICMP6EchoReply)
+		default:
+			return 0, errNotTranslatable
+		}
+		// ICMPv6 covers a pseudo-header, so recompute the checksum.
+		put16(out[2:4], 0)
+		put16(out[2:4], ^foldChecksum(checksumSum(out)+pseudoSum6(src, dst, ICMPv6, uint32(len(out)))))
+		proto = ICMPv6
+	default:
+		return 0, errNotTranslatable
+	}
+
+	put32(buf[0:4], 6<<28|uint32(pkt[1])<<20) // version, traffic class, flow label
+	put16(buf[4:6], uint16(len(seg)))
+	buf[6] = uint8(proto)
+	buf[7] = pkt[8] // TTL
+	putIP6(buf[8:24], src)
+	putIP6(buf[24:40], dst)
+	return n, nil
+}
+
+// adjustTransportChecksum updates the TCP or UDP checksum of seg for
+// its pseudo-header changing from one summing to oldPseudo to one
+// summing to newPseudo, per RFC 1624.
+func adjustTransportChecksum(proto IP4Proto, seg []byte, oldPseudo, newPseudo uint64) error {
+	ofs, _ := transportChecksumOffset(proto)
+	minLen := udpHeaderLength
+	if proto == TCP {
+		minLen = tcpHeaderLength
+	}
+	if len(seg) < minLen {
+		return errNotTranslatable
+	}
+	old := get16(seg[ofs : ofs+2])
+	ac := uint64(^old) + uint64(^foldChecksum(oldPseudo)) + newPseudo
+	csum := ^foldChecksum(ac)
+	if proto == UDP {
+		csum = udpChecksum(csum)
+	}
+	put16(seg[ofs:ofs+2], csum)
+	return nil
+}
+
+// udpChecksum returns csum as sent in a UDP header, where zero means
+// "no checksum" and a computed zero is sent as 0xffff (RFC 768).
+func udpChecksum(csum uint16) uint16 {
+	if csum == 0 {
+		return 0xffff
+	}
+	return csum
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "testing"
+
+func TestTranslate(t *testing.T) {
+	src4 := IP4Port{IP: 0x01020304, Port: 123}
+	dst4 := IP4Port{IP: 0x05060708, Port: 567}
+	payload := []byte("request_payload")
+	build := func(f func(buf []byte) (int, error)) []byte {
+		buf := make([]byte, 128)
+		n, err := f(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	udp := build(func(buf []byte) (int, error) { return MakeUDP4(src4, dst4, payload, buf) })
+	tcp := build(func(buf []byte) (int, error) {
+		return MakeTCP4(src4, dst4, 100, 200, TCPAck|TCPPsh, 1000, payload, buf)
+	})
+	echo := build(func(buf []byte) (int, error) {
+		return MakeICMP4EchoRequest(src4.IP, dst4.IP, 7, 1, payload, buf)
+	})
+	echo[1] = 0xb8 // DSCP EF
+	echo[8] = 33   // TTL
+	put16(echo[10:12], ChecksumExcluding(echo[:ipHeaderLength], 10))
+
+	for _, tt := range []struct {
+		name    string
+		pkt     []byte
+		proto6  IP4Proto
+		proto4  IP4Proto
+		segType uint8 // first byte of the ICMP translation, if ICMP
+	}{
+		{"udp", udp, UDP, UDP, 0},
+		{"tcp", tcp, TCP, TCP, 0},
+		{"icmp_echo", echo, ICMPv6, ICMP, uint8(ICMP6EchoRequest)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			buf6 := make([]byte, 128)
+			n, err := Translate4to6(tt.pkt, testIP6Src, testIP6Dst, buf6)
+			if err != nil {
+				t.Fatalf("Translate4to6: %v", err)
+			}
+			pkt6 := buf6[:n]
+			if n != len(tt.pkt)-ipHeaderLength+ip6HeaderLength {
+				t.Errorf("IPv6 length %d; want %d", n, len(tt.pkt)-ipHeaderLength+ip6HeaderLength)
+			}
+			if c := transportChecksum6(pkt6); c != 0 {
+				t.Errorf("bad IPv6 transport checksum (residue %#04x)", c)
+			}
+			var q Parsed
+			q.Decode(pkt6)
+			if q.IPVersion != 6 || q.IPProto != tt.proto6 || q.HopLimit != tt.pkt[8] {
+				t.Errorf("decoded %v, hop limit %d", &q, q.HopLimit)
+			}
+			if tc := uint8(get16(pkt6[0:2]) >> 4); tc != tt.pkt[1] {
+				t.Errorf("traffic class %#02x; want %#02x", tc, tt.pkt[1])
+			}
+			if tt.segType != 0 && pkt6[ip6HeaderLength] != tt.segType {
+				t.Errorf("ICMPv6 type %d; want %d", pkt6[ip6HeaderLength], tt.segType)
+			}
+
+			buf4 := make([]byte, 128)
+			n, err = Translate6to4(pkt6, src4.IP, dst4.IP, buf4)
+			if err != nil {
+				t.Fatalf("Translate6to4: %v", err)
+			}
+			pkt4 := buf4[:n]
+			if ipChecksum(pkt4[:ipHeaderLength]) != 0 {
+				t.Errorf("bad IPv4 header checksum")
+			}
+			if tt.proto4 == ICMP {
+				if ipChecksum(pkt4[ipHeaderLength:]) != 0 {
+					t.Errorf("bad ICMP checksum")
+				}
+			} else if c := transportChecksum4(pkt4); c != 0 {
+				t.Errorf("bad IPv4 transport checksum (residue %#04x)", c)
+			}
+			if get16(pkt4[6:8]) != ip4FlagDF {
+				t.Errorf("flags %#04x; want DF", get16(pkt4[6:8]))
+			}
+			// Round trip: only the IPID and DF flag differ.
+			orig := append([]byte(nil), tt.pkt...)
+			put16(orig[6:8], ip4FlagDF)
+			if d := DiffIgnoring(pkt4, orig, IgnoreIPID|IgnoreChecksums); d != "" {
+				t.Errorf("round trip changed the packet: %s", d)
+			}
+		})
+	}
+}
+
+func TestTranslateUDPZeroChecksum(t *testing.T) {
+	pkt := append([]byte(nil), udpRequestBuffer...)
+	put16(pkt[26:28], 0)
+	buf := make([]byte, 128)
+	n, err := Translate4to6(pkt, testIP6Src, testIP6Dst, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get16(buf[46:48]) == 0 {
+		t.Errorf("UDP checksum still zero")
+	}
+	if c := transportChecksum6(buf[:n]); c != 0 {
+		t.Errorf("bad UDP checksum (residue %#04x)", c)
+	}
+}
+
+func TestTranslateExtensionHeaders(t *testing.T) {
+	pkt6 := makeUDP6(10)
+	put16(pkt6[46:48], 0)
+	put16(pkt6[46:48], transportChecksum6(pkt6))
+	hbh := []byte{0, 0, 1, 4, 0, 0, 0, 0}
+	buf := make([]byte, 128)
+	n, err := Translate6to4(withIP6ExtHeader(pkt6, ip6HopByHop, hbh), 1, 2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != ipHeaderLength+udpHeaderLength+10 || IP4Proto(buf[9]) != UDP {
+		t.Errorf("hop-by-hop header not dropped: %x", buf[:n])
+	}
+	if c := transportChecksum4(buf[:n]); c != 0 {
+		t.Errorf("bad UDP checksum (residue %#04x)", c)
+	}
+}
+
+func TestTranslateRejects(t *testing.T) {
+	buf := make([]byte, 128)
+	frag4 := makeFragment(1, 0, true, testPayload(16))
+	igmp := append([]byte(nil), udpRequestBuffer...)
+	igmp[9] = uint8(IGMP)
+	unreach := make([]byte, 128)
+	n, _ := MakeICMP4FragNeeded(udpRequestBuffer, 1280, unreach)
+	unreach = unreach[:n]
+	for name, pkt := range map[string][]byte{
+		"fragment":    frag4,
+		"igmp":        igmp,
+		"unreachable": unreach,
+	} {
+		if _, err := Translate4to6(pkt, testIP6Src, testIP6Dst, buf); err == nil {
+			t.Errorf("Translate4to6(%s) succeeded", name)
+		}
+	}
+
+	part := makeUDP6(8)[ip6HeaderLength:]
+	noNext := withIP6ExtHeader(makeUDP6(0)[:ip6HeaderLength], ip6DestOpts, make([]byte, 8))
+	noNext[ip6HeaderLength] = ip6NoNext
+	for name, pkt := range map[string][]byte{
+		"fragment":        fragment6(1, 0, true, part),
+		"atomic_fragment": fragment6(1, 0, false, part),
+		"no_next_header":  noNext,
+	} {
+		if _, err := Translate6to4(pkt, 1, 2, buf); err == nil {
+			t.Errorf("Translate6to4(%s) succeeded", name)
+		}
+	}
+
+	if _, err := Translate4to6(udpRequestBuffer, testIP6Src, testIP6Dst, buf[:50]); err != ErrSmallBuffer {
+		t.Errorf("small buffer: got %v; want %v", err, ErrSmallBuffer)
+	}
+}
+
+func TestTranslate4to6Options(t *testing.T) {
+	reply := make([]byte, 64)
+	n, err := MakeICMP4EchoRequest(0x01020304, 0x05060708, 9, 3, []byte("pong"), reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply = reply[:n]
+	reply[ipHeaderLength] = uint8(ICMP4EchoReply)
+	put16(reply[ipHeaderLength+2:], ChecksumExcluding(reply[ipHeaderLength:], 2))
+
+	// Options are dropped, and the echo reply becomes an ICMPv6 one.
+	pkt := withIP4Options(reply, []byte{0x94, 0x04, 0x00, 0x00})
+	buf := make([]byte, 128)
+	n, err = Translate4to6(pkt, testIP6Src, testIP6Dst, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != ip6HeaderLength+len(reply)-ipHeaderLength {
+		t.Errorf("length %d; options not dropped", n)
+	}
+	if ICMP6Type(buf[ip6HeaderLength]) != ICMP6EchoReply {
+		t.Errorf("ICMPv6 type %d; want %d", buf[ip6HeaderLength], ICMP6EchoReply)
+	}
+	if c := transportChecksum6(buf[:n]); c != 0 {
+		t.Errorf("bad ICMPv6 checksum (residue %#04x)", c)
+	}
+
+	// Source routed packets are dropped.
+	lsrr := withIP4Options(reply, []byte{ip4OptNOP, ip4OptLSRR, 7, 4, 10, 0, 0, 1})
+	if _, err := Translate4to6(lsrr, testIP6Src, testIP6Dst, buf); err == nil {
+		t.Errorf("source routed packet translated")
+	}
+}
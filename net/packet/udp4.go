@@ -23,10 +23,10 @@ func (UDP4Header) Len() int {
 
 func (h UDP4Header) Marshal(buf []byte) error {
 	if len(buf) < udpTotalHeaderLength {
-		return errSmallBuffer
+		return ErrSmallBuffer
 	}
 	if len(buf) > maxPacketLength {
-		return errLargePacket
+		return ErrLargePacket
 	}
 	// The caller does not need to set this.
 	h.IPProto = UDP
@@ -40,7 +40,13 @@ func (h UDP4Header) Marshal(buf []byte) error {
 	h.IP4Header.MarshalPseudo(buf)
 
 	// UDP checksum with IP pseudo header.
-	put16(buf[26:28], ipChecksum(buf[8:]))
+	// A computed checksum of zero is sent as all ones, because zero
+	// means the sender didn't compute one (RFC 768).
+	csum := ipChecksum(buf[8:])
+	if csum == 0 {
+		csum = 0xffff
+	}
+	put16(buf[26:28], csum)
 
 	h.IP4Header.Marshal(buf)
 
@@ -51,3 +57,64 @@ func (h *UDP4Header) ToResponse() {
 	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
 	h.IP4Header.ToResponse()
 }
+
+// VerifyUDP4Checksum reports whether buf holds an IPv4 UDP datagram
+// whose checksum is correct, over the IPv4 pseudo-header, UDP header
+// and payload. A zero checksum means the sender didn't compute one,
+// which IPv4 allows (RFC 768), so such datagrams are reported as
+// valid.
+//
+// The UDP length field must fit within the IPv4 payload; bytes after
+// it are ignored. Fragments are reported as invalid, since their
+// checksum can only be verified after reassembly.
+func VerifyUDP4Checksum(buf []byte) bool {
+	hlen, length, err := checkIP4(buf)
+	if err != nil || IP4Proto(buf[9]) != UDP {
+		return false
+	}
+	if get16(buf[6:8])&(ip4FlagMF|ip4FragOffsetMask) != 0 {
+		return false
+	}
+	seg := buf[hlen:length]
+	if len(seg) < udpHeaderLength {
+		return false
+	}
+	udpLen := int(get16(seg[4:6]))
+	if udpLen < udpHeaderLength || udpLen > len(seg) {
+		return false
+	}
+	if get16(seg[6:8]) == 0 {
+		return true
+	}
+	seg = seg[:udpLen]
+	ac := checksumSum(seg) + pseudoSum4(IP4(get32(buf[12:16])), IP4(get32(buf[16:20])), UDP, udpLen)
+	return foldChecksum(ac) == 0xffff
+}
+
+// MakeUDP4 writes to buf a complete IPv4 UDP datagram from src to dst
+// carrying payload, with lengths and checksums filled in.
+// It returns the number of bytes written.
+func MakeUDP4(src, dst IP4Port, payload []byte, buf []byte) (int, error) {
+	n := udpTotalHeaderLength + len(payload)
+	if n > maxPacketLength {
+		return 0, ErrLargePacket
+	}
+	if len(buf) < n {
+		return 0, ErrSmallBuffer
+	}
+	buf = buf[:n]
+
+	h := UDP4Header{
+		IP4Header: IP4Header{
+			SrcIP: src.IP,
+			DstIP: dst.IP,
+		},
+		SrcPort: src.Port,
+		DstPort: dst.Port,
+	}
+	copy(buf[udpTotalHeaderLength:], payload)
+	if err := h.Marshal(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
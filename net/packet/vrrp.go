@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// vrrpHeaderLength is the length of the fixed part of a VRRP
+// advertisement, up to and including the checksum.
+const vrrpHeaderLength = 8
+
+// VRRPHeader is the fixed part of a VRRP advertisement, as defined
+// by RFC 3768 (version 2) and RFC 5798 (version 3).
+//
+// CARP uses VRRP's protocol number and a version 2 layout, so CARP
+// advertisements decode with their virtual host ID as VRID; their
+// Priority holds the CARP advskew instead.
+type VRRPHeader struct {
+	Version   uint8
+	Type      uint8 // 1 is an advertisement
+	VRID      uint8 // virtual router ID
+	Priority  uint8 // 255 for the address owner, 0 when resigning
+	AddrCount uint8 // number of addresses that follow the header
+	// AdvertInterval is the advertisement interval, in seconds for
+	// version 2 and in centiseconds for version 3.
+	AdvertInterval uint16
+	Checksum       uint16
+}
+
+// VRRPHeader returns the VRRP header of q. ok is false if q is not an
+// IPv4 VRRP packet.
+func (q *Parsed) VRRPHeader() (h VRRPHeader, ok bool) {
+	if q.IPVersion != 4 || q.IPProto != VRRP || q.TransportSkipped || q.length < q.subofs+vrrpHeaderLength {
+		return VRRPHeader{}, false
+	}
+	b := q.b[q.subofs:q.length]
+	h = VRRPHeader{
+		Version:   b[0] >> 4,
+		Type:      b[0] & 0x0f,
+		VRID:      b[1],
+		Priority:  b[2],
+		AddrCount: b[3],
+		Checksum:  get16(b[6:8]),
+	}
+	if h.Version == 2 {
+		h.AdvertInterval = uint16(b[5]) // byte 4 is the auth type
+	} else {
+		h.AdvertInterval = get16(b[4:6]) & 0x0fff
+	}
+	return h, true
+}
+
+// VRRPChecksumValid reports whether q is an IPv4 VRRP packet with a
+// valid checksum. Version 2 checksums cover only the VRRP message;
+// version 3 checksums also cover the IPv4 pseudo-header.
+func (q *Parsed) VRRPChecksumValid() bool {
+	if q.IPVersion != 4 || q.IPProto != VRRP || q.TransportSkipped || q.length < q.subofs+vrrpHeaderLength {
+		return false
+	}
+	msg := q.b[q.subofs:q.length]
+	ac := checksumSum(msg)
+	if msg[0]>>4 != 2 {
+		ac += pseudoSum4(q.SrcIP, q.DstIP, VRRP, len(msg))
+	}
+	return foldChecksum(ac) == 0xffff
+}
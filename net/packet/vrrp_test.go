@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"net"
+	"testing"
+)
+
+// makeVRRP returns an IPv4 packet from 192.168.1.2 to 224.0.0.18
+// holding the VRRP message msg, with its checksum filled in.
+func makeVRRP(msg []byte) []byte {
+	pkt := make([]byte, ipHeaderLength+len(msg))
+	h := IP4Header{
+		IPProto: VRRP,
+		SrcIP:   NewIP4(net.ParseIP("192.168.1.2")),
+		DstIP:   NewIP4(net.ParseIP("224.0.0.18")),
+	}
+	h.Marshal(pkt)
+	copy(pkt[ipHeaderLength:], msg)
+	if msg[0]>>4 == 2 {
+		put16(pkt[26:28], ChecksumExcluding(pkt[ipHeaderLength:], 6))
+	} else {
+		put16(pkt[26:28], transportChecksum4(pkt))
+	}
+	return pkt
+}
+
+func TestVRRP(t *testing.T) {
+	v2 := makeVRRP([]byte{
+		0x21, 51, 100, 1, // version 2 advertisement, VRID 51, priority 100, 1 address
+		0, 1, 0, 0, // no authentication, 1s interval, checksum
+		192, 168, 1, 1,
+		0, 0, 0, 0, 0, 0, 0, 0, // authentication data
+	})
+	v3 := makeVRRP([]byte{
+		0x31, 7, 255, 1, // version 3 advertisement, VRID 7, owner, 1 address
+		0x00, 0x64, 0, 0, // 100cs interval, checksum
+		192, 168, 1, 1,
+	})
+	tests := []struct {
+		name string
+		pkt  []byte
+		want VRRPHeader
+	}{
+		{"v2", v2, VRRPHeader{Version: 2, Type: 1, VRID: 51, Priority: 100, AddrCount: 1, AdvertInterval: 1, Checksum: get16(v2[26:28])}},
+		{"v3", v3, VRRPHeader{Version: 3, Type: 1, VRID: 7, Priority: 255, AddrCount: 1, AdvertInterval: 100, Checksum: get16(v3[26:28])}},
+	}
+	for _, tt := range tests {
+		var q Parsed
+		q.Decode(tt.pkt)
+		if q.IPProto != VRRP {
+			t.Fatalf("%s: decoded as %v", tt.name, q.IPProto)
+		}
+		got, ok := q.VRRPHeader()
+		if !ok || got != tt.want {
+			t.Errorf("%s: VRRPHeader = %+v, %v; want %+v", tt.name, got, ok, tt.want)
+		}
+		if !q.VRRPChecksumValid() {
+			t.Errorf("%s: checksum not valid", tt.name)
+		}
+		tt.pkt[len(tt.pkt)-1] ^= 1
+		q.Decode(tt.pkt)
+		if q.VRRPChecksumValid() {
+			t.Errorf("%s: corrupted checksum valid", tt.name)
+		}
+	}
+
+	var q Parsed
+	q.Decode(udpRequestBuffer)
+	if _, ok := q.VRRPHeader(); ok {
+		t.Errorf("VRRPHeader ok for UDP packet")
+	}
+	if q.VRRPChecksumValid() {
+		t.Errorf("VRRPChecksumValid true for UDP packet")
+	}
+	short := makeVRRP([]byte{0x21, 1, 100, 0, 0, 1, 0, 0})
+	put16(short[2:4], ipHeaderLength+4)
+	q.Decode(short[:ipHeaderLength+4])
+	if q.IPProto != Unknown {
+		t.Errorf("truncated VRRP decoded as %v; want Unknown", q.IPProto)
+	}
+	// DecodeIPOnly doesn't check the VRRP header, so the accessors must.
+	if err := DecodeIPOnly(short[:ipHeaderLength+4], &q); err != nil || q.IPProto != VRRP {
+		t.Fatalf("DecodeIPOnly: %v, proto %v", err, q.IPProto)
+	}
+	if _, ok := q.VRRPHeader(); ok {
+		t.Errorf("VRRPHeader ok for truncated VRRP")
+	}
+	if q.VRRPChecksumValid() {
+		t.Errorf("VRRPChecksumValid true for truncated VRRP")
+	}
+}
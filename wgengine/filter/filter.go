@@ -98,11 +98,8 @@ func NewAllowAllForTest(logf logger.Logf) *Filter {
 		Srcs: []netaddr.IPPrefix{any4},
 		Dsts: []NetPortRange{
 			{
-				Net: any4,
-				Ports: PortRange{
-					First: 0,
-					Last:  65535,
-				},
+				Net:   any4,
+				Ports: []PortRange{PortRangeAny},
 			},
 		},
 	}
@@ -348,6 +345,8 @@ func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
 	}
 
 	switch q.IPProto {
+	case packet.ICMP, packet.TCP, packet.UDP:
+		// Handled by runIn and runOut.
 	case packet.Unknown:
 		// Unknown packets are dangerous; always drop them.
 		f.logRateLimit(rf, q, dir, Drop, "unknown")
@@ -357,6 +356,12 @@ func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
 		// Very small fragments are considered Junk by Parsed.
 		f.logRateLimit(rf, q, dir, Accept, "fragment")
 		return Accept
+	default:
+		// Parsed recognizes more protocols than the filter has
+		// rules for, such as ESP and AH. Drop those too, in both
+		// directions, as if they were unknown.
+		f.logRateLimit(rf, q, dir, Drop, "unhandled proto")
+		return Drop
 	}
 
 	return noVerdict
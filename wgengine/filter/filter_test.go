@@ -10,7 +10,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
-	"strconv"
 	"strings"
 	"testing"
 
@@ -57,28 +56,11 @@ func nets(nets ...string) (ret []netaddr.IPPrefix) {
 }
 
 func ports(s string) PortRange {
-	if s == "*" {
-		return PortRange{First: 0, Last: 65535}
-	}
-
-	var fs, ls string
-	i := strings.IndexByte(s, '-')
-	if i == -1 {
-		fs = s
-		ls = fs
-	} else {
-		fs = s[:i]
-		ls = s[i+1:]
-	}
-	first, err := strconv.ParseInt(fs, 10, 16)
+	pr, err := ParsePortRange(s)
 	if err != nil {
-		panic(fmt.Sprintf("invalid NetPortRange %q", s))
+		panic(fmt.Sprintf("invalid NetPortRange %q: %v", s, err))
 	}
-	last, err := strconv.ParseInt(ls, 10, 16)
-	if err != nil {
-		panic(fmt.Sprintf("invalid NetPortRange %q", s))
-	}
-	return PortRange{uint16(first), uint16(last)}
+	return pr
 }
 
 func netports(netPorts ...string) (ret []NetPortRange) {
@@ -88,9 +70,9 @@ func netports(netPorts ...string) (ret []NetPortRange) {
 			panic(fmt.Sprintf("invalid NetPortRange %q", s))
 		}
 
-		npr := NetPortRange{
-			Net:   nets(s[:i])[0],
-			Ports: ports(s[i+1:]),
+		npr := NetPortRange{Net: nets(s[:i])[0]}
+		for _, pr := range strings.Split(s[i+1:], ",") {
+			npr.Ports = append(npr.Ports, ports(pr))
 		}
 		ret = append(ret, npr)
 	}
@@ -104,6 +86,7 @@ var matches = []Match{
 	{Srcs: nets("0.0.0.0/0"), Dsts: netports("100.122.98.50:*")},
 	{Srcs: nets("0.0.0.0/0"), Dsts: netports("0.0.0.0/0:443")},
 	{Srcs: nets("153.1.1.1", "153.1.1.2", "153.3.3.3"), Dsts: netports("1.2.3.4:999")},
+	{Srcs: nets("8.3.3.3"), Dsts: netports("1.2.3.4:80,8000-8010")},
 }
 
 func newFilter(logf logger.Logf) *Filter {
@@ -149,6 +132,12 @@ func TestFilter(t *testing.T) {
 		{Accept, parsed(TCP, 0x11223344, 0x647a6232, 0, 999)},
 		{Accept, parsed(TCP, 0x11223344, 0x647a6232, 0, 0)},
 
+		// A destination with several port ranges.
+		{Accept, parsed(TCP, 0x08030303, 0x01020304, 0, 80)},
+		{Accept, parsed(TCP, 0x08030303, 0x01020304, 0, 8005)},
+		{Drop, parsed(TCP, 0x08030303, 0x01020304, 0, 81)},
+		{Drop, parsed(TCP, 0x08030303, 0x01020304, 0, 8011)},
+
 		// localNets prefilter - accepted by policy filter, but
 		// unexpected dst IP.
 		{Drop, parsed(TCP, 0x08010101, 0x10203040, 0, 443)},
@@ -245,6 +234,99 @@ func TestParseIP(t *testing.T) {
 	}
 }
 
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortRange
+		wantErr string
+	}{
+		{"*", PortRangeAny, ""},
+		{"22", PortRange{22, 22}, ""},
+		{"80-443", PortRange{80, 443}, ""},
+		{"0-65535", PortRangeAny, ""},
+		{"65535", PortRange{65535, 65535}, ""},
+		{"", PortRange{}, `port range "": missing port number`},
+		{"80-", PortRange{}, `port range "80-": missing port number`},
+		{"443-80", PortRange{}, `port range "443-80": first port 443 is after last port 80`},
+		{"65536", PortRange{}, `port range "65536": port 65536 out of range (max 65535)`},
+		{"http", PortRange{}, `port range "http": invalid port "http"`},
+		{"-1", PortRange{}, `port range "-1": missing port number`},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortRange(tt.in)
+		if err != nil {
+			if err.Error() != tt.wantErr {
+				t.Errorf("ParsePortRange(%q) error: %v; want error %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if tt.wantErr != "" {
+			t.Errorf("ParsePortRange(%q) = %v; want error %q", tt.in, got, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePortRange(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPortRangeForEach(t *testing.T) {
+	collect := func(pr PortRange, limit int) (ret []uint16) {
+		pr.ForEach(func(port uint16) bool {
+			ret = append(ret, port)
+			return len(ret) < limit
+		})
+		return ret
+	}
+	tests := []struct {
+		pr    PortRange
+		limit int
+		want  []uint16
+	}{
+		{PortRange{80, 83}, 10, []uint16{80, 81, 82, 83}},
+		{PortRange{22, 22}, 10, []uint16{22}},
+		{PortRange{65533, 65535}, 10, []uint16{65533, 65534, 65535}},
+		{PortRange{443, 80}, 10, nil},
+		{PortRange{1000, 2000}, 2, []uint16{1000, 1001}},
+	}
+	for _, tt := range tests {
+		got := collect(tt.pr, tt.limit)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v.ForEach visited %v; want %v", tt.pr, got, tt.want)
+		}
+		for _, port := range got {
+			if !tt.pr.Contains(port) {
+				t.Errorf("%v.ForEach visited %d, which it doesn't contain", tt.pr, port)
+			}
+		}
+	}
+
+	n := 0
+	PortRangeAny.ForEach(func(uint16) bool {
+		n++
+		return true
+	})
+	if n != 65536 {
+		t.Errorf("PortRangeAny.ForEach visited %d ports; want 65536", n)
+	}
+}
+
+func TestNetPortRangeString(t *testing.T) {
+	tests := []struct {
+		npr  NetPortRange
+		want string
+	}{
+		{netports("1.2.3.4:22")[0], "1.2.3.4/32:22"},
+		{netports("100.64.0.0/10:22,80-443")[0], "100.64.0.0/10:[22,80-443]"},
+		{NetPortRange{Net: nets("1.2.3.4")[0]}, "1.2.3.4/32:[]"},
+	}
+	for _, tt := range tests {
+		if got := tt.npr.String(); got != tt.want {
+			t.Errorf("String() = %q; want %q", got, tt.want)
+		}
+	}
+}
+
 func BenchmarkFilter(b *testing.B) {
 	acl := newFilter(b.Logf)
 
@@ -300,6 +382,10 @@ func TestPreFilter(t *testing.T) {
 		{"tcp", noVerdict, rawdefault(TCP, 200)},
 		{"udp", noVerdict, rawdefault(UDP, 200)},
 		{"icmp", noVerdict, rawdefault(ICMP, 200)},
+		{"esp", Drop, rawdefault(packet.ESP, 200)},
+		{"ah", Drop, rawdefault(packet.AH, 200)},
+		{"vrrp", Drop, rawdefault(packet.VRRP, 200)},
+		{"pim", Drop, rawdefault(packet.PIM, 200)},
 	}
 	f := NewAllowNone(t.Logf)
 	for _, testPacket := range packets {
@@ -312,6 +398,26 @@ func TestPreFilter(t *testing.T) {
 	}
 }
 
+// TestUnhandledProtos checks that protocols Parsed recognizes but the
+// filter has no rules for are dropped in both directions.
+func TestUnhandledProtos(t *testing.T) {
+	acl := newFilter(t.Logf)
+	for _, proto := range []packet.IP4Proto{packet.VRRP, packet.ESP, packet.AH, packet.PIM} {
+		b := rawpacket(proto, 0x08010101, 0x01020304, 999, 22, 200)
+		q := &packet.Parsed{}
+		q.Decode(b)
+		if q.IPProto != proto {
+			t.Fatalf("%v: decoded as %v", proto, q.IPProto)
+		}
+		if got := acl.RunIn(q, 0); got != Drop {
+			t.Errorf("%v: RunIn = %v; want %v", proto, got, Drop)
+		}
+		if got := acl.RunOut(q, 0); got != Drop {
+			t.Errorf("%v: RunOut = %v; want %v", proto, got, Drop)
+		}
+	}
+}
+
 func parsed(proto packet.IP4Proto, src, dst packet.IP4, sport, dport uint16) packet.Parsed {
 	return packet.Parsed{
 		IPProto:  proto,
@@ -367,6 +473,19 @@ func rawpacket(proto packet.IP4Proto, src, dst packet.IP4, sport, dport uint16,
 		hdr[9] = 6
 		// flags + fragOff
 		bin.PutUint16(hdr[6:8], (1<<13)|1234)
+	case packet.VRRP:
+		hdr[9] = 112
+	case packet.ESP:
+		hdr[9] = 50
+	case packet.AH:
+		hdr[9] = 51
+		// AH payload length, in place of the source port's low
+		// byte: a 12-byte header with a 4-byte ICV.
+		hdr[21] = 1
+	case packet.PIM:
+		hdr[9] = 103
+		// PIM version 2 Register, in place of the source port.
+		hdr[20] = 0x21
 	case Unknown:
 	default:
 		panic("unknown protocol")
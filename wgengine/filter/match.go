@@ -5,7 +5,9 @@
 package filter
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"inet.af/netaddr"
@@ -26,23 +28,90 @@ func (pr PortRange) String() string {
 	}
 }
 
-// contains returns whether port is in pr.
-func (pr PortRange) contains(port uint16) bool {
+// PortRangeAny is the range of all ports, written "*".
+var PortRangeAny = PortRange{First: 0, Last: 65535}
+
+// ParsePortRange parses a port range in the forms String produces:
+// a single port ("80"), an inclusive range ("80-443"), or "*" for all
+// ports.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "*" {
+		return PortRangeAny, nil
+	}
+	fs, ls := s, s
+	if i := strings.IndexByte(s, '-'); i != -1 {
+		fs, ls = s[:i], s[i+1:]
+	}
+	first, err := parsePort(fs)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q: %v", s, err)
+	}
+	last, err := parsePort(ls)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("port range %q: %v", s, err)
+	}
+	if first > last {
+		return PortRange{}, fmt.Errorf("port range %q: first port %d is after last port %d", s, first, last)
+	}
+	return PortRange{First: first, Last: last}, nil
+}
+
+// parsePort parses a port number in decimal.
+func parsePort(s string) (uint16, error) {
+	if s == "" {
+		return 0, errors.New("missing port number")
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return 0, fmt.Errorf("port %s out of range (max 65535)", s)
+		}
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// Contains returns whether port is in pr.
+func (pr PortRange) Contains(port uint16) bool {
 	return port >= pr.First && port <= pr.Last
 }
 
-// NetPortRange combines an IP address prefix and PortRange.
+// ForEach calls f for each port in pr, in increasing order, until f
+// returns false.
+func (pr PortRange) ForEach(f func(port uint16) bool) {
+	if pr.First > pr.Last {
+		return
+	}
+	for port := pr.First; ; port++ {
+		// Checking for the last port before incrementing keeps port
+		// from wrapping around after 65535.
+		if !f(port) || port == pr.Last {
+			return
+		}
+	}
+}
+
+// NetPortRange combines an IP address prefix and the port ranges
+// allowed on it.
 type NetPortRange struct {
 	Net   netaddr.IPPrefix
-	Ports PortRange
+	Ports []PortRange
 }
 
 func (npr NetPortRange) String() string {
-	return fmt.Sprintf("%v:%v", npr.Net, npr.Ports)
+	if len(npr.Ports) == 1 {
+		return fmt.Sprintf("%v:%v", npr.Net, npr.Ports[0])
+	}
+	ports := make([]string, 0, len(npr.Ports))
+	for _, pr := range npr.Ports {
+		ports = append(ports, pr.String())
+	}
+	return fmt.Sprintf("%v:[%s]", npr.Net, strings.Join(ports, ","))
 }
 
 // Match matches packets from any IP address in Srcs to any ip:port in
-// Dsts.
+// Dsts, that is to any port in one of a Dsts entry's Ports on an IP
+// address in its Net.
 type Match struct {
 	Dsts []NetPortRange
 	Srcs []netaddr.IPPrefix
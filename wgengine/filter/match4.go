@@ -89,8 +89,12 @@ func newMatches4(ms []Match) (ret matches4) {
 			}
 		}
 		for _, dst := range m.Dsts {
-			if dst.Net.IP.Is4() {
-				m4.dsts = append(m4.dsts, npr4{net4FromIPPrefix(dst.Net), dst.Ports})
+			if !dst.Net.IP.Is4() {
+				continue
+			}
+			net := net4FromIPPrefix(dst.Net)
+			for _, pr := range dst.Ports {
+				m4.dsts = append(m4.dsts, npr4{net, pr})
 			}
 		}
 		if len(m4.srcs) > 0 && len(m4.dsts) > 0 {
@@ -111,7 +115,7 @@ func (ms matches4) match(q *packet.Parsed) bool {
 			if !dst.net.Contains(q.DstIP) {
 				continue
 			}
-			if !dst.ports.contains(q.DstPort) {
+			if !dst.ports.Contains(q.DstPort) {
 				continue
 			}
 			return true
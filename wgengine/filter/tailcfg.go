@@ -46,10 +46,10 @@ func MatchesFromFilterRules(pf []tailcfg.FilterRule) ([]Match, error) {
 			}
 			m.Dsts = append(m.Dsts, NetPortRange{
 				Net: net,
-				Ports: PortRange{
+				Ports: []PortRange{{
 					First: d.Ports.First,
 					Last:  d.Ports.Last,
-				},
+				}},
 			})
 		}
 
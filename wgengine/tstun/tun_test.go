@@ -90,7 +90,7 @@ func netports(netPorts ...string) (ret []filter.NetPortRange) {
 
 		npr := filter.NetPortRange{
 			Net:   nets(s[:i])[0],
-			Ports: ports(s[i+1:]),
+			Ports: []filter.PortRange{ports(s[i+1:])},
 		}
 		ret = append(ret, npr)
 	}